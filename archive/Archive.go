@@ -0,0 +1,65 @@
+package archive
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"face-service/config"
+	"face-service/repository"
+	"github.com/globalsign/mgo/bson"
+	"os"
+	"path/filepath"
+)
+
+func FilePath(a *repository.EventArchive) string {
+	return filepath.Join(config.Get().EventArchiveDir, a.UserId.Hex(), a.Id.Hex()+".ndjson.gz")
+}
+
+func FileName(a *repository.EventArchive) string {
+	return a.DeviceId + "-" + a.From.Format("20060102") + "-" + a.To.Format("20060102") + ".ndjson.gz"
+}
+
+// WriteEvents writes docs as gzip-compressed NDJSON to the file of a and
+// returns its size. The file only appears under its final name once it is
+// complete, so a crash never leaves a truncated archive behind.
+func WriteEvents(a *repository.EventArchive, docs []bson.M) (int64, error) {
+	path := FilePath(a)
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return 0, err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	gz := gzip.NewWriter(f)
+	encoder := json.NewEncoder(gz)
+	for _, doc := range docs {
+		if err := encoder.Encode(doc); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return 0, err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
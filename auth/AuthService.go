@@ -4,7 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"errors"
-	"face-service/db"
+	"face-service/repository"
 	"firebase.google.com/go"
 	"firebase.google.com/go/auth"
 	"github.com/dgrijalva/jwt-go"
@@ -16,36 +16,55 @@ import (
 	"google.golang.org/api/option"
 	"log"
 	"os"
+	"sync"
 	"time"
 )
 
+// ErrDeviceToken is returned for the token of a device used where a user is
+// expected.
+var ErrDeviceToken = errors.New("device tokens are not accepted here")
+
 type AuthService struct {
-	App *firebase.App
-}
+	App           *firebase.App
+	Users         repository.UserRepository
+	ServiceTokens repository.ServiceTokenRepository
+	SlackConfigs  repository.SlackConfigRepository
 
-var authService *AuthService
+	appLock sync.Mutex
+}
 
-func GetAuthService() (*AuthService, error) {
-	if authService == nil {
+// NewAuthService creates the auth service on top of the given repositories.
+// The Firebase app is only initialized when a Firebase call is first needed,
+// so JWT validation works without Firebase credentials.
+func NewAuthService(repos *repository.Repositories) *AuthService {
+	return &AuthService{
+		Users:         repos.Users,
+		ServiceTokens: repos.ServiceTokens,
+		SlackConfigs:  repos.SlackConfigs,
+	}
+}
 
+func (s *AuthService) getApp() (*firebase.App, error) {
+	s.appLock.Lock()
+	defer s.appLock.Unlock()
+	if s.App == nil {
 		rawKey, err := base64.StdEncoding.DecodeString(os.Getenv("FIREBASE_ADMIN_ACCOUNT"))
 		if err != nil {
-			log.Fatal("[FIREBASE]", "Fail to parse admin key")
+			log.Println("[FIREBASE]", "Fail to parse admin key")
+			return nil, err
 		}
 
 		opt := option.WithCredentialsJSON(rawKey)
 		app, err := firebase.NewApp(context.Background(), nil, opt)
 		if err != nil {
-			log.Fatalln("[FIREBASE]", "Error initializing app", err)
+			log.Println("[FIREBASE]", "Error initializing app", err)
+			return nil, err
 		}
 
 		log.Println("[FIREBASE]", "Firebase connected successfully")
-
-		authService = &AuthService{
-			App: app,
-		}
+		s.App = app
 	}
-	return authService, nil
+	return s.App, nil
 }
 
 func CurrentUser(c *gin.Context) *User {
@@ -64,7 +83,11 @@ func CurrentJWT(c *gin.Context) string {
 }
 
 func (s *AuthService) getAuthClient() (*auth.Client, error) {
-	return s.App.Auth(context.Background())
+	app, err := s.getApp()
+	if err != nil {
+		return nil, err
+	}
+	return app.Auth(context.Background())
 }
 
 func (s *AuthService) GetUserFromToken(jwtToken string) (*User, error) {
@@ -72,6 +95,9 @@ func (s *AuthService) GetUserFromToken(jwtToken string) (*User, error) {
 		return []byte(os.Getenv("TOKEN_SECRET")), nil
 	})
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
+		if claims["type"] == "device_token" {
+			return nil, ErrDeviceToken
+		}
 		_roles := claims["roles"].([]interface{})
 		roles := make([]string, len(_roles))
 		for i, role := range _roles {
@@ -89,8 +115,8 @@ func (s *AuthService) GetUserFromToken(jwtToken string) (*User, error) {
 	}
 }
 
-func (s *AuthService) CreateUserWithEmail(email string, password string, displayName string) (*User, error) {
-	if c, err := dao.Collection("user").Find(bson.M{"email": email}).Count(); err != nil {
+func (s *AuthService) CreateUserWithEmail(ctx context.Context, email string, password string, displayName string) (*User, error) {
+	if c, err := s.Users.CountByEmail(repository.AsSystem(ctx), email); err != nil {
 		log.Println("[DB]", "Fail to check user email exists")
 		return nil, err
 	} else if c > 0 {
@@ -109,7 +135,7 @@ func (s *AuthService) CreateUserWithEmail(email string, password string, display
 		return nil, err
 	}
 
-	u, err := client.CreateUser(context.Background(), params)
+	u, err := client.CreateUser(ctx, params)
 	if err != nil {
 		log.Println("[FIREBASE]", "Error creating user:", err)
 		return nil, err
@@ -124,17 +150,21 @@ func (s *AuthService) CreateUserWithEmail(email string, password string, display
 		Email:       u.Email,
 		Roles:       []string{"user"},
 	}
-	err = dao.Collection("user").Insert(&user)
-	if err != nil {
+	err = s.Users.Insert(repository.AsSystem(ctx), &user)
+	if repository.IsDuplicate(err) {
+		log.Println("[DB]", "User email", email, "was registered concurrently")
+		return nil, errors.New("USER_EMAIL_ALREADY_USED")
+	} else if err != nil {
 		return nil, err
 	}
 
-	sendSlackInvitation(&user)
+	s.sendSlackInvitation(ctx, &user)
 
 	return &user, err
 }
 
-func sendSlackInvitation(u *User) {
+func (s *AuthService) sendSlackInvitation(ctx context.Context, u *User) {
+	ctx = repository.WithOwner(ctx, u.Id)
 	log.Println("[SLACK]", "Sending slack invitation for user", u.Email)
 	sc := model.SlackConfig{
 		Id:             bson.NewObjectId(),
@@ -142,7 +172,7 @@ func sendSlackInvitation(u *User) {
 		SentInvitation: false,
 	}
 
-	if err := dao.Collection("slack_config").Insert(&sc); err != nil {
+	if err := s.SlackConfigs.Insert(ctx, &sc); err != nil {
 		log.Println("[DB]", "Fail to insert slack_config for user:", u.Email)
 	} else {
 		if err := slack.SendSlackInvitation(u.Email); err != nil {
@@ -154,14 +184,14 @@ func sendSlackInvitation(u *User) {
 					log.Println("[SLACK]", "Fail to lookup user by email:", u.Email, "by error", err.Error())
 				} else {
 					sc.SlackUserId = slackUser.Id
-					if dao.Collection("slack_config").UpdateId(sc.Id, &sc); err != nil {
+					if err := s.SlackConfigs.Update(ctx, &sc); err != nil {
 						log.Println("[DB]", "Fail to update slack_config for user:", u.Email)
 					} else {
 						log.Println("[DB]", "Linked user:", u.Email, "with Slack user id", sc.SlackUserId)
 					}
 				}
 			} else if err.Error() == "ALREADY_IN_TEAM_INVITED_USER" {
-				if dao.Collection("slack_config").Update(bson.M{"userId": u.Id}, bson.M{"$set": bson.M{"sendInvitation": true}}); err != nil {
+				if err := s.SlackConfigs.SetSentInvitation(ctx); err != nil {
 					log.Println("[DB]", "Fail to update slack_config for user:", u.Email)
 				} else {
 					log.Println("[DB]", "Updated user:", u.Email, "set sendInvitation = true")
@@ -169,28 +199,24 @@ func sendSlackInvitation(u *User) {
 			}
 		} else {
 			sc.SentInvitation = true
-			if err := dao.Collection("slack_config").UpdateId(sc.Id, &sc); err != nil {
+			if err := s.SlackConfigs.Update(ctx, &sc); err != nil {
 				log.Println("[DB]", "Fail to update slack_config to set email sent to true for user:", u.Email)
 			}
 		}
 	}
 }
 
-func (s *AuthService) LoginWithFirebaseToken(firebaseToken string) (*User, string, error) {
-	client, err := s.App.Auth(context.Background())
-	token, err := client.VerifyIDToken(context.Background(), firebaseToken)
+func (s *AuthService) LoginWithFirebaseToken(ctx context.Context, firebaseToken string) (*User, string, error) {
+	client, err := s.getAuthClient()
+	if err != nil {
+		return nil, "", err
+	}
+	token, err := client.VerifyIDToken(ctx, firebaseToken)
 	if err != nil {
 		log.Println("[FIREBASE]", "Fail to parse token")
 		return nil, "", err
 	}
-	user := User{}
-	err = dao.Collection("user").
-		Find(
-			bson.M{
-				"email": token.Claims["email"].(string),
-			}).
-		One(&user)
-
+	user, err := s.Users.FindByEmail(repository.AsSystem(ctx), token.Claims["email"].(string))
 	if err != nil {
 		return nil, "", err
 	}
@@ -206,10 +232,41 @@ func (s *AuthService) LoginWithFirebaseToken(firebaseToken string) (*User, strin
 		"type":       "login_token",
 	})
 	jwtTokenString, err := jwtToken.SignedString([]byte(os.Getenv("TOKEN_SECRET")))
-	return &user, jwtTokenString, err
+	return user, jwtTokenString, err
+}
+
+// SignDeviceToken issues the credentials of a device bound to user. The token
+// is not stored; the caller stores it once the device exists. The user routes
+// refuse it; a route meant for devices has to check it is still stored, as
+// deleting the device removes it.
+func (s *AuthService) SignDeviceToken(user *User, deviceId bson.ObjectId) (*ServiceToken, error) {
+	tokenId := uuid.New().String()
+	now := time.Now()
+	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iat":        now.Unix(),
+		"exp":        now.AddDate(1, 0, 0).Unix(),
+		"user_id":    user.Id.Hex(),
+		"user_email": user.Email,
+		"type":       "device_token",
+		"roles":      []string{"device"},
+		"token_id":   tokenId,
+		"device_id":  deviceId.Hex(),
+	})
+	token, err := jwtToken.SignedString([]byte(os.Getenv("TOKEN_SECRET")))
+	if err != nil {
+		return nil, err
+	}
+	return &ServiceToken{
+		Id:        bson.NewObjectId(),
+		UserId:    user.Id,
+		Token:     token,
+		CreatedAt: now,
+		TokenId:   tokenId,
+		DeviceId:  deviceId,
+	}, nil
 }
 
-func (s *AuthService) NewServiceToken(user *User) (*ServiceToken, error) {
+func (s *AuthService) NewServiceToken(ctx context.Context, user *User) (*ServiceToken, error) {
 
 	tokenId := uuid.New().String()
 	now := time.Now()
@@ -236,7 +293,7 @@ func (s *AuthService) NewServiceToken(user *User) (*ServiceToken, error) {
 		TokenId:   tokenId,
 	}
 
-	err = dao.Collection("service_token").Insert(&st)
+	err = s.ServiceTokens.Insert(repository.WithOwner(ctx, user.Id), &st)
 
 	return &st, err
 }
@@ -1,13 +1,13 @@
 package auth
 
 import (
+	"face-service/repository"
 	"github.com/gin-gonic/gin"
 	"log"
 	"strings"
 )
 
-func FirebaseAuthMiddleware() gin.HandlerFunc {
-	authService, _ := GetAuthService()
+func FirebaseAuthMiddleware(authService *AuthService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.Request.Header.Get("Authorization")
 		token := ""
@@ -24,11 +24,14 @@ func FirebaseAuthMiddleware() gin.HandlerFunc {
 		} else {
 			log.Println("JWT Token", token)
 			user, err := authService.GetUserFromToken(token)
-			if err != nil {
+			if err == ErrDeviceToken {
+				c.AbortWithStatusJSON(403, gin.H{"error": err.Error()})
+			} else if err != nil {
 				c.AbortWithStatusJSON(401, gin.H{"err": err})
 			} else {
 				c.Set("user", user)
 				c.Set("jwtToken", token)
+				c.Request = c.Request.WithContext(repository.WithOwner(c.Request.Context(), user.Id))
 				c.Next()
 			}
 		}
@@ -0,0 +1,17 @@
+package auth
+
+import "github.com/gin-gonic/gin"
+
+// RequireRole lets through the users that have role. It must run after
+// FirebaseAuthMiddleware.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, r := range CurrentUser(c).Roles {
+			if r == role {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(403, gin.H{"error": "requires role " + role})
+	}
+}
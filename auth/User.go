@@ -1,11 +1,7 @@
 package auth
 
-import "github.com/globalsign/mgo/bson"
+import "face-service/repository"
 
-type User struct {
-	Id bson.ObjectId `json:"id" bson:"_id"`
-	Email string `json:"email" bson:"email"`
-	DisplayName string `json:"displayName" bson:"displayName"`
-	Roles []string `json:"roles" bson:"roles"`
-}
+type User = repository.User
 
+type ServiceToken = repository.ServiceToken
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// camera inserts a camera of the user userId.
+func (s *testServer) camera(userId bson.ObjectId) string {
+	device := model.Device{Id: bson.NewObjectId(), DeviceId: bson.NewObjectId().Hex()}
+	if err := s.repos.Devices.Insert(repository.WithOwner(context.Background(), userId), &device); err != nil {
+		s.t.Fatal(err)
+	}
+	return device.Id.Hex()
+}
+
+// await fetches path until its status is no longer running and decodes it
+// into out.
+func (s *testServer) await(token string, path string, out interface{}) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := s.do(token, "GET", path, nil)
+		var state struct {
+			Status string `json:"status"`
+		}
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &state) != nil {
+			s.t.Fatalf("GET %s: expected 200, got %d: %s", path, w.Code, w.Body.String())
+		}
+		if state.Status != "running" {
+			if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+				s.t.Fatal(err)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("GET %s: still running", path)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// startOnce sends a request that starts work on a device until the device is
+// no longer busy, which it stays for a moment after its work finished.
+func (s *testServer) startOnce(token string, path string, body interface{}, out interface{}) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		w := s.do(token, "POST", path, body)
+		if w.Code == http.StatusTooManyRequests && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		if w.Code != http.StatusAccepted {
+			s.t.Fatalf("POST %s: expected 202, got %d: %s", path, w.Code, w.Body.String())
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			s.t.Fatal(err)
+		}
+		return
+	}
+}
+
+func TestRecognizeWithFakeRecognizer(t *testing.T) {
+	s := newTestServer(t)
+	token, _ := s.login("alice@example.com")
+	var ingested ingestAnswer
+	s.expect(http.StatusOK, token, "POST", "/api/labels", []gin.H{
+		{"label": "alice", "descriptor": splitDescriptor(0.1, 0)},
+		{"label": "bob", "descriptor": splitDescriptor(0, 0.1)},
+	}, &ingested)
+	expectStatuses(t, ingested, "inserted", "inserted")
+
+	photo := []byte("a photo of alice and bob")
+	faces := make([]model.FaceDetails, 2)
+	copy(faces[0].Descriptor[:], splitDescriptor(0.11, 0))
+	copy(faces[1].Descriptor[:], splitDescriptor(0, 0.09))
+	s.recognizer.Set(photo, faces)
+
+	var answer struct {
+		Results []struct {
+			FaceDetailsList []model.FaceDetails `json:"faceDetailsList"`
+			Matches         []struct {
+				Label string `json:"label"`
+			} `json:"matches"`
+		} `json:"results"`
+	}
+	s.expect(http.StatusOK, token, "POST", "/api/recognize", gin.H{"images": [][]byte{photo, []byte("another photo")}, "match": true}, &answer)
+	if len(answer.Results) != 2 {
+		t.Fatalf("expected a result per image, got %d", len(answer.Results))
+	}
+	if matches := answer.Results[0].Matches; len(matches) != 2 || matches[0].Label != "alice" || matches[1].Label != "bob" {
+		t.Fatalf("expected alice and bob on the photo, got %+v", matches)
+	}
+	// an image the recognizer was not told about gets one face of its own
+	if len(answer.Results[1].FaceDetailsList) != 1 {
+		t.Fatalf("expected one face on another photo, got %d", len(answer.Results[1].FaceDetailsList))
+	}
+}
+
+func TestRecognitionJobs(t *testing.T) {
+	s := newTestServer(t)
+	token, userId := s.login("alice@example.com")
+	camera := s.camera(userId)
+
+	type job struct {
+		Id     string `json:"id"`
+		Status string `json:"status"`
+		Frames []struct {
+			FaceDetailsList []model.FaceDetails `json:"faceDetailsList"`
+		} `json:"frames"`
+	}
+	var started, finished job
+	s.expect(http.StatusAccepted, token, "POST", "/api/recognitions", gin.H{"deviceId": camera, "totalPics": 3, "frameDelay": 1}, &started)
+	s.await(token, "/api/recognitions/"+started.Id, &finished)
+	if finished.Status != "completed" || len(finished.Frames) != 3 {
+		t.Fatalf("expected a completed job of 3 frames, got %s with %d", finished.Status, len(finished.Frames))
+	}
+	for n, frame := range finished.Frames {
+		if len(frame.FaceDetailsList) != 1 {
+			t.Fatalf("expected one face on frame %d, got %d", n, len(frame.FaceDetailsList))
+		}
+	}
+	for _, path := range []string{"/frames/0", "/frames/2?thumbnail=true"} {
+		if w := s.do(token, "GET", "/api/recognitions/"+started.Id+path, nil); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+			t.Fatalf("GET %s: expected a JPEG, got %d %s", path, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+	s.expect(http.StatusNotFound, token, "GET", "/api/recognitions/"+started.Id+"/frames/3", nil, nil)
+
+	// a job holds the camera, also against enrollments, until it is canceled
+	s.frames.Pause()
+	defer s.frames.Resume()
+	var held job
+	s.startOnce(token, "/api/recognitions", gin.H{"deviceId": camera}, &held)
+	s.expect(http.StatusTooManyRequests, token, "POST", "/api/recognitions", gin.H{"deviceId": camera}, nil)
+	s.expect(http.StatusTooManyRequests, token, "POST", "/api/device/"+camera+"/enroll", gin.H{"label": "alice"}, nil)
+	var canceled job
+	s.expect(http.StatusOK, token, "POST", "/api/recognitions/"+held.Id+"/cancel", nil, &canceled)
+	if canceled.Status != "canceled" {
+		t.Fatalf("expected the job to be canceled, got %s", canceled.Status)
+	}
+	// the paused capture gives up with the job
+	var next job
+	s.startOnce(token, "/api/recognitions", gin.H{"deviceId": camera}, &next)
+	s.expect(http.StatusOK, token, "POST", "/api/recognitions/"+next.Id+"/cancel", nil, nil)
+}
+
+func TestEnrollment(t *testing.T) {
+	s := newTestServer(t)
+	token, userId := s.login("alice@example.com")
+	camera := s.camera(userId)
+
+	type session struct {
+		Id       string `json:"id"`
+		Status   string `json:"status"`
+		Frames   int    `json:"frames"`
+		Accepted int    `json:"accepted"`
+		Rejected int    `json:"rejected"`
+		Samples  []struct {
+			Status string `json:"status"`
+			Code   string `json:"code"`
+		} `json:"samples"`
+	}
+	var started, finished session
+	s.startOnce(token, "/api/device/"+camera+"/enroll", gin.H{"label": "carol", "samples": 3, "frameDelay": 1}, &started)
+	s.await(token, "/api/enrollment/"+started.Id, &finished)
+	if finished.Status != "completed" || finished.Accepted != 3 || finished.Frames != 3 {
+		t.Fatalf("expected 3 samples accepted out of 3 frames, got %+v", finished)
+	}
+	var faces struct {
+		Items []interface{} `json:"items"`
+	}
+	s.expect(http.StatusOK, token, "GET", "/api/label/carol/descriptors", nil, &faces)
+	if len(faces.Items) != 3 {
+		t.Fatalf("expected 3 faces of carol, got %d", len(faces.Items))
+	}
+
+	// frames showing more than one face cannot tell whose face it is
+	s.recognizer.FacesPerImage = 2
+	s.startOnce(token, "/api/device/"+camera+"/enroll", gin.H{"label": "dave", "samples": 2, "frameDelay": 1}, &started)
+	s.await(token, "/api/enrollment/"+started.Id, &finished)
+	if finished.Status != "failed" || finished.Accepted != 0 || finished.Rejected != 6 {
+		t.Fatalf("expected every one of 6 frames to be rejected, got %+v", finished)
+	}
+	for _, sample := range finished.Samples {
+		if sample.Code != "multiple_faces" {
+			t.Fatalf("expected frames with multiple faces, got %+v", sample)
+		}
+	}
+}
@@ -4,15 +4,59 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
 	MongoDBUri     string
 	DBName         string
 	MQTTBroker     string
+	Recognizer     string
 	GinDebug       bool
 	MongoDBUserSSL bool
+	AutoMigrate    bool
+
+	DBReadTimeout      time.Duration
+	DBWriteTimeout     time.Duration
+	DBAggregateTimeout time.Duration
+
+	SoftDeleteGracePeriod time.Duration
+	TrashPurgeInterval    time.Duration
+
+	EventRetentionDays     int
+	EventArchiveDir        string
+	RetentionSweepInterval time.Duration
+
+	MatchEuclideanThreshold float64
+	MatchCosineThreshold    float64
+	GalleryCacheTTL         time.Duration
+
+	DescriptorModel             string
+	DescriptorDimension         int
+	DescriptorMinNorm           float64
+	DescriptorMaxNorm           float64
+	DescriptorDuplicateDistance float64
+	AllowEmptyGalleries         bool
+
+	RecognitionJobsPerDevice int
+	RecognitionJobRetention  time.Duration
+	InstanceId               string
+
+	UnlabeledClusterDistance float64
+	UnlabeledPoolLimit       int
+
+	DeviceHeartbeatTimeout time.Duration
+	PresenceSweepInterval  time.Duration
+
+	ClaimCodeTTL        time.Duration
+	ClaimDeliveryWindow time.Duration
+	ClaimUrl            string
+
+	CommandTimeout       time.Duration
+	CommandMaxTimeout    time.Duration
+	CommandSweepInterval time.Duration
 }
 
 type MongoDBCredential struct {
@@ -38,11 +82,87 @@ func init() {
 	}
 
 	conf.GinDebug = os.Getenv("GIN_DEBUG") == "true"
+	conf.AutoMigrate = os.Getenv("AUTO_MIGRATE") != "false"
+
+	conf.DBReadTimeout = getDuration("DB_READ_TIMEOUT", 5*time.Second)
+	conf.DBWriteTimeout = getDuration("DB_WRITE_TIMEOUT", 10*time.Second)
+	conf.DBAggregateTimeout = getDuration("DB_AGGREGATE_TIMEOUT", 30*time.Second)
+
+	conf.SoftDeleteGracePeriod = getDuration("SOFT_DELETE_GRACE_PERIOD", 30*24*time.Hour)
+	conf.TrashPurgeInterval = getDuration("TRASH_PURGE_INTERVAL", time.Hour)
+
+	conf.EventRetentionDays = 90
+	if days, err := strconv.Atoi(os.Getenv("EVENT_RETENTION_DAYS")); err == nil {
+		conf.EventRetentionDays = days
+	}
+	conf.EventArchiveDir = os.Getenv("EVENT_ARCHIVE_DIR")
+	if conf.EventArchiveDir == "" {
+		conf.EventArchiveDir = "data/archive"
+	}
+	conf.RetentionSweepInterval = getDuration("RETENTION_SWEEP_INTERVAL", time.Hour)
+
+	conf.MatchEuclideanThreshold = getFloat("MATCH_EUCLIDEAN_THRESHOLD", 0.6)
+	conf.MatchCosineThreshold = getFloat("MATCH_COSINE_THRESHOLD", 0.1)
+	conf.GalleryCacheTTL = getDuration("GALLERY_CACHE_TTL", 10*time.Minute)
+
+	// the model the recognizer computes descriptors with; descriptors of
+	// other models are never compared with its own
+	conf.DescriptorModel = os.Getenv("DESCRIPTOR_MODEL")
+	if conf.DescriptorModel == "" {
+		conf.DescriptorModel = "dlib_face_recognition_resnet_model_v1"
+	}
+	conf.DescriptorDimension = 128
+	if dimension, err := strconv.Atoi(os.Getenv("DESCRIPTOR_DIMENSION")); err == nil {
+		conf.DescriptorDimension = dimension
+	}
+	conf.DescriptorMinNorm = getFloat("DESCRIPTOR_MIN_NORM", 0.1)
+	conf.DescriptorMaxNorm = getFloat("DESCRIPTOR_MAX_NORM", 10)
+	conf.DescriptorDuplicateDistance = getFloat("DESCRIPTOR_DUPLICATE_DISTANCE", 0.05)
+	// faces of another model are computed again from their crop by
+	// POST /admin/reembed; faces without one never match again, so the
+	// service refuses to start when that leaves a gallery empty, unless
+	// allowed here
+	conf.AllowEmptyGalleries = os.Getenv("ALLOW_EMPTY_GALLERIES") == "true"
+
+	conf.RecognitionJobsPerDevice = 1
+	if jobs, err := strconv.Atoi(os.Getenv("RECOGNITION_JOBS_PER_DEVICE")); err == nil && jobs > 0 {
+		conf.RecognitionJobsPerDevice = jobs
+	}
+	conf.RecognitionJobRetention = getDuration("RECOGNITION_JOB_RETENTION", time.Hour)
+	// names this instance on the jobs it runs, so that it only interrupts its
+	// own when it restarts; it has to stay the same across restarts
+	conf.InstanceId = os.Getenv("INSTANCE_ID")
+	if conf.InstanceId == "" {
+		conf.InstanceId, _ = os.Hostname()
+	}
+
+	conf.UnlabeledClusterDistance = getFloat("UNLABELED_CLUSTER_DISTANCE", 0.5)
+	conf.UnlabeledPoolLimit = 2000
+	if limit, err := strconv.Atoi(os.Getenv("UNLABELED_POOL_LIMIT")); err == nil && limit > 0 {
+		conf.UnlabeledPoolLimit = limit
+	}
+
+	// devices send a heartbeat every 30 seconds
+	conf.DeviceHeartbeatTimeout = getDuration("DEVICE_HEARTBEAT_TIMEOUT", 90*time.Second)
+	conf.PresenceSweepInterval = getDuration("PRESENCE_SWEEP_INTERVAL", 30*time.Second)
+
+	conf.ClaimCodeTTL = getDuration("CLAIM_CODE_TTL", 10*time.Minute)
+	conf.ClaimDeliveryWindow = getDuration("CLAIM_DELIVERY_WINDOW", 24*time.Hour)
+	// what claim code QR codes point to, followed by the code
+	conf.ClaimUrl = os.Getenv("CLAIM_URL")
+	if conf.ClaimUrl == "" {
+		conf.ClaimUrl = "swd://claim?code="
+	}
+
+	conf.CommandTimeout = getDuration("COMMAND_TIMEOUT", 10*time.Second)
+	conf.CommandMaxTimeout = getDuration("COMMAND_MAX_TIMEOUT", time.Minute)
+	conf.CommandSweepInterval = getDuration("COMMAND_SWEEP_INTERVAL", 30*time.Second)
 
 	conf.MQTTBroker = os.Getenv("MQTT_BROKER")
 	if conf.MQTTBroker == "" {
 		conf.MQTTBroker = "tcp://localhost:1883"
 	}
+	conf.Recognizer = os.Getenv("RECOGNIZER")
 }
 
 func Get() *Config {
@@ -56,3 +176,27 @@ func getDBName(mongodbUri string) string {
 	}
 	return strings.Trim(parsed.Path, "/")
 }
+
+func getDuration(key string, defaultValue time.Duration) time.Duration {
+	if os.Getenv(key) == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		log.Println("invalid duration", os.Getenv(key), "for", key, "using default", defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+func getFloat(key string, defaultValue float64) float64 {
+	if os.Getenv(key) == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		log.Println("invalid number", os.Getenv(key), "for", key, "using default", defaultValue)
+		return defaultValue
+	}
+	return f
+}
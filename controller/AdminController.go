@@ -0,0 +1,186 @@
+package controller
+
+import (
+	"context"
+	"face-service/auth"
+	"face-service/config"
+	"face-service/recognition"
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"log"
+	"sync"
+	"time"
+)
+
+const reembedBatch = 100
+
+// ReembedJob computes again, with the model of the recognizer, the stored
+// faces that have a crop but were computed by another model. Stranded counts
+// those that have none, which are left out of matching.
+type ReembedJob struct {
+	Id         bson.ObjectId            `json:"id"`
+	Model      string                   `json:"model"`
+	Status     string                   `json:"status"`
+	Processed  int                      `json:"processed"`
+	Reembedded int                      `json:"reembedded"`
+	Skipped    int                      `json:"skipped"`
+	Failed     int                      `json:"failed"`
+	Stranded   repository.StrandedFaces `json:"stranded"`
+	Error      string                   `json:"error,omitempty"`
+	StartedAt  time.Time                `json:"startedAt"`
+	FinishedAt *time.Time               `json:"finishedAt,omitempty"`
+}
+
+// reembedJob is the last re-embedding job started on this instance.
+var reembedLock = sync.Mutex{}
+var reembedJob *ReembedJob
+
+func AdminController(r *gin.RouterGroup, repos *repository.Repositories, recognizer recognition.Recognizer) {
+	admin := r.Group("/admin", auth.RequireRole("admin"))
+
+	admin.POST("/reembed", func(c *gin.Context) {
+		reembedLock.Lock()
+		defer reembedLock.Unlock()
+		if reembedJob != nil && reembedJob.Status == reembedRunning {
+			c.JSON(409, gin.H{"error": "a re-embedding job is already running"})
+			return
+		}
+		reembedJob = &ReembedJob{
+			Id:        bson.NewObjectId(),
+			Model:     config.Get().DescriptorModel,
+			Status:    reembedRunning,
+			StartedAt: time.Now(),
+		}
+		log.Println("[REEMBED]", "Job", reembedJob.Id.Hex(), "started by", auth.CurrentUser(c).Email, "for model", reembedJob.Model)
+		go runReembed(repos, recognizer, reembedJob.Model)
+		c.JSON(202, *reembedJob)
+	})
+
+	admin.GET("/reembed", func(c *gin.Context) {
+		reembedLock.Lock()
+		defer reembedLock.Unlock()
+		if reembedJob == nil {
+			c.JSON(404, gin.H{"error": "no re-embedding job"})
+			return
+		}
+		c.JSON(200, *reembedJob)
+	})
+}
+
+const (
+	reembedRunning   = "running"
+	reembedCompleted = "completed"
+	reembedJobFailed = "failed"
+
+	// outcomes of a single face
+	reembedDone    = "reembedded"
+	reembedSkipped = "skipped"
+	reembedFailed  = "failed"
+)
+
+// runReembed walks the stale faces of every user. A face whose crop shows
+// exactly one face to the new model is stored again under the same label and
+// the old one is moved to the trash; the others, like the faces without a
+// crop, are left as they are and no longer take part in matching.
+func runReembed(repos *repository.Repositories, recognizer recognition.Recognizer, descriptorModel string) {
+	ingestions := make(map[bson.ObjectId]*ingestion)
+	defer func() {
+		for _, in := range ingestions {
+			in.finish()
+		}
+	}()
+
+	stranded, err := repos.Faces.CountStranded(repository.AsSystem(context.Background()), descriptorModel)
+	if err != nil {
+		finishReembed(err)
+		return
+	}
+	reembedLock.Lock()
+	reembedJob.Stranded = stranded
+	reembedLock.Unlock()
+
+	after := bson.ObjectId("")
+	for {
+		faces, err := repos.Faces.FindStale(repository.AsSystem(context.Background()), descriptorModel, after, reembedBatch)
+		if err != nil {
+			finishReembed(err)
+			return
+		}
+		if len(faces) == 0 {
+			break
+		}
+		for _, face := range faces {
+			after = face.Id
+			outcome := reembedFace(repos, recognizer, ingestions, descriptorModel, face)
+			reembedLock.Lock()
+			reembedJob.Processed++
+			switch outcome {
+			case reembedDone:
+				reembedJob.Reembedded++
+			case reembedSkipped:
+				reembedJob.Skipped++
+			default:
+				reembedJob.Failed++
+			}
+			reembedLock.Unlock()
+		}
+	}
+	finishReembed(nil)
+}
+
+func reembedFace(repos *repository.Repositories, recognizer recognition.Recognizer, ingestions map[bson.ObjectId]*ingestion, descriptorModel string, face repository.StoredFace) string {
+	ctx := repository.WithOwner(context.Background(), face.UserId)
+	crop, err := repos.Frames.Read(ctx, face.CropId)
+	if err != nil {
+		log.Println("[REEMBED]", "Fail to read crop of face", face.Id.Hex(), "by error", err.Error())
+		return reembedFailed
+	}
+	response, err := recognizer.Recognize(ctx, model.RecognizeRequest{
+		IncludeFacesDetails: true,
+		Images:              [][]byte{crop},
+		TimeoutSeconds:      30,
+	})
+	if err != nil {
+		log.Println("[REEMBED]", "Fail to recognize crop of face", face.Id.Hex(), "by error", err.Error())
+		return reembedFailed
+	}
+	if len(response.FaceDetailsList) != 1 || len(response.FaceDetailsList[0]) != 1 {
+		return reembedSkipped
+	}
+
+	in := ingestions[face.UserId]
+	if in == nil {
+		in = newIngestion(ctx, repos.Faces, descriptorModel)
+		ingestions[face.UserId] = in
+	}
+	reembedded := face.Face
+	reembedded.Descriptor = append([]float32(nil), response.FaceDetailsList[0][0].Descriptor[:]...)
+	var result ingestResult
+	in.ingest(&reembedded, face.CropId, &result)
+	switch result.Status {
+	case ingestInserted:
+		if err := repos.Faces.Supersede(ctx, face.Id, result.Id); err != nil {
+			log.Println("[DB]", "Fail to supersede face", face.Id.Hex(), "by error", err.Error())
+		}
+		return reembedDone
+	case ingestFailed:
+		return reembedFailed
+	}
+	return reembedSkipped
+}
+
+func finishReembed(err error) {
+	galleries.InvalidateAll()
+	reembedLock.Lock()
+	defer reembedLock.Unlock()
+	now := time.Now()
+	reembedJob.FinishedAt = &now
+	reembedJob.Status = reembedCompleted
+	if err != nil {
+		reembedJob.Status = reembedJobFailed
+		reembedJob.Error = err.Error()
+	}
+	log.Println("[REEMBED]", "Job", reembedJob.Id.Hex(), reembedJob.Status, "with", reembedJob.Reembedded, "of", reembedJob.Processed, "face(s) re-embedded and", reembedJob.Stranded.Faces, "without crop")
+}
@@ -31,9 +31,7 @@ type UserInfo struct {
 
 var firebaseConfig FirebaseWebConfig
 
-func AuthController(r *gin.RouterGroup) {
-	authService, _ := auth.GetAuthService()
-
+func AuthController(r *gin.RouterGroup, authService *auth.AuthService) {
 
 	if wcnf, err := base64.StdEncoding.DecodeString(os.Getenv("FIREBASE_WEB_CONFIG")); err != nil {
 		log.Fatalln("Fail to parse firebase web config key FIREBASE_WEB_CONFIG", err)
@@ -45,11 +43,11 @@ func AuthController(r *gin.RouterGroup) {
 		ri := RegisterInfo{}
 		err := c.ShouldBindJSON(&ri)
 		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
-		if user, err := authService.CreateUserWithEmail(ri.UserEmail, ri.Password, ri.DisplayName); err != nil {
-			c.JSON(500, gin.H{"error": "Fail to create user with email. Error: " + err.Error()})
+		if user, err := authService.CreateUserWithEmail(c.Request.Context(), ri.UserEmail, ri.Password, ri.DisplayName); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": "Fail to create user with email. Error: " + err.Error()})
 			return
 		} else {
 			c.JSON(200, gin.H{"user": user})
@@ -60,10 +58,10 @@ func AuthController(r *gin.RouterGroup) {
 	r.POST("/login/firebase", func(c *gin.Context) {
 		loginInfo := LoginWithFirebase{}
 		if err := c.ShouldBindJSON(&loginInfo); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		} else {
-			if user, jwtToken, err := authService.LoginWithFirebaseToken(loginInfo.Token); err != nil {
-				c.JSON(500, gin.H{"error": "login fail by error: " + err.Error()})
+			if user, jwtToken, err := authService.LoginWithFirebaseToken(c.Request.Context(), loginInfo.Token); err != nil {
+				c.JSON(errorStatus(err), gin.H{"error": "login fail by error: " + err.Error()})
 				return
 			} else {
 				c.JSON(200, gin.H{"user": user, "jwtToken": jwtToken})
@@ -1,24 +1,35 @@
 package controller
 
 import (
+	"context"
 	"face-service/auth"
-	"face-service/db"
+	"face-service/config"
+	"face-service/repository"
 	"github.com/gin-gonic/gin"
 	"github.com/globalsign/mgo/bson"
 	"github.com/google/uuid"
 	"github.com/ndphu/swd-commons/model"
 	"log"
+	"time"
 )
 
-func DeskController(r *gin.RouterGroup) {
+// RuleUpdateRequest is what the owner of a rule may change: a rule stays on
+// its desk and keeps its type.
+type RuleUpdateRequest struct {
+	IntervalMinutes int `json:"intervalMinutes"`
+}
+
+func DeskController(r *gin.RouterGroup, repos *repository.Repositories) {
 
 	r.GET("/desks", func(c *gin.Context) {
-		user := auth.CurrentUser(c)
-		var desks []model.Desk
-		if err := dao.Collection("desk").Find(bson.M{"owner": user.Id}).All(&desks); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		p, ok := pageRequest(c)
+		if !ok {
+			return
+		}
+		if desks, next, err := repos.Desks.FindPage(c.Request.Context(), p); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		} else {
-			c.JSON(200, desks)
+			c.JSON(200, pageResponse(desks, next))
 		}
 	})
 
@@ -33,14 +44,14 @@ func DeskController(r *gin.RouterGroup) {
 				desk.DeskId = uuid.New().String()
 			}
 			desk.Owner = user.Id
-			if err := dao.Collection("desk").Insert(&desk); err != nil {
-				c.JSON(500, gin.H{"error": err})
+			if err := repos.Desks.Insert(c.Request.Context(), &desk); err != nil {
+				c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 				return
 			} else {
 				// notification rule
-				if err := createDefaultRules(&desk); err != nil {
+				if err := createDefaultRules(c.Request.Context(), repos.Rules, &desk); err != nil {
 					log.Println("Fail to crate new desk by error:", err.Error())
-					c.JSON(500, gin.H{"error": err.Error()})
+					c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 					return
 				}
 				c.JSON(201, desk)
@@ -50,42 +61,84 @@ func DeskController(r *gin.RouterGroup) {
 	})
 
 	r.GET("/desk/:deskId", func(c *gin.Context) {
-		var desk model.Desk
-		if err := dao.Collection("desk").Find(bson.M{
-			"deskId": c.Param("deskId"),
-			"owner":  auth.CurrentUser(c).Id,
-		}).One(&desk); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		if desk, err := repos.Desks.FindByDeskId(c.Request.Context(), c.Param("deskId")); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		} else {
 			c.JSON(200, desk)
 		}
 	})
 
+	r.DELETE("/desk/:deskId", func(c *gin.Context) {
+		devices, err := repos.Devices.FindByDesk(c.Request.Context(), c.Param("deskId"))
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		if err := repos.Trash.DeleteDesk(c.Request.Context(), c.Param("deskId")); err != nil {
+			log.Println("Fail to delete desk", c.Param("deskId"), "by error", err)
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		for i := range devices {
+			releaseDevice(c.Request.Context(), repos, &devices[i])
+		}
+		galleries.Invalidate(auth.CurrentUser(c).Id)
+		c.JSON(200, gin.H{"message": "desk deleted"})
+	})
+
+	r.POST("/desk/:deskId/restore", func(c *gin.Context) {
+		notBefore := time.Now().Add(-config.Get().SoftDeleteGracePeriod)
+		if err := repos.Trash.RestoreDesk(c.Request.Context(), c.Param("deskId"), notBefore); err != nil {
+			log.Println("Fail to restore desk", c.Param("deskId"), "by error", err)
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		if devices, err := repos.Devices.FindByDesk(c.Request.Context(), c.Param("deskId")); err == nil {
+			for _, device := range devices {
+				republishDesired(c.Request.Context(), repos, device.Id)
+			}
+		}
+		galleries.Invalidate(auth.CurrentUser(c).Id)
+		c.JSON(200, gin.H{"message": "desk restored"})
+	})
+
 	r.GET("/desk/:deskId/faceInfos", func(c *gin.Context) {
-		var faces []model.Face
-		if err := dao.Collection("face").Find(bson.M{
-			"deskId": c.Param("deskId"),
-			"owner":  auth.CurrentUser(c).Id,
-		}).All(&faces); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		p, ok := pageRequest(c)
+		if !ok {
+			return
+		}
+		if _, err := repos.Desks.FindByDeskId(c.Request.Context(), c.Param("deskId")); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		if faces, next, err := repos.Faces.FindPageByDesk(c.Request.Context(), c.Param("deskId"), c.Query("label"), p); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		} else {
-			c.JSON(200, faces)
+			c.JSON(200, pageResponse(faces, next))
 		}
 	})
 
 	r.GET("/desk/:deskId/devices", func(c *gin.Context) {
-		var devices []model.Device
-		if err := dao.Collection("device").Find(bson.M{
-			"deskId": c.Param("deskId"),
-			"owner":  auth.CurrentUser(c).Id,
-		}).All(&devices); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		p, ok := pageRequest(c)
+		if !ok {
+			return
+		}
+		if _, err := repos.Desks.FindByDeskId(c.Request.Context(), c.Param("deskId")); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		if devices, next, err := repos.Devices.FindPageByDesk(c.Request.Context(), c.Param("deskId"), c.Query("type"), p); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		} else {
-			c.JSON(200, devices)
+			c.JSON(200, pageResponse(devices, next))
 		}
 	})
 
 	r.POST("/desk/:deskId/devices", func(c *gin.Context) {
+		if _, err := repos.Desks.FindByDeskId(c.Request.Context(), c.Param("deskId")); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
 		var device model.Device
 		if err := c.ShouldBindJSON(&device); err != nil {
 			c.JSON(400, gin.H{"error": err.Error()})
@@ -102,8 +155,8 @@ func DeskController(r *gin.RouterGroup) {
 				return
 			}
 
-			if err := dao.Collection("device").Insert(&device); err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
+			if err := repos.Devices.Insert(c.Request.Context(), &device); err != nil {
+				c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			} else {
 				c.JSON(201, device)
 			}
@@ -111,30 +164,39 @@ func DeskController(r *gin.RouterGroup) {
 	})
 
 	r.GET("/desk/:deskId/rules", func(c *gin.Context) {
-		var rules = make([]model.Rule, 0)
-		if err := dao.Collection("rule").Find(bson.M{"deskId": c.Param("deskId")}).All(&rules); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		if _, err := repos.Desks.FindByDeskId(c.Request.Context(), c.Param("deskId")); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		if rules, err := repos.Rules.FindByDesk(c.Request.Context(), c.Param("deskId")); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		} else {
 			c.JSON(200, rules)
 		}
 	})
 
 	r.POST("/rule/:ruleId", func(c *gin.Context) {
-		var rule model.Rule
-		if err := c.ShouldBindJSON(&rule); err != nil {
+		ruleId, ok := objectIdParam(c, "ruleId")
+		if !ok {
+			return
+		}
+		var req RuleUpdateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(400, gin.H{"error": err.Error()})
+		} else if req.IntervalMinutes <= 0 {
+			c.JSON(400, gin.H{"error": "intervalMinutes must be positive"})
 		} else {
-			if err := dao.Collection("rule").UpdateId(bson.ObjectIdHex(c.Param("ruleId")), &rule); err != nil {
+			if rule, err := repos.Rules.SetInterval(c.Request.Context(), ruleId, req.IntervalMinutes); err != nil {
 				log.Println("Fail to update rule:", c.Param("ruleId"), "by error:", err.Error())
-				c.JSON(500, gin.H{"error": err})
+				c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			} else {
 				c.JSON(201, rule)
 			}
 		}
 	})
 }
-func createDefaultRules(desk *model.Desk) error {
-	return dao.Collection("rule").Insert(model.Rule{
+func createDefaultRules(ctx context.Context, rules repository.RuleRepository, desk *model.Desk) error {
+	return rules.Insert(ctx, model.Rule{
 		Id:              bson.NewObjectId(),
 		DeskId:          desk.DeskId,
 		IntervalMinutes: model.DefaultSittingRemindInterval,
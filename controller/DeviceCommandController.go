@@ -0,0 +1,256 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"face-service/config"
+	"face-service/repository"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"log"
+	"sync"
+	"time"
+)
+
+// Devices get commands on the commands topic of their device id and
+// acknowledge them on commandAckTopic with the id of the command.
+const commandAckTopic = "/3ml/device/+/commands/ack"
+
+func commandTopic(deviceId string) string {
+	return "/3ml/device/" + deviceId + "/commands"
+}
+
+// deviceCommands are the commands a device can be sent, with the check of
+// their arguments.
+var deviceCommands = map[string]func(args map[string]interface{}) error{
+	"reboot":   noArgs,
+	"selfTest": noArgs,
+	"blink": func(args map[string]interface{}) error {
+		for name, value := range args {
+			if name != "seconds" {
+				return errors.New("blink takes seconds only")
+			}
+			if seconds, ok := value.(float64); !ok || seconds < 1 || seconds > 60 {
+				return errors.New("blink lasts from 1 to 60 seconds")
+			}
+		}
+		return nil
+	},
+}
+
+func noArgs(args map[string]interface{}) error {
+	if len(args) > 0 {
+		return errors.New("command takes no argument")
+	}
+	return nil
+}
+
+// commandWaiters are the requests of this instance waiting for the
+// acknowledgement of a command.
+var commandLock = sync.Mutex{}
+var commandWaiters = make(map[bson.ObjectId]chan *repository.DeviceCommand)
+
+type CommandRequest struct {
+	Command string                 `json:"command"`
+	Args    map[string]interface{} `json:"args"`
+	// Wait defaults to true: the request returns once the device acknowledged
+	// the command or after Timeout seconds.
+	Wait    *bool `json:"wait"`
+	Timeout int   `json:"timeout"`
+}
+
+// CommandMessage is what a device gets on its commands topic.
+type CommandMessage struct {
+	Id        bson.ObjectId `json:"id"`
+	Command   string        `json:"command"`
+	Args      bson.M        `json:"args,omitempty"`
+	ExpiresAt time.Time     `json:"expiresAt"`
+}
+
+// CommandAckMessage is what a device publishes on commandAckTopic. A command
+// failed when Error is set.
+type CommandAckMessage struct {
+	Id     string      `json:"id"`
+	Result interface{} `json:"result"`
+	Error  string      `json:"error"`
+}
+
+func DeviceCommandController(r *gin.RouterGroup, repos *repository.Repositories) {
+	r.POST("/device/:deviceId/commands", func(c *gin.Context) {
+		var req CommandRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		check, known := deviceCommands[req.Command]
+		if !known {
+			c.JSON(400, gin.H{"error": "unknown command " + req.Command})
+			return
+		}
+		if err := check(req.Args); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		timeout := config.Get().CommandTimeout
+		if req.Timeout < 0 || time.Duration(req.Timeout)*time.Second > config.Get().CommandMaxTimeout {
+			c.JSON(400, gin.H{"error": "timeout must be up to " + config.Get().CommandMaxTimeout.String()})
+			return
+		} else if req.Timeout > 0 {
+			timeout = time.Duration(req.Timeout) * time.Second
+		}
+		device, ok := findDevice(c, repos)
+		if !ok {
+			return
+		}
+		if device.DeviceId == "" {
+			c.JSON(409, gin.H{"error": "device is not connected to MQTT"})
+			return
+		}
+
+		now := time.Now()
+		command := repository.DeviceCommand{
+			Id:        bson.NewObjectId(),
+			DeviceId:  device.DeviceId,
+			Command:   req.Command,
+			Status:    repository.CommandPending,
+			CreatedAt: now,
+			ExpiresAt: now.Add(timeout),
+		}
+		if len(req.Args) > 0 {
+			command.Args = bson.M(req.Args)
+		}
+		if err := repos.Commands.Insert(c.Request.Context(), &command); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		wait := req.Wait == nil || *req.Wait
+		var acked chan *repository.DeviceCommand
+		if wait {
+			// registered before publishing, so that a quick ack is not missed
+			acked = make(chan *repository.DeviceCommand, 1)
+			commandLock.Lock()
+			commandWaiters[command.Id] = acked
+			commandLock.Unlock()
+			defer func() {
+				commandLock.Lock()
+				delete(commandWaiters, command.Id)
+				commandLock.Unlock()
+			}()
+		}
+		if err := publishDevice(commandTopic(device.DeviceId), false, CommandMessage{
+			Id:        command.Id,
+			Command:   command.Command,
+			Args:      command.Args,
+			ExpiresAt: command.ExpiresAt,
+		}); err != nil {
+			log.Println("[COMMAND]", "Fail to send", command.Command, "to device", device.DeviceId, "by error", err.Error())
+			if failed, err := repos.Commands.Complete(c.Request.Context(), command.Id, command.DeviceId, repository.CommandFailed, nil, err.Error()); err == nil {
+				command = *failed
+			}
+			c.JSON(503, command)
+			return
+		}
+		log.Println("[COMMAND]", "Sent", command.Command, command.Id.Hex(), "to device", device.DeviceId)
+		if !wait {
+			c.JSON(202, command)
+			return
+		}
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case done := <-acked:
+			c.JSON(200, done)
+			return
+		case <-timer.C:
+		case <-c.Request.Context().Done():
+			// the expirer times the command out
+			return
+		}
+		// the ack may have reached another instance
+		done, err := repos.Commands.Complete(c.Request.Context(), command.Id, command.DeviceId, repository.CommandTimedOut, nil, "no acknowledgement in time")
+		if err == repository.ErrNotFound {
+			done, err = repos.Commands.FindById(c.Request.Context(), command.Id)
+		}
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		} else if done.Status == repository.CommandTimedOut {
+			c.JSON(504, done)
+		} else {
+			c.JSON(200, done)
+		}
+	})
+
+	r.GET("/device/:deviceId/commands", func(c *gin.Context) {
+		p, ok := pageRequest(c)
+		if !ok {
+			return
+		}
+		device, ok := findDevice(c, repos)
+		if !ok {
+			return
+		}
+		if commands, next, err := repos.Commands.FindPageByDevice(c.Request.Context(), device.DeviceId, p); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, pageResponse(commands, next))
+		}
+	})
+
+	r.GET("/device/:deviceId/commands/:commandId", func(c *gin.Context) {
+		commandId, ok := objectIdParam(c, "commandId")
+		if !ok {
+			return
+		}
+		device, ok := findDevice(c, repos)
+		if !ok {
+			return
+		}
+		command, err := repos.Commands.FindById(c.Request.Context(), commandId)
+		if err == nil && command.DeviceId != device.DeviceId {
+			err = repository.ErrNotFound
+		}
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, command)
+		}
+	})
+}
+
+// subscribeCommands records the acknowledgements of devices and hands them to
+// the requests waiting for them.
+func subscribeCommands(c mqtt.Client, repos *repository.Repositories) {
+	c.Subscribe(commandAckTopic, 1, func(client mqtt.Client, message mqtt.Message) {
+		var ack CommandAckMessage
+		if err := json.Unmarshal(message.Payload(), &ack); err != nil || !bson.IsObjectIdHex(ack.Id) {
+			log.Println("[COMMAND]", "Ignoring invalid acknowledgement on", message.Topic())
+			return
+		}
+		go recordAck(repos, topicDeviceId(message.Topic()), ack)
+	}).Wait()
+}
+
+func recordAck(repos *repository.Repositories, deviceId string, ack CommandAckMessage) {
+	status := repository.CommandAcked
+	if ack.Error != "" {
+		status = repository.CommandFailed
+	}
+	command, err := repos.Commands.Complete(repository.AsSystem(context.Background()), bson.ObjectIdHex(ack.Id), deviceId, status, ack.Result, ack.Error)
+	if err == repository.ErrNotFound {
+		log.Println("[COMMAND]", "Ignoring late or unknown acknowledgement", ack.Id, "of device", deviceId)
+		return
+	} else if err != nil {
+		log.Println("[DB]", "Fail to record acknowledgement", ack.Id, "of device", deviceId, "by error", err.Error())
+		return
+	}
+	commandLock.Lock()
+	acked, waiting := commandWaiters[command.Id]
+	commandLock.Unlock()
+	if waiting {
+		acked <- command
+	}
+}
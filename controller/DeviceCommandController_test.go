@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"testing"
+)
+
+func TestDeviceCommands(t *testing.T) {
+	repos := repository.NewMemoryRepositories()
+	user := bson.NewObjectId()
+	device := model.Device{Id: bson.NewObjectId(), DeviceId: "SN-1", Name: "Camera"}
+	if err := repos.Devices.Insert(repository.WithOwner(context.Background(), user), &device); err != nil {
+		t.Fatal(err)
+	}
+	router := testRouter(user, func(r *gin.RouterGroup) { DeviceCommandController(r, repos) })
+	path := "/api/device/" + device.Id.Hex() + "/commands"
+
+	var command repository.DeviceCommand
+	if status := serve(t, router, "POST", path, gin.H{"command": "reboot"}, &command); status != 503 || command.Status != repository.CommandFailed {
+		t.Fatalf("expected a failed command without a broker, got %d %+v", status, command)
+	}
+
+	// the device acknowledges what it gets on its topic, and fails to blink
+	broker := &fakeBroker{onPublish: func(topic string, payload []byte) {
+		var sent CommandMessage
+		if topic != commandTopic("SN-1") || json.Unmarshal(payload, &sent) != nil {
+			t.Errorf("unexpected command on %s: %s", topic, payload)
+			return
+		}
+		ack := CommandAckMessage{Id: sent.Id.Hex(), Result: "ok"}
+		if sent.Command == "blink" {
+			ack = CommandAckMessage{Id: sent.Id.Hex(), Error: "no led"}
+		}
+		go recordAck(repos, "SN-1", ack)
+	}}
+	useBroker(t, broker)
+	if status := serve(t, router, "POST", path, gin.H{"command": "reboot"}, &command); status != 200 || command.Status != repository.CommandAcked || command.Result != "ok" {
+		t.Fatalf("expected an acknowledged command, got %d %+v", status, command)
+	}
+	if status := serve(t, router, "POST", path, gin.H{"command": "blink", "args": gin.H{"seconds": 5}}, &command); status != 200 || command.Status != repository.CommandFailed || command.Error != "no led" {
+		t.Fatalf("expected a failed command, got %d %+v", status, command)
+	}
+	for _, req := range []gin.H{{"command": "format"}, {"command": "blink", "args": gin.H{"seconds": 600}}, {"command": "reboot", "timeout": 3600}} {
+		if status := serve(t, router, "POST", path, req, nil); status != 400 {
+			t.Fatalf("expected %v to be refused, got %d", req, status)
+		}
+	}
+
+	// a device that stays silent times the command out, and a late ack does
+	// not change that
+	broker.onPublish = nil
+	if status := serve(t, router, "POST", path, gin.H{"command": "selfTest", "timeout": 1}, &command); status != 504 || command.Status != repository.CommandTimedOut {
+		t.Fatalf("expected a timed out command, got %d %+v", status, command)
+	}
+	recordAck(repos, "SN-1", CommandAckMessage{Id: command.Id.Hex()})
+	if serve(t, router, "GET", path+"/"+command.Id.Hex(), nil, &command); command.Status != repository.CommandTimedOut {
+		t.Fatalf("a late ack changed the command: %+v", command)
+	}
+
+	// without waiting, the ack is recorded for the history
+	if status := serve(t, router, "POST", path, gin.H{"command": "selfTest", "wait": false}, &command); status != 202 || command.Status != repository.CommandPending {
+		t.Fatalf("expected a pending command, got %d %+v", status, command)
+	}
+	recordAck(repos, "other", CommandAckMessage{Id: command.Id.Hex()})
+	recordAck(repos, "SN-1", CommandAckMessage{Id: command.Id.Hex(), Result: "passed"})
+	var history struct {
+		Items []repository.DeviceCommand `json:"items"`
+	}
+	serve(t, router, "GET", path, nil, &history)
+	if len(history.Items) != 5 || history.Items[0].Id != command.Id || history.Items[0].Status != repository.CommandAcked {
+		t.Fatalf("expected 5 commands with the acknowledged one first, got %+v", history.Items)
+	}
+}
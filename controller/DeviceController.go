@@ -1,31 +1,73 @@
 package controller
 
 import (
-	"face-service/auth"
+	"encoding/json"
 	"face-service/config"
-	"face-service/db"
+	"face-service/repository"
 	"github.com/gin-gonic/gin"
-	"github.com/globalsign/mgo/bson"
+	"github.com/google/uuid"
 	"github.com/ndphu/swd-commons/model"
 	"github.com/ndphu/swd-commons/service"
 	"log"
-	"strconv"
+	"time"
 )
 
-func DeviceController(r *gin.RouterGroup) {
+// deviceTypes are the types a device can be given. A device without one is a
+// camera, which paths name cameraTypeName.
+const cameraTypeName = "CAMERA"
+
+var deviceTypes = map[model.DeviceType]bool{
+	"":                           true,
+	model.DeviceTypeWaterMonitor: true,
+}
+
+// isCamera tells whether device has a camera to capture frames from.
+func isCamera(device *model.Device) bool {
+	return device.Type == ""
+}
+
+type DeviceUpdateRequest struct {
+	Name   *string           `json:"name"`
+	Type   *model.DeviceType `json:"type"`
+	DeskId *string           `json:"deskId"`
+}
+
+// DeviceUpdatedMessage tells the watchers of a desk that one of its devices
+// changed, or moved from FromDeskId.
+type DeviceUpdatedMessage struct {
+	Device     *model.Device `json:"device"`
+	FromDeskId string        `json:"fromDeskId"`
+}
+
+func DeviceController(r *gin.RouterGroup, repos *repository.Repositories) {
 	r.GET("/device/:deviceId", func(c *gin.Context) {
-		var device model.Device
-		if err := dao.Collection("device").Find(bson.M{"_id": bson.ObjectIdHex(c.Param("deviceId"))}).One(&device); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		deviceId, ok := objectIdParam(c, "deviceId")
+		if !ok {
+			return
+		}
+		if device, err := repos.Devices.FindById(c.Request.Context(), deviceId); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		} else {
 			c.JSON(200, device)
 		}
 	})
 
+	// PUT sets every field a device may change; PATCH only those given
+	r.PUT("/device/:deviceId", func(c *gin.Context) {
+		updateDevice(c, repos, false)
+	})
+
+	r.PATCH("/device/:deviceId", func(c *gin.Context) {
+		updateDevice(c, repos, true)
+	})
+
 	r.GET("/device/:deviceId/capture/live", func(c *gin.Context) {
-		var device model.Device
-		if err := dao.Collection("device").Find(bson.M{"_id": bson.ObjectIdHex(c.Param("deviceId"))}).One(&device); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		deviceId, ok := objectIdParam(c, "deviceId")
+		if !ok {
+			return
+		}
+		if device, err := repos.Devices.FindById(c.Request.Context(), deviceId); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
 		} else {
 			service.ServeLiveStream(service.NewClientOpts(config.Get().MQTTBroker), device.DeviceId, c)
@@ -33,93 +75,160 @@ func DeviceController(r *gin.RouterGroup) {
 	})
 
 	r.GET("/device/:deviceId/events", func(c *gin.Context) {
-		user := auth.CurrentUser(c)
-		var device model.Device
-		if err := dao.Collection("device").Find(bson.M{"_id": bson.ObjectIdHex(c.Param("deviceId")), "owner": user.Id}).One(&device); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		deviceId, ok := objectIdParam(c, "deviceId")
+		if !ok {
+			return
+		}
+		p, ok := pageRequest(c)
+		if !ok {
+			return
+		}
+		filter := repository.EventFilter{Type: c.Query("type")}
+		if filter.From, ok = timeQuery(c, "from"); !ok {
+			return
+		}
+		if filter.To, ok = timeQuery(c, "to"); !ok {
+			return
+		}
+		if device, err := repos.Devices.FindById(c.Request.Context(), deviceId); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
 		} else {
-			events := make([]model.Event, 0)
-			if err := dao.Collection("event").
-				Find(bson.M{"deviceId": device.DeviceId}).
-				Sort("-timestamp").
-				Limit(50).All(&events);
-				err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
+			if events, next, err := repos.Events.FindPageByDevice(c.Request.Context(), device.DeviceId, filter, p); err != nil {
+				c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			} else {
-				c.JSON(200, events)
+				c.JSON(200, pageResponse(events, next))
 			}
 		}
 	})
 
-	r.GET("/device/:deviceId/startRecognize", func(c *gin.Context) {
-		user := auth.CurrentUser(c)
-		d := model.Device{}
-		if err := dao.Collection("device").Find(bson.M{"_id": bson.ObjectIdHex(c.Param("deviceId")), "owner": user.Id}).One(&d); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+	r.DELETE("/device/:deviceId", func(c *gin.Context) {
+		deviceId, ok := objectIdParam(c, "deviceId")
+		if !ok {
 			return
 		}
-
-		totalPics := 12
-		if c.Query("totalPics") != "" {
-			if pic, err := strconv.Atoi(c.Query("totalPics")); err == nil && pic > 0 {
-				totalPics = pic
-			}
+		device, err := repos.Devices.FindById(c.Request.Context(), deviceId)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
 		}
-		frameDelay := 250
-		if c.Query("frameDelay") != "" {
-			if delay, err := strconv.Atoi(c.Query("frameDelay")); err == nil && delay > 0 {
-				frameDelay = delay
-			}
+		if err := repos.Trash.DeleteDevice(c.Request.Context(), deviceId); err != nil {
+			log.Println("Fail to delete device", deviceId.Hex(), "by error", err)
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
 		}
+		releaseDevice(c.Request.Context(), repos, device)
+		c.JSON(200, gin.H{"message": "device deleted"})
+	})
 
-		var device model.Device
-		if err := dao.Collection("device").Find(bson.M{"_id": bson.ObjectIdHex(c.Param("deviceId")), "owner": user.Id}).One(&device); err != nil {
-			c.JSON(500, gin.H{"error": "device not exists"})
+	r.POST("/device/:deviceId/restore", func(c *gin.Context) {
+		deviceId, ok := objectIdParam(c, "deviceId")
+		if !ok {
 			return
 		}
-
-		if frames, err := service.CaptureFrameContinuously(service.NewClientOpts(config.Get().MQTTBroker), device.DeviceId, frameDelay, totalPics); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		notBefore := time.Now().Add(-config.Get().SoftDeleteGracePeriod)
+		if err := repos.Trash.RestoreDevice(c.Request.Context(), deviceId, notBefore); err != nil {
+			log.Println("Fail to restore device", deviceId.Hex(), "by error", err)
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
-		} else {
-			if response, err := service.CallRecognizeWithRequest(service.NewClientOpts(config.Get().MQTTBroker), model.RecognizeRequest{
-				IncludeFacesDetails: true,
-				Images:              frames,
-				TimeoutSeconds:      30,
-			}); err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
-				return
-			} else {
-				result := make([]RecognizeResponse, 0)
-				for i, fd := range response.FaceDetailsList {
-					result = append(result, RecognizeResponse{
-						Image:           frames[i],
-						FaceDetailsList: fd,
-					})
-				}
-				c.JSON(200, result)
-			}
 		}
+		republishDesired(c.Request.Context(), repos, deviceId)
+		c.JSON(200, gin.H{"message": "device restored"})
 	})
-	r.DELETE("/device/:deviceId", func(c *gin.Context) {
-		user := auth.CurrentUser(c)
-		d := model.Device{}
-		if err := dao.Collection("device").Find(bson.M{"_id": bson.ObjectIdHex(c.Param("deviceId")), "owner": user.Id}).One(&d); err != nil {
-			log.Println("No permission to delete or device not exists")
-			c.JSON(500, gin.H{"error": err.Error()})
+}
+
+func updateDevice(c *gin.Context, repos *repository.Repositories, partial bool) {
+	var req DeviceUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if !partial && (req.Name == nil || req.Type == nil || req.DeskId == nil) {
+		c.JSON(400, gin.H{"error": "name, type and deskId are required"})
+		return
+	}
+	if req.Name == nil && req.Type == nil && req.DeskId == nil {
+		c.JSON(400, gin.H{"error": "nothing to update"})
+		return
+	}
+	if req.DeskId != nil && *req.DeskId == "" {
+		c.JSON(400, gin.H{"error": "deskId cannot be empty"})
+		return
+	}
+	former, ok := findDevice(c, repos)
+	if !ok {
+		return
+	}
+	if req.Type != nil && *req.Type != former.Type && !checkTypeChange(c, repos, former, *req.Type) {
+		return
+	}
+	if req.DeskId != nil && *req.DeskId != former.DeskId {
+		if _, err := repos.Desks.FindByDeskId(c.Request.Context(), *req.DeskId); err == repository.ErrNotFound {
+			c.JSON(400, gin.H{"error": "unknown desk " + *req.DeskId})
 			return
-		}
-		if err := dao.Collection("device").RemoveId(d.Id); err != nil {
-			log.Println("Fail to delete device", d.Id, "by error", err)
-			c.JSON(500, gin.H{"error": err.Error()})
+		} else if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(200, gin.H{"message": "device deleted"})
+	}
+	device, err := repos.Devices.Update(c.Request.Context(), former.Id, repository.DeviceChanges{
+		Name:   req.Name,
+		Type:   req.Type,
+		DeskId: req.DeskId,
 	})
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if device.DeskId != former.DeskId {
+		log.Println("[DEVICE]", "Device", device.Id.Hex(), "moved from desk", former.DeskId, "to", device.DeskId)
+	}
+	notifyDeviceUpdated(device, former.DeskId)
+	c.JSON(200, device)
+}
+
+// checkTypeChange answers 400 or 409 unless device can become of deviceType:
+// water monitors are known by their serial, and the desired settings of
+// device must fit its new type.
+func checkTypeChange(c *gin.Context, repos *repository.Repositories, device *model.Device, deviceType model.DeviceType) bool {
+	if !deviceTypes[deviceType] {
+		c.JSON(400, gin.H{"error": "unknown device type " + string(deviceType)})
+		return false
+	}
+	if _, err := uuid.Parse(device.DeviceId); deviceType == model.DeviceTypeWaterMonitor && (device.DeviceId == "" || err == nil) {
+		c.JSON(409, gin.H{"error": "device is not known by its serial; claim it as a water monitor instead"})
+		return false
+	}
+	shadow, err := repos.Shadows.FindByDevice(c.Request.Context(), device)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return false
+	}
+	for name, value := range shadow.Desired {
+		check, known := deviceSettings[name]
+		if !known {
+			continue
+		}
+		if err := check(deviceType, settingValue(value)); err != nil {
+			c.JSON(409, gin.H{"error": "desired setting " + name + " does not fit the new type: " + err.Error()})
+			return false
+		}
+	}
+	return true
 }
 
-type RecognizeResponse struct {
-	Image           []byte              `json:"image"`
-	FaceDetailsList []model.FaceDetails `json:"faceDetailsList"`
+// notifyDeviceUpdated tells the watchers of the desk of device, and of the
+// desk it moved from if any.
+func notifyDeviceUpdated(device *model.Device, fromDeskId string) {
+	payload, err := json.Marshal(DeviceUpdatedMessage{Device: device, FromDeskId: fromDeskId})
+	if err != nil {
+		log.Println("[DEVICE]", "Fail to marshal update of device", device.Id.Hex(), "by error", err.Error())
+		return
+	}
+	msg := WSMessage{Code: 200, Type: "DEVICE_UPDATED", Payload: string(payload)}
+	if device.DeskId != fromDeskId {
+		msg.Type = "DEVICE_MOVED"
+		notifyDesk(fromDeskId, msg)
+	}
+	notifyDesk(device.DeskId, msg)
 }
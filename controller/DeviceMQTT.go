@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"face-service/config"
+	"face-service/repository"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/ndphu/swd-commons/service"
+	"sync"
+)
+
+var errDevicesUnreachable = errors.New("devices are unreachable: not connected to the broker")
+
+// deviceClient talks with the devices on their own topics. It is nil until
+// MonitorDevices connected.
+var deviceLock = sync.Mutex{}
+var deviceClient mqtt.Client
+
+// MonitorDevices connects to the broker on behalf of the devices: it answers
+// their announcements, keeps track of their presence, and stores the
+// configuration they report and the commands they acknowledge.
+func MonitorDevices(repos *repository.Repositories) {
+	ops := service.GetDefaultOps()
+	ops.AddBroker(config.Get().MQTTBroker)
+	ops.ClientID = uuid.New().String()
+
+	ops.OnConnect = func(c mqtt.Client) {
+		subscribeProvisioning(c, repos)
+		subscribePresence(c, repos)
+		subscribeShadows(c, repos)
+		subscribeCommands(c, repos)
+	}
+	client := mqtt.NewClient(ops)
+	if tok := client.Connect(); tok.Wait() && tok.Error() != nil {
+		panic(tok.Error())
+	}
+	deviceLock.Lock()
+	deviceClient = client
+	deviceLock.Unlock()
+}
+
+// publishDevice sends payload as JSON on topic. A retained message is kept by
+// the broker for the device to get when it next connects.
+func publishDevice(topic string, retained bool, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return publishRaw(topic, retained, data)
+}
+
+// clearRetained makes the broker drop the message it retains on topic.
+func clearRetained(topic string) error {
+	return publishRaw(topic, true, []byte{})
+}
+
+func publishRaw(topic string, retained bool, data []byte) error {
+	deviceLock.Lock()
+	client := deviceClient
+	deviceLock.Unlock()
+	if client == nil {
+		return errDevicesUnreachable
+	}
+	if tok := client.Publish(topic, 1, retained, data); tok.Wait() && tok.Error() != nil {
+		return tok.Error()
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"face-service/repository"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// doneToken is the token of an operation that completed with err.
+type doneToken struct {
+	err error
+}
+
+func (t doneToken) Wait() bool                       { return true }
+func (t doneToken) WaitTimeout(_ time.Duration) bool { return true }
+func (t doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (t doneToken) Error() error { return t.err }
+
+// fakeBroker stands in for the device client. It hands what is published to
+// onPublish; any other use of the client panics.
+type fakeBroker struct {
+	mqtt.Client
+	onPublish func(topic string, payload []byte)
+}
+
+func (b *fakeBroker) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if b.onPublish != nil {
+		b.onPublish(topic, payload.([]byte))
+	}
+	return doneToken{}
+}
+
+// useBroker makes b the device client until the test ends.
+func useBroker(t *testing.T, b *fakeBroker) {
+	deviceLock.Lock()
+	deviceClient = b
+	deviceLock.Unlock()
+	t.Cleanup(func() {
+		deviceLock.Lock()
+		deviceClient = nil
+		deviceLock.Unlock()
+	})
+}
+
+// testRouter serves routes as user, without a token.
+func testRouter(user bson.ObjectId, routes ...func(r *gin.RouterGroup)) *gin.Engine {
+	router := gin.New()
+	api := router.Group("/api", func(c *gin.Context) {
+		c.Set("user", &repository.User{Id: user})
+		c.Request = c.Request.WithContext(repository.WithOwner(c.Request.Context(), user))
+	})
+	for _, route := range routes {
+		route(api)
+	}
+	return router
+}
+
+// serve sends body as JSON and decodes the answer into out when given.
+func serve(t *testing.T, router *gin.Engine, method string, path string, body interface{}, out interface{}) int {
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: fail to decode answer %s: %v", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
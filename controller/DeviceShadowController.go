@@ -0,0 +1,279 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"face-service/repository"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Devices get their desired configuration, retained, on the desired topic of
+// their device id and answer on reportedConfigTopic with the settings they
+// run with.
+const reportedConfigTopic = "/3ml/device/+/config/reported"
+
+func desiredConfigTopic(deviceId string) string {
+	return "/3ml/device/" + deviceId + "/config/desired"
+}
+
+var resolutionPattern = regexp.MustCompile(`^[1-9][0-9]{1,4}x[1-9][0-9]{1,4}$`)
+var clockPattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+// deviceSetting checks the value of a setting for a type of device.
+type deviceSetting func(deviceType model.DeviceType, value interface{}) error
+
+// deviceSettings are the settings a device can be given. Cameras are every
+// device but water monitors.
+var deviceSettings = map[string]deviceSetting{
+	"frameRate": func(deviceType model.DeviceType, value interface{}) error {
+		if deviceType == model.DeviceTypeWaterMonitor {
+			return errors.New("water monitors have no frame rate")
+		}
+		if rate, ok := value.(float64); !ok || rate <= 0 || rate > 60 {
+			return errors.New("frame rate must be a number of up to 60 per second")
+		}
+		return nil
+	},
+	"resolution": func(deviceType model.DeviceType, value interface{}) error {
+		if deviceType == model.DeviceTypeWaterMonitor {
+			return errors.New("water monitors have no resolution")
+		}
+		if resolution, ok := value.(string); !ok || !resolutionPattern.MatchString(resolution) {
+			return errors.New("resolution must read as WIDTHxHEIGHT")
+		}
+		return nil
+	},
+	"captureSchedule": func(deviceType model.DeviceType, value interface{}) error {
+		schedule, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.New("capture schedule must be an object with from and to")
+		}
+		for _, bound := range []string{"from", "to"} {
+			if clock, ok := schedule[bound].(string); !ok || !clockPattern.MatchString(clock) {
+				return errors.New("capture schedule " + bound + " must read as HH:MM")
+			}
+		}
+		if days, ok := schedule["days"]; ok {
+			list, ok := days.([]interface{})
+			if !ok {
+				return errors.New("capture schedule days must be a list of weekdays from 0 to 6")
+			}
+			for _, day := range list {
+				if d, ok := day.(float64); !ok || d < 0 || d > 6 || d != float64(int(d)) {
+					return errors.New("capture schedule days must be a list of weekdays from 0 to 6")
+				}
+			}
+		}
+		return nil
+	},
+	"calibration": func(deviceType model.DeviceType, value interface{}) error {
+		if deviceType != model.DeviceTypeWaterMonitor {
+			return errors.New("only water monitors are calibrated")
+		}
+		calibration, ok := value.(map[string]interface{})
+		if !ok || len(calibration) == 0 {
+			return errors.New("calibration must be an object of numbers")
+		}
+		for name, v := range calibration {
+			if _, ok := v.(float64); !ok || !validSettingName(name) {
+				return errors.New("calibration must be an object of numbers")
+			}
+		}
+		return nil
+	},
+}
+
+// DesiredConfigMessage is what a device gets on its desired topic: every
+// setting desired, not only those just changed.
+type DesiredConfigMessage struct {
+	Version int    `json:"version"`
+	Desired bson.M `json:"desired"`
+}
+
+// ReportedConfigMessage is what a device publishes on its reported topic once
+// it applied a desired configuration, or when it starts.
+type ReportedConfigMessage struct {
+	Version  int                    `json:"version"`
+	Reported map[string]interface{} `json:"reported"`
+}
+
+type DeviceConfigResponse struct {
+	*repository.DeviceShadow
+	Delta     bson.M `json:"delta"`
+	Published *bool  `json:"published,omitempty"`
+}
+
+// DeviceShadowController serves the configuration of devices. A PATCH is a
+// JSON merge patch of the desired settings: null removes a setting.
+func DeviceShadowController(r *gin.RouterGroup, repos *repository.Repositories) {
+	r.GET("/device/:deviceId/config", func(c *gin.Context) {
+		device, ok := findDevice(c, repos)
+		if !ok {
+			return
+		}
+		if shadow, err := repos.Shadows.FindByDevice(c.Request.Context(), device); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, DeviceConfigResponse{DeviceShadow: shadow, Delta: shadow.Delta()})
+		}
+	})
+
+	r.GET("/device/:deviceId/config/delta", func(c *gin.Context) {
+		device, ok := findDevice(c, repos)
+		if !ok {
+			return
+		}
+		if shadow, err := repos.Shadows.FindByDevice(c.Request.Context(), device); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, gin.H{"version": shadow.Version, "reportedVersion": shadow.ReportedVersion, "delta": shadow.Delta()})
+		}
+	})
+
+	r.PATCH("/device/:deviceId/config", func(c *gin.Context) {
+		var patch map[string]interface{}
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if len(patch) == 0 {
+			c.JSON(400, gin.H{"error": "no setting to change"})
+			return
+		}
+		device, ok := findDevice(c, repos)
+		if !ok {
+			return
+		}
+		if device.DeviceId == "" {
+			c.JSON(409, gin.H{"error": "device is not connected to MQTT"})
+			return
+		}
+		for name, value := range patch {
+			check, known := deviceSettings[name]
+			if !known {
+				c.JSON(400, gin.H{"error": "unknown setting " + name})
+				return
+			}
+			if value == nil {
+				continue
+			}
+			if err := check(device.Type, value); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		shadow, err := repos.Shadows.UpdateDesired(c.Request.Context(), device, bson.M(patch))
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		// the device catches up on the retained message when it reconnects;
+		// until then the delta shows what it has yet to apply
+		published := true
+		if err := publishDevice(desiredConfigTopic(device.DeviceId), true, DesiredConfigMessage{
+			Version: shadow.Version,
+			Desired: shadow.Desired,
+		}); err != nil {
+			log.Println("[SHADOW]", "Fail to send desired config to device", device.DeviceId, "by error", err.Error())
+			published = false
+		}
+		c.JSON(200, DeviceConfigResponse{DeviceShadow: shadow, Delta: shadow.Delta(), Published: &published})
+	})
+}
+
+// republishDesired gives a restored device back the desired config its
+// deletion cleared.
+func republishDesired(ctx context.Context, repos *repository.Repositories, deviceId bson.ObjectId) {
+	device, err := repos.Devices.FindById(ctx, deviceId)
+	if err != nil || device.DeviceId == "" {
+		return
+	}
+	shadow, err := repos.Shadows.FindByDevice(ctx, device)
+	if err != nil {
+		log.Println("[DB]", "Fail to find config of device", device.DeviceId, "by error", err.Error())
+		return
+	}
+	if shadow.Version == 0 {
+		return
+	}
+	if err := publishDevice(desiredConfigTopic(device.DeviceId), true, DesiredConfigMessage{
+		Version: shadow.Version,
+		Desired: shadow.Desired,
+	}); err != nil {
+		log.Println("[SHADOW]", "Fail to send desired config to device", device.DeviceId, "by error", err.Error())
+	}
+}
+
+// settingValue turns a stored setting back into what it was decoded from
+// JSON as, which is what the settings are checked on.
+func settingValue(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return value
+	}
+	return decoded
+}
+
+// findDevice answers 400 or 404 unless the :deviceId of the request is a
+// device of the current user.
+func findDevice(c *gin.Context, repos *repository.Repositories) (*model.Device, bool) {
+	deviceId, ok := objectIdParam(c, "deviceId")
+	if !ok {
+		return nil, false
+	}
+	device, err := repos.Devices.FindById(c.Request.Context(), deviceId)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return device, true
+}
+
+// subscribeShadows stores the configuration devices report.
+func subscribeShadows(c mqtt.Client, repos *repository.Repositories) {
+	c.Subscribe(reportedConfigTopic, 1, func(client mqtt.Client, message mqtt.Message) {
+		var report ReportedConfigMessage
+		if err := json.Unmarshal(message.Payload(), &report); err != nil || report.Reported == nil {
+			log.Println("[SHADOW]", "Ignoring invalid report on", message.Topic())
+			return
+		}
+		go recordReported(repos, topicDeviceId(message.Topic()), report)
+	}).Wait()
+}
+
+func recordReported(repos *repository.Repositories, deviceId string, report ReportedConfigMessage) {
+	if deviceId == "" {
+		return
+	}
+	// setting names become field names; the database takes no dots nor
+	// leading dollars in those
+	reported := bson.M{}
+	for name, value := range report.Reported {
+		if validSettingName(name) {
+			reported[name] = value
+		}
+	}
+	_, err := repos.Shadows.UpdateReported(repository.AsSystem(context.Background()), deviceId, report.Version, reported)
+	if err == repository.ErrNotFound {
+		return
+	} else if err == repository.ErrStaleReport {
+		log.Println("[SHADOW]", "Ignoring stale report of device", deviceId, "version", report.Version)
+	} else if err != nil {
+		log.Println("[DB]", "Fail to record reported config of device", deviceId, "by error", err.Error())
+	}
+}
+
+func validSettingName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "$") && !strings.Contains(name, ".")
+}
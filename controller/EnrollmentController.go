@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"context"
+	"face-service/auth"
+	"face-service/config"
+	"face-service/recognition"
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"log"
+	"time"
+)
+
+const (
+	defaultEnrollSamples = 5
+	maxEnrollSamples     = 20
+	enrollFramesPerRound = 4
+	enrollTimeout        = 5 * time.Minute
+
+	enrollNoFace        = "no_face"
+	enrollMultipleFaces = "multiple_faces"
+)
+
+type EnrollRequest struct {
+	Label      string `json:"label"`
+	Samples    int    `json:"samples"`
+	FrameDelay int    `json:"frameDelay"`
+}
+
+func EnrollmentController(r *gin.RouterGroup, repos *repository.Repositories, recognizer recognition.Recognizer, frames recognition.FrameSource) {
+	r.POST("/device/:deviceId/enroll", func(c *gin.Context) {
+		deviceId, ok := objectIdParam(c, "deviceId")
+		if !ok {
+			return
+		}
+		var req EnrollRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Label == "" {
+			c.JSON(400, gin.H{"error": "missing label"})
+			return
+		}
+		if req.Samples <= 0 {
+			req.Samples = defaultEnrollSamples
+		} else if req.Samples > maxEnrollSamples {
+			req.Samples = maxEnrollSamples
+		}
+		if req.FrameDelay <= 0 {
+			req.FrameDelay = 250
+		}
+
+		device, err := repos.Devices.FindById(c.Request.Context(), deviceId)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		if !isCamera(device) {
+			c.JSON(409, gin.H{"error": "device is not a camera"})
+			return
+		}
+		// an enrollment holds the device like a recognition job
+		release, err := recognitions.Reserve(device.Id)
+		if err != nil {
+			c.JSON(recognitionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		now := time.Now()
+		session := repository.EnrollmentSession{
+			Id:        bson.NewObjectId(),
+			DeviceId:  device.Id,
+			Label:     req.Label,
+			Status:    repository.EnrollmentRunning,
+			Target:    req.Samples,
+			MaxFrames: req.Samples * 3,
+			Samples:   make([]repository.EnrollmentSample, 0),
+			Instance:  config.Get().InstanceId,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		if err := repos.Enrollments.Insert(c.Request.Context(), &session); err != nil {
+			release()
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		// the enrollment runs on its own copy while the response is written
+		running := session
+		running.Samples = make([]repository.EnrollmentSample, 0, running.MaxFrames)
+		ctx, cancel := context.WithTimeout(repository.WithOwner(context.Background(), auth.CurrentUser(c).Id), enrollTimeout)
+		go func() {
+			defer cancel()
+			defer release()
+			runEnrollment(ctx, repos, recognizer, frames, &running, device.DeviceId, req.FrameDelay)
+		}()
+		c.JSON(202, session)
+	})
+
+	r.GET("/enrollment/:sessionId", func(c *gin.Context) {
+		sessionId, ok := objectIdParam(c, "sessionId")
+		if !ok {
+			return
+		}
+		if session, err := repos.Enrollments.FindById(c.Request.Context(), sessionId); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, session)
+		}
+	})
+}
+
+// runEnrollment captures frames in rounds until the session has enough
+// accepted samples or has used up its frames. Only frames showing exactly one
+// face can tell whose face it is, so the others are rejected.
+func runEnrollment(ctx context.Context, repos *repository.Repositories, recognizer recognition.Recognizer, source recognition.FrameSource, session *repository.EnrollmentSession, deviceId string, frameDelay int) {
+	in := newIngestion(ctx, repos.Faces, config.Get().DescriptorModel)
+	defer in.finish()
+
+	for session.Accepted < session.Target && session.Frames < session.MaxFrames {
+		if err := ctx.Err(); err != nil {
+			failEnrollment(repos, session, err)
+			return
+		}
+		frames, err := source.Capture(ctx, deviceId, frameDelay, enrollFramesPerRound)
+		if err != nil {
+			failEnrollment(repos, session, err)
+			return
+		}
+		response, err := recognizer.Recognize(ctx, model.RecognizeRequest{
+			IncludeFacesDetails: true,
+			Images:              frames,
+			TimeoutSeconds:      30,
+		})
+		if err != nil {
+			failEnrollment(repos, session, err)
+			return
+		}
+		for i, details := range response.FaceDetailsList {
+			if session.Accepted >= session.Target || session.Frames >= session.MaxFrames || i >= len(frames) {
+				break
+			}
+			session.Frames++
+			sample := enrollSample(in, session, details)
+			if sample.Status == ingestInserted {
+				storeCrop(ctx, repos, sample.FaceId, frames[i], details[0].Rect)
+			}
+			session.Samples = append(session.Samples, sample)
+		}
+		saveEnrollment(repos, session)
+	}
+	session.Status = repository.EnrollmentCompleted
+	if session.Accepted < session.Target {
+		session.Status = repository.EnrollmentFailed
+		session.Error = "not enough usable frames"
+	}
+	log.Println("[ENROLL]", "Session", session.Id.Hex(), session.Status, "with", session.Accepted, "sample(s) for label", session.Label)
+	saveEnrollment(repos, session)
+}
+
+func enrollSample(in *ingestion, session *repository.EnrollmentSession, details []model.FaceDetails) repository.EnrollmentSample {
+	sample := repository.EnrollmentSample{Frame: session.Frames}
+	switch {
+	case len(details) == 0:
+		sample.Status, sample.Code = ingestRejected, enrollNoFace
+	case len(details) > 1:
+		sample.Status, sample.Code = ingestRejected, enrollMultipleFaces
+	default:
+		face := model.Face{
+			Label:      session.Label,
+			Descriptor: append([]float32(nil), details[0].Descriptor[:]...),
+		}
+		var result ingestResult
+		in.ingest(&face, "", &result)
+		sample.Status, sample.FaceId, sample.Code, sample.Error = result.Status, result.Id, result.Code, result.Error
+	}
+	if sample.Status == ingestInserted {
+		session.Accepted++
+	} else {
+		session.Rejected++
+	}
+	return sample
+}
+
+func failEnrollment(repos *repository.Repositories, session *repository.EnrollmentSession, err error) {
+	log.Println("[ENROLL]", "Session", session.Id.Hex(), "failed by error", err.Error())
+	session.Status = repository.EnrollmentFailed
+	session.Error = err.Error()
+	saveEnrollment(repos, session)
+}
+
+// saveEnrollment does not use the session context, which may be the reason the
+// session ended.
+func saveEnrollment(repos *repository.Repositories, session *repository.EnrollmentSession) {
+	session.UpdatedAt = time.Now()
+	ctx := repository.WithOwner(context.Background(), session.UserId)
+	if err := repos.Enrollments.Update(ctx, session); err != nil {
+		log.Println("[DB]", "Fail to update enrollment session", session.Id.Hex(), "by error", err.Error())
+	}
+}
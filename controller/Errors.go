@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+)
+
+// errorStatus maps an error to the HTTP status to answer with. Documents of
+// other users are reported as missing, database timeouts become 504, requests
+// the client gave up on become 499 and unique key violations become 409.
+func errorStatus(err error) int {
+	if repository.IsDuplicate(err) {
+		return 409
+	}
+	switch err {
+	case repository.ErrNotFound:
+		return 404
+	case repository.ErrNoOwner:
+		return 403
+	case repository.ErrTimeout:
+		return 504
+	case repository.ErrCanceled:
+		return 499
+	case repository.ErrInvalidCursor, repository.ErrInvalidSort:
+		return 400
+	case repository.ErrLabelExists, repository.ErrInTrash:
+		return 409
+	}
+	return 500
+}
+
+// objectIdParam reads an ObjectId path parameter. A malformed id cannot match
+// anything, so it is answered with 404 like any other missing document.
+func objectIdParam(c *gin.Context, name string) (bson.ObjectId, bool) {
+	if !bson.IsObjectIdHex(c.Param(name)) {
+		c.JSON(404, gin.H{"error": "not found"})
+		return "", false
+	}
+	return bson.ObjectIdHex(c.Param(name)), true
+}
@@ -1,51 +1,116 @@
 package controller
 
 import (
-	"bytes"
-	"crypto/md5"
-	"encoding/binary"
+	"context"
 	"face-service/auth"
-	"face-service/db"
-	"fmt"
+	"face-service/config"
+	"face-service/descriptor"
+	"face-service/gallery"
+	"face-service/recognition"
+	"face-service/repository"
 	"github.com/gin-gonic/gin"
 	"github.com/globalsign/mgo/bson"
 	"github.com/ndphu/swd-commons/model"
+	"image"
+	"log"
+	"time"
 )
 
-func LabelController(r *gin.RouterGroup) {
+func LabelController(r *gin.RouterGroup, repos *repository.Repositories) {
 	r.POST("/labels", func(c *gin.Context) {
-		u := auth.CurrentUser(c)
 		faces := make([]model.Face, 0)
 		if err := c.ShouldBindJSON(&faces); err != nil {
 			c.JSON(400, gin.H{"error": err.Error()})
 		} else {
-			if len(faces) > 0 {
-				for _, face := range faces {
-					face.Id = bson.NewObjectId()
-					face.UserId = u.Id
-					var buf bytes.Buffer
-					if err := binary.Write(&buf, binary.LittleEndian, face.Descriptor); err != nil {
-						panic(err)
-					} else {
-						face.MD5 = fmt.Sprintf("%x", md5.Sum(buf.Bytes()))
-						if err := dao.Collection("face").Insert(&face); err != nil {
-							panic(err)
-						}
-					}
-				}
+			c.JSON(200, ingestFaces(c.Request.Context(), repos.Faces, descriptorModel(c), faces))
+		}
+	})
+
+	r.GET("/labels", func(c *gin.Context) {
+		if labels, err := repos.Faces.Labels(c.Request.Context()); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, labels)
+		}
+	})
+
+	r.PATCH("/label/:label", func(c *gin.Context) {
+		var req struct {
+			Label string `json:"label"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Label == "" || req.Label == c.Param("label") {
+			c.JSON(400, gin.H{"error": "invalid label"})
+			return
+		}
+		// the thresholds the new label kept from faces that are gone win over
+		// those of the renamed label, so moving them cannot conflict
+		updateLabels(c, func(ctx context.Context) (int, error) {
+			count, err := repos.Faces.RenameLabel(ctx, c.Param("label"), req.Label)
+			if err == nil && count > 0 {
+				_, err = repos.Thresholds.RenameLabel(ctx, c.Param("label"), req.Label)
 			}
-			c.JSON(200, gin.H{"error": ""})
+			return count, err
+		})
+	})
+
+	r.POST("/labels/merge", func(c *gin.Context) {
+		var req struct {
+			From string `json:"from"`
+			Into string `json:"into"`
 		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if req.From == "" || req.Into == "" || req.From == req.Into {
+			c.JSON(400, gin.H{"error": "invalid labels"})
+			return
+		}
+		// the merged label is matched with the thresholds of into
+		updateLabels(c, func(ctx context.Context) (int, error) {
+			count, err := repos.Faces.MergeLabel(ctx, req.From, req.Into)
+			if err == nil && count > 0 {
+				_, err = repos.Thresholds.RemoveLabel(ctx, req.From)
+			}
+			return count, err
+		})
+	})
+
+	r.DELETE("/label/:label", func(c *gin.Context) {
+		updateLabels(c, func(ctx context.Context) (int, error) {
+			count, err := repos.Trash.DeleteLabel(ctx, c.Param("label"))
+			if err == nil && count > 0 {
+				_, err = repos.Thresholds.RemoveLabel(ctx, c.Param("label"))
+			}
+			return count, err
+		})
+	})
+
+	// a restored label is matched with the default threshold again
+	r.POST("/label/:label/restore", func(c *gin.Context) {
+		notBefore := time.Now().Add(-config.Get().SoftDeleteGracePeriod)
+		updateLabels(c, func(ctx context.Context) (int, error) {
+			count, err := repos.Trash.RestoreLabel(ctx, c.Param("label"), notBefore)
+			if err == repository.ErrNotFound {
+				return 0, nil
+			}
+			return count, err
+		})
 	})
 
 	r.GET("/label/:label/descriptors", func(c *gin.Context) {
-		faces := make([]model.Face, 0)
-		if err := dao.Collection("face").Find(bson.M{
-			"label": c.Param("label"),
-		}).All(&faces); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		p, ok := pageRequest(c)
+		if !ok {
+			return
+		}
+		if faces, next, err := repos.Faces.FindPageByLabel(c.Request.Context(), c.Param("label"), p); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		} else {
-			c.JSON(200, faces)
+			c.JSON(200, pageResponse(faces, next))
 		}
 	})
 
@@ -54,21 +119,186 @@ func LabelController(r *gin.RouterGroup) {
 		if err := c.ShouldBindJSON(&faces); err != nil {
 			c.JSON(400, gin.H{"error": err.Error()})
 		} else {
-			if len(faces) > 0 {
-				for _, face := range faces {
-					face.Id = bson.NewObjectId()
-					var buf bytes.Buffer
-					if err := binary.Write(&buf, binary.LittleEndian, face.Descriptor); err != nil {
-						panic(err)
-					} else {
-						face.MD5 = fmt.Sprintf("%x", md5.Sum(buf.Bytes()))
-						if err := dao.Collection("face").Insert(&face); err != nil {
-							panic(err)
-						}
-					}
-				}
+			for i := range faces {
+				faces[i].Label = c.Param("label")
 			}
-			c.JSON(200, gin.H{"error": ""})
+			c.JSON(200, ingestFaces(c.Request.Context(), repos.Faces, descriptorModel(c), faces))
 		}
 	})
 }
+
+// descriptorModel returns the model that computed uploaded descriptors, which
+// clients computing them elsewhere name with ?model=.
+func descriptorModel(c *gin.Context) string {
+	if m := c.Query("model"); m != "" {
+		return m
+	}
+	return config.Get().DescriptorModel
+}
+
+// updateLabels runs a label change and answers with the number of faces it
+// touched; a change that touched none means the label does not exist.
+func updateLabels(c *gin.Context, change func(ctx context.Context) (int, error)) {
+	count, err := change(c.Request.Context())
+	if err != nil {
+		log.Println("[DB]", "Fail to update labels by error", err.Error())
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if count == 0 {
+		c.JSON(404, gin.H{"error": "label not found"})
+		return
+	}
+	galleries.Invalidate(auth.CurrentUser(c).Id)
+	c.JSON(200, gin.H{"faces": count})
+}
+
+const (
+	ingestInserted  = "inserted"
+	ingestDuplicate = "duplicate"
+	ingestRejected  = "rejected"
+	ingestFailed    = "failed"
+)
+
+type ingestResult struct {
+	Index  int           `json:"index"`
+	Status string        `json:"status"`
+	Id     bson.ObjectId `json:"id,omitempty"`
+	Code   string        `json:"code,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+func (r *ingestResult) reject(err *descriptor.ValidationError) {
+	r.Status, r.Code, r.Error = ingestRejected, err.Code, err.Message
+}
+
+// ingestion stores the faces of one upload, all computed by the same model.
+// Faces lying too close to a sample of their label, stored or earlier in the
+// upload, are rejected.
+type ingestion struct {
+	ctx       context.Context
+	faces     repository.FaceRepository
+	model     string
+	validator descriptor.Validator
+	limit     float64
+	index     *gallery.Index
+	indexErr  error
+	accepted  map[string][][]float32
+}
+
+func newIngestion(ctx context.Context, faces repository.FaceRepository, descriptorModel string) *ingestion {
+	conf := config.Get()
+	in := &ingestion{
+		ctx:   ctx,
+		faces: faces,
+		model: descriptorModel,
+		validator: descriptor.Validator{
+			Dimension: conf.DescriptorDimension,
+			MinNorm:   conf.DescriptorMinNorm,
+			MaxNorm:   conf.DescriptorMaxNorm,
+		},
+		limit:    conf.DescriptorDuplicateDistance,
+		accepted: make(map[string][][]float32),
+	}
+	if in.limit > 0 {
+		owner, _ := repository.OwnerFrom(ctx)
+		in.index, in.indexErr = galleries.Get(owner, descriptorModel, func() ([]model.Face, error) {
+			return faces.FindAll(ctx, descriptorModel)
+		})
+	}
+	return in
+}
+
+// finish makes the faces stored so far visible to matching.
+func (in *ingestion) finish() {
+	if len(in.accepted) == 0 {
+		return
+	}
+	if owner, ok := repository.OwnerFrom(in.ctx); ok {
+		galleries.Invalidate(owner)
+	}
+}
+
+// ingestFaces stores every valid face of an upload that its owner does not
+// have yet under the same label. A failing face does not stop the rest of the
+// batch.
+func ingestFaces(ctx context.Context, faces repository.FaceRepository, descriptorModel string, batch []model.Face) gin.H {
+	in := newIngestion(ctx, faces, descriptorModel)
+	results := make([]ingestResult, len(batch))
+	counts := map[string]int{ingestInserted: 0, ingestDuplicate: 0, ingestRejected: 0, ingestFailed: 0}
+	for i := range batch {
+		results[i] = ingestResult{Index: i}
+		in.ingest(&batch[i], "", &results[i])
+		counts[results[i].Status]++
+	}
+	in.finish()
+	return gin.H{
+		"inserted":  counts[ingestInserted],
+		"duplicate": counts[ingestDuplicate],
+		"rejected":  counts[ingestRejected],
+		"failed":    counts[ingestFailed],
+		"items":     results,
+	}
+}
+
+// ingest stores face, along with the crop it was computed from when there is
+// one.
+func (in *ingestion) ingest(face *model.Face, cropId bson.ObjectId, result *ingestResult) {
+	if face.Label == "" {
+		result.Status, result.Error = ingestFailed, "missing label"
+		return
+	}
+	if err := in.validator.Validate(face.Descriptor); err != nil {
+		result.reject(err)
+		return
+	}
+	if in.limit > 0 {
+		if in.indexErr != nil {
+			result.Status, result.Error = ingestFailed, in.indexErr.Error()
+			return
+		}
+		// a distance of 0 is the very same descriptor, which the upsert
+		// reports as a duplicate
+		if d, ok := in.index.NearestInLabel(face.Descriptor, face.Label); ok && d > 0 && d <= in.limit {
+			result.reject(descriptor.NearDuplicate(d))
+			return
+		}
+		for _, other := range in.accepted[face.Label] {
+			if d, _ := descriptor.Distance(descriptor.Euclidean, face.Descriptor, other); d > 0 && d <= in.limit {
+				result.reject(descriptor.NearDuplicate(d))
+				return
+			}
+		}
+	}
+
+	face.Id = bson.NewObjectId()
+	sum, err := descriptor.MD5(face.Descriptor)
+	face.MD5 = sum
+	if err != nil {
+		result.Status, result.Error = ingestFailed, err.Error()
+	} else if inserted, err := in.faces.Upsert(in.ctx, face, repository.FaceMeta{Model: in.model, CropId: cropId}); err != nil {
+		log.Println("[DB]", "Fail to store face", result.Index, "of label", face.Label, "by error", err.Error())
+		result.Status, result.Error = ingestFailed, err.Error()
+	} else if inserted {
+		result.Status, result.Id = ingestInserted, face.Id
+		in.accepted[face.Label] = append(in.accepted[face.Label], face.Descriptor)
+	} else {
+		result.Status = ingestDuplicate
+	}
+}
+
+// storeCrop keeps the face at rect of frame as the image a stored face was
+// computed from, so that the face can be computed again once the recognizer
+// changes its model. A face without a crop is still usable.
+func storeCrop(ctx context.Context, repos *repository.Repositories, faceId bson.ObjectId, frame []byte, rect image.Rectangle) {
+	crop, err := recognition.Crop(frame, rect)
+	if err == nil {
+		var cropId bson.ObjectId
+		if cropId, err = repos.Frames.Insert(ctx, faceId.Hex()+"-crop.jpg", crop); err == nil {
+			err = repos.Faces.SetCrop(ctx, faceId, cropId)
+		}
+	}
+	if err != nil {
+		log.Println("[DB]", "Fail to store crop of face", faceId.Hex(), "by error", err.Error())
+	}
+}
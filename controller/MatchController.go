@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"context"
+	"face-service/auth"
+	"face-service/config"
+	"face-service/descriptor"
+	"face-service/gallery"
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/ndphu/swd-commons/model"
+	"strconv"
+)
+
+const (
+	defaultMatchK = 5
+	maxMatchK     = 100
+)
+
+// galleries caches the face index of every user that matched recently. It must
+// be invalidated by everything that adds or removes faces of a user.
+var galleries = gallery.NewCache(config.Get().GalleryCacheTTL)
+
+// MatchOptions tunes how descriptors are matched against a gallery. Missing
+// values fall back to the defaults of the metric.
+type MatchOptions struct {
+	K         int      `json:"k" form:"k"`
+	Metric    string   `json:"metric" form:"metric"`
+	Threshold *float64 `json:"threshold" form:"threshold"`
+}
+
+// resolve fills in the defaults and returns the thresholds to match with. A
+// threshold given in the options applies to every label.
+func (o *MatchOptions) resolve() (gallery.Thresholds, error) {
+	if o.Metric == "" {
+		o.Metric = descriptor.Euclidean
+	}
+	threshold := 0.0
+	switch o.Metric {
+	case descriptor.Euclidean:
+		threshold = config.Get().MatchEuclideanThreshold
+	case descriptor.Cosine:
+		threshold = config.Get().MatchCosineThreshold
+	default:
+		return gallery.Thresholds{}, descriptor.ErrUnknownMetric
+	}
+	perLabel := o.Threshold == nil
+	if !perLabel {
+		threshold = *o.Threshold
+	}
+	if o.K <= 0 {
+		o.K = defaultMatchK
+	} else if o.K > maxMatchK {
+		o.K = maxMatchK
+	}
+	return gallery.Thresholds{Default: threshold, PerLabel: perLabel}, nil
+}
+
+// loadManualThresholds adds the thresholds the owner of ctx set by hand for
+// descriptorModel and metric.
+func loadManualThresholds(ctx context.Context, repos *repository.Repositories, descriptorModel string, metric string, t *gallery.Thresholds) error {
+	if !t.PerLabel {
+		return nil
+	}
+	manual, err := repos.Thresholds.FindAll(ctx, descriptorModel)
+	if err != nil {
+		return err
+	}
+	t.Manual = make(map[string]float64)
+	for _, m := range manual {
+		if m.Metric == metric {
+			t.Manual[m.Label] = m.Threshold
+		}
+	}
+	return nil
+}
+
+type MatchRequest struct {
+	MatchOptions
+	// Model names the model that computed the descriptors; it defaults to
+	// the one of the recognizer.
+	Model       string      `json:"model"`
+	Descriptors [][]float32 `json:"descriptors"`
+}
+
+func MatchController(r *gin.RouterGroup, repos *repository.Repositories) {
+	r.POST("/match", func(c *gin.Context) {
+		var req MatchRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if len(req.Descriptors) == 0 {
+			c.JSON(400, gin.H{"error": "no descriptors"})
+			return
+		}
+		thresholds, err := req.resolve()
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Model == "" {
+			req.Model = config.Get().DescriptorModel
+		}
+		index, err := userGallery(c, repos, req.Model)
+		if err == nil {
+			err = loadManualThresholds(c.Request.Context(), repos, req.Model, req.Metric, &thresholds)
+		}
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		matches := make([]*descriptor.Match, len(req.Descriptors))
+		for i, d := range req.Descriptors {
+			if matches[i], err = index.Match(d, req.Metric, req.K, thresholds); err != nil {
+				c.JSON(400, gin.H{"error": "descriptor " + strconv.Itoa(i) + ": " + err.Error()})
+				return
+			}
+		}
+		response := gin.H{
+			"model":   req.Model,
+			"metric":  req.Metric,
+			"matches": matches,
+		}
+		// with thresholds per label, each match tells the one it was decided with
+		if !thresholds.PerLabel {
+			response["threshold"] = thresholds.Default
+		}
+		c.JSON(200, response)
+	})
+}
+
+// userGallery returns the gallery index of the current user made of
+// descriptors of one model.
+func userGallery(c *gin.Context, repos *repository.Repositories, descriptorModel string) (*gallery.Index, error) {
+	ctx := c.Request.Context()
+	return galleries.Get(auth.CurrentUser(c).Id, descriptorModel, func() ([]model.Face, error) {
+		return repos.Faces.FindAll(ctx, descriptorModel)
+	})
+}
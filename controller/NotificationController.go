@@ -2,19 +2,15 @@ package controller
 
 import (
 	"face-service/auth"
-	"face-service/db"
+	"face-service/repository"
 	"github.com/gin-gonic/gin"
-	"github.com/globalsign/mgo/bson"
-	"github.com/ndphu/swd-commons/model"
 	"github.com/ndphu/swd-commons/slack"
 	"log"
 )
 
-func NotificationController(r *gin.RouterGroup) {
+func NotificationController(r *gin.RouterGroup, repos *repository.Repositories) {
 	r.GET("/slackConfig", func(c *gin.Context) {
-		user := auth.CurrentUser(c)
-		sc := model.SlackConfig{}
-		if err := dao.Collection("slack_config").Find(bson.M{"userId": user.Id}).One(&sc); err != nil {
+		if sc, err := repos.SlackConfigs.Find(c.Request.Context()); err != nil {
 			c.JSON(200, gin.H{"error": err.Error()})
 		} else {
 			c.JSON(200, sc)
@@ -30,12 +26,12 @@ func NotificationController(r *gin.RouterGroup) {
 				log.Println("[SLACK]", "User with email", user.Email, "is already in Slack team. Linking user email and Slack user")
 				if slackUser, err := slack.LookupUserIdByEmail(user.Email); err != nil {
 					log.Println("[SLACK]", "Fail to lookup user by email:", user.Email, "by error", err.Error())
-					c.JSON(500, gin.H{"error": err.Error()})
+					c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 					return
 				} else {
-					if dao.Collection("slack_config").Update(bson.M{"userId": user.Id}, bson.M{"$set": bson.M{"slackUserId": slackUser.Id}}); err != nil {
+					if err := repos.SlackConfigs.SetSlackUserId(c.Request.Context(), slackUser.Id); err != nil {
 						log.Println("[DB]", "Fail to update slack_config for user:", user.Email)
-						c.JSON(500, gin.H{"error": err.Error()})
+						c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 					} else {
 						log.Println("[DB]", "Linked user:", user.Email, "with Slack user id", slackUser.Id)
 						c.JSON(200, gin.H{"error": ""})
@@ -47,12 +43,12 @@ func NotificationController(r *gin.RouterGroup) {
 				return
 			default:
 				log.Println("[SLACK]", "Fail to send user email invitation", err.Error())
-				c.JSON(500, gin.H{"error": err.Error()})
+				c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 				return
 			}
 		} else {
-			if dao.Collection("slack_config").Update(bson.M{"userId": user.Id}, bson.M{"$set": bson.M{"sendInvitation": true}}); err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
+			if err := repos.SlackConfigs.SetSentInvitation(c.Request.Context()); err != nil {
+				c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			} else {
 				c.JSON(200, gin.H{"message": "Sent invitation to user successfully"})
 			}
@@ -61,9 +57,8 @@ func NotificationController(r *gin.RouterGroup) {
 
 	r.GET("/testSlackNotification", func(c *gin.Context) {
 		user := auth.CurrentUser(c)
-		sc := model.SlackConfig{}
-		if err := dao.Collection("slack_config").Find(bson.M{"userId": user.Id}).One(&sc); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		if sc, err := repos.SlackConfigs.Find(c.Request.Context()); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		} else {
 			if sc.UserId == "" {
 				if slackUser, err := slack.LookupUserIdByEmail(user.Email); err != nil {
@@ -73,14 +68,14 @@ func NotificationController(r *gin.RouterGroup) {
 				} else {
 					log.Println("[SLACK]", "Found Slack user id", slackUser.Id, "for email", user.Email)
 					sc.SlackUserId = slackUser.Id
-					if err := dao.Collection("slack_config").UpdateId(sc.Id, sc); err != nil {
-						c.JSON(500, gin.H{"error": "Fail to update user to DB"})
+					if err := repos.SlackConfigs.Update(c.Request.Context(), sc); err != nil {
+						c.JSON(errorStatus(err), gin.H{"error": "Fail to update user to DB"})
 						return
 					}
 				}
 			}
 			if err := slack.SendSimpleTextMessageToUser(sc.SlackUserId, "This is a test notification."); err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
+				c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			} else {
 				c.JSON(200, gin.H{})
 			}
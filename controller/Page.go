@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"time"
+)
+
+// pageRequest reads the limit, cursor and sort query parameters of a list
+// endpoint. A malformed limit is answered with 400.
+func pageRequest(c *gin.Context) (repository.PageRequest, bool) {
+	p := repository.PageRequest{
+		Cursor: c.Query("cursor"),
+		Sort:   c.Query("sort"),
+	}
+	if c.Query("limit") != "" {
+		limit, err := strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 {
+			c.JSON(400, gin.H{"error": "invalid limit"})
+			return p, false
+		}
+		p.Limit = limit
+	}
+	return p, true
+}
+
+// timeQuery reads an optional RFC3339 query parameter. A malformed value is
+// answered with 400.
+func timeQuery(c *gin.Context, name string) (time.Time, bool) {
+	if c.Query(name) == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse(time.RFC3339, c.Query(name))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid " + name})
+		return t, false
+	}
+	return t, true
+}
+
+func pageResponse(items interface{}, next string) gin.H {
+	return gin.H{"items": items, "nextCursor": next}
+}
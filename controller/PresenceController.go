@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"face-service/repository"
+	"github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Devices publish a heartbeat every now and then, and leave a last will on
+// their status topic for the broker to publish when they drop off.
+const (
+	heartbeatTopic = "/3ml/device/+/heartbeat"
+	statusTopic    = "/3ml/device/+/status"
+)
+
+// DeviceHeartbeat is the payload of heartbeats; every field is optional.
+type DeviceHeartbeat struct {
+	Firmware string `json:"firmware"`
+}
+
+// DeviceStatusMessage is the payload of status messages, last wills included.
+// A bare "online" or "offline" is accepted too.
+type DeviceStatusMessage struct {
+	Status string `json:"status"`
+}
+
+// subscribePresence keeps track of which devices are online from their
+// heartbeats and last wills.
+func subscribePresence(c mqtt.Client, repos *repository.Repositories) {
+	c.Subscribe(heartbeatTopic, 0, func(client mqtt.Client, message mqtt.Message) {
+		var heartbeat DeviceHeartbeat
+		if len(message.Payload()) > 0 {
+			if err := json.Unmarshal(message.Payload(), &heartbeat); err != nil {
+				log.Println("[PRESENCE]", "Ignoring invalid heartbeat on", message.Topic())
+				return
+			}
+		}
+		now := time.Now()
+		queuePresence(repos, topicDeviceId(message.Topic()), repository.DevicePresence{
+			Online:   true,
+			LastSeen: &now,
+			Firmware: heartbeat.Firmware,
+		})
+	}).Wait()
+	c.Subscribe(statusTopic, 1, func(client mqtt.Client, message mqtt.Message) {
+		status := DeviceStatusMessage{Status: strings.TrimSpace(string(message.Payload()))}
+		if strings.HasPrefix(status.Status, "{") {
+			json.Unmarshal(message.Payload(), &status)
+		}
+		presence := repository.DevicePresence{}
+		switch status.Status {
+		case "online":
+			now := time.Now()
+			presence.Online, presence.LastSeen = true, &now
+		case "offline":
+		default:
+			log.Println("[PRESENCE]", "Ignoring invalid status on", message.Topic())
+			return
+		}
+		queuePresence(repos, topicDeviceId(message.Topic()), presence)
+	}).Wait()
+}
+
+// topicDeviceId returns the device id of a /3ml/device/<deviceId>/... topic.
+func topicDeviceId(topic string) string {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 4 {
+		return ""
+	}
+	return parts[3]
+}
+
+// presenceQueues holds the presence updates of every device that are not
+// recorded yet. A device has a goroutine recording its updates in the order
+// they arrived for as long as it has any, so that a last will cannot be
+// overtaken by the heartbeat before it.
+var presenceLock = sync.Mutex{}
+var presenceQueues = make(map[string][]repository.DevicePresence)
+
+// queuePresence records presence without blocking the client goroutine.
+func queuePresence(repos *repository.Repositories, deviceId string, presence repository.DevicePresence) {
+	if deviceId == "" {
+		return
+	}
+	presenceLock.Lock()
+	queue, recording := presenceQueues[deviceId]
+	presenceQueues[deviceId] = append(queue, presence)
+	presenceLock.Unlock()
+	if !recording {
+		go recordQueuedPresence(repos, deviceId)
+	}
+}
+
+func recordQueuedPresence(repos *repository.Repositories, deviceId string) {
+	for {
+		presenceLock.Lock()
+		queue := presenceQueues[deviceId]
+		if len(queue) == 0 {
+			delete(presenceQueues, deviceId)
+			presenceLock.Unlock()
+			return
+		}
+		presenceQueues[deviceId] = queue[1:]
+		presenceLock.Unlock()
+		recordPresence(repos, deviceId, queue[0])
+	}
+}
+
+func recordPresence(repos *repository.Repositories, deviceId string, presence repository.DevicePresence) {
+	former, err := repos.Devices.UpdatePresence(repository.AsSystem(context.Background()), deviceId, presence)
+	if err == repository.ErrNotFound {
+		return
+	} else if err != nil {
+		log.Println("[DB]", "Fail to record presence of device", deviceId, "by error", err.Error())
+		return
+	}
+	if former.Online == presence.Online {
+		return
+	}
+	status := *former
+	status.Online = presence.Online
+	if presence.LastSeen != nil {
+		status.LastSeen = presence.LastSeen
+	}
+	if presence.Firmware != "" {
+		status.Firmware = presence.Firmware
+	}
+	NotifyPresence(status)
+}
+
+// NotifyPresence tells the watchers of the desk of a device that it went
+// online or offline.
+func NotifyPresence(status repository.DeviceStatus) {
+	log.Println("[PRESENCE]", "Device", status.DeviceId, "of desk", status.DeskId, "online:", status.Online)
+	payload, err := json.Marshal(status)
+	if err != nil {
+		log.Println("[PRESENCE]", "Fail to marshal status of device", status.DeviceId, "by error", err.Error())
+		return
+	}
+	notifyDesk(status.DeskId, WSMessage{
+		Code:    200,
+		Type:    "DEVICE_PRESENCE",
+		Payload: string(payload),
+	})
+}
@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"context"
+	"face-service/repository"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"testing"
+	"time"
+)
+
+func TestPresenceRecordedInOrder(t *testing.T) {
+	repos := repository.NewMemoryRepositories()
+	ctx := repository.WithOwner(context.Background(), bson.NewObjectId())
+	device := model.Device{Id: bson.NewObjectId(), DeviceId: "SN-1", DeskId: "front"}
+	if err := repos.Devices.Insert(ctx, &device); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		now := time.Now()
+		queuePresence(repos, "SN-1", repository.DevicePresence{Online: true, LastSeen: &now, Firmware: "1.0"})
+		queuePresence(repos, "SN-1", repository.DevicePresence{})
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		presenceLock.Lock()
+		_, recording := presenceQueues["SN-1"]
+		presenceLock.Unlock()
+		if !recording {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("presence was not recorded")
+		}
+	}
+	devices, _, err := repos.Devices.FindPageByDesk(ctx, "front", "", repository.PageRequest{Limit: 1})
+	if err != nil || len(devices) != 1 {
+		t.Fatalf("expected the device, got %+v, %v", devices, err)
+	}
+	if devices[0].Online || devices[0].Firmware != "1.0" {
+		t.Fatalf("expected the last will to be recorded last, got %+v", devices[0].DevicePresence)
+	}
+}
@@ -0,0 +1,372 @@
+package controller
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"face-service/auth"
+	"face-service/config"
+	"face-service/repository"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"github.com/google/uuid"
+	"github.com/ndphu/swd-commons/model"
+	"github.com/skip2/go-qrcode"
+	"log"
+	"strings"
+	"time"
+)
+
+// Devices announce themselves on announceTopic and get their claim code, then
+// their identity once claimed, on the topics of their serial.
+const (
+	announceTopic = "/3ml/provisioning/announce"
+
+	claimCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	claimCodeLength   = 6
+	qrCodeSize        = 256
+)
+
+// DeviceAnnouncement is what an unclaimed device publishes on announceTopic.
+// PublicKey is the base64 X25519 key its identity is sealed to.
+type DeviceAnnouncement struct {
+	Serial    string           `json:"serial"`
+	Nonce     string           `json:"nonce"`
+	PublicKey string           `json:"publicKey"`
+	Type      model.DeviceType `json:"type"`
+	Name      string           `json:"name"`
+}
+
+type ClaimCodeMessage struct {
+	ClaimCode string    `json:"claimCode"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	QRCodeUrl string    `json:"qrCodeUrl"`
+}
+
+// DeviceIdentity is what a claimed device gets to talk to the service.
+type DeviceIdentity struct {
+	Id       bson.ObjectId    `json:"id"`
+	DeviceId string           `json:"deviceId"`
+	DeskId   string           `json:"deskId"`
+	Type     model.DeviceType `json:"type"`
+	Name     string           `json:"name"`
+	Token    SealedToken      `json:"token"`
+}
+
+// SealedToken is a device token only the device can open: AES-256-GCM with
+// the SHA-256 of the X25519 secret shared by EphemeralKey and the key of the
+// device, followed by both public keys, and the serial as additional data.
+// Every field is base64.
+type SealedToken struct {
+	EphemeralKey string `json:"ephemeralKey"`
+	Nonce        string `json:"nonce"`
+	Ciphertext   string `json:"ciphertext"`
+}
+
+type ClaimRequest struct {
+	ClaimCode string `json:"claimCode"`
+	Name      string `json:"name"`
+}
+
+func ProvisioningController(r *gin.RouterGroup, repos *repository.Repositories, authService *auth.AuthService) {
+	r.POST("/desk/:deskId/devices/claim", func(c *gin.Context) {
+		var req ClaimRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		code := strings.ToUpper(strings.TrimSpace(req.ClaimCode))
+		if !validClaimCode(code) {
+			c.JSON(400, gin.H{"error": "invalid claim code"})
+			return
+		}
+		if _, err := repos.Desks.FindByDeskId(c.Request.Context(), c.Param("deskId")); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		user := auth.CurrentUser(c)
+		device := model.Device{
+			Id:     bson.NewObjectId(),
+			DeskId: c.Param("deskId"),
+			Owner:  user.Id,
+		}
+		token, err := authService.SignDeviceToken(user, device.Id)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		pairing, err := repos.Pairings.Claim(c.Request.Context(), code, device.Id, token.Token, time.Now().Add(config.Get().ClaimDeliveryWindow))
+		if err == repository.ErrNotFound {
+			c.JSON(404, gin.H{"error": "unknown or expired claim code"})
+			return
+		} else if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		device.Type = pairing.Type
+		device.Name = req.Name
+		if device.Name == "" {
+			device.Name = pairing.Name
+		}
+		// water monitors are known by their serial to the services reading them
+		device.DeviceId = uuid.New().String()
+		if device.Type == model.DeviceTypeWaterMonitor {
+			device.DeviceId = pairing.Serial
+		}
+		err = repos.Devices.Insert(c.Request.Context(), &device)
+		if repository.IsDuplicate(err) && device.Type == model.DeviceTypeWaterMonitor {
+			// the serial is still held by the device it was released from
+			// when that one was deleted, which gives way
+			if n, purgeErr := repos.Trash.PurgeDevice(repository.AsSystem(c.Request.Context()), device.DeviceId); purgeErr == nil {
+				log.Println("[PROVISIONING]", "Purged", n, "document(s) of the deleted device of serial", pairing.Serial)
+				err = repos.Devices.Insert(c.Request.Context(), &device)
+			} else if purgeErr != repository.ErrNotFound {
+				log.Println("[DB]", "Fail to purge deleted device of serial", pairing.Serial, "by error", purgeErr.Error())
+			}
+		}
+		if err != nil {
+			if err := repos.Pairings.Release(c.Request.Context(), pairing.Id); err != nil {
+				log.Println("[PROVISIONING]", "Fail to release pairing of serial", pairing.Serial, "by error", err.Error())
+			}
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		if err := repos.ServiceTokens.Insert(c.Request.Context(), token); err != nil {
+			log.Println("[DB]", "Fail to store token of device", device.Id.Hex(), "by error", err.Error())
+		}
+		log.Println("[PROVISIONING]", "Device", pairing.Serial, "claimed as", device.Id.Hex(), "on desk", device.DeskId)
+		publishIdentity(&device, pairing)
+		c.JSON(201, device)
+	})
+}
+
+// ClaimCodeQRController serves the QR codes of claim codes. It needs no
+// authentication, so that devices can show their own.
+func ClaimCodeQRController(r *gin.RouterGroup) {
+	r.GET("/claim/:code/qr.png", func(c *gin.Context) {
+		code := strings.ToUpper(c.Param("code"))
+		if !validClaimCode(code) {
+			c.JSON(404, gin.H{"error": "invalid claim code"})
+			return
+		}
+		png, err := qrcode.Encode(config.Get().ClaimUrl+code, qrcode.Medium, qrCodeSize)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("Cache-Control", "public, max-age=600")
+		c.Data(200, "image/png", png)
+	})
+}
+
+// subscribeProvisioning answers the announcements of devices.
+func subscribeProvisioning(c mqtt.Client, repos *repository.Repositories) {
+	c.Subscribe(announceTopic, 1, func(client mqtt.Client, message mqtt.Message) {
+		var announcement DeviceAnnouncement
+		if err := json.Unmarshal(message.Payload(), &announcement); err != nil || announcement.Serial == "" || strings.ContainsAny(announcement.Serial, "/+#") || !validPublicKey(announcement.PublicKey) {
+			log.Println("[PROVISIONING]", "Ignoring invalid announcement", string(message.Payload()))
+			return
+		}
+		// announcements arrive on the client goroutine, which must not block
+		go answerAnnouncement(repos, announcement)
+	}).Wait()
+}
+
+// answerAnnouncement sends a device its claim code, or its identity when it
+// was claimed already. A pending device announcing itself with another nonce
+// or key, such as after a reset, starts over with a new claim code. Anyone
+// can announce any serial, so a claimed pairing is never replaced: the owner
+// deletes the device to have it claimed again.
+func answerAnnouncement(repos *repository.Repositories, a DeviceAnnouncement) {
+	ctx := repository.AsSystem(context.Background())
+	pairing, err := repos.Pairings.FindBySerial(ctx, a.Serial)
+	if err != nil && err != repository.ErrNotFound {
+		log.Println("[DB]", "Fail to find pairing of serial", a.Serial, "by error", err.Error())
+		return
+	}
+	now := time.Now()
+	same := pairing != nil && pairing.Nonce == a.Nonce && pairing.PublicKey == a.PublicKey
+	if pairing != nil && pairing.Status == repository.PairingClaimed {
+		if same && pairing.ExpiresAt.After(now) {
+			sendIdentity(repos, pairing)
+		} else {
+			log.Println("[PROVISIONING]", "Ignoring announcement of claimed device", a.Serial)
+		}
+		return
+	}
+	if !same || !pairing.ExpiresAt.After(now) {
+		if pairing, err = newPairing(ctx, repos, pairing, a); err != nil {
+			log.Println("[DB]", "Fail to save pairing of serial", a.Serial, "by error", err.Error())
+			return
+		}
+		log.Println("[PROVISIONING]", "Device", a.Serial, "announced itself with claim code", pairing.ClaimCode)
+	}
+	publishProvisioning(pairing.Serial, "claim", ClaimCodeMessage{
+		ClaimCode: pairing.ClaimCode,
+		ExpiresAt: pairing.ExpiresAt,
+		QRCodeUrl: "/api/public/claim/" + pairing.ClaimCode + "/qr.png",
+	})
+}
+
+// newPairing gives a device a new claim code, replacing its former pairing if
+// any. A code already given to another device is drawn again.
+func newPairing(ctx context.Context, repos *repository.Repositories, former *repository.DevicePairing, a DeviceAnnouncement) (*repository.DevicePairing, error) {
+	now := time.Now()
+	pairing := &repository.DevicePairing{
+		Id:        bson.NewObjectId(),
+		Serial:    a.Serial,
+		Nonce:     a.Nonce,
+		PublicKey: a.PublicKey,
+		Type:      a.Type,
+		Name:      a.Name,
+		Status:    repository.PairingPending,
+		CreatedAt: now,
+		ExpiresAt: now.Add(config.Get().ClaimCodeTTL),
+	}
+	if former != nil {
+		pairing.Id = former.Id
+	}
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if pairing.ClaimCode, err = newClaimCode(); err != nil {
+			return nil, err
+		}
+		if err = repos.Pairings.Save(ctx, pairing); !repository.IsDuplicate(err) {
+			break
+		}
+	}
+	return pairing, err
+}
+
+func sendIdentity(repos *repository.Repositories, pairing *repository.DevicePairing) {
+	ctx := repository.WithOwner(context.Background(), pairing.UserId)
+	device, err := repos.Devices.FindById(ctx, pairing.DeviceId)
+	if err != nil {
+		log.Println("[PROVISIONING]", "Fail to find device of serial", pairing.Serial, "by error", err.Error())
+		return
+	}
+	publishIdentity(device, pairing)
+}
+
+// publishIdentity sends a claimed device its identity, with its token sealed
+// to the key it announced.
+func publishIdentity(device *model.Device, pairing *repository.DevicePairing) {
+	token, err := sealToken(pairing.PublicKey, pairing.Serial, pairing.Token)
+	if err != nil {
+		log.Println("[PROVISIONING]", "Fail to seal token of device", pairing.Serial, "by error", err.Error())
+		return
+	}
+	publishProvisioning(pairing.Serial, "identity", DeviceIdentity{
+		Id:       device.Id,
+		DeviceId: device.DeviceId,
+		DeskId:   device.DeskId,
+		Type:     device.Type,
+		Name:     device.Name,
+		Token:    *token,
+	})
+}
+
+func sealToken(publicKey string, serial string, token string) (*SealedToken, error) {
+	raw, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	deviceKey, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(deviceKey)
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256(append(append(shared, ephemeral.PublicKey().Bytes()...), deviceKey.Bytes()...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &SealedToken{
+		EphemeralKey: base64.StdEncoding.EncodeToString(ephemeral.PublicKey().Bytes()),
+		Nonce:        base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext:   base64.StdEncoding.EncodeToString(gcm.Seal(nil, nonce, []byte(token), []byte(serial))),
+	}, nil
+}
+
+func validPublicKey(publicKey string) bool {
+	raw, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return false
+	}
+	_, err = ecdh.X25519().NewPublicKey(raw)
+	return err == nil
+}
+
+// releaseDevice revokes the token of a deleted device, forgets its pairing,
+// so that the physical device can be claimed again, and drops its retained
+// desired config. A restored device has to be claimed again to get a token;
+// claiming a water monitor again purges the deleted device of its serial.
+func releaseDevice(ctx context.Context, repos *repository.Repositories, device *model.Device) {
+	if _, err := repos.ServiceTokens.RemoveByDevice(ctx, device.Id); err != nil {
+		log.Println("[DB]", "Fail to revoke token of device", device.Id.Hex(), "by error", err.Error())
+	}
+	if err := repos.Pairings.RemoveByDevice(ctx, device.Id); err != nil && err != repository.ErrNotFound {
+		log.Println("[DB]", "Fail to remove pairing of device", device.Id.Hex(), "by error", err.Error())
+	}
+	if device.DeviceId == "" {
+		return
+	}
+	if err := clearRetained(desiredConfigTopic(device.DeviceId)); err != nil {
+		log.Println("[SHADOW]", "Fail to clear desired config of device", device.DeviceId, "by error", err.Error())
+	}
+}
+
+// publishProvisioning sends a device what it is waiting for. When it cannot,
+// the device gets it on its next announcement.
+func publishProvisioning(serial string, kind string, payload interface{}) {
+	if err := publishDevice("/3ml/provisioning/"+serial+"/"+kind, false, payload); err != nil {
+		log.Println("[PROVISIONING]", "Fail to send", kind, "to device", serial, "by error", err.Error())
+	}
+}
+
+func newClaimCode() (string, error) {
+	b := make([]byte, claimCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// the alphabet has 32 letters, so every byte maps to one evenly
+	for i := range b {
+		b[i] = claimCodeAlphabet[int(b[i])%len(claimCodeAlphabet)]
+	}
+	return string(b), nil
+}
+
+func validClaimCode(code string) bool {
+	if len(code) != claimCodeLength {
+		return false
+	}
+	for _, r := range code {
+		if !strings.ContainsRune(claimCodeAlphabet, r) {
+			return false
+		}
+	}
+	return true
+}
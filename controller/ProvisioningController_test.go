@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"face-service/repository"
+	"github.com/globalsign/mgo/bson"
+	"testing"
+	"time"
+)
+
+func TestSealToken(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealToken(base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), "SN-1", "secret-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode := func(s string) []byte {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(decode(sealed.EphemeralKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := sha256.Sum256(append(append(shared, ephemeral.Bytes()...), key.PublicKey().Bytes()...))
+	block, _ := aes.NewCipher(secret[:])
+	gcm, _ := cipher.NewGCM(block)
+	token, err := gcm.Open(nil, decode(sealed.Nonce), decode(sealed.Ciphertext), []byte("SN-1"))
+	if err != nil || string(token) != "secret-token" {
+		t.Fatalf("expected the device to open its token, got %q, %v", token, err)
+	}
+}
+
+func TestAnnouncementKeepsClaimedPairing(t *testing.T) {
+	repos := repository.NewMemoryRepositories()
+	ctx := repository.AsSystem(context.Background())
+	key := func() string {
+		k, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(k.PublicKey().Bytes())
+	}
+	claimed := repository.DevicePairing{
+		Id:        bson.NewObjectId(),
+		Serial:    "SN-1",
+		Nonce:     "device",
+		PublicKey: key(),
+		ClaimCode: "ABCDEF",
+		Status:    repository.PairingClaimed,
+		UserId:    bson.NewObjectId(),
+		DeviceId:  bson.NewObjectId(),
+		Token:     "token",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	if err := repos.Pairings.Save(ctx, &claimed); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []DeviceAnnouncement{
+		{Serial: "SN-1", Nonce: "attacker", PublicKey: key()},
+		{Serial: "SN-1", Nonce: "device", PublicKey: key()},
+	} {
+		answerAnnouncement(repos, a)
+		pairing, err := repos.Pairings.FindBySerial(ctx, "SN-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pairing.Status != repository.PairingClaimed || pairing.PublicKey != claimed.PublicKey || pairing.ClaimCode != claimed.ClaimCode {
+			t.Fatalf("announcement with nonce %s replaced the claimed pairing: %+v", a.Nonce, pairing)
+		}
+	}
+
+	// a pending pairing starts over for a reset device
+	claimed.Status = repository.PairingPending
+	if err := repos.Pairings.Save(ctx, &claimed); err != nil {
+		t.Fatal(err)
+	}
+	reset := DeviceAnnouncement{Serial: "SN-1", Nonce: "reset", PublicKey: key()}
+	answerAnnouncement(repos, reset)
+	if pairing, _ := repos.Pairings.FindBySerial(ctx, "SN-1"); pairing.PublicKey != reset.PublicKey || pairing.ClaimCode == claimed.ClaimCode {
+		t.Fatalf("expected a new claim code for the reset device, got %+v", pairing)
+	}
+}
@@ -0,0 +1,265 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"face-service/auth"
+	"face-service/config"
+	"face-service/recognition"
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"log"
+	"strconv"
+)
+
+const (
+	defaultTotalPics  = 12
+	maxTotalPics      = 60
+	defaultFrameDelay = 250
+)
+
+// recognitions runs the recognition jobs of this instance and holds the
+// devices that enroll, so a camera serves at most its share of both. It is set
+// up by RecognitionController.
+var recognitions *recognition.Manager
+
+type RecognitionRequest struct {
+	DeviceId   string `json:"deviceId"`
+	TotalPics  int    `json:"totalPics"`
+	FrameDelay int    `json:"frameDelay"`
+}
+
+func RecognitionController(r *gin.RouterGroup, repos *repository.Repositories, recognizer recognition.Recognizer, frames recognition.FrameSource) {
+	recognitions = recognition.NewManager(config.Get().RecognitionJobsPerDevice, config.Get().RecognitionJobRetention, func(job recognition.Job) {
+		saveRecognition(repos, job)
+		notifyRecognition(job)
+	}, func(job recognition.Job, frames []repository.RecognitionFrame) {
+		removeFrames(repository.WithOwner(context.Background(), job.UserId), repos.Frames, job.Id, frames)
+	})
+
+	r.POST("/recognitions", func(c *gin.Context) {
+		var req RecognitionRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if !bson.IsObjectIdHex(req.DeviceId) {
+			c.JSON(400, gin.H{"error": "invalid deviceId"})
+			return
+		}
+		startRecognition(c, repos, recognizer, frames, bson.ObjectIdHex(req.DeviceId), req.TotalPics, req.FrameDelay)
+	})
+
+	// startRecognize predates recognition jobs; it starts one and answers with
+	// it instead of waiting for the results.
+	r.GET("/device/:deviceId/startRecognize", func(c *gin.Context) {
+		deviceId, ok := objectIdParam(c, "deviceId")
+		if !ok {
+			return
+		}
+		totalPics, _ := strconv.Atoi(c.Query("totalPics"))
+		frameDelay, _ := strconv.Atoi(c.Query("frameDelay"))
+		startRecognition(c, repos, recognizer, frames, deviceId, totalPics, frameDelay)
+	})
+
+	r.GET("/recognitions/:jobId", func(c *gin.Context) {
+		jobId, ok := objectIdParam(c, "jobId")
+		if !ok {
+			return
+		}
+		if job, err := findRecognition(c, repos, jobId); err != nil {
+			c.JSON(recognitionStatus(err), gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, job)
+		}
+	})
+
+	r.GET("/recognitions/:jobId/frames/:n", func(c *gin.Context) {
+		jobId, ok := objectIdParam(c, "jobId")
+		if !ok {
+			return
+		}
+		job, err := findRecognition(c, repos, jobId)
+		if err != nil {
+			c.JSON(recognitionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		n, err := strconv.Atoi(c.Param("n"))
+		if err != nil || n < 0 || n >= len(job.Frames) {
+			c.JSON(404, gin.H{"error": "frame not found"})
+			return
+		}
+		fileId := job.Frames[n].FileId
+		if c.Query("thumbnail") == "true" && job.Frames[n].ThumbnailId.Valid() {
+			fileId = job.Frames[n].ThumbnailId
+		}
+		data, err := repos.Frames.Read(c.Request.Context(), fileId)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		// stored frames never change
+		c.Header("Cache-Control", "private, max-age=86400")
+		c.Data(200, "image/jpeg", data)
+	})
+
+	r.POST("/recognitions/:jobId/cancel", func(c *gin.Context) {
+		jobId, ok := objectIdParam(c, "jobId")
+		if !ok {
+			return
+		}
+		if job, err := recognitions.Cancel(auth.CurrentUser(c).Id, jobId); err != nil {
+			c.JSON(recognitionStatus(err), gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, job)
+		}
+	})
+}
+
+// startRecognition starts a recognition job on a device of the current user
+// and answers with it right away.
+func startRecognition(c *gin.Context, repos *repository.Repositories, recognizer recognition.Recognizer, frames recognition.FrameSource, deviceId bson.ObjectId, totalPics int, frameDelay int) {
+	if totalPics <= 0 {
+		totalPics = defaultTotalPics
+	} else if totalPics > maxTotalPics {
+		totalPics = maxTotalPics
+	}
+	if frameDelay <= 0 {
+		frameDelay = defaultFrameDelay
+	}
+	device, err := repos.Devices.FindById(c.Request.Context(), deviceId)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if !isCamera(device) {
+		c.JSON(409, gin.H{"error": "device is not a camera"})
+		return
+	}
+	user := auth.CurrentUser(c)
+	job, err := recognitions.Start(repository.WithOwner(context.Background(), user.Id), recognition.Job{
+		UserId:     user.Id,
+		DeviceId:   device.Id,
+		TotalPics:  totalPics,
+		FrameDelay: frameDelay,
+		Model:      config.Get().DescriptorModel,
+		Instance:   config.Get().InstanceId,
+	}, recognizeOnDevice(recognizer, frames, repos, device.DeviceId))
+	if err != nil {
+		c.JSON(recognitionStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(202, job)
+}
+
+// findRecognition prefers the state of a job running on this instance over the
+// saved one, which may lag behind.
+func findRecognition(c *gin.Context, repos *repository.Repositories, id bson.ObjectId) (*recognition.Job, error) {
+	if job, err := recognitions.Get(auth.CurrentUser(c).Id, id); err == nil {
+		return &job, nil
+	}
+	return repos.Recognitions.FindById(c.Request.Context(), id)
+}
+
+func recognizeOnDevice(recognizer recognition.Recognizer, source recognition.FrameSource, repos *repository.Repositories, deviceId string) recognition.RunFunc {
+	return func(ctx context.Context, job recognition.Job, stage func(string)) ([]repository.RecognitionFrame, error) {
+		images, err := source.Capture(ctx, deviceId, job.FrameDelay, job.TotalPics)
+		if err != nil {
+			return nil, err
+		}
+		stage(recognition.StageRecognizing)
+		response, err := recognizer.Recognize(ctx, model.RecognizeRequest{
+			IncludeFacesDetails: true,
+			Images:              images,
+			TimeoutSeconds:      30,
+		})
+		if err != nil {
+			return nil, err
+		}
+		stage(recognition.StageStoring)
+		frames := make([]repository.RecognitionFrame, 0, len(images))
+		for i, fd := range response.FaceDetailsList {
+			if i >= len(images) {
+				break
+			}
+			frame, err := storeFrame(ctx, repos.Frames, job.Id, i, images[i])
+			if err != nil {
+				if frame != nil {
+					frames = append(frames, *frame)
+				}
+				// ctx may be done already
+				removeFrames(repository.WithOwner(context.Background(), job.UserId), repos.Frames, job.Id, frames)
+				return nil, err
+			}
+			frame.FaceDetailsList = fd
+			frames = append(frames, *frame)
+		}
+		collectUnlabeled(ctx, repos, job.Id, frames)
+		return frames, nil
+	}
+}
+
+// storeFrame saves the n-th captured image of a job as JPEG along with its
+// thumbnail. A frame that cannot be thumbnailed is kept without one. If the
+// thumbnail fails to be stored, the frame is returned with the error.
+func storeFrame(ctx context.Context, frameStore repository.FrameRepository, jobId bson.ObjectId, n int, image []byte) (*repository.RecognitionFrame, error) {
+	data, err := recognition.ToJPEG(image)
+	if err != nil {
+		return nil, err
+	}
+	name := jobId.Hex() + "-" + strconv.Itoa(n)
+	frame := &repository.RecognitionFrame{N: n}
+	if frame.FileId, err = frameStore.Insert(ctx, name+".jpg", data); err != nil {
+		return nil, err
+	}
+	if thumb, err := recognition.Thumbnail(data, recognition.ThumbnailWidth); err != nil {
+		log.Println("[RECOGNITION]", "Fail to thumbnail frame", n, "of job", jobId.Hex(), "by error", err.Error())
+	} else if frame.ThumbnailId, err = frameStore.Insert(ctx, name+"-thumb.jpg", thumb); err != nil {
+		return frame, err
+	}
+	return frame, nil
+}
+
+// removeFrames removes the stored frames of a job that does not keep them.
+func removeFrames(ctx context.Context, frameStore repository.FrameRepository, jobId bson.ObjectId, frames []repository.RecognitionFrame) {
+	if err := frameStore.Remove(ctx, repository.FrameIds(frames)...); err != nil {
+		log.Println("[RECOGNITION]", "Fail to remove frames of job", jobId.Hex(), "by error", err.Error())
+	}
+}
+
+func saveRecognition(repos *repository.Repositories, job recognition.Job) {
+	ctx := repository.WithOwner(context.Background(), job.UserId)
+	if err := repos.Recognitions.Save(ctx, &job); err != nil {
+		log.Println("[DB]", "Fail to save recognition", job.Id.Hex(), "by error", err.Error())
+	}
+}
+
+// notifyRecognition pushes the status of a job to its owner. Frames are left
+// out; they are fetched once the job completed.
+func notifyRecognition(job recognition.Job) {
+	job.Frames = nil
+	payload, err := json.Marshal(job)
+	if err != nil {
+		log.Println("[RECOGNITION]", "Fail to marshal job", job.Id.Hex(), "by error", err.Error())
+		return
+	}
+	notifyUser(job.UserId, WSMessage{
+		Code:    200,
+		Type:    "RECOGNITION_PROGRESS",
+		Payload: string(payload),
+	})
+}
+
+func recognitionStatus(err error) int {
+	switch err {
+	case recognition.ErrNotFound:
+		return 404
+	case recognition.ErrDeviceBusy:
+		return 429
+	case recognition.ErrDone:
+		return 409
+	}
+	return errorStatus(err)
+}
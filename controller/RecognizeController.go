@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"errors"
+	"face-service/config"
+	"face-service/descriptor"
+	"face-service/recognition"
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/ndphu/swd-commons/model"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	maxRecognizeImages    = 20
+	maxRecognizeImageSize = 10 << 20
+	// a JSON body carries the images in base64, which is 4/3 of their size,
+	// next to the match options
+	maxRecognizeBodySize = maxRecognizeImages*maxRecognizeImageSize*4/3 + 1<<20
+	// a multipart body carries them as they are
+	maxRecognizeFormSize = maxRecognizeImages*maxRecognizeImageSize + 1<<20
+)
+
+var errImageTooLarge = errors.New("image too large")
+var errImageCount = errors.New("expected 1 to 20 images")
+
+// RecognizeRequest carries images either as multipart "images" files or, in
+// a JSON body, as base64 strings.
+type RecognizeRequest struct {
+	MatchOptions
+	Images [][]byte `json:"images"`
+	Match  bool     `json:"match" form:"match"`
+}
+
+type RecognizedImage struct {
+	Index           int                 `json:"index"`
+	FaceDetailsList []model.FaceDetails `json:"faceDetailsList"`
+	Matches         []*descriptor.Match `json:"matches,omitempty"`
+}
+
+func RecognizeController(r *gin.RouterGroup, repos *repository.Repositories, recognizer recognition.Recognizer) {
+	r.POST("/recognize", func(c *gin.Context) {
+		var req RecognizeRequest
+		var err error
+		// the body is bounded before anything parses it
+		if strings.HasPrefix(c.ContentType(), "multipart/") {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxRecognizeFormSize)
+			err = readUploadedImages(c, &req)
+		} else {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxRecognizeBodySize)
+			err = c.ShouldBindJSON(&req)
+		}
+		var tooLarge *http.MaxBytesError
+		if err == errImageTooLarge || errors.As(err, &tooLarge) {
+			c.JSON(413, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if len(req.Images) == 0 || len(req.Images) > maxRecognizeImages {
+			c.JSON(400, gin.H{"error": errImageCount.Error()})
+			return
+		}
+		for _, image := range req.Images {
+			if len(image) > maxRecognizeImageSize {
+				c.JSON(413, gin.H{"error": errImageTooLarge.Error()})
+				return
+			}
+		}
+		thresholds, err := req.resolve()
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		response, err := recognizer.Recognize(c.Request.Context(), model.RecognizeRequest{
+			IncludeFacesDetails: true,
+			Images:              req.Images,
+			TimeoutSeconds:      30,
+		})
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		results := make([]RecognizedImage, 0, len(response.FaceDetailsList))
+		for i, fd := range response.FaceDetailsList {
+			results = append(results, RecognizedImage{Index: i, FaceDetailsList: fd})
+		}
+		if req.Match {
+			descriptorModel := config.Get().DescriptorModel
+			index, err := userGallery(c, repos, descriptorModel)
+			if err == nil {
+				err = loadManualThresholds(c.Request.Context(), repos, descriptorModel, req.Metric, &thresholds)
+			}
+			if err != nil {
+				c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			for i := range results {
+				results[i].Matches = make([]*descriptor.Match, 0, len(results[i].FaceDetailsList))
+				for _, face := range results[i].FaceDetailsList {
+					match, err := index.Match(face.Descriptor[:], req.Metric, req.K, thresholds)
+					if err != nil {
+						c.JSON(500, gin.H{"error": err.Error()})
+						return
+					}
+					results[i].Matches = append(results[i].Matches, match)
+				}
+			}
+		}
+		c.JSON(200, gin.H{"model": config.Get().DescriptorModel, "results": results})
+	})
+}
+
+// readUploadedImages reads the "images" files and the match options of a
+// multipart form. No file is read unless all of them fit.
+func readUploadedImages(c *gin.Context, req *RecognizeRequest) error {
+	if err := c.ShouldBind(req); err != nil {
+		return err
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		return err
+	}
+	headers := form.File["images"]
+	if len(headers) == 0 || len(headers) > maxRecognizeImages {
+		return errImageCount
+	}
+	for _, header := range headers {
+		if header.Size > maxRecognizeImageSize {
+			return errImageTooLarge
+		}
+	}
+	for _, header := range headers {
+		file, err := header.Open()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		req.Images = append(req.Images, data)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"face-service/archive"
+	"face-service/config"
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/ndphu/swd-commons/model"
+	"log"
+	"os"
+)
+
+type RetentionPolicyRequest struct {
+	RetentionDays int `json:"retentionDays"`
+}
+
+// RetentionController manages event retention policies and serves the
+// archives the sweeper wrote. The device type "default" addresses the policy
+// that applies to every type without one of its own, and CAMERA the policy of
+// cameras.
+func RetentionController(r *gin.RouterGroup, repos *repository.Repositories) {
+	r.GET("/retention", func(c *gin.Context) {
+		if policies, err := repos.Retention.FindAll(c.Request.Context()); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, gin.H{
+				"defaultRetentionDays": config.Get().EventRetentionDays,
+				"policies":             policies,
+			})
+		}
+	})
+
+	r.PUT("/retention/:deviceType", func(c *gin.Context) {
+		deviceType, ok := policyDeviceType(c)
+		if !ok {
+			return
+		}
+		var req RetentionPolicyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if req.RetentionDays < 0 {
+			c.JSON(400, gin.H{"error": "retentionDays must be 0 (keep forever) or more"})
+			return
+		}
+		policy := repository.RetentionPolicy{
+			DeviceType:    deviceType,
+			RetentionDays: req.RetentionDays,
+		}
+		if err := repos.Retention.Upsert(c.Request.Context(), &policy); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, policy)
+		}
+	})
+
+	r.DELETE("/retention/:deviceType", func(c *gin.Context) {
+		deviceType, ok := policyDeviceType(c)
+		if !ok {
+			return
+		}
+		if err := repos.Retention.Remove(c.Request.Context(), deviceType); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, gin.H{"message": "retention policy deleted"})
+		}
+	})
+
+	r.GET("/archives", func(c *gin.Context) {
+		if archives, err := repos.EventArchives.FindAll(c.Request.Context()); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, archives)
+		}
+	})
+
+	r.GET("/archive/:archiveId", func(c *gin.Context) {
+		archiveId, ok := objectIdParam(c, "archiveId")
+		if !ok {
+			return
+		}
+		a, err := repos.EventArchives.FindById(c.Request.Context(), archiveId)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		path := archive.FilePath(a)
+		if _, err := os.Stat(path); err != nil {
+			log.Println("[RETENTION]", "Archive file", path, "is missing")
+			c.JSON(404, gin.H{"error": "archive file not found"})
+			return
+		}
+		c.FileAttachment(path, archive.FileName(a))
+	})
+}
+
+// policyDeviceType reads the :deviceType of a request, which is "default",
+// CAMERA or another known device type, and answers 400 otherwise.
+func policyDeviceType(c *gin.Context) (string, bool) {
+	switch name := c.Param("deviceType"); {
+	case name == "default":
+		return repository.DefaultPolicyType, true
+	case name == cameraTypeName:
+		return "", true
+	case name != "" && deviceTypes[model.DeviceType(name)]:
+		return name, true
+	}
+	c.JSON(400, gin.H{"error": "unknown device type " + c.Param("deviceType")})
+	return "", false
+}
@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"face-service/config"
+	"face-service/descriptor"
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+)
+
+type ThresholdRequest struct {
+	Model     string  `json:"model"`
+	Metric    string  `json:"metric"`
+	Threshold float64 `json:"threshold"`
+}
+
+// ThresholdController serves the threshold each label is matched with. Both
+// the metric and the model default to those of matching, and are given with
+// ?metric= and ?model= when reading or removing.
+func ThresholdController(r *gin.RouterGroup, repos *repository.Repositories) {
+	r.GET("/label/:label/threshold", func(c *gin.Context) {
+		opts := MatchOptions{Metric: c.Query("metric")}
+		thresholds, err := opts.resolve()
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		descriptorModel := descriptorModel(c)
+		if !labelExists(c, repos) {
+			return
+		}
+		index, err := userGallery(c, repos, descriptorModel)
+		if err == nil {
+			err = loadManualThresholds(c.Request.Context(), repos, descriptorModel, opts.Metric, &thresholds)
+		}
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		// faces of another model may not have the dimension of the current one
+		dim, _ := index.LabelDimension(c.Param("label"))
+		threshold := index.Threshold(c.Param("label"), opts.Metric, dim, thresholds)
+		c.JSON(200, gin.H{
+			"label":     c.Param("label"),
+			"model":     descriptorModel,
+			"metric":    opts.Metric,
+			"default":   thresholds.Default,
+			"threshold": threshold,
+		})
+	})
+
+	r.PUT("/label/:label/threshold", func(c *gin.Context) {
+		var req ThresholdRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		opts := MatchOptions{Metric: req.Metric}
+		if _, err := opts.resolve(); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Threshold <= 0 || (opts.Metric == descriptor.Cosine && req.Threshold > 2) {
+			c.JSON(400, gin.H{"error": "invalid threshold"})
+			return
+		}
+		if req.Model == "" {
+			req.Model = config.Get().DescriptorModel
+		}
+		if !labelExists(c, repos) {
+			return
+		}
+		threshold := repository.LabelThreshold{
+			Model:     req.Model,
+			Label:     c.Param("label"),
+			Metric:    opts.Metric,
+			Threshold: req.Threshold,
+		}
+		if err := repos.Thresholds.Upsert(c.Request.Context(), &threshold); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, threshold)
+		}
+	})
+
+	r.DELETE("/label/:label/threshold", func(c *gin.Context) {
+		opts := MatchOptions{Metric: c.Query("metric")}
+		if _, err := opts.resolve(); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if err := repos.Thresholds.Remove(c.Request.Context(), descriptorModel(c), c.Param("label"), opts.Metric); err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, gin.H{"message": "label threshold deleted"})
+		}
+	})
+}
+
+// labelExists answers 404 when the current user has no face of the label.
+func labelExists(c *gin.Context, repos *repository.Repositories) bool {
+	faces, _, err := repos.Faces.FindPageByLabel(c.Request.Context(), c.Param("label"), repository.PageRequest{Limit: 1})
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return false
+	}
+	if len(faces) == 0 {
+		c.JSON(404, gin.H{"error": "label not found"})
+		return false
+	}
+	return true
+}
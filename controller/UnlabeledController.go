@@ -0,0 +1,238 @@
+package controller
+
+import (
+	"context"
+	"face-service/config"
+	"face-service/descriptor"
+	"face-service/gallery"
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	clusterRepresentatives = 3
+	clusterSuggestions     = 3
+)
+
+type UnlabeledCluster struct {
+	Size            int                    `json:"size"`
+	FaceIds         []bson.ObjectId        `json:"faceIds"`
+	Representatives []UnlabeledSample      `json:"representatives"`
+	Suggestions     []descriptor.Candidate `json:"suggestions"`
+}
+
+// UnlabeledSample shows an unlabeled face on the frame it was found on.
+type UnlabeledSample struct {
+	repository.UnlabeledFace
+	FrameUrl     string `json:"frameUrl"`
+	ThumbnailUrl string `json:"thumbnailUrl"`
+}
+
+type AssignRequest struct {
+	FaceIds []bson.ObjectId `json:"faceIds"`
+	Label   string          `json:"label"`
+}
+
+func UnlabeledController(r *gin.RouterGroup, repos *repository.Repositories) {
+	r.GET("/faces/unlabeled/clusters", func(c *gin.Context) {
+		minSize := 1
+		if c.Query("minSize") != "" {
+			size, err := strconv.Atoi(c.Query("minSize"))
+			if err != nil || size <= 0 {
+				c.JSON(400, gin.H{"error": "invalid minSize"})
+				return
+			}
+			minSize = size
+		}
+		descriptorModel := config.Get().DescriptorModel
+		faces, err := repos.Unlabeled.FindLatest(c.Request.Context(), descriptorModel, config.Get().UnlabeledPoolLimit)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		index, err := userGallery(c, repos, descriptorModel)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		descriptors := make([][]float32, len(faces))
+		for i := range faces {
+			descriptors[i] = faces[i].Descriptor
+		}
+		clusters := make([]UnlabeledCluster, 0)
+		for _, members := range gallery.Cluster(descriptors, config.Get().UnlabeledClusterDistance) {
+			if len(members) < minSize {
+				continue
+			}
+			cluster := UnlabeledCluster{
+				Size:            len(members),
+				FaceIds:         make([]bson.ObjectId, len(members)),
+				Representatives: make([]UnlabeledSample, 0, clusterRepresentatives),
+			}
+			for i, m := range members {
+				cluster.FaceIds[i] = faces[m].Id
+			}
+			for _, m := range gallery.Representatives(descriptors, members, clusterRepresentatives) {
+				cluster.Representatives = append(cluster.Representatives, unlabeledSample(faces[m]))
+			}
+			cluster.Suggestions, err = suggestLabels(index, gallery.Centroid(descriptors, members))
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			clusters = append(clusters, cluster)
+		}
+		c.JSON(200, clusters)
+	})
+
+	r.POST("/faces/unlabeled/assign", func(c *gin.Context) {
+		var req AssignRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Label == "" || len(req.FaceIds) == 0 {
+			c.JSON(400, gin.H{"error": "missing label or faces"})
+			return
+		}
+		found, err := repos.Unlabeled.FindByIds(c.Request.Context(), req.FaceIds)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		// faces of another model are not in any cluster the user could see
+		descriptorModel := config.Get().DescriptorModel
+		unlabeled := make([]repository.UnlabeledFace, 0, len(found))
+		for _, u := range found {
+			if u.Model == descriptorModel {
+				unlabeled = append(unlabeled, u)
+			}
+		}
+		if len(unlabeled) == 0 {
+			c.JSON(404, gin.H{"error": "faces not found"})
+			return
+		}
+		faces := make([]model.Face, len(unlabeled))
+		ids := make([]bson.ObjectId, len(unlabeled))
+		for i, u := range unlabeled {
+			faces[i] = model.Face{Label: req.Label, Descriptor: u.Descriptor}
+			ids[i] = u.Id
+		}
+		result := ingestFaces(c.Request.Context(), repos.Faces, descriptorModel, faces)
+		frames := make(map[bson.ObjectId]*repository.Recognition)
+		for _, item := range result["items"].([]ingestResult) {
+			if item.Status == ingestInserted {
+				cropUnlabeled(c.Request.Context(), repos, frames, unlabeled[item.Index], item.Id)
+			}
+		}
+		// faces that were rejected would be rejected again, so all leave the pool
+		if result["failed"] == 0 {
+			if _, err := repos.Unlabeled.RemoveByIds(c.Request.Context(), ids); err != nil {
+				c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+		}
+		c.JSON(200, result)
+	})
+}
+
+// cropUnlabeled stores the crop of a face assigned from the pool, cut out of
+// the recognition frame it was found on. recognitions caches the recognitions
+// of the assigned faces.
+func cropUnlabeled(ctx context.Context, repos *repository.Repositories, recognitions map[bson.ObjectId]*repository.Recognition, face repository.UnlabeledFace, faceId bson.ObjectId) {
+	found, ok := recognitions[face.RecognitionId]
+	if !ok {
+		var err error
+		if found, err = repos.Recognitions.FindById(ctx, face.RecognitionId); err != nil {
+			log.Println("[DB]", "Fail to find recognition", face.RecognitionId.Hex(), "by error", err.Error())
+		}
+		recognitions[face.RecognitionId] = found
+	}
+	if found == nil || face.Frame >= len(found.Frames) {
+		return
+	}
+	frame, err := repos.Frames.Read(ctx, found.Frames[face.Frame].FileId)
+	if err != nil {
+		log.Println("[DB]", "Fail to read frame", face.Frame, "of recognition", face.RecognitionId.Hex(), "by error", err.Error())
+		return
+	}
+	storeCrop(ctx, repos, faceId, frame, face.Rect)
+}
+
+// suggestLabels names the labels of the gallery nearest to a cluster,
+// however far they are.
+func suggestLabels(index *gallery.Index, centroid []float32) ([]descriptor.Candidate, error) {
+	candidates, err := index.Search(centroid, descriptor.Euclidean, clusterSuggestions*4)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	suggestions := make([]descriptor.Candidate, 0, clusterSuggestions)
+	for _, candidate := range candidates {
+		if !seen[candidate.Label] && len(suggestions) < clusterSuggestions {
+			seen[candidate.Label] = true
+			suggestions = append(suggestions, candidate)
+		}
+	}
+	return suggestions, nil
+}
+
+func unlabeledSample(face repository.UnlabeledFace) UnlabeledSample {
+	frameUrl := "/api/recognitions/" + face.RecognitionId.Hex() + "/frames/" + strconv.Itoa(face.Frame)
+	return UnlabeledSample{
+		UnlabeledFace: face,
+		FrameUrl:      frameUrl,
+		ThumbnailUrl:  frameUrl + "?thumbnail=true",
+	}
+}
+
+// collectUnlabeled adds the faces of a recognition that match no label of the
+// gallery to the unlabeled pool. Failing to do so does not fail the
+// recognition.
+func collectUnlabeled(ctx context.Context, repos *repository.Repositories, recognitionId bson.ObjectId, frames []repository.RecognitionFrame) {
+	owner, _ := repository.OwnerFrom(ctx)
+	descriptorModel := config.Get().DescriptorModel
+	index, err := galleries.Get(owner, descriptorModel, func() ([]model.Face, error) {
+		return repos.Faces.FindAll(ctx, descriptorModel)
+	})
+	if err != nil {
+		log.Println("[RECOGNITION]", "Fail to load gallery of recognition", recognitionId.Hex(), "by error", err.Error())
+		return
+	}
+	thresholds := gallery.Thresholds{Default: config.Get().MatchEuclideanThreshold, PerLabel: true}
+	if err := loadManualThresholds(ctx, repos, descriptorModel, descriptor.Euclidean, &thresholds); err != nil {
+		log.Println("[RECOGNITION]", "Fail to load label thresholds of recognition", recognitionId.Hex(), "by error", err.Error())
+		return
+	}
+	now := time.Now()
+	unlabeled := make([]repository.UnlabeledFace, 0)
+	for _, frame := range frames {
+		for _, fd := range frame.FaceDetailsList {
+			d := append([]float32(nil), fd.Descriptor[:]...)
+			if match, err := index.Match(d, descriptor.Euclidean, 1, thresholds); err != nil || match.Label != descriptor.Unknown {
+				continue
+			}
+			unlabeled = append(unlabeled, repository.UnlabeledFace{
+				Id:            bson.NewObjectId(),
+				RecognitionId: recognitionId,
+				Frame:         frame.N,
+				Rect:          fd.Rect,
+				Descriptor:    d,
+				Model:         descriptorModel,
+				CreatedAt:     now,
+			})
+		}
+	}
+	if len(unlabeled) == 0 {
+		return
+	}
+	if err := repos.Unlabeled.Insert(ctx, unlabeled...); err != nil {
+		log.Println("[DB]", "Fail to store unlabeled faces of recognition", recognitionId.Hex(), "by error", err.Error())
+	}
+}
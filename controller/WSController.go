@@ -1,9 +1,11 @@
 package controller
 
 import (
+	"context"
 	"encoding/json"
+	"face-service/auth"
 	"face-service/config"
-	"face-service/db"
+	"face-service/repository"
 	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/gin-gonic/gin"
 	"github.com/globalsign/mgo/bson"
@@ -24,23 +26,40 @@ var WSUpgrader = websocket.Upgrader{
 	},
 }
 
+// wsConn serializes the writes to a connection, which supports one writer at
+// a time. Every write goes through WriteJSON.
+type wsConn struct {
+	*websocket.Conn
+	writeLock sync.Mutex
+}
+
+func (c *wsConn) WriteJSON(v interface{}) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.Conn.WriteJSON(v)
+}
+
 var wsLock = sync.Mutex{}
-var wsMap = make(map[string]*websocket.Conn)
+var wsMap = make(map[string]*wsConn)
+var wsUsers = make(map[string]bson.ObjectId)
 
 var deviceNotifyLock = sync.Mutex{}
 var deviceNotifyConnMap = make(map[string]map[string]bool)
 
-func WSController(r *gin.RouterGroup) {
-
-	monitorNotifications()
+func WSController(r *gin.RouterGroup, repos *repository.Repositories) {
 
 	r.GET("/ws", func(c *gin.Context) {
-		if conn, err := WSUpgrader.Upgrade(c.Writer, c.Request, nil); err != nil {
+		user := auth.CurrentUser(c)
+		if upgraded, err := WSUpgrader.Upgrade(c.Writer, c.Request, nil); err != nil {
 			log.Println("[WS] Failed to set WebSocket upgrade: ", err)
 		} else {
+			conn := &wsConn{Conn: upgraded}
 			wsId := uuid.New().String()
 			log.Println("[WS]", "Registering WS connection:", wsId)
+			wsLock.Lock()
 			wsMap[wsId] = conn
+			wsUsers[wsId] = user.Id
+			wsLock.Unlock()
 
 			conn.WriteJSON(WSMessage{
 				Code:    200,
@@ -50,19 +69,37 @@ func WSController(r *gin.RouterGroup) {
 
 			conn.SetCloseHandler(func(code int, text string) error {
 				log.Println("[WS]", "Websocket closed code:", code, "text:", text)
-				wsLock.Lock()
-				delete(wsMap, wsId)
-				wsLock.Unlock()
+				unregisterConnection(wsId)
 				return nil
 			})
 
-			go serveWebSocket(wsId)
+			go serveWebSocket(repository.WithOwner(context.Background(), user.Id), repos, wsId)
 		}
 	})
 }
 
-func serveWebSocket(wsId string) {
+// unregisterConnection forgets a connection along with the desks it watches.
+func unregisterConnection(wsId string) {
+	wsLock.Lock()
+	delete(wsMap, wsId)
+	delete(wsUsers, wsId)
+	wsLock.Unlock()
+	deviceNotifyLock.Lock()
+	for deskId, conns := range deviceNotifyConnMap {
+		delete(conns, wsId)
+		if len(conns) == 0 {
+			delete(deviceNotifyConnMap, deskId)
+		}
+	}
+	deviceNotifyLock.Unlock()
+}
+
+// serveWebSocket reads messages of one connection until it fails or closes,
+// then unregisters the connection. ctx carries the owner of the connection so
+// desks can only be watched by the user who owns them.
+func serveWebSocket(ctx context.Context, repos *repository.Repositories, wsId string) {
 	defer func() {
+		unregisterConnection(wsId)
 		log.Println("[WS]", "Stopped serving connection", wsId)
 	}()
 
@@ -83,7 +120,7 @@ func serveWebSocket(wsId string) {
 		case "WATCH_DESK":
 			deskId := wsmsg.Payload
 
-			if count, _ := dao.Collection("desk").Find(bson.M{"deskId": deskId}).Count(); count <= 0 {
+			if count, _ := repos.Desks.CountByDeskId(ctx, deskId); count <= 0 {
 				if err := conn.WriteJSON(WSMessage{
 					Code:    200,
 					Type:    "APP_NOTIFICATION_WATCH_DESK_FAIL",
@@ -127,9 +164,11 @@ func serveWebSocket(wsId string) {
 	}
 }
 
-func monitorNotifications() {
-	desks := make([]model.Desk, 0)
-	if err := dao.Collection("desk").Find(nil).All(&desks); err != nil {
+// MonitorNotifications subscribes to the notification topic of every desk and
+// pushes received notifications to the WebSocket connections watching it.
+func MonitorNotifications(repos *repository.Repositories) {
+	desks, err := repos.Desks.FindAll(repository.AsSystem(context.Background()))
+	if err != nil {
 		panic(err)
 	}
 
@@ -147,25 +186,11 @@ func monitorNotifications() {
 					return
 				}
 				log.Println("[WS]", "Pushing notification for desk", nf.DeskId)
-				log.Println("[WS]", "Number for subscriber", len(deviceNotifyConnMap[nf.DeskId]))
-				for wsId := range deviceNotifyConnMap[nf.DeskId] {
-					wsLock.Lock()
-					conn, exists := wsMap[wsId]
-					wsLock.Unlock()
-					if !exists {
-						continue
-					}
-
-					if err := conn.WriteJSON(WSMessage{
-						Code:    200,
-						Type:    "APP_NOTIFICATION_REMIND",
-						Payload: "You are sitting for too long. To protect you health, please consider to take a break for better health.",
-					}); err != nil {
-						log.Println("[WS]", "Fail to send notification of desk", nf.DeskId, "and connection", wsId, "error", err.Error())
-					} else {
-						log.Println("[WS]", "Push notification successfully")
-					}
-				}
+				notifyDesk(nf.DeskId, WSMessage{
+					Code:    200,
+					Type:    "APP_NOTIFICATION_REMIND",
+					Payload: "You are sitting for too long. To protect you health, please consider to take a break for better health.",
+				})
 			}).Wait()
 		}
 	}
@@ -176,6 +201,42 @@ func monitorNotifications() {
 	}
 }
 
+// notifyUser pushes msg to every WebSocket connection of user.
+func notifyUser(user bson.ObjectId, msg WSMessage) {
+	conns := make(map[string]*wsConn)
+	wsLock.Lock()
+	for wsId, owner := range wsUsers {
+		if conn, exists := wsMap[wsId]; exists && owner == user {
+			conns[wsId] = conn
+		}
+	}
+	wsLock.Unlock()
+	for wsId, conn := range conns {
+		if err := conn.WriteJSON(msg); err != nil {
+			log.Println("[WS]", "Fail to send", msg.Type, "to connection", wsId, "error", err.Error())
+		}
+	}
+}
+
+// notifyDesk pushes msg to every WebSocket connection watching deskId.
+func notifyDesk(deskId string, msg WSMessage) {
+	conns := make(map[string]*wsConn)
+	deviceNotifyLock.Lock()
+	wsLock.Lock()
+	for wsId := range deviceNotifyConnMap[deskId] {
+		if conn, exists := wsMap[wsId]; exists {
+			conns[wsId] = conn
+		}
+	}
+	wsLock.Unlock()
+	deviceNotifyLock.Unlock()
+	for wsId, conn := range conns {
+		if err := conn.WriteJSON(msg); err != nil {
+			log.Println("[WS]", "Fail to send", msg.Type, "of desk", deskId, "to connection", wsId, "error", err.Error())
+		}
+	}
+}
+
 type WSMessage struct {
 	Code    int    `json:"code"`
 	Type    string `json:"type"`
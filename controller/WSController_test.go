@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"context"
+	"face-service/repository"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dialNotified registers the server side of a new connection for user and
+// returns the client side.
+func dialNotified(t *testing.T, user bson.ObjectId) (*websocket.Conn, string, func()) {
+	wsId := bson.NewObjectId().Hex()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgraded, err := WSUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		wsLock.Lock()
+		wsMap[wsId] = &wsConn{Conn: upgraded}
+		wsUsers[wsId] = user
+		wsLock.Unlock()
+	}))
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		wsLock.Lock()
+		_, registered := wsMap[wsId]
+		wsLock.Unlock()
+		if registered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection was not registered")
+		}
+	}
+	return client, wsId, func() {
+		client.Close()
+		wsLock.Lock()
+		delete(wsMap, wsId)
+		delete(wsUsers, wsId)
+		wsLock.Unlock()
+		server.Close()
+	}
+}
+
+func TestConcurrentNotifications(t *testing.T) {
+	user := bson.NewObjectId()
+	client, _, done := dialNotified(t, user)
+	defer done()
+
+	const senders, messages = 4, 50
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				notifyUser(user, WSMessage{Code: 200, Type: "RECOGNITION_UPDATED"})
+			}
+		}()
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < senders*messages; i++ {
+		var msg WSMessage
+		if err := client.ReadJSON(&msg); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestConcurrentDeskNotifications(t *testing.T) {
+	user := bson.NewObjectId()
+	client, wsId, done := dialNotified(t, user)
+	defer done()
+	deskId := bson.NewObjectId().Hex()
+	deviceNotifyLock.Lock()
+	deviceNotifyConnMap[deskId] = map[string]bool{wsId: true}
+	deviceNotifyLock.Unlock()
+	defer func() {
+		deviceNotifyLock.Lock()
+		delete(deviceNotifyConnMap, deskId)
+		deviceNotifyLock.Unlock()
+	}()
+
+	const senders, messages = 4, 50
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				// desk and user notifications share the connection
+				if i%2 == 0 {
+					notifyDesk(deskId, WSMessage{Code: 200, Type: "DEVICE_UPDATED"})
+				} else {
+					notifyUser(user, WSMessage{Code: 200, Type: "RECOGNITION_UPDATED"})
+				}
+			}
+		}(i)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < senders*messages; i++ {
+		var msg WSMessage
+		if err := client.ReadJSON(&msg); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestBrokenConnectionUnregistered(t *testing.T) {
+	user := bson.NewObjectId()
+	client, wsId, done := dialNotified(t, user)
+	defer done()
+	deskId := bson.NewObjectId().Hex()
+	deviceNotifyLock.Lock()
+	deviceNotifyConnMap[deskId] = map[string]bool{wsId: true}
+	deviceNotifyLock.Unlock()
+
+	go serveWebSocket(repository.WithOwner(context.Background(), user), repository.NewMemoryRepositories(), wsId)
+	// dropped without a close frame, as a lost network does
+	client.UnderlyingConn().Close()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		wsLock.Lock()
+		_, registered := wsMap[wsId]
+		_, known := wsUsers[wsId]
+		wsLock.Unlock()
+		deviceNotifyLock.Lock()
+		_, watched := deviceNotifyConnMap[deskId]
+		deviceNotifyLock.Unlock()
+		if !registered && !known && !watched {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("broken connection was not unregistered")
+		}
+	}
+}
@@ -17,10 +17,11 @@ var (
 	dao *DAO = nil
 )
 
-func init()  {
+// Connect dials MongoDB with the configured URI. It must be called before
+// Collection or GetSession are used.
+func Connect() {
 	conf := config.Get()
 
-
 	dialInfo, err:= mgo.ParseURL(conf.MongoDBUri)
 	if err != nil {
 		panic(err)
@@ -66,4 +67,8 @@ func Collection(name string) *mgo.Collection {
 
 func GetSession() *mgo.Session {
 	return dao.Session
-}
\ No newline at end of file
+}
+
+func DB() *mgo.Database {
+	return dao.Session.DB(dao.DBName)
+}
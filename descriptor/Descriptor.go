@@ -0,0 +1,18 @@
+package descriptor
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+)
+
+// MD5 hashes the little-endian bytes of a face descriptor. It is the key used
+// to recognize the same descriptor being stored twice.
+func MD5(d []float32) (string, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, d); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", md5.Sum(buf.Bytes())), nil
+}
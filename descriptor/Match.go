@@ -0,0 +1,68 @@
+package descriptor
+
+import (
+	"errors"
+	"github.com/globalsign/mgo/bson"
+	"math"
+)
+
+const (
+	Euclidean = "euclidean"
+	Cosine    = "cosine"
+
+	Unknown = "unknown"
+)
+
+var (
+	ErrUnknownMetric     = errors.New("unknown metric")
+	ErrDimensionMismatch = errors.New("descriptor dimension mismatch")
+)
+
+// Candidate is a stored face close to a queried descriptor.
+type Candidate struct {
+	FaceId   bson.ObjectId `json:"faceId"`
+	Label    string        `json:"label"`
+	Distance float64       `json:"distance"`
+}
+
+// Match is the outcome of matching one descriptor against a gallery. Label is
+// the label of the nearest candidate within the threshold of that label, or
+// Unknown. Confidence grows from 0 to 1 as the nearest candidate gets closer,
+// and is 0.5 right at the threshold.
+type Match struct {
+	Label      string      `json:"label"`
+	Distance   float64     `json:"distance"`
+	Threshold  float64     `json:"threshold"`
+	Confidence float64     `json:"confidence"`
+	Candidates []Candidate `json:"candidates"`
+}
+
+// Distance measures how far apart two descriptors are with metric. Cosine
+// distance is 1 minus the cosine similarity, so both metrics grow with
+// dissimilarity.
+func Distance(metric string, a, b []float32) (float64, error) {
+	if len(a) != len(b) {
+		return 0, ErrDimensionMismatch
+	}
+	switch metric {
+	case Euclidean:
+		sum := 0.0
+		for i := range a {
+			d := float64(a[i]) - float64(b[i])
+			sum += d * d
+		}
+		return math.Sqrt(sum), nil
+	case Cosine:
+		dot, na, nb := 0.0, 0.0, 0.0
+		for i := range a {
+			dot += float64(a[i]) * float64(b[i])
+			na += float64(a[i]) * float64(a[i])
+			nb += float64(b[i]) * float64(b[i])
+		}
+		if na == 0 || nb == 0 {
+			return 1, nil
+		}
+		return 1 - dot/math.Sqrt(na*nb), nil
+	}
+	return 0, ErrUnknownMetric
+}
@@ -0,0 +1,55 @@
+package descriptor
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	CodeDimension     = "dimension"
+	CodeNotFinite     = "not_finite"
+	CodeNorm          = "norm"
+	CodeNearDuplicate = "near_duplicate"
+)
+
+// ValidationError explains why a descriptor was refused. Code is stable and
+// meant for clients, Message for people.
+type ValidationError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// Validator checks descriptors before they are enrolled. A zero Dimension
+// accepts any length.
+type Validator struct {
+	Dimension int
+	MinNorm   float64
+	MaxNorm   float64
+}
+
+func (v Validator) Validate(d []float32) *ValidationError {
+	if v.Dimension > 0 && len(d) != v.Dimension {
+		return &ValidationError{CodeDimension, fmt.Sprintf("descriptor has %d values, expected %d", len(d), v.Dimension)}
+	}
+	sum := 0.0
+	for i, x := range d {
+		if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) {
+			return &ValidationError{CodeNotFinite, fmt.Sprintf("value %d is not a finite number", i)}
+		}
+		sum += float64(x) * float64(x)
+	}
+	if norm := math.Sqrt(sum); norm < v.MinNorm || norm > v.MaxNorm {
+		return &ValidationError{CodeNorm, fmt.Sprintf("descriptor norm %.4f is outside [%g, %g]", norm, v.MinNorm, v.MaxNorm)}
+	}
+	return nil
+}
+
+// NearDuplicate refuses a descriptor lying within distance of a sample that
+// is already enrolled, which adds nothing but weight to that sample.
+func NearDuplicate(distance float64) *ValidationError {
+	return &ValidationError{CodeNearDuplicate, fmt.Sprintf("descriptor is %.4f away from an enrolled sample", distance)}
+}
@@ -0,0 +1,26 @@
+package descriptor
+
+import (
+	"math"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	v := Validator{Dimension: 4, MinNorm: 0.1, MaxNorm: 10}
+	for _, c := range []struct {
+		d    []float32
+		code string
+	}{
+		{[]float32{0.1, 0.2, 0.3, 0.4}, ""},
+		{[]float32{0.1, 0.2, 0.3}, CodeDimension},
+		{[]float32{0.1, float32(math.NaN()), 0.3, 0.4}, CodeNotFinite},
+		{[]float32{0.1, 0.2, float32(math.Inf(-1)), 0.4}, CodeNotFinite},
+		{[]float32{0, 0, 0, 0}, CodeNorm},
+		{[]float32{10, 0, 0, 0.1}, CodeNorm},
+	} {
+		err := v.Validate(c.d)
+		if c.code == "" && err != nil || c.code != "" && (err == nil || err.Code != c.code) {
+			t.Fatalf("expected code %q for %v, got %v", c.code, c.d, err)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"face-service/config"
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// ingestAnswer is the answer to an upload of faces.
+type ingestAnswer struct {
+	Inserted  int `json:"inserted"`
+	Duplicate int `json:"duplicate"`
+	Rejected  int `json:"rejected"`
+	Failed    int `json:"failed"`
+	Items     []struct {
+		Index  int    `json:"index"`
+		Status string `json:"status"`
+		Id     string `json:"id"`
+		Code   string `json:"code"`
+		Error  string `json:"error"`
+	} `json:"items"`
+}
+
+// statuses returns the status of every item of the upload in order.
+func (a *ingestAnswer) statuses() []string {
+	statuses := make([]string, len(a.Items))
+	for i, item := range a.Items {
+		statuses[i] = item.Status
+	}
+	return statuses
+}
+
+func expectStatuses(t *testing.T, a ingestAnswer, expected ...string) {
+	statuses := a.statuses()
+	if len(statuses) != len(expected) {
+		t.Fatalf("expected %d items, got %v", len(expected), statuses)
+	}
+	for i := range expected {
+		if statuses[i] != expected[i] || a.Items[i].Index != i {
+			t.Fatalf("expected %v, got %v", expected, statuses)
+		}
+	}
+}
+
+func TestIngestUpsertsFaces(t *testing.T) {
+	s := newTestServer(t)
+	token, _ := s.login("alice@example.com")
+	batch := []gin.H{
+		{"label": "alice", "descriptor": testDescriptor(0.05)},
+		{"label": "alice", "descriptor": testDescriptor(0.05)},
+		{"descriptor": testDescriptor(0.1)},
+		{"label": "alice", "descriptor": testDescriptor(0.2)},
+	}
+	var first ingestAnswer
+	s.expect(http.StatusOK, token, "POST", "/api/labels", batch, &first)
+	expectStatuses(t, first, "inserted", "duplicate", "failed", "inserted")
+	if first.Inserted != 2 || first.Duplicate != 1 || first.Failed != 1 || first.Items[0].Id == "" {
+		t.Fatalf("unexpected counts of first upload: %+v", first)
+	}
+
+	var again ingestAnswer
+	s.expect(http.StatusOK, token, "POST", "/api/labels", batch, &again)
+	expectStatuses(t, again, "duplicate", "duplicate", "failed", "duplicate")
+
+	// the same descriptor under another label is another face
+	var other ingestAnswer
+	s.expect(http.StatusOK, token, "POST", "/api/label/bob/descriptors", []gin.H{{"descriptor": testDescriptor(0.05)}}, &other)
+	expectStatuses(t, other, "inserted")
+
+	// and so is the same descriptor of another user
+	bob, _ := s.login("bob@example.com")
+	s.expect(http.StatusOK, bob, "POST", "/api/labels", batch[:1], &other)
+	expectStatuses(t, other, "inserted")
+
+	var faces struct {
+		Items []interface{} `json:"items"`
+	}
+	s.expect(http.StatusOK, token, "GET", "/api/label/alice/descriptors", nil, &faces)
+	if len(faces.Items) != 2 {
+		t.Fatalf("expected 2 faces of alice, got %d", len(faces.Items))
+	}
+}
+
+// splitDescriptor is a descriptor of the configured dimension with a in its
+// first half and b in the second, so that descriptors point apart.
+func splitDescriptor(a, b float32) []float32 {
+	d := testDescriptor(a)
+	for i := len(d) / 2; i < len(d); i++ {
+		d[i] = b
+	}
+	return d
+}
+
+type matchAnswer struct {
+	Metric    string   `json:"metric"`
+	Threshold *float64 `json:"threshold"`
+	Matches   []struct {
+		Label      string  `json:"label"`
+		Distance   float64 `json:"distance"`
+		Candidates []struct {
+			FaceId string `json:"faceId"`
+			Label  string `json:"label"`
+		} `json:"candidates"`
+	} `json:"matches"`
+}
+
+// labels returns the label of every match in order.
+func (a *matchAnswer) labels() []string {
+	labels := make([]string, len(a.Matches))
+	for i, m := range a.Matches {
+		labels[i] = m.Label
+	}
+	return labels
+}
+
+func TestMatchDescriptors(t *testing.T) {
+	s := newTestServer(t)
+	token, _ := s.login("alice@example.com")
+	var ingested ingestAnswer
+	s.expect(http.StatusOK, token, "POST", "/api/labels", []gin.H{
+		{"label": "alice", "descriptor": splitDescriptor(0.1, 0)},
+		{"label": "bob", "descriptor": splitDescriptor(0, 0.1)},
+	}, &ingested)
+	expectStatuses(t, ingested, "inserted", "inserted")
+
+	queries := [][]float32{splitDescriptor(0.11, 0), splitDescriptor(0, 0.09), splitDescriptor(1, 1)}
+	var answer matchAnswer
+	s.expect(http.StatusOK, token, "POST", "/api/match", gin.H{"descriptors": queries, "k": 1}, &answer)
+	if labels := answer.labels(); len(labels) != 3 || labels[0] != "alice" || labels[1] != "bob" || labels[2] != "unknown" {
+		t.Fatalf("expected alice, bob and unknown, got %v", labels)
+	}
+	if answer.Metric != "euclidean" || len(answer.Matches[0].Candidates) != 1 || answer.Matches[0].Candidates[0].FaceId != ingested.Items[0].Id {
+		t.Fatalf("expected the nearest face of alice only, got %+v", answer.Matches[0])
+	}
+
+	// cosine distance ignores the norm, which is what keeps the last one apart
+	s.expect(http.StatusOK, token, "POST", "/api/match", gin.H{"descriptors": queries[2:], "metric": "cosine"}, &answer)
+	if len(answer.Matches[0].Candidates) != 2 || answer.Matches[0].Label != "unknown" {
+		t.Fatalf("expected both faces as candidates of an unknown face, got %+v", answer.Matches[0])
+	}
+	s.expect(http.StatusOK, token, "POST", "/api/match", gin.H{"descriptors": [][]float32{splitDescriptor(5, 0)}, "metric": "cosine"}, &answer)
+	if labels := answer.labels(); labels[0] != "alice" {
+		t.Fatalf("expected alice by cosine distance, got %v", labels)
+	}
+
+	// a threshold given with the request applies to every label
+	s.expect(http.StatusOK, token, "POST", "/api/match", gin.H{"descriptors": queries[:1], "threshold": 0.01}, &answer)
+	if labels := answer.labels(); labels[0] != "unknown" || answer.Threshold == nil || *answer.Threshold != 0.01 {
+		t.Fatalf("expected unknown within 0.01, got %v, %v", labels, answer.Threshold)
+	}
+
+	s.expect(http.StatusBadRequest, token, "POST", "/api/match", gin.H{"descriptors": [][]float32{}}, nil)
+	s.expect(http.StatusBadRequest, token, "POST", "/api/match", gin.H{"descriptors": queries, "metric": "manhattan"}, nil)
+
+	// faces of another dimension are never candidates
+	s.expect(http.StatusOK, token, "POST", "/api/match", gin.H{"descriptors": [][]float32{{0.1, 0.2}}}, &answer)
+	if answer.Matches[0].Label != "unknown" || len(answer.Matches[0].Candidates) != 0 {
+		t.Fatalf("expected no candidates of another dimension, got %+v", answer.Matches[0])
+	}
+
+	// another user matches against a gallery of its own
+	bob, _ := s.login("bob@example.com")
+	s.expect(http.StatusOK, bob, "POST", "/api/match", gin.H{"descriptors": queries[:1]}, &answer)
+	if answer.Matches[0].Label != "unknown" || len(answer.Matches[0].Candidates) != 0 {
+		t.Fatalf("expected no candidates in an empty gallery, got %+v", answer.Matches[0])
+	}
+}
+
+func TestIngestRejectsDescriptors(t *testing.T) {
+	s := newTestServer(t)
+	token, _ := s.login("alice@example.com")
+	var answer ingestAnswer
+	s.expect(http.StatusOK, token, "POST", "/api/labels", []gin.H{
+		{"label": "alice", "descriptor": testDescriptor(0.05)},
+		{"label": "alice", "descriptor": []float32{0.1, 0.2}},
+		{"label": "alice", "descriptor": testDescriptor(0)},
+		{"label": "alice", "descriptor": testDescriptor(1)},
+		{"label": "alice", "descriptor": testDescriptor(0.052)},
+		{"label": "bob", "descriptor": testDescriptor(0.052)},
+	}, &answer)
+	expectStatuses(t, answer, "inserted", "rejected", "rejected", "rejected", "rejected", "inserted")
+	for i, code := range []string{"", "dimension", "norm", "norm", "near_duplicate", ""} {
+		if answer.Items[i].Code != code || (code != "") != (answer.Items[i].Error != "") {
+			t.Fatalf("expected code %q for item %d, got %+v", code, i, answer.Items[i])
+		}
+	}
+	if answer.Inserted != 2 || answer.Rejected != 4 {
+		t.Fatalf("unexpected counts: %+v", answer)
+	}
+
+	// stored samples count as well as those earlier in the upload, while the
+	// very same descriptor is a duplicate
+	s.expect(http.StatusOK, token, "POST", "/api/label/alice/descriptors", []gin.H{
+		{"descriptor": testDescriptor(0.053)},
+		{"descriptor": testDescriptor(0.05)},
+		{"descriptor": testDescriptor(0.2)},
+		{"descriptor": testDescriptor(0.202)},
+	}, &answer)
+	expectStatuses(t, answer, "rejected", "duplicate", "inserted", "rejected")
+	if answer.Items[3].Code != "near_duplicate" {
+		t.Fatalf("expected a near duplicate of the upload, got %+v", answer.Items[3])
+	}
+}
+
+func TestUnlabeledClusters(t *testing.T) {
+	s := newTestServer(t)
+	token, userId := s.login("alice@example.com")
+	var ingested ingestAnswer
+	s.expect(http.StatusOK, token, "POST", "/api/labels", []gin.H{{"label": "carol", "descriptor": splitDescriptor(0, 0.5)}}, &ingested)
+	expectStatuses(t, ingested, "inserted")
+
+	pool := [][]float32{
+		splitDescriptor(0.1, 0), splitDescriptor(0.11, 0), splitDescriptor(0.12, 0),
+		splitDescriptor(0, 0.3), splitDescriptor(0, 0.31),
+		testDescriptor(0.8),
+	}
+	ids := make([]bson.ObjectId, len(pool))
+	recognitionId := bson.NewObjectId()
+	for i, d := range pool {
+		ids[i] = bson.NewObjectId()
+		face := repository.UnlabeledFace{
+			Id:            ids[i],
+			RecognitionId: recognitionId,
+			Frame:         i,
+			Descriptor:    d,
+			Model:         config.Get().DescriptorModel,
+			CreatedAt:     time.Now(),
+		}
+		if err := s.repos.Unlabeled.Insert(repository.WithOwner(context.Background(), userId), face); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var clusters []struct {
+		Size            int      `json:"size"`
+		FaceIds         []string `json:"faceIds"`
+		Representatives []struct {
+			FrameUrl string `json:"frameUrl"`
+		} `json:"representatives"`
+		Suggestions []struct {
+			Label string `json:"label"`
+		} `json:"suggestions"`
+	}
+	s.expect(http.StatusOK, token, "GET", "/api/faces/unlabeled/clusters", nil, &clusters)
+	if len(clusters) != 3 || clusters[0].Size != 3 || clusters[1].Size != 2 || clusters[2].Size != 1 {
+		t.Fatalf("expected clusters of 3, 2 and 1 faces, got %+v", clusters)
+	}
+	if len(clusters[0].Representatives) != 3 || clusters[0].Representatives[0].FrameUrl == "" {
+		t.Fatalf("expected 3 representatives with frames, got %+v", clusters[0].Representatives)
+	}
+	if len(clusters[1].Suggestions) == 0 || clusters[1].Suggestions[0].Label != "carol" {
+		t.Fatalf("expected carol to be suggested first, got %+v", clusters[1].Suggestions)
+	}
+	s.expect(http.StatusOK, token, "GET", "/api/faces/unlabeled/clusters?minSize=2", nil, &clusters)
+	if len(clusters) != 2 {
+		t.Fatalf("expected 2 clusters of at least 2 faces, got %d", len(clusters))
+	}
+	s.expect(http.StatusBadRequest, token, "GET", "/api/faces/unlabeled/clusters?minSize=0", nil, nil)
+
+	// a cluster is assigned at once, and only by the owner of its faces
+	assign := gin.H{"faceIds": clusters[1].FaceIds, "label": "dave"}
+	bob, _ := s.login("bob@example.com")
+	s.expect(http.StatusNotFound, bob, "POST", "/api/faces/unlabeled/assign", assign, nil)
+	s.expect(http.StatusBadRequest, token, "POST", "/api/faces/unlabeled/assign", gin.H{"faceIds": clusters[1].FaceIds}, nil)
+	var assigned ingestAnswer
+	s.expect(http.StatusOK, token, "POST", "/api/faces/unlabeled/assign", assign, &assigned)
+	expectStatuses(t, assigned, "inserted", "inserted")
+	s.expect(http.StatusNotFound, token, "POST", "/api/faces/unlabeled/assign", assign, nil)
+
+	s.expect(http.StatusOK, token, "GET", "/api/faces/unlabeled/clusters", nil, &clusters)
+	if len(clusters) != 2 || clusters[0].Size != 3 || clusters[1].Size != 1 {
+		t.Fatalf("expected the assigned cluster to leave the pool, got %+v", clusters)
+	}
+	var faces struct {
+		Items []interface{} `json:"items"`
+	}
+	s.expect(http.StatusOK, token, "GET", "/api/label/dave/descriptors", nil, &faces)
+	if len(faces.Items) != 2 {
+		t.Fatalf("expected 2 faces of dave, got %d", len(faces.Items))
+	}
+}
+
+func TestDeletedLabelReused(t *testing.T) {
+	s := newTestServer(t)
+	token, _ := s.login("alice@example.com")
+	batch := []gin.H{{"label": "alice", "descriptor": testDescriptor(0.05)}}
+	var answer ingestAnswer
+	s.expect(http.StatusOK, token, "POST", "/api/labels", batch, &answer)
+	s.expect(http.StatusOK, token, "DELETE", "/api/label/alice", nil, nil)
+	s.expect(http.StatusOK, token, "POST", "/api/labels", batch, &answer)
+	expectStatuses(t, answer, "inserted")
+
+	s.expect(http.StatusOK, token, "POST", "/api/labels", []gin.H{{"label": "bob", "descriptor": testDescriptor(0.2)}}, &answer)
+	s.expect(http.StatusOK, token, "DELETE", "/api/label/alice", nil, nil)
+	s.expect(http.StatusOK, token, "PATCH", "/api/label/bob", gin.H{"label": "alice"}, nil)
+	s.expect(http.StatusNotFound, token, "POST", "/api/label/alice/restore", nil, nil)
+	var faces struct {
+		Items []interface{} `json:"items"`
+	}
+	s.expect(http.StatusOK, token, "GET", "/api/label/alice/descriptors", nil, &faces)
+	if len(faces.Items) != 1 {
+		t.Fatalf("expected the renamed face only, got %d faces", len(faces.Items))
+	}
+}
+
+func TestThresholdOfOtherModel(t *testing.T) {
+	s := newTestServer(t)
+	token, userId := s.login("alice@example.com")
+	ctx := repository.WithOwner(context.Background(), userId)
+	for i, d := range [][]float32{{1, 0, 0, 0}, {0.9, 0.1, 0, 0}, {0.95, 0, 0.1, 0}} {
+		face := model.Face{Id: bson.NewObjectId(), Label: "alice", MD5: strconv.Itoa(i), Descriptor: d}
+		if _, err := s.repos.Faces.Upsert(ctx, &face, repository.FaceMeta{Model: "small"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var answer struct {
+		Model     string `json:"model"`
+		Threshold struct {
+			Source string `json:"source"`
+		} `json:"threshold"`
+	}
+	s.expect(http.StatusOK, token, "GET", "/api/label/alice/threshold?model=small", nil, &answer)
+	if answer.Model != "small" || answer.Threshold.Source != "calibrated" {
+		t.Fatalf("expected a threshold calibrated on the faces of small, got %+v", answer)
+	}
+	s.expect(http.StatusOK, token, "GET", "/api/label/alice/threshold", nil, &answer)
+	if answer.Threshold.Source != "default" {
+		t.Fatalf("expected the default threshold without faces of the current model, got %+v", answer)
+	}
+}
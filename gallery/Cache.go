@@ -0,0 +1,108 @@
+package gallery
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"sync"
+	"time"
+)
+
+// Cache keeps the index of every user gallery that was searched recently, one
+// per descriptor model. Indexes are built on first use and dropped on
+// Invalidate or once they are older than the TTL, which bounds staleness when
+// another instance of the service changed the gallery.
+type Cache struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[cacheKey]*entry
+	// generations count the invalidations of the galleries being loaded,
+	// which loading counts the loads of
+	generations map[bson.ObjectId]uint64
+	loading     map[bson.ObjectId]int
+	epoch       uint64
+}
+
+type cacheKey struct {
+	owner bson.ObjectId
+	model string
+}
+
+type entry struct {
+	index    *Index
+	loadedAt time.Time
+}
+
+func NewCache(ttl time.Duration) *Cache {
+	return &Cache{
+		ttl:         ttl,
+		entries:     make(map[cacheKey]*entry),
+		generations: make(map[bson.ObjectId]uint64),
+		loading:     make(map[bson.ObjectId]int),
+	}
+}
+
+// Get returns the index of the owner gallery made of descriptors of one
+// model, building it from load when it is not cached.
+func (c *Cache) Get(owner bson.ObjectId, descriptorModel string, load func() ([]model.Face, error)) (*Index, error) {
+	key := cacheKey{owner: owner, model: descriptorModel}
+	c.lock.Lock()
+	if e := c.entries[key]; e != nil && time.Since(e.loadedAt) < c.ttl {
+		c.lock.Unlock()
+		return e.index, nil
+	}
+	generation, epoch := c.generations[owner], c.epoch
+	c.loading[owner]++
+	c.lock.Unlock()
+
+	faces, err := load()
+	var index *Index
+	if err == nil {
+		index = NewIndex(faces)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// an invalidation during the load means faces may already be stale
+	if err == nil && c.generations[owner] == generation && c.epoch == epoch {
+		c.entries[key] = &entry{index: index, loadedAt: time.Now()}
+	}
+	if c.loading[owner]--; c.loading[owner] == 0 {
+		delete(c.loading, owner)
+		delete(c.generations, owner)
+	}
+	c.evictExpired()
+	return index, err
+}
+
+// evictExpired drops the indexes older than the TTL. Loads are rare enough
+// to scan every entry on each one.
+func (c *Cache) evictExpired() {
+	for key, e := range c.entries {
+		if time.Since(e.loadedAt) >= c.ttl {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Invalidate drops the cached indexes of the owner gallery.
+func (c *Cache) Invalidate(owner bson.ObjectId) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key := range c.entries {
+		if key.owner == owner {
+			delete(c.entries, key)
+		}
+	}
+	// only the loads in flight compare generations
+	if c.loading[owner] > 0 {
+		c.generations[owner]++
+	}
+}
+
+// InvalidateAll drops the cached indexes of every gallery.
+func (c *Cache) InvalidateAll() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[cacheKey]*entry)
+	c.epoch++
+}
@@ -0,0 +1,41 @@
+package gallery
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"testing"
+	"time"
+)
+
+func TestCacheEviction(t *testing.T) {
+	c := NewCache(20 * time.Millisecond)
+	loads := 0
+	load := func() ([]model.Face, error) {
+		loads++
+		return nil, nil
+	}
+	alice, bob := bson.NewObjectId(), bson.NewObjectId()
+	c.Get(alice, "m", load)
+	c.Get(alice, "m", load)
+	if loads != 1 {
+		t.Fatalf("expected the index to be cached, got %d loads", loads)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	c.Get(bob, "m", load)
+	if _, cached := c.entries[cacheKey{owner: alice, model: "m"}]; cached {
+		t.Fatal("expired index of another owner is still cached")
+	}
+
+	// an invalidation during a load keeps the loaded index out of the cache
+	c.Get(alice, "m", func() ([]model.Face, error) {
+		c.Invalidate(alice)
+		return nil, nil
+	})
+	if _, cached := c.entries[cacheKey{owner: alice, model: "m"}]; cached {
+		t.Fatal("index invalidated while loading was cached")
+	}
+	if len(c.generations) != 0 || len(c.loading) != 0 {
+		t.Fatalf("expected no bookkeeping once loads are done, got %v and %v", c.generations, c.loading)
+	}
+}
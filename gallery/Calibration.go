@@ -0,0 +1,140 @@
+package gallery
+
+import (
+	"face-service/descriptor"
+	"math"
+)
+
+const (
+	ThresholdDefault    = "default"
+	ThresholdCalibrated = "calibrated"
+	ThresholdManual     = "manual"
+
+	// labels with fewer faces do not tell their spread apart from noise
+	minCalibrationFaces = 3
+	// the spread of a label is estimated on its first faces only
+	maxCalibrationFaces = 64
+	// a calibrated threshold lies this many standard deviations above the
+	// mean distance between faces of the label
+	calibrationDeviations = 2
+)
+
+// Thresholds decides how close a descriptor must lie to the nearest face of a
+// label to be named after it.
+type Thresholds struct {
+	// Default applies to labels that have neither a manual threshold nor
+	// enough faces to be calibrated, and bounds calibrated thresholds.
+	Default float64
+	// Manual holds the thresholds users set by hand, by label.
+	Manual map[string]float64
+	// PerLabel lets every label have its own threshold, manual or
+	// calibrated from the spread of its faces; without it Default applies to
+	// every label.
+	PerLabel bool
+}
+
+// Spread describes the distances between the faces of a label.
+type Spread struct {
+	Faces  int     `json:"faces"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stdDev"`
+}
+
+// Threshold is the threshold a label is matched with.
+type Threshold struct {
+	Value  float64 `json:"value"`
+	Source string  `json:"source"`
+	Spread *Spread `json:"spread,omitempty"`
+}
+
+type spreadKey struct {
+	label  string
+	metric string
+	dim    int
+}
+
+// Threshold returns the threshold of label for descriptors of dimension dim.
+// Calibrated thresholds are kept between half of and the whole default: they
+// tighten matching for labels whose faces lie close together but never loosen
+// it.
+func (ix *Index) Threshold(label string, metric string, dim int, t Thresholds) Threshold {
+	if manual, ok := t.Manual[label]; ok && t.PerLabel {
+		return Threshold{Value: manual, Source: ThresholdManual}
+	}
+	threshold := Threshold{Value: t.Default, Source: ThresholdDefault}
+	if !t.PerLabel {
+		return threshold
+	}
+	spread, ok := ix.Spread(label, metric, dim)
+	if !ok {
+		return threshold
+	}
+	threshold.Spread = &spread
+	if spread.Faces < minCalibrationFaces {
+		return threshold
+	}
+	threshold.Value = math.Max(t.Default/2, math.Min(t.Default, spread.Mean+calibrationDeviations*spread.StdDev))
+	threshold.Source = ThresholdCalibrated
+	return threshold
+}
+
+// Spread measures the distances between every pair of faces of label with
+// metric. It is computed once per index and label.
+func (ix *Index) Spread(label string, metric string, dim int) (Spread, bool) {
+	key := spreadKey{label: label, metric: metric, dim: dim}
+	ix.spreadLock.Lock()
+	defer ix.spreadLock.Unlock()
+	if spread, ok := ix.spreads[key]; ok {
+		return spread, spread.Faces > 0
+	}
+	var spread Spread
+	if b := ix.blocks[dim]; b != nil {
+		faces := make([][]float32, 0)
+		for i := range b.ids {
+			if b.labels[i] == label && len(faces) < maxCalibrationFaces {
+				faces = append(faces, b.vectors[i*b.dim:(i+1)*b.dim])
+			}
+		}
+		spread = measureSpread(faces, metric)
+	}
+	ix.spreads[key] = spread
+	return spread, spread.Faces > 0
+}
+
+func measureSpread(faces [][]float32, metric string) Spread {
+	spread := Spread{Faces: len(faces)}
+	var sum, squares float64
+	pairs := 0
+	for i := range faces {
+		for j := i + 1; j < len(faces); j++ {
+			d, err := descriptor.Distance(metric, faces[i], faces[j])
+			if err != nil {
+				continue
+			}
+			sum, squares, pairs = sum+d, squares+d*d, pairs+1
+		}
+	}
+	if pairs > 0 {
+		spread.Mean = sum / float64(pairs)
+		spread.StdDev = math.Sqrt(math.Max(0, squares/float64(pairs)-spread.Mean*spread.Mean))
+	}
+	return spread
+}
+
+// Confidence maps the distance of a match to (0, 1) with a logistic curve
+// centered on the threshold: 0.5 at the threshold, higher when nearer. The
+// curve is as steep as the spread of the label allows, and never flatter than
+// a tenth of the threshold.
+func Confidence(distance float64, threshold Threshold) float64 {
+	scale := threshold.Value / 10
+	if threshold.Spread != nil && threshold.Spread.StdDev > scale {
+		scale = threshold.Spread.StdDev
+	}
+	if scale <= 0 {
+		if distance <= threshold.Value {
+			return 1
+		}
+		return 0
+	}
+	return 1 / (1 + math.Exp((distance-threshold.Value)/scale))
+}
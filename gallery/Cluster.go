@@ -0,0 +1,78 @@
+package gallery
+
+import (
+	"sort"
+)
+
+// Cluster groups descriptors by single linkage: two descriptors closer than
+// threshold always end up in the same cluster. Clusters hold descriptor
+// indexes and come largest first.
+func Cluster(descriptors [][]float32, threshold float64) [][]int {
+	parent := make([]int, len(descriptors))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	limit := float32(threshold * threshold)
+	for i := range descriptors {
+		for j := i + 1; j < len(descriptors); j++ {
+			if len(descriptors[i]) != len(descriptors[j]) {
+				continue
+			}
+			if squaredDistance(descriptors[i], descriptors[j]) <= limit {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	byRoot := make(map[int][]int)
+	for i := range descriptors {
+		root := find(i)
+		byRoot[root] = append(byRoot[root], i)
+	}
+	clusters := make([][]int, 0, len(byRoot))
+	for _, members := range byRoot {
+		clusters = append(clusters, members)
+	}
+	sort.Slice(clusters, func(a, b int) bool {
+		if len(clusters[a]) != len(clusters[b]) {
+			return len(clusters[a]) > len(clusters[b])
+		}
+		return clusters[a][0] < clusters[b][0]
+	})
+	return clusters
+}
+
+// Centroid averages the descriptors of members.
+func Centroid(descriptors [][]float32, members []int) []float32 {
+	centroid := make([]float32, len(descriptors[members[0]]))
+	for _, m := range members {
+		for i, x := range descriptors[m] {
+			centroid[i] += x
+		}
+	}
+	for i := range centroid {
+		centroid[i] /= float32(len(members))
+	}
+	return centroid
+}
+
+// Representatives returns up to count members nearest to the centroid, which
+// show a cluster better than its outliers.
+func Representatives(descriptors [][]float32, members []int, count int) []int {
+	centroid := Centroid(descriptors, members)
+	sorted := append([]int(nil), members...)
+	sort.SliceStable(sorted, func(a, b int) bool {
+		return squaredDistance(centroid, descriptors[sorted[a]]) < squaredDistance(centroid, descriptors[sorted[b]])
+	})
+	if len(sorted) > count {
+		sorted = sorted[:count]
+	}
+	return sorted
+}
@@ -0,0 +1,21 @@
+package gallery
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCluster(t *testing.T) {
+	// 0 and 0.8 are too far apart on their own but linked through 0.4
+	descriptors := [][]float32{{5}, {0}, {0.4}, {0.8}, {5.1}, {0, 1}}
+	clusters := Cluster(descriptors, 0.5)
+	if !reflect.DeepEqual(clusters, [][]int{{1, 2, 3}, {0, 4}, {5}}) {
+		t.Fatalf("unexpected clusters %v", clusters)
+	}
+	if centroid := Centroid(descriptors, clusters[0]); len(centroid) != 1 || centroid[0] < 0.39 || centroid[0] > 0.41 {
+		t.Fatalf("expected centroid 0.4, got %v", centroid)
+	}
+	if r := Representatives(descriptors, clusters[0], 2); len(r) != 2 || r[0] != 2 {
+		t.Fatalf("expected the middle face to represent the cluster first, got %v", r)
+	}
+}
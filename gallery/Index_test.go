@@ -0,0 +1,165 @@
+package gallery
+
+import (
+	"face-service/descriptor"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func randomFaces(r *rand.Rand, n int, dim int) []model.Face {
+	faces := make([]model.Face, n)
+	for i := range faces {
+		d := make([]float32, dim)
+		for j := range d {
+			d[j] = float32(r.NormFloat64() * 0.1)
+		}
+		faces[i] = model.Face{Id: bson.NewObjectId(), Label: "label-" + strconv.Itoa(i%100), Descriptor: d}
+	}
+	return faces
+}
+
+// squaredDistance64 is the plain float64 loop squaredDistance replaces.
+func squaredDistance64(a, b []float32) float64 {
+	sum := 0.0
+	for i := range a {
+		d := float64(a[i]) - float64(b[i])
+		sum += d * d
+	}
+	return sum
+}
+
+func TestIndexSearch(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	faces := randomFaces(r, 500, 128)
+	ix := NewIndex(faces)
+	query := randomFaces(r, 1, 128)[0].Descriptor
+	candidates, err := ix.Search(query, descriptor.Euclidean, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// brute force in float64 must agree on the nearest face
+	best, nearest := math.MaxFloat64, ""
+	for _, f := range faces {
+		if d := squaredDistance64(query, f.Descriptor); d < best {
+			best, nearest = d, f.Id.Hex()
+		}
+	}
+	if len(candidates) != 5 || candidates[0].FaceId.Hex() != nearest {
+		t.Fatalf("expected nearest face %s, got %+v", nearest, candidates)
+	}
+	if math.Abs(candidates[0].Distance-math.Sqrt(best)) > 1e-4 {
+		t.Fatalf("expected distance %f, got %f", math.Sqrt(best), candidates[0].Distance)
+	}
+	for i := 1; i < len(candidates); i++ {
+		if candidates[i].Distance < candidates[i-1].Distance {
+			t.Fatalf("candidates are not nearest first: %+v", candidates)
+		}
+	}
+}
+
+// BenchmarkIndexSearch10k searches a gallery of 10k descriptors, and scans it
+// with the float64 loop for comparison.
+func BenchmarkIndexSearch10k(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	faces := randomFaces(r, 10000, 128)
+	ix := NewIndex(faces)
+	query := randomFaces(r, 1, 128)[0].Descriptor
+	for _, metric := range []string{descriptor.Euclidean, descriptor.Cosine} {
+		b.Run(metric, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := ix.Search(query, metric, 10); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	b.Run("float64-scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			best := math.MaxFloat64
+			for _, f := range faces {
+				if d := squaredDistance64(query, f.Descriptor); d < best {
+					best = d
+				}
+			}
+		}
+	})
+	b.Run("float32-scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			best := float32(math.MaxFloat32)
+			for _, f := range faces {
+				if d := squaredDistance(query, f.Descriptor); d < best {
+					best = d
+				}
+			}
+		}
+	})
+}
+
+// median returns the median duration of n runs of f.
+func median(n int, f func()) time.Duration {
+	durations := make([]time.Duration, n)
+	for i := range durations {
+		start := time.Now()
+		f()
+		durations[i] = time.Since(start)
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[n/2]
+}
+
+// TestIndexSearch10kCost holds a search of 10k descriptors to what does not
+// depend on the machine: a fixed number of allocations and less time than
+// the float64 scan it replaces, which the race detector cannot tell apart.
+// BenchmarkIndexSearch10k tells how long it takes on a given machine.
+func TestIndexSearch10kCost(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	faces := randomFaces(r, 10000, 128)
+	ix := NewIndex(faces)
+	query := randomFaces(r, 1, 128)[0].Descriptor
+	scan := median(11, func() {
+		best := math.MaxFloat64
+		for _, f := range faces {
+			if d := squaredDistance64(query, f.Descriptor); d < best {
+				best = d
+			}
+		}
+	})
+	for _, metric := range []string{descriptor.Euclidean, descriptor.Cosine} {
+		allocs := testing.AllocsPerRun(10, func() {
+			if _, err := ix.Search(query, metric, 10); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs > 2 {
+			t.Fatalf("%s search allocates %v times", metric, allocs)
+		}
+		if raceEnabled {
+			continue
+		}
+		search := median(11, func() { ix.Search(query, metric, 10) })
+		if search > scan {
+			t.Fatalf("%s search takes %v, more than the %v of a float64 scan", metric, search, scan)
+		}
+	}
+}
+
+func TestLabelDimension(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	faces := append(randomFaces(r, 2, 4), randomFaces(r, 1, 128)...)
+	for i := range faces {
+		faces[i].Label = "alice"
+	}
+	ix := NewIndex(append(faces, randomFaces(r, 3, 128)...))
+	if dim, ok := ix.LabelDimension("alice"); !ok || dim != 4 {
+		t.Fatalf("expected alice to have 4 dimensions, got %d, %v", dim, ok)
+	}
+	if _, ok := ix.LabelDimension("bob"); ok {
+		t.Fatal("expected bob to have no face")
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package gallery
+
+// raceEnabled tells timing tests that the race detector slows every memory
+// access down, whatever code does it.
+const raceEnabled = true
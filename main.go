@@ -1,16 +1,83 @@
 package main
 
 import (
+	"context"
 	"face-service/auth"
+	"face-service/config"
 	"face-service/controller"
+	"face-service/db"
+	"face-service/migration"
+	"face-service/recognition"
+	"face-service/repository"
+	"face-service/worker"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"log"
+	"os"
 	"time"
 )
 
 
 func main() {
+	dao.Connect()
 
+	migrateOnly := len(os.Args) > 1 && os.Args[1] == "migrate"
+	if migrateOnly || config.Get().AutoMigrate {
+		if err := migration.Run(dao.DB()); err != nil {
+			log.Fatalln("[MIGRATION]", err)
+		}
+	}
+	if migrateOnly {
+		return
+	}
+
+	repos := repository.NewMongoRepositories()
+	if interrupted, err := repos.Recognitions.Interrupt(repository.AsSystem(context.Background()), config.Get().InstanceId, "interrupted by a restart"); err != nil {
+		log.Println("[RECOGNITION]", "Fail to mark interrupted recognitions by error", err.Error())
+	} else if interrupted > 0 {
+		log.Println("[RECOGNITION]", "Failed", interrupted, "recognition(s) interrupted by a restart")
+	}
+	if interrupted, err := repos.Enrollments.Interrupt(repository.AsSystem(context.Background()), config.Get().InstanceId, "interrupted by a restart"); err != nil {
+		log.Println("[ENROLL]", "Fail to mark interrupted enrollments by error", err.Error())
+	} else if interrupted > 0 {
+		log.Println("[ENROLL]", "Failed", interrupted, "enrollment(s) interrupted by a restart")
+	}
+
+	checkDescriptorModel(repos)
+
+	controller.MonitorNotifications(repos)
+	controller.MonitorDevices(repos)
+	worker.StartTrashPurger(repos.Trash)
+	worker.StartRetentionSweeper(repos)
+	worker.StartPresenceSweeper(repos.Devices, controller.NotifyPresence)
+	worker.StartCommandExpirer(repos.Commands)
+
+	recognizer := recognition.NewRecognizer(config.Get().Recognizer, config.Get().MQTTBroker)
+	frames := recognition.NewFrameSource(config.Get().MQTTBroker)
+	setupRouter(repos, auth.NewAuthService(repos), recognizer, frames).Run()
+}
+
+// checkDescriptorModel refuses a switch of descriptor model that leaves the
+// gallery of a user empty for good.
+func checkDescriptorModel(repos *repository.Repositories) {
+	descriptorModel := config.Get().DescriptorModel
+	stranded, err := repos.Faces.CountStranded(repository.AsSystem(context.Background()), descriptorModel)
+	if err != nil {
+		log.Println("[REEMBED]", "Fail to count faces without crop by error", err.Error())
+		return
+	}
+	if stranded.Users > 0 && !config.Get().AllowEmptyGalleries {
+		log.Fatalln("[REEMBED]", stranded.Faces, "face(s) of another model than", descriptorModel, "have no crop to be computed again from, which leaves",
+			stranded.Users, "user(s) without faces to match; set ALLOW_EMPTY_GALLERIES=true to start anyway")
+	}
+	if stranded.Faces > 0 {
+		log.Println("[REEMBED]", stranded.Faces, "face(s) of another model than", descriptorModel, "have no crop and no longer take part in matching")
+	}
+}
+
+// setupRouter registers every route on a new engine. It does not touch MQTT or
+// the database directly, so it can be driven with in-memory repositories.
+func setupRouter(repos *repository.Repositories, authService *auth.AuthService, recognizer recognition.Recognizer, frames recognition.FrameSource) *gin.Engine {
 	r := gin.Default()
 
 	r.Use(cors.New(cors.Config{
@@ -22,17 +89,29 @@ func main() {
 	}))
 
 	apiGroup := r.Group("/api")
-	apiGroup.Use(auth.FirebaseAuthMiddleware())
+	apiGroup.Use(auth.FirebaseAuthMiddleware(authService))
 
-	controller.LabelController(apiGroup)
-	controller.DeskController(apiGroup)
-	controller.DeviceController(apiGroup)
-	controller.WSController(apiGroup)
-	controller.NotificationController(apiGroup.Group("/notification"))
+	controller.LabelController(apiGroup, repos)
+	controller.DeskController(apiGroup, repos)
+	controller.DeviceController(apiGroup, repos)
+	controller.DeviceShadowController(apiGroup, repos)
+	controller.DeviceCommandController(apiGroup, repos)
+	controller.WSController(apiGroup, repos)
+	controller.NotificationController(apiGroup.Group("/notification"), repos)
+	controller.RetentionController(apiGroup, repos)
+	controller.MatchController(apiGroup, repos)
+	controller.ThresholdController(apiGroup, repos)
+	controller.EnrollmentController(apiGroup, repos, recognizer, frames)
+	controller.RecognitionController(apiGroup, repos, recognizer, frames)
+	controller.RecognizeController(apiGroup, repos, recognizer)
+	controller.UnlabeledController(apiGroup, repos)
+	controller.AdminController(apiGroup, repos, recognizer)
+	controller.ProvisioningController(apiGroup, repos, authService)
 
 	authGroup := r.Group("/api/auth")
-	controller.AuthController(authGroup)
+	controller.AuthController(authGroup, authService)
 
-	r.Run()
-}
+	controller.ClaimCodeQRController(r.Group("/api/public"))
 
+	return r
+}
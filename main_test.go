@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"face-service/auth"
+	"face-service/recognition"
+	"face-service/repository"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	os.Setenv("TOKEN_SECRET", "test-secret")
+	// base64 of an empty firebase web config
+	os.Setenv("FIREBASE_WEB_CONFIG", "e30=")
+}
+
+// testServer drives the whole API on in-memory repositories, with fake
+// recognizer and cameras.
+type testServer struct {
+	t          *testing.T
+	router     *gin.Engine
+	repos      *repository.Repositories
+	recognizer *recognition.FakeRecognizer
+	frames     *recognition.FakeFrameSource
+}
+
+func newTestServer(t *testing.T) *testServer {
+	repos := repository.NewMemoryRepositories()
+	recognizer, frames := recognition.NewFakeRecognizer(), recognition.NewFakeFrameSource()
+	return &testServer{
+		t:          t,
+		router:     setupRouter(repos, auth.NewAuthService(repos), recognizer, frames),
+		repos:      repos,
+		recognizer: recognizer,
+		frames:     frames,
+	}
+}
+
+// login registers a user with email and returns a login token of it along
+// with its id.
+func (s *testServer) login(email string) (string, bson.ObjectId) {
+	user := repository.User{Id: bson.NewObjectId(), Email: email, Roles: []string{"user"}}
+	if err := s.repos.Users.Insert(repository.AsSystem(context.Background()), &user); err != nil {
+		s.t.Fatalf("fail to insert user %s: %v", email, err)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iat":        time.Now().Unix(),
+		"exp":        time.Now().Add(time.Hour).Unix(),
+		"user_id":    user.Id.Hex(),
+		"user_email": user.Email,
+		"roles":      user.Roles,
+		"type":       "login_token",
+	}).SignedString([]byte(os.Getenv("TOKEN_SECRET")))
+	if err != nil {
+		s.t.Fatalf("fail to sign token of %s: %v", email, err)
+	}
+	return token, user.Id
+}
+
+// do sends body, as JSON unless it is nil, with token as bearer when given.
+func (s *testServer) do(token string, method string, path string, body interface{}) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			s.t.Fatalf("fail to marshal body of %s %s: %v", method, path, err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+// expect sends a request, fails the test unless it is answered with status
+// and decodes the answer into out when given.
+func (s *testServer) expect(status int, token string, method string, path string, body interface{}, out interface{}) {
+	w := s.do(token, method, path, body)
+	if w.Code != status {
+		s.t.Fatalf("%s %s: expected %d, got %d: %s", method, path, status, w.Code, w.Body.String())
+	}
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			s.t.Fatalf("%s %s: fail to decode answer: %v", method, path, err)
+		}
+	}
+}
+
+func TestRouterSmoke(t *testing.T) {
+	s := newTestServer(t)
+	s.expect(http.StatusUnauthorized, "", "GET", "/api/desks", nil, nil)
+
+	token, _ := s.login("alice@example.com")
+	var desk struct {
+		DeskId string `json:"deskId"`
+	}
+	s.expect(http.StatusCreated, token, "POST", "/api/desks", gin.H{"name": "Front desk"}, &desk)
+
+	var desks struct {
+		Items []interface{} `json:"items"`
+	}
+	s.expect(http.StatusOK, token, "GET", "/api/desks", nil, &desks)
+	if len(desks.Items) != 1 {
+		t.Fatalf("expected 1 desk, got %d", len(desks.Items))
+	}
+
+	var device struct {
+		Id string `json:"id"`
+	}
+	s.expect(http.StatusCreated, token, "POST", "/api/desk/"+desk.DeskId+"/devices", gin.H{"name": "Camera"}, &device)
+	s.expect(http.StatusOK, token, "GET", "/api/device/"+device.Id, nil, nil)
+	s.expect(http.StatusOK, token, "DELETE", "/api/device/"+device.Id, nil, nil)
+	s.expect(http.StatusNotFound, token, "GET", "/api/device/"+device.Id, nil, nil)
+	s.expect(http.StatusOK, token, "POST", "/api/device/"+device.Id+"/restore", nil, nil)
+	s.expect(http.StatusOK, token, "GET", "/api/device/"+device.Id, nil, nil)
+}
+
+func TestDeviceTypeChange(t *testing.T) {
+	s := newTestServer(t)
+	token, _ := s.login("alice@example.com")
+	var desk struct {
+		DeskId string `json:"deskId"`
+	}
+	s.expect(http.StatusCreated, token, "POST", "/api/desks", gin.H{"name": "Front desk"}, &desk)
+
+	var camera, serial struct {
+		Id string `json:"id"`
+	}
+	s.expect(http.StatusCreated, token, "POST", "/api/desk/"+desk.DeskId+"/devices", gin.H{"name": "Camera"}, &camera)
+	s.expect(http.StatusBadRequest, token, "PATCH", "/api/device/"+camera.Id, gin.H{"type": "TOASTER"}, nil)
+	// a generated id is no serial
+	s.expect(http.StatusConflict, token, "PATCH", "/api/device/"+camera.Id, gin.H{"type": "WATER_MONITOR"}, nil)
+
+	s.expect(http.StatusCreated, token, "POST", "/api/desk/"+desk.DeskId+"/devices", gin.H{"name": "Sensor", "deviceId": "SN-42"}, &serial)
+	device := "/api/device/" + serial.Id
+	s.expect(http.StatusOK, token, "PATCH", device+"/config", gin.H{"frameRate": 10}, nil)
+	s.expect(http.StatusConflict, token, "PATCH", device, gin.H{"type": "WATER_MONITOR"}, nil)
+	s.expect(http.StatusOK, token, "PATCH", device+"/config", gin.H{"frameRate": nil}, nil)
+	s.expect(http.StatusOK, token, "PATCH", device, gin.H{"type": "WATER_MONITOR"}, nil)
+	s.expect(http.StatusOK, token, "PATCH", device+"/config", gin.H{"calibration": gin.H{"offset": 1.5}}, nil)
+	s.expect(http.StatusConflict, token, "PUT", device, gin.H{"name": "Sensor", "type": "", "deskId": desk.DeskId}, nil)
+	s.expect(http.StatusOK, token, "PUT", device, gin.H{"name": "Water", "type": "WATER_MONITOR", "deskId": desk.DeskId}, nil)
+}
+
+func TestDuplicateKeysConflict(t *testing.T) {
+	s := newTestServer(t)
+	token, _ := s.login("alice@example.com")
+	s.expect(http.StatusCreated, token, "POST", "/api/desks", gin.H{"name": "Front desk", "deskId": "front"}, nil)
+	var conflict struct {
+		Error string `json:"error"`
+	}
+	s.expect(http.StatusConflict, token, "POST", "/api/desks", gin.H{"name": "Other desk", "deskId": "front"}, &conflict)
+	if conflict.Error == "" {
+		t.Fatal("expected the conflict to be explained")
+	}
+
+	s.expect(http.StatusCreated, token, "POST", "/api/desk/front/devices", gin.H{"name": "Sensor", "deviceId": "SN-1"}, nil)
+	s.expect(http.StatusConflict, token, "POST", "/api/desk/front/devices", gin.H{"name": "Sensor", "deviceId": "SN-1"}, nil)
+}
+
+func TestRuleUpdateKeepsDesk(t *testing.T) {
+	s := newTestServer(t)
+	token, _ := s.login("alice@example.com")
+	s.expect(http.StatusCreated, token, "POST", "/api/desks", gin.H{"name": "Front desk", "deskId": "front"}, nil)
+	var rules []struct {
+		Id              string `json:"id"`
+		DeskId          string `json:"deskId"`
+		Type            string `json:"type"`
+		IntervalMinutes int    `json:"intervalMinutes"`
+	}
+	s.expect(http.StatusOK, token, "GET", "/api/desk/front/rules", nil, &rules)
+	rule := rules[0]
+
+	s.expect(http.StatusBadRequest, token, "POST", "/api/rule/"+rule.Id, gin.H{"intervalMinutes": 0}, nil)
+	s.expect(http.StatusCreated, token, "POST", "/api/rule/"+rule.Id, gin.H{"intervalMinutes": 42, "deskId": "elsewhere", "type": "OTHER"}, nil)
+	s.expect(http.StatusOK, token, "GET", "/api/desk/front/rules", nil, &rules)
+	for _, r := range rules {
+		if r.Id == rule.Id && (r.IntervalMinutes != 42 || r.DeskId != "front" || r.Type != rule.Type) {
+			t.Fatalf("expected only the interval to change, got %+v", r)
+		}
+	}
+}
+
+func TestRetentionPolicyTypes(t *testing.T) {
+	s := newTestServer(t)
+	token, _ := s.login("alice@example.com")
+	s.expect(http.StatusBadRequest, token, "PUT", "/api/retention/TOASTER", gin.H{"retentionDays": 7}, nil)
+	s.expect(http.StatusOK, token, "PUT", "/api/retention/default", gin.H{"retentionDays": 30}, nil)
+	s.expect(http.StatusOK, token, "PUT", "/api/retention/CAMERA", gin.H{"retentionDays": 7}, nil)
+	var retention struct {
+		Policies []struct {
+			DeviceType    string `json:"deviceType"`
+			RetentionDays int    `json:"retentionDays"`
+		} `json:"policies"`
+	}
+	s.expect(http.StatusOK, token, "GET", "/api/retention", nil, &retention)
+	days := make(map[string]int)
+	for _, p := range retention.Policies {
+		days[p.DeviceType] = p.RetentionDays
+	}
+	if len(days) != 2 || days[repository.DefaultPolicyType] != 30 || days[""] != 7 {
+		t.Fatalf("expected a default and a camera policy, got %+v", retention.Policies)
+	}
+	s.expect(http.StatusOK, token, "DELETE", "/api/retention/CAMERA", nil, nil)
+	s.expect(http.StatusOK, token, "GET", "/api/retention", nil, &retention)
+	if len(retention.Policies) != 1 || retention.Policies[0].DeviceType != repository.DefaultPolicyType {
+		t.Fatalf("expected the default policy to be kept, got %+v", retention.Policies)
+	}
+}
+
+func TestReclaimDeletedDevice(t *testing.T) {
+	s := newTestServer(t)
+	token, _ := s.login("alice@example.com")
+	pair := func(serial string, code string) {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pairing := repository.DevicePairing{
+			Id:        bson.NewObjectId(),
+			Serial:    serial,
+			PublicKey: base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()),
+			Type:      model.DeviceTypeWaterMonitor,
+			ClaimCode: code,
+			Status:    repository.PairingPending,
+			ExpiresAt: time.Now().Add(time.Hour),
+		}
+		if err := s.repos.Pairings.Save(repository.AsSystem(context.Background()), &pairing); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var front, back struct {
+		DeskId string `json:"deskId"`
+	}
+	s.expect(http.StatusCreated, token, "POST", "/api/desks", gin.H{"name": "Front desk"}, &front)
+	s.expect(http.StatusCreated, token, "POST", "/api/desks", gin.H{"name": "Back desk"}, &back)
+	var device struct {
+		Id       string `json:"id"`
+		DeviceId string `json:"deviceId"`
+	}
+	claim := func(deskId string, code string, status int) {
+		s.expect(status, token, "POST", "/api/desk/"+deskId+"/devices/claim", gin.H{"claimCode": code}, &device)
+	}
+
+	pair("SN-1", "ABCDEF")
+	claim(front.DeskId, "ABCDEF", http.StatusCreated)
+	deleted := device.Id
+	s.expect(http.StatusOK, token, "DELETE", "/api/device/"+deleted, nil, nil)
+	pair("SN-1", "BCDEFG")
+	claim(front.DeskId, "BCDEFG", http.StatusCreated)
+	if device.DeviceId != "SN-1" || device.Id == deleted {
+		t.Fatalf("expected a new device known as SN-1, got %+v", device)
+	}
+	s.expect(http.StatusNotFound, token, "POST", "/api/device/"+deleted+"/restore", nil, nil)
+
+	// a deleted desk releases its devices too
+	s.expect(http.StatusOK, token, "DELETE", "/api/desk/"+front.DeskId, nil, nil)
+	pair("SN-1", "CDEFGH")
+	claim(back.DeskId, "CDEFGH", http.StatusCreated)
+
+	// a live device keeps its serial
+	_, bob := s.login("bob@example.com")
+	taken := model.Device{Id: bson.NewObjectId(), DeviceId: "SN-2", Type: model.DeviceTypeWaterMonitor}
+	if err := s.repos.Devices.Insert(repository.WithOwner(context.Background(), bob), &taken); err != nil {
+		t.Fatal(err)
+	}
+	pair("SN-2", "DEFGHJ")
+	s.expect(http.StatusConflict, token, "POST", "/api/desk/"+back.DeskId+"/devices/claim", gin.H{"claimCode": "DEFGHJ"}, nil)
+}
+
+func TestCaptureOnCamerasOnly(t *testing.T) {
+	s := newTestServer(t)
+	token, userId := s.login("alice@example.com")
+	monitor := model.Device{Id: bson.NewObjectId(), DeviceId: "SN-1", Type: model.DeviceTypeWaterMonitor}
+	if err := s.repos.Devices.Insert(repository.WithOwner(context.Background(), userId), &monitor); err != nil {
+		t.Fatal(err)
+	}
+	s.expect(http.StatusConflict, token, "POST", "/api/device/"+monitor.Id.Hex()+"/enroll", gin.H{"label": "alice"}, nil)
+	s.expect(http.StatusConflict, token, "POST", "/api/recognitions", gin.H{"deviceId": monitor.Id.Hex()}, nil)
+}
@@ -0,0 +1,76 @@
+package migration
+
+import (
+	"fmt"
+	"github.com/globalsign/mgo"
+	"log"
+	"sort"
+	"time"
+)
+
+const collectionName = "schema_migration"
+
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(db *mgo.Database) error
+}
+
+type AppliedMigration struct {
+	Version     int       `json:"version" bson:"_id"`
+	Description string    `json:"description" bson:"description"`
+	AppliedAt   time.Time `json:"appliedAt" bson:"appliedAt"`
+}
+
+// Run applies every migration whose version is not yet recorded in the
+// schema_migration collection, in version order. It stops at the first
+// failing migration so later ones never run against a half-migrated schema.
+func Run(db *mgo.Database) error {
+	applied := make([]AppliedMigration, 0)
+	if err := db.C(collectionName).Find(nil).All(&applied); err != nil {
+		return err
+	}
+	done := make(map[int]bool)
+	for _, a := range applied {
+		done[a.Version] = true
+	}
+
+	pending := make([]Migration, 0)
+	for _, m := range migrations {
+		if !done[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Version < pending[j].Version
+	})
+
+	if len(pending) == 0 {
+		log.Println("[MIGRATION]", "Schema is up to date")
+		return nil
+	}
+
+	for _, m := range pending {
+		log.Println("[MIGRATION]", "Applying version", m.Version, "-", m.Description)
+		if err := m.Up(db); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+		if err := db.C(collectionName).Insert(AppliedMigration{
+			Version:     m.Version,
+			Description: m.Description,
+			AppliedAt:   time.Now(),
+		}); err != nil && !mgo.IsDup(err) {
+			// a duplicate means another instance applied it concurrently;
+			// every migration is idempotent so that is harmless
+			return err
+		}
+	}
+	log.Println("[MIGRATION]", "Applied", len(pending), "migration(s)")
+	return nil
+}
+
+func Applied(db *mgo.Database) ([]AppliedMigration, error) {
+	applied := make([]AppliedMigration, 0)
+	err := db.C(collectionName).Find(nil).Sort("_id").All(&applied)
+	return applied, err
+}
@@ -0,0 +1,294 @@
+package migration
+
+import (
+	"face-service/descriptor"
+	"face-service/repository"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"log"
+	"strings"
+	"time"
+)
+
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "backfill md5 on faces stored without one",
+		Up:          backfillFaceMD5,
+	},
+	{
+		Version:     2,
+		Description: "remove duplicate faces with the same user and md5",
+		Up:          removeDuplicateFaces,
+	},
+	{
+		Version:     3,
+		Description: "create unique and lookup indexes",
+		Up:          createIndexes,
+	},
+	{
+		Version:     4,
+		Description: "index deletedAt for the trash purger",
+		Up:          createTrashIndexes,
+	},
+	{
+		Version:     5,
+		Description: "index retention policies and event archives",
+		Up:          createRetentionIndexes,
+	},
+	{
+		Version:     6,
+		Description: "key unique faces on user, label and md5",
+		Up:          rekeyFaceIndex,
+	},
+	{
+		Version:     7,
+		Description: "index unlabeled faces and expire them after 30 days",
+		Up:          createUnlabeledFaceIndexes,
+	},
+	{
+		Version:     8,
+		Description: "tag descriptors with the model that computed them",
+		Up:          tagDescriptorModel,
+	},
+	{
+		Version:     9,
+		Description: "create unique index for label thresholds",
+		Up:          createLabelThresholdIndexes,
+	},
+	{
+		Version:     10,
+		Description: "index device pairings and expire them",
+		Up:          createDevicePairingIndexes,
+	},
+	{
+		Version:     11,
+		Description: "index devices for presence tracking",
+		Up:          createDevicePresenceIndexes,
+	},
+	{
+		Version:     12,
+		Description: "index device commands by device and by expiry",
+		Up:          createDeviceCommandIndexes,
+	},
+	{
+		Version:     13,
+		Description: "key default retention policies apart from cameras",
+		Up:          rekeyDefaultRetention,
+	},
+}
+
+func backfillFaceMD5(db *mgo.Database) error {
+	iter := db.C("face").Find(bson.M{"$or": []bson.M{
+		{"md5": bson.M{"$exists": false}},
+		{"md5": ""},
+	}}).Iter()
+	var face model.Face
+	updated := 0
+	for iter.Next(&face) {
+		sum, err := descriptor.MD5(face.Descriptor)
+		if err != nil {
+			log.Println("[MIGRATION]", "Skipping face", face.Id.Hex(), "with unreadable descriptor:", err.Error())
+			continue
+		}
+		if err := db.C("face").UpdateId(face.Id, bson.M{"$set": bson.M{"md5": sum}}); err != nil {
+			iter.Close()
+			return err
+		}
+		updated++
+	}
+	log.Println("[MIGRATION]", "Backfilled md5 for", updated, "face(s)")
+	return iter.Close()
+}
+
+func removeDuplicateFaces(db *mgo.Database) error {
+	var groups []struct {
+		Ids []bson.ObjectId `bson:"ids"`
+	}
+	if err := db.C("face").Pipe([]bson.M{
+		{"$sort": bson.M{"_id": 1}},
+		{"$group": bson.M{
+			"_id":   bson.M{"userId": "$userId", "md5": "$md5"},
+			"ids":   bson.M{"$push": "$_id"},
+			"count": bson.M{"$sum": 1},
+		}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	}).AllowDiskUse().All(&groups); err != nil {
+		return err
+	}
+	removed := 0
+	for _, g := range groups {
+		// keep the oldest face of every group
+		info, err := db.C("face").RemoveAll(bson.M{"_id": bson.M{"$in": g.Ids[1:]}})
+		if err != nil {
+			return err
+		}
+		removed += info.Removed
+	}
+	log.Println("[MIGRATION]", "Removed", removed, "duplicate face(s)")
+	return nil
+}
+
+func createIndexes(db *mgo.Database) error {
+	return ensureIndexes(db, map[string][]mgo.Index{
+		"desk": {
+			{Key: []string{"deskId"}, Unique: true},
+			{Key: []string{"owner"}},
+		},
+		"device": {
+			{Key: []string{"deviceId"}, Unique: true},
+			{Key: []string{"deskId", "owner"}},
+		},
+		"face": {
+			{Key: []string{"userId", "md5"}, Unique: true},
+			{Key: []string{"label"}},
+		},
+		"user": {
+			{Key: []string{"email"}, Unique: true},
+		},
+		"event": {
+			// devices can emit several events within the same timestamp, so
+			// this one only backs the "latest events" query
+			{Key: []string{"deviceId", "-timestamp"}, Background: true},
+		},
+		"rule": {
+			{Key: []string{"deskId"}},
+		},
+		"slack_config": {
+			{Key: []string{"userId"}, Unique: true},
+		},
+		"service_token": {
+			{Key: []string{"tokenId"}, Unique: true},
+		},
+	})
+}
+
+func createTrashIndexes(db *mgo.Database) error {
+	index := mgo.Index{Key: []string{"deletedAt"}, Sparse: true, Background: true}
+	return ensureIndexes(db, map[string][]mgo.Index{
+		"desk":   {index},
+		"device": {index},
+		"rule":   {index},
+		"face":   {index},
+		"event":  {index},
+	})
+}
+
+func createRetentionIndexes(db *mgo.Database) error {
+	return ensureIndexes(db, map[string][]mgo.Index{
+		"retention_policy": {
+			{Key: []string{"userId", "deviceType"}, Unique: true},
+		},
+		"event_archive": {
+			{Key: []string{"userId", "-createdAt"}},
+		},
+	})
+}
+
+// rekeyFaceIndex lets the same descriptor be stored under several labels of a
+// user; uploads are deduplicated per label since then. Versions 2 and 3 ran
+// with the former key and stay as they shipped.
+func rekeyFaceIndex(db *mgo.Database) error {
+	if err := db.C("face").DropIndex("userId", "md5"); err != nil && !strings.Contains(err.Error(), "index not found") {
+		log.Println("[MIGRATION]", "Fail to drop face index [userId md5] by error", err.Error())
+		return err
+	}
+	return ensureIndexes(db, map[string][]mgo.Index{
+		"face": {
+			{Key: []string{"userId", "label", "md5"}, Unique: true},
+		},
+	})
+}
+
+func createUnlabeledFaceIndexes(db *mgo.Database) error {
+	return ensureIndexes(db, map[string][]mgo.Index{
+		"unlabeled_face": {
+			{Key: []string{"userId", "-createdAt"}},
+			{Key: []string{"createdAt"}, ExpireAfter: 30 * 24 * time.Hour},
+		},
+	})
+}
+
+// tagDescriptorModel records that every descriptor stored so far came from
+// the model the service used before descriptors were tagged.
+func tagDescriptorModel(db *mgo.Database) error {
+	for _, collection := range []string{"face", "unlabeled_face", "recognition"} {
+		info, err := db.C(collection).UpdateAll(
+			bson.M{"model": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"model": repository.LegacyDescriptorModel}},
+		)
+		if err != nil {
+			log.Println("[MIGRATION]", "Fail to tag", collection, "by error", err.Error())
+			return err
+		}
+		log.Println("[MIGRATION]", "Tagged", info.Updated, "document(s) of", collection, "with model", repository.LegacyDescriptorModel)
+	}
+	return ensureIndexes(db, map[string][]mgo.Index{
+		"face": {
+			{Key: []string{"userId", "model"}},
+		},
+	})
+}
+
+func createLabelThresholdIndexes(db *mgo.Database) error {
+	return ensureIndexes(db, map[string][]mgo.Index{
+		"label_threshold": {
+			{Key: []string{"userId", "model", "label", "metric"}, Unique: true},
+		},
+	})
+}
+
+func createDevicePairingIndexes(db *mgo.Database) error {
+	return ensureIndexes(db, map[string][]mgo.Index{
+		"device_pairing": {
+			{Key: []string{"serial"}, Unique: true},
+			{Key: []string{"claimCode"}, Unique: true},
+			// expiresAt is the expiry itself
+			{Key: []string{"expiresAt"}, ExpireAfter: time.Second},
+		},
+	})
+}
+
+func createDevicePresenceIndexes(db *mgo.Database) error {
+	return ensureIndexes(db, map[string][]mgo.Index{
+		"device": {
+			{Key: []string{"online", "lastSeen"}, Background: true},
+		},
+	})
+}
+
+func createDeviceCommandIndexes(db *mgo.Database) error {
+	return ensureIndexes(db, map[string][]mgo.Index{
+		"device_command": {
+			{Key: []string{"userId", "deviceId", "-_id"}, Background: true},
+			{Key: []string{"status", "expiresAt"}, Background: true},
+		},
+	})
+}
+
+// rekeyDefaultRetention moves the default retention policies off the empty
+// device type, which is the type of cameras.
+func rekeyDefaultRetention(db *mgo.Database) error {
+	info, err := db.C("retention_policy").UpdateAll(
+		bson.M{"deviceType": ""},
+		bson.M{"$set": bson.M{"deviceType": repository.DefaultPolicyType}},
+	)
+	if err != nil {
+		return err
+	}
+	log.Println("[MIGRATION]", "Rekeyed", info.Updated, "default retention policy(ies)")
+	return nil
+}
+
+func ensureIndexes(db *mgo.Database, indexes map[string][]mgo.Index) error {
+	for collection, list := range indexes {
+		for _, index := range list {
+			if err := db.C(collection).EnsureIndex(index); err != nil {
+				log.Println("[MIGRATION]", "Fail to create index", index.Key, "on", collection, "by error", err.Error())
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeviceTokenLifecycle(t *testing.T) {
+	s := newTestServer(t)
+	token, userId := s.login("alice@example.com")
+	var desk struct {
+		DeskId string `json:"deskId"`
+	}
+	s.expect(http.StatusCreated, token, "POST", "/api/desks", gin.H{"name": "Front desk"}, &desk)
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	system := repository.AsSystem(context.Background())
+	if err := s.repos.Pairings.Save(system, &repository.DevicePairing{
+		Id:        bson.NewObjectId(),
+		Serial:    "SN-1",
+		Nonce:     "nonce",
+		PublicKey: base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()),
+		ClaimCode: "ABCDEF",
+		Status:    repository.PairingPending,
+		ExpiresAt: time.Now().Add(time.Minute),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var device struct {
+		Id string `json:"id"`
+	}
+	s.expect(http.StatusCreated, token, "POST", "/api/desk/"+desk.DeskId+"/devices/claim", gin.H{"claimCode": "ABCDEF"}, &device)
+
+	pairing, err := s.repos.Pairings.FindBySerial(system, "SN-1")
+	if err != nil || pairing.Token == "" {
+		t.Fatalf("expected the claimed pairing to keep the device token, got %+v, %v", pairing, err)
+	}
+	// the device token does not act as its owner
+	s.expect(http.StatusForbidden, pairing.Token, "GET", "/api/desks", nil, nil)
+
+	s.expect(http.StatusOK, token, "DELETE", "/api/device/"+device.Id, nil, nil)
+	if _, err := s.repos.Pairings.FindBySerial(system, "SN-1"); err != repository.ErrNotFound {
+		t.Fatalf("expected the pairing of a deleted device to be removed, got %v", err)
+	}
+	if n, err := s.repos.ServiceTokens.RemoveByDevice(repository.WithOwner(context.Background(), userId), bson.ObjectIdHex(device.Id)); err != nil || n != 0 {
+		t.Fatalf("expected the token of a deleted device to be revoked, got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,89 @@
+package recognition
+
+import (
+	"context"
+	"image"
+	"image/draw"
+	"sync"
+)
+
+// FakeFrameSource captures without any camera. Every frame it ever captures is
+// a distinct JPEG, so the fake recognizer derives distinct faces from each.
+// While paused, captures wait until it resumes or their ctx is done.
+type FakeFrameSource struct {
+	lock     sync.Mutex
+	captured int
+	paused   chan struct{}
+}
+
+func NewFakeFrameSource() *FakeFrameSource {
+	return &FakeFrameSource{}
+}
+
+// Pause holds the captures from now on until Resume is called.
+func (f *FakeFrameSource) Pause() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.paused == nil {
+		f.paused = make(chan struct{})
+	}
+}
+
+// Resume lets the held captures go on.
+func (f *FakeFrameSource) Resume() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.paused != nil {
+		close(f.paused)
+		f.paused = nil
+	}
+}
+
+// Captured returns the number of frames captured so far.
+func (f *FakeFrameSource) Captured() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.captured
+}
+
+func (f *FakeFrameSource) Capture(ctx context.Context, deviceId string, frameDelay int, total int) ([][]byte, error) {
+	f.lock.Lock()
+	paused := f.paused
+	f.lock.Unlock()
+	if paused != nil {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-paused:
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	first := f.captured
+	f.captured += total
+	f.lock.Unlock()
+	frames := make([][]byte, total)
+	for i := range frames {
+		frame, err := fakeFrame(first + i)
+		if err != nil {
+			return nil, err
+		}
+		frames[i] = frame
+	}
+	return frames, nil
+}
+
+// fakeFrame returns the n-th frame, a small JPEG whose 8x8 blocks are white
+// for the bits of n that are set, which survives compression.
+func fakeFrame(n int) ([]byte, error) {
+	img := image.NewGray(image.Rect(0, 0, 64, 48))
+	for bit := 0; bit < 48; bit++ {
+		if n&(1<<uint(bit)) != 0 {
+			x, y := bit%8*8, bit/8*8
+			draw.Draw(img, image.Rect(x, y, x+8, y+8), image.White, image.Point{}, draw.Src)
+		}
+	}
+	return encodeJPEG(img)
+}
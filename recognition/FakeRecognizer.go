@@ -0,0 +1,93 @@
+package recognition
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/ndphu/swd-commons/model"
+	"image"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// FakeRecognizer answers without any inference. Images given faces with Set
+// get exactly those; any other image gets FacesPerImage faces derived from the
+// image bytes, so the same image always yields the same boxes and descriptors.
+type FakeRecognizer struct {
+	FacesPerImage int
+
+	lock  sync.Mutex
+	faces map[string][]model.FaceDetails
+}
+
+func NewFakeRecognizer() *FakeRecognizer {
+	return &FakeRecognizer{
+		FacesPerImage: 1,
+		faces:         make(map[string][]model.FaceDetails),
+	}
+}
+
+// Set makes the recognizer return faces for image.
+func (f *FakeRecognizer) Set(image []byte, faces []model.FaceDetails) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.faces[imageKey(image)] = faces
+}
+
+func (f *FakeRecognizer) Recognize(ctx context.Context, req model.RecognizeRequest) (*model.RecognizeResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	response := &model.RecognizeResponse{FaceDetailsList: make([][]model.FaceDetails, len(req.Images))}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i, img := range req.Images {
+		if faces, exists := f.faces[imageKey(img)]; exists {
+			response.FaceDetailsList[i] = faces
+		} else {
+			response.FaceDetailsList[i] = derivedFaces(img, f.FacesPerImage)
+		}
+	}
+	return response, nil
+}
+
+// derivedFaces lays count faces side by side on the image and gives each a
+// unit descriptor seeded by the image hash and the face position.
+func derivedFaces(img []byte, count int) []model.FaceDetails {
+	width, height := 640, 480
+	if config, _, err := image.DecodeConfig(bytes.NewReader(img)); err == nil {
+		width, height = config.Width, config.Height
+	}
+	sum := sha256.Sum256(img)
+	seed := int64(binary.LittleEndian.Uint64(sum[:8]))
+	faces := make([]model.FaceDetails, count)
+	for n := range faces {
+		size := width / (count + 1)
+		if size > height/2 {
+			size = height / 2
+		}
+		x := (n+1)*width/(count+1) - size/2
+		y := (height - size) / 2
+		faces[n].Rect = image.Rect(x, y, x+size, y+size)
+
+		r := rand.New(rand.NewSource(seed + int64(n)))
+		norm := 0.0
+		for i := range faces[n].Descriptor {
+			faces[n].Descriptor[i] = float32(r.NormFloat64())
+			norm += float64(faces[n].Descriptor[i]) * float64(faces[n].Descriptor[i])
+		}
+		norm = math.Sqrt(norm)
+		for i := range faces[n].Descriptor {
+			faces[n].Descriptor[i] = float32(float64(faces[n].Descriptor[i]) / norm)
+		}
+	}
+	return faces
+}
+
+func imageKey(img []byte) string {
+	sum := sha256.Sum256(img)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,93 @@
+package recognition
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+)
+
+const (
+	ThumbnailWidth = 160
+	jpegQuality    = 85
+)
+
+// ToJPEG returns frame as JPEG, re-encoding it when the camera sent another
+// format.
+func ToJPEG(frame []byte) ([]byte, error) {
+	if bytes.HasPrefix(frame, []byte{0xFF, 0xD8}) {
+		return frame, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	return encodeJPEG(img)
+}
+
+// Thumbnail scales a JPEG frame down to width, keeping its aspect ratio.
+// Frames already narrower are returned as they are.
+func Thumbnail(frame []byte, width int) ([]byte, error) {
+	img, err := jpeg.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() <= width {
+		return frame, nil
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	// box filter: every thumbnail pixel averages the source pixels it covers
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			var r, g, b, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, _ := img.At(sx, sy).RGBA()
+					r, g, b, n = r+pr, g+pg, b+pb, n+1
+				}
+			}
+			i := thumb.PixOffset(x, y)
+			thumb.Pix[i] = uint8(r / n >> 8)
+			thumb.Pix[i+1] = uint8(g / n >> 8)
+			thumb.Pix[i+2] = uint8(b / n >> 8)
+			thumb.Pix[i+3] = 0xFF
+		}
+	}
+	return encodeJPEG(thumb)
+}
+
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Crop cuts the face at rect out of a frame as JPEG, with a margin of a
+// quarter of the face size on every side so it can be detected again.
+func Crop(frame []byte, rect image.Rectangle) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	margin := image.Pt(rect.Dx()/4, rect.Dy()/4)
+	rect = image.Rectangle{Min: rect.Min.Sub(margin), Max: rect.Max.Add(margin)}.Intersect(img.Bounds())
+	if rect.Empty() {
+		return nil, errors.New("face is outside of the frame")
+	}
+	crop := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(crop, crop.Bounds(), img, rect.Min, draw.Src)
+	return encodeJPEG(crop)
+}
@@ -0,0 +1,42 @@
+package recognition
+
+import (
+	"context"
+	"github.com/ndphu/swd-commons/service"
+)
+
+// FrameSource captures frames from the camera of a device.
+type FrameSource interface {
+	// Capture takes total frames from the camera of deviceId, frameDelay
+	// milliseconds apart, and gives up as soon as ctx is done.
+	Capture(ctx context.Context, deviceId string, frameDelay int, total int) ([][]byte, error)
+}
+
+// NewFrameSource returns a frame source that asks cameras over MQTT.
+func NewFrameSource(broker string) FrameSource {
+	return &mqttFrameSource{broker: broker}
+}
+
+// mqttFrameSource asks the camera of a device for frames over MQTT.
+type mqttFrameSource struct {
+	broker string
+}
+
+func (s *mqttFrameSource) Capture(ctx context.Context, deviceId string, frameDelay int, total int) ([][]byte, error) {
+	type result struct {
+		frames [][]byte
+		err    error
+	}
+	// the MQTT capture cannot be interrupted; a done ctx only stops waiting
+	done := make(chan result, 1)
+	go func() {
+		frames, err := service.CaptureFrameContinuously(service.NewClientOpts(s.broker), deviceId, frameDelay, total)
+		done <- result{frames, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-done:
+		return res.frames, res.err
+	}
+}
@@ -0,0 +1,21 @@
+package recognition
+
+import "face-service/repository"
+
+const (
+	StatusRunning   = repository.RecognitionRunning
+	StatusCompleted = repository.RecognitionCompleted
+	StatusFailed    = repository.RecognitionFailed
+	StatusCanceled  = repository.RecognitionCanceled
+
+	StageCapturing   = "capturing"
+	StageRecognizing = "recognizing"
+	StageStoring     = "storing"
+)
+
+// Job is a recognition while it runs; it is saved as is once it changes.
+type Job = repository.Recognition
+
+func done(j *Job) bool {
+	return j.Status != StatusRunning
+}
@@ -0,0 +1,230 @@
+package recognition
+
+import (
+	"context"
+	"errors"
+	"face-service/repository"
+	"github.com/globalsign/mgo/bson"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("recognition job not found")
+	ErrDeviceBusy = errors.New("too many recognition jobs on device")
+	ErrDone       = errors.New("recognition job already finished")
+)
+
+// RunFunc performs a job. It reports the stage it enters through stage and
+// should give up as soon as ctx is done.
+type RunFunc func(ctx context.Context, job Job, stage func(string)) ([]repository.RecognitionFrame, error)
+
+// Manager runs recognition jobs in the background and keeps them, finished
+// ones included, for the retention period so their results can be fetched.
+type Manager struct {
+	perDevice int
+	retention time.Duration
+	notify    func(Job)
+	discard   func(Job, []repository.RecognitionFrame)
+
+	lock sync.Mutex
+	jobs map[bson.ObjectId]*Job
+	// cancels holds the jobs whose run has not returned yet
+	cancels map[bson.ObjectId]context.CancelFunc
+	// pending holds the changes of a job not notified yet, in order; a job is
+	// there while its changes are being notified
+	pending map[bson.ObjectId][]Job
+	// reserved counts the slots of a device held by other work than jobs
+	reserved map[bson.ObjectId]int
+}
+
+// NewManager allows perDevice running jobs on a device at a time; a canceled
+// job counts until its run returns. notify is
+// called with a copy of a job whenever it changes, in order for each job but
+// not under any lock. discard is called with the frames a run returned for a
+// job that was canceled meanwhile, which are not kept.
+func NewManager(perDevice int, retention time.Duration, notify func(Job), discard func(Job, []repository.RecognitionFrame)) *Manager {
+	return &Manager{
+		perDevice: perDevice,
+		retention: retention,
+		notify:    notify,
+		discard:   discard,
+		jobs:      make(map[bson.ObjectId]*Job),
+		cancels:   make(map[bson.ObjectId]context.CancelFunc),
+		pending:   make(map[bson.ObjectId][]Job),
+		reserved:  make(map[bson.ObjectId]int),
+	}
+}
+
+// Start registers job and runs it with run. ctx scopes the job; it is
+// detached from the request that started it.
+func (m *Manager) Start(ctx context.Context, job Job, run RunFunc) (Job, error) {
+	m.lock.Lock()
+	m.prune()
+	if m.busy(job.DeviceId) {
+		m.lock.Unlock()
+		return job, ErrDeviceBusy
+	}
+	now := time.Now()
+	job.Id = bson.NewObjectId()
+	job.Status = StatusRunning
+	job.Stage = StageCapturing
+	job.CreatedAt, job.UpdatedAt = now, now
+	ctx, cancel := context.WithCancel(ctx)
+	m.jobs[job.Id] = &job
+	m.cancels[job.Id] = cancel
+	snapshot := job
+	m.enqueue(snapshot)
+	m.lock.Unlock()
+
+	log.Println("[RECOGNITION]", "Starting job", job.Id.Hex(), "on device", job.DeviceId.Hex())
+	go func() {
+		defer cancel()
+		frames, err := run(ctx, snapshot, func(stage string) {
+			m.update(snapshot.Id, func(j *Job) {
+				if !done(j) {
+					j.Stage = stage
+				}
+			})
+		})
+		kept := false
+		m.update(snapshot.Id, func(j *Job) {
+			switch {
+			case j.Status != StatusRunning:
+			case ctx.Err() == context.Canceled:
+				j.Status = StatusCanceled
+			case err != nil:
+				j.Status, j.Error = StatusFailed, err.Error()
+			default:
+				j.Status, j.Frames = StatusCompleted, frames
+				kept = true
+			}
+			j.Stage = ""
+		})
+		if !kept && len(frames) > 0 && m.discard != nil {
+			m.discard(snapshot, frames)
+		}
+		m.lock.Lock()
+		delete(m.cancels, snapshot.Id)
+		m.lock.Unlock()
+	}()
+	return snapshot, nil
+}
+
+// Reserve holds a slot of a device for other work than a job, such as an
+// enrollment, until release is called. It fails with ErrDeviceBusy like Start.
+func (m *Manager) Reserve(deviceId bson.ObjectId) (release func(), err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.busy(deviceId) {
+		return nil, ErrDeviceBusy
+	}
+	m.reserved[deviceId]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			if m.reserved[deviceId]--; m.reserved[deviceId] == 0 {
+				delete(m.reserved, deviceId)
+			}
+		})
+	}, nil
+}
+
+// busy tells whether the running jobs and reservations of a device use up its
+// slots. It expects the lock to be held.
+func (m *Manager) busy(deviceId bson.ObjectId) bool {
+	running := m.reserved[deviceId]
+	for id := range m.cancels {
+		if m.jobs[id].DeviceId == deviceId {
+			running++
+		}
+	}
+	return running >= m.perDevice
+}
+
+// Get returns the job id of owner.
+func (m *Manager) Get(owner bson.ObjectId, id bson.ObjectId) (Job, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	job, exists := m.jobs[id]
+	if !exists || job.UserId != owner {
+		return Job{}, ErrNotFound
+	}
+	return *job, nil
+}
+
+// Cancel stops the running job id of owner. The job is reported as canceled
+// right away; its run is expected to notice ctx and stop on its own.
+func (m *Manager) Cancel(owner bson.ObjectId, id bson.ObjectId) (Job, error) {
+	m.lock.Lock()
+	job, exists := m.jobs[id]
+	if !exists || job.UserId != owner {
+		m.lock.Unlock()
+		return Job{}, ErrNotFound
+	}
+	if done(job) {
+		m.lock.Unlock()
+		return *job, ErrDone
+	}
+	m.cancels[id]()
+	m.lock.Unlock()
+	return m.update(id, func(j *Job) {
+		j.Status, j.Stage = StatusCanceled, ""
+	}), nil
+}
+
+func (m *Manager) update(id bson.ObjectId, change func(*Job)) Job {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	job, exists := m.jobs[id]
+	if !exists {
+		return Job{}
+	}
+	change(job)
+	job.UpdatedAt = time.Now()
+	snapshot := *job
+	m.enqueue(snapshot)
+	return snapshot
+}
+
+// enqueue queues the notification of a change of a job, and starts notifying
+// the changes of the job unless that is under way. It expects the lock to be
+// held.
+func (m *Manager) enqueue(snapshot Job) {
+	if m.notify == nil {
+		return
+	}
+	queue, notifying := m.pending[snapshot.Id]
+	m.pending[snapshot.Id] = append(queue, snapshot)
+	if !notifying {
+		go m.notifyPending(snapshot.Id)
+	}
+}
+
+func (m *Manager) notifyPending(id bson.ObjectId) {
+	for {
+		m.lock.Lock()
+		queue := m.pending[id]
+		if len(queue) == 0 {
+			delete(m.pending, id)
+			m.lock.Unlock()
+			return
+		}
+		m.pending[id] = queue[1:]
+		m.lock.Unlock()
+		m.notify(queue[0])
+	}
+}
+
+// prune forgets the jobs that finished longer ago than the retention period
+// and whose run has returned. It expects the lock to be held.
+func (m *Manager) prune() {
+	for id, job := range m.jobs {
+		if _, running := m.cancels[id]; !running && done(job) && time.Since(job.UpdatedAt) > m.retention {
+			delete(m.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package recognition
+
+import (
+	"context"
+	"face-service/repository"
+	"github.com/globalsign/mgo/bson"
+	"testing"
+	"time"
+)
+
+func TestCanceledJobHoldsDevice(t *testing.T) {
+	m := NewManager(1, time.Minute, nil, nil)
+	owner, device := bson.NewObjectId(), bson.NewObjectId()
+	release := make(chan struct{})
+	returned := make(chan struct{})
+	// the run ignores ctx until it is released
+	stuck := func(ctx context.Context, job Job, stage func(string)) ([]repository.RecognitionFrame, error) {
+		<-release
+		return nil, ctx.Err()
+	}
+	job, err := m.Start(context.Background(), Job{UserId: owner, DeviceId: device}, func(ctx context.Context, job Job, stage func(string)) ([]repository.RecognitionFrame, error) {
+		defer close(returned)
+		return stuck(ctx, job, stage)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canceled, err := m.Cancel(owner, job.Id); err != nil || canceled.Status != StatusCanceled {
+		t.Fatalf("expected the job to be canceled, got %v, %v", canceled.Status, err)
+	}
+	if _, err := m.Start(context.Background(), Job{UserId: owner, DeviceId: device}, stuck); err != ErrDeviceBusy {
+		t.Fatalf("expected ErrDeviceBusy while the canceled run goes on, got %v", err)
+	}
+
+	close(release)
+	<-returned
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := m.Start(context.Background(), Job{UserId: owner, DeviceId: device}, stuck)
+		if err == nil {
+			break
+		}
+		if err != ErrDeviceBusy || time.Now().After(deadline) {
+			t.Fatalf("expected the device to be free once the run returned, got %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNotificationsInOrder(t *testing.T) {
+	blocked := bson.NewObjectId()
+	release := make(chan struct{})
+	changes := make(chan Job, 16)
+	m := NewManager(1, time.Minute, func(job Job) {
+		if job.DeviceId == blocked {
+			<-release
+		}
+		changes <- job
+	}, nil)
+	owner := bson.NewObjectId()
+	// a job whose notifications hang does not hold up other jobs
+	if _, err := m.Start(context.Background(), Job{UserId: owner, DeviceId: blocked}, func(ctx context.Context, job Job, stage func(string)) ([]repository.RecognitionFrame, error) {
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	job, err := m.Start(context.Background(), Job{UserId: owner, DeviceId: bson.NewObjectId()}, func(ctx context.Context, job Job, stage func(string)) ([]repository.RecognitionFrame, error) {
+		stage(StageRecognizing)
+		stage(StageStoring)
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{StageCapturing, StageRecognizing, StageStoring, StatusCompleted}
+	for i, w := range want {
+		select {
+		case got := <-changes:
+			if got.Id != job.Id {
+				t.Fatalf("change %d: expected job %s, got %s", i, job.Id.Hex(), got.Id.Hex())
+			}
+			if got.Stage != w && got.Status != w {
+				t.Fatalf("change %d: expected %s, got %s/%s", i, w, got.Status, got.Stage)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("change %d: no notification", i)
+		}
+	}
+	close(release)
+}
+
+func TestReservationHoldsDevice(t *testing.T) {
+	m := NewManager(1, time.Minute, nil, nil)
+	owner, device := bson.NewObjectId(), bson.NewObjectId()
+	idle := func(ctx context.Context, job Job, stage func(string)) ([]repository.RecognitionFrame, error) {
+		return nil, nil
+	}
+	release, err := m.Reserve(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Start(context.Background(), Job{UserId: owner, DeviceId: device}, idle); err != ErrDeviceBusy {
+		t.Fatalf("expected ErrDeviceBusy while the device is reserved, got %v", err)
+	}
+	if _, err := m.Reserve(device); err != ErrDeviceBusy {
+		t.Fatalf("expected a second reservation to fail, got %v", err)
+	}
+	if _, err := m.Reserve(bson.NewObjectId()); err != nil {
+		t.Fatalf("expected another device to be free, got %v", err)
+	}
+
+	release()
+	release()
+	if again, err := m.Reserve(device); err != nil {
+		t.Fatalf("expected the device to be free once released, got %v", err)
+	} else {
+		again()
+	}
+	if _, err := m.Start(context.Background(), Job{UserId: owner, DeviceId: device}, idle); err != nil {
+		t.Fatalf("expected a job to start once released, got %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package recognition
+
+import (
+	"context"
+	"errors"
+	"github.com/ndphu/swd-commons/model"
+	"github.com/ndphu/swd-commons/service"
+	"log"
+)
+
+const (
+	BackendMQTT = "mqtt"
+	BackendFake = "fake"
+)
+
+// Recognizer finds faces and their descriptors on images.
+// FaceDetailsList of the response has one entry per requested image.
+type Recognizer interface {
+	Recognize(ctx context.Context, req model.RecognizeRequest) (*model.RecognizeResponse, error)
+}
+
+// NewRecognizer returns the recognizer of a configured backend. An unknown
+// backend falls back to MQTT.
+func NewRecognizer(backend string, broker string) Recognizer {
+	switch backend {
+	case BackendFake:
+		log.Println("[RECOGNITION]", "Using the fake recognizer")
+		return NewFakeRecognizer()
+	case BackendMQTT, "":
+	default:
+		log.Println("[RECOGNITION]", "Unknown recognizer backend", backend, "using", BackendMQTT)
+	}
+	return &mqttRecognizer{broker: broker}
+}
+
+// mqttRecognizer sends images to the recognizer service over MQTT.
+type mqttRecognizer struct {
+	broker string
+}
+
+func (r *mqttRecognizer) Recognize(ctx context.Context, req model.RecognizeRequest) (*model.RecognizeResponse, error) {
+	type result struct {
+		response *model.RecognizeResponse
+		err      error
+	}
+	// the MQTT round trip cannot be interrupted; a done ctx only stops waiting
+	done := make(chan result, 1)
+	go func() {
+		response, err := service.CallRecognizeWithRequest(service.NewClientOpts(r.broker), req)
+		done <- result{response, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-done:
+		if res.err == nil && res.response != nil && res.response.Error != "" {
+			return nil, errors.New(res.response.Error)
+		}
+		return res.response, res.err
+	}
+}
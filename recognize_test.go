@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// upload posts sizes as "images" files of a multipart form and returns the
+// status of the answer.
+func (s *testServer) upload(token string, path string, sizes ...int) int {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for i, size := range sizes {
+		part, err := form.CreateFormFile("images", "image-"+strconv.Itoa(i)+".jpg")
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		image := bytes.Repeat([]byte{byte(i)}, size)
+		if _, err := part.Write(image); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	form.Close()
+	req := httptest.NewRequest("POST", path, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestRecognizeUploadLimits(t *testing.T) {
+	s := newTestServer(t)
+	token, _ := s.login("alice@example.com")
+	if status := s.upload(token, "/api/recognize", 100, 100); status != http.StatusOK {
+		t.Fatalf("expected 2 images to be recognized, got %d", status)
+	}
+	sizes := make([]int, 21)
+	for i := range sizes {
+		sizes[i] = 100
+	}
+	if status := s.upload(token, "/api/recognize", sizes...); status != http.StatusBadRequest {
+		t.Fatalf("expected 21 images to be refused, got %d", status)
+	}
+	if status := s.upload(token, "/api/recognize"); status != http.StatusBadRequest {
+		t.Fatalf("expected a form without images to be refused, got %d", status)
+	}
+	if status := s.upload(token, "/api/recognize", 100, 10<<20+1); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected an image over 10 MiB to be refused, got %d", status)
+	}
+	s.expect(http.StatusBadRequest, token, "POST", "/api/recognize", map[string]interface{}{"images": []string{}}, nil)
+}
@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"face-service/config"
+	"face-service/db"
+	"github.com/globalsign/mgo"
+	"time"
+)
+
+var (
+	ErrTimeout  = errors.New("database operation timed out")
+	ErrCanceled = errors.New("database operation canceled")
+)
+
+type operation int
+
+const (
+	readOperation operation = iota
+	writeOperation
+	aggregateOperation
+)
+
+func (op operation) timeout() time.Duration {
+	switch op {
+	case writeOperation:
+		return config.Get().DBWriteTimeout
+	case aggregateOperation:
+		return config.Get().DBAggregateTimeout
+	}
+	return config.Get().DBReadTimeout
+}
+
+// run executes fn against a copy of the dao session. It returns as soon as
+// ctx is done or the timeout of the operation class elapses, whichever comes
+// first; the socket timeout on the copied session makes sure the abandoned
+// call does not hold the connection forever.
+func run(ctx context.Context, op operation, fn func(db *mgo.Database) error) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	timeout := op.timeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	session := dao.GetSession().Copy()
+	session.SetSocketTimeout(timeout)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(session.DB(dao.DB().Name))
+	}()
+
+	select {
+	case err := <-done:
+		session.Close()
+		return err
+	case <-ctx.Done():
+		go func() {
+			<-done
+			session.Close()
+		}()
+		return contextError(ctx.Err())
+	}
+}
+
+func checkContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+	return nil
+}
+
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return ErrCanceled
+}
@@ -0,0 +1,162 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+)
+
+type DeskRepository interface {
+	FindAll(ctx context.Context) ([]model.Desk, error)
+	FindPage(ctx context.Context, p PageRequest) ([]model.Desk, string, error)
+	FindByDeskId(ctx context.Context, deskId string) (*model.Desk, error)
+	CountByDeskId(ctx context.Context, deskId string) (int, error)
+	Insert(ctx context.Context, desk *model.Desk) error
+}
+
+type mongoDeskRepository struct{}
+
+func (r *mongoDeskRepository) FindAll(ctx context.Context) ([]model.Desk, error) {
+	filter, err := scoped(ctx, bson.M{}, "owner")
+	if err != nil {
+		return nil, err
+	}
+	desks := make([]model.Desk, 0)
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("desk").Find(filter).All(&desks)
+	})
+	return desks, err
+}
+
+func (r *mongoDeskRepository) FindPage(ctx context.Context, p PageRequest) ([]model.Desk, string, error) {
+	filter, err := scoped(ctx, bson.M{}, "owner")
+	if err != nil {
+		return nil, "", err
+	}
+	q, err := newPageQuery(p, filter, "_id", "_id", "name")
+	if err != nil {
+		return nil, "", err
+	}
+	desks := make([]model.Desk, 0)
+	next := ""
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		docs, cursor, err := findPage(db.C("desk"), q)
+		if err != nil {
+			return err
+		}
+		next = cursor
+		return decodeDocuments(docs, &desks)
+	})
+	return desks, next, err
+}
+
+func (r *mongoDeskRepository) FindByDeskId(ctx context.Context, deskId string) (*model.Desk, error) {
+	filter, err := scoped(ctx, bson.M{"deskId": deskId}, "owner")
+	if err != nil {
+		return nil, err
+	}
+	var desk model.Desk
+	if err := run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("desk").Find(filter).One(&desk)
+	}); err != nil {
+		return nil, err
+	}
+	return &desk, nil
+}
+
+func (r *mongoDeskRepository) CountByDeskId(ctx context.Context, deskId string) (int, error) {
+	filter, err := scoped(ctx, bson.M{"deskId": deskId}, "owner")
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = run(ctx, readOperation, func(db *mgo.Database) (err error) {
+		count, err = db.C("desk").Find(filter).Count()
+		return
+	})
+	return count, err
+}
+
+func (r *mongoDeskRepository) Insert(ctx context.Context, desk *model.Desk) error {
+	if err := claim(ctx, &desk.Owner); err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		err := db.C("desk").Insert(desk)
+		if IsDuplicate(err) {
+			if count, countErr := db.C("desk").Find(trashedDesk(desk)).Count(); countErr == nil && count > 0 {
+				return ErrInTrash
+			}
+		}
+		return err
+	})
+}
+
+// trashedDesk matches the desk of the same owner and id as desk in the trash.
+func trashedDesk(desk *model.Desk) bson.M {
+	return bson.M{"deskId": desk.DeskId, "owner": desk.Owner, "deletedAt": bson.M{"$ne": nil}}
+}
+
+type memoryDeskRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryDeskRepository) FindAll(ctx context.Context) ([]model.Desk, error) {
+	filter, err := memoryScoped(ctx, bson.M{}, "owner")
+	if err != nil {
+		return nil, err
+	}
+	desks := make([]model.Desk, 0)
+	err = decodeDocuments(r.store.find("desk", filter), &desks)
+	return desks, err
+}
+
+func (r *memoryDeskRepository) FindPage(ctx context.Context, p PageRequest) ([]model.Desk, string, error) {
+	filter, err := memoryScoped(ctx, bson.M{}, "owner")
+	if err != nil {
+		return nil, "", err
+	}
+	q, err := newPageQuery(p, filter, "_id", "_id", "name")
+	if err != nil {
+		return nil, "", err
+	}
+	docs, next := r.store.findPage("desk", q)
+	desks := make([]model.Desk, 0)
+	err = decodeDocuments(docs, &desks)
+	return desks, next, err
+}
+
+func (r *memoryDeskRepository) FindByDeskId(ctx context.Context, deskId string) (*model.Desk, error) {
+	filter, err := memoryScoped(ctx, bson.M{"deskId": deskId}, "owner")
+	if err != nil {
+		return nil, err
+	}
+	var desk model.Desk
+	if err := r.store.findOne("desk", filter, &desk); err != nil {
+		return nil, err
+	}
+	return &desk, nil
+}
+
+func (r *memoryDeskRepository) CountByDeskId(ctx context.Context, deskId string) (int, error) {
+	filter, err := memoryScoped(ctx, bson.M{"deskId": deskId}, "owner")
+	if err != nil {
+		return 0, err
+	}
+	return r.store.count("desk", filter), nil
+}
+
+func (r *memoryDeskRepository) Insert(ctx context.Context, desk *model.Desk) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := claim(ctx, &desk.Owner); err != nil {
+		return err
+	}
+	err := r.store.insert("desk", desk)
+	if err == ErrDuplicateKey && r.store.count("desk", trashedDesk(desk)) > 0 {
+		return ErrInTrash
+	}
+	return err
+}
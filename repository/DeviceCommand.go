@@ -0,0 +1,210 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"time"
+)
+
+const (
+	CommandPending  = "pending"
+	CommandAcked    = "acked"
+	CommandFailed   = "failed"
+	CommandTimedOut = "timed_out"
+)
+
+// DeviceCommand is a command sent to the device known to MQTT as DeviceId.
+// Its id is the correlation id the device acknowledges it with.
+type DeviceCommand struct {
+	Id          bson.ObjectId `json:"id" bson:"_id"`
+	UserId      bson.ObjectId `json:"userId" bson:"userId"`
+	DeviceId    string        `json:"deviceId" bson:"deviceId"`
+	Command     string        `json:"command" bson:"command"`
+	Args        bson.M        `json:"args,omitempty" bson:"args,omitempty"`
+	Status      string        `json:"status" bson:"status"`
+	Result      interface{}   `json:"result,omitempty" bson:"result,omitempty"`
+	Error       string        `json:"error,omitempty" bson:"error,omitempty"`
+	CreatedAt   time.Time     `json:"createdAt" bson:"createdAt"`
+	ExpiresAt   time.Time     `json:"expiresAt" bson:"expiresAt"`
+	CompletedAt *time.Time    `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+}
+
+type DeviceCommandRepository interface {
+	FindById(ctx context.Context, id bson.ObjectId) (*DeviceCommand, error)
+	// FindPageByDevice lists the commands sent to a device, newest first.
+	FindPageByDevice(ctx context.Context, deviceId string, p PageRequest) ([]DeviceCommand, string, error)
+	Insert(ctx context.Context, command *DeviceCommand) error
+	// Complete moves a pending command of deviceId to status and returns it,
+	// or fails with ErrNotFound when it is not pending anymore.
+	Complete(ctx context.Context, id bson.ObjectId, deviceId string, status string, result interface{}, reason string) (*DeviceCommand, error)
+	// Expire times out the pending commands that expired before the given
+	// time. It needs a system context.
+	Expire(ctx context.Context, before time.Time) (int, error)
+}
+
+func completion(status string, result interface{}, reason string, now time.Time) bson.M {
+	set := bson.M{"status": status, "completedAt": now}
+	if result != nil {
+		set["result"] = result
+	}
+	if reason != "" {
+		set["error"] = reason
+	}
+	return set
+}
+
+func expiredCommands(before time.Time) bson.M {
+	return bson.M{"status": CommandPending, "expiresAt": bson.M{"$lt": before}}
+}
+
+type mongoDeviceCommandRepository struct{}
+
+func (r *mongoDeviceCommandRepository) FindById(ctx context.Context, id bson.ObjectId) (*DeviceCommand, error) {
+	filter, err := scoped(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var command DeviceCommand
+	if err := run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("device_command").Find(filter).One(&command)
+	}); err != nil {
+		return nil, err
+	}
+	return &command, nil
+}
+
+func (r *mongoDeviceCommandRepository) FindPageByDevice(ctx context.Context, deviceId string, p PageRequest) ([]DeviceCommand, string, error) {
+	filter, err := scoped(ctx, bson.M{"deviceId": deviceId}, "userId")
+	if err != nil {
+		return nil, "", err
+	}
+	q, err := newPageQuery(p, filter, "-_id", "_id")
+	if err != nil {
+		return nil, "", err
+	}
+	commands := make([]DeviceCommand, 0)
+	next := ""
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		docs, cursor, err := findPage(db.C("device_command"), q)
+		if err != nil {
+			return err
+		}
+		next = cursor
+		return decodeDocuments(docs, &commands)
+	})
+	return commands, next, err
+}
+
+func (r *mongoDeviceCommandRepository) Insert(ctx context.Context, command *DeviceCommand) error {
+	if err := claim(ctx, &command.UserId); err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("device_command").Insert(command)
+	})
+}
+
+func (r *mongoDeviceCommandRepository) Complete(ctx context.Context, id bson.ObjectId, deviceId string, status string, result interface{}, reason string) (*DeviceCommand, error) {
+	filter, err := scoped(ctx, bson.M{"_id": id, "deviceId": deviceId, "status": CommandPending}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var command DeviceCommand
+	err = run(ctx, writeOperation, func(db *mgo.Database) error {
+		_, err := db.C("device_command").Find(filter).Apply(mgo.Change{
+			Update:    bson.M{"$set": completion(status, result, reason, time.Now())},
+			ReturnNew: true,
+		}, &command)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &command, nil
+}
+
+func (r *mongoDeviceCommandRepository) Expire(ctx context.Context, before time.Time) (int, error) {
+	if !isSystem(ctx) {
+		return 0, ErrSystemOnly
+	}
+	expired := 0
+	err := run(ctx, writeOperation, func(db *mgo.Database) error {
+		info, err := db.C("device_command").UpdateAll(expiredCommands(before), bson.M{
+			"$set": completion(CommandTimedOut, nil, "no acknowledgement in time", time.Now()),
+		})
+		if err == nil {
+			expired = info.Updated
+		}
+		return err
+	})
+	return expired, err
+}
+
+type memoryDeviceCommandRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryDeviceCommandRepository) FindById(ctx context.Context, id bson.ObjectId) (*DeviceCommand, error) {
+	filter, err := memoryScoped(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var command DeviceCommand
+	if err := r.store.findOne("device_command", filter, &command); err != nil {
+		return nil, err
+	}
+	return &command, nil
+}
+
+func (r *memoryDeviceCommandRepository) FindPageByDevice(ctx context.Context, deviceId string, p PageRequest) ([]DeviceCommand, string, error) {
+	filter, err := memoryScoped(ctx, bson.M{"deviceId": deviceId}, "userId")
+	if err != nil {
+		return nil, "", err
+	}
+	q, err := newPageQuery(p, filter, "-_id", "_id")
+	if err != nil {
+		return nil, "", err
+	}
+	docs, next := r.store.findPage("device_command", q)
+	commands := make([]DeviceCommand, 0)
+	err = decodeDocuments(docs, &commands)
+	return commands, next, err
+}
+
+func (r *memoryDeviceCommandRepository) Insert(ctx context.Context, command *DeviceCommand) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := claim(ctx, &command.UserId); err != nil {
+		return err
+	}
+	return r.store.insert("device_command", command)
+}
+
+func (r *memoryDeviceCommandRepository) Complete(ctx context.Context, id bson.ObjectId, deviceId string, status string, result interface{}, reason string) (*DeviceCommand, error) {
+	filter, err := memoryScoped(ctx, bson.M{"_id": id, "deviceId": deviceId, "status": CommandPending}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	if n, err := r.store.update("device_command", filter, completion(status, result, reason, time.Now())); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+	var command DeviceCommand
+	if err := r.store.findOne("device_command", bson.M{"_id": id}, &command); err != nil {
+		return nil, err
+	}
+	return &command, nil
+}
+
+func (r *memoryDeviceCommandRepository) Expire(ctx context.Context, before time.Time) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+	if !isSystem(ctx) {
+		return 0, ErrSystemOnly
+	}
+	return r.store.update("device_command", expiredCommands(before), completion(CommandTimedOut, nil, "no acknowledgement in time", time.Now()))
+}
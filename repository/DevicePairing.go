@@ -0,0 +1,209 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"time"
+)
+
+const (
+	PairingPending = "pending"
+	PairingClaimed = "claimed"
+)
+
+// DevicePairing follows a physical device from its announcement to the
+// device it was bound to. Nonce and PublicKey are chosen by the device; its
+// identity is only ever sent sealed to PublicKey, so that only the device
+// can read its token.
+type DevicePairing struct {
+	Id        bson.ObjectId    `json:"id" bson:"_id"`
+	Serial    string           `json:"serial" bson:"serial"`
+	Nonce     string           `json:"-" bson:"nonce"`
+	PublicKey string           `json:"-" bson:"publicKey"`
+	Type      model.DeviceType `json:"type" bson:"type"`
+	Name      string           `json:"name" bson:"name"`
+	ClaimCode string           `json:"claimCode" bson:"claimCode"`
+	Status    string           `json:"status" bson:"status"`
+	UserId    bson.ObjectId    `json:"userId,omitempty" bson:"userId,omitempty"`
+	DeviceId  bson.ObjectId    `json:"deviceId,omitempty" bson:"deviceId,omitempty"`
+	Token     string           `json:"-" bson:"token,omitempty"`
+	CreatedAt time.Time        `json:"createdAt" bson:"createdAt"`
+	ExpiresAt time.Time        `json:"expiresAt" bson:"expiresAt"`
+}
+
+type DevicePairingRepository interface {
+	// FindBySerial and Save serve the announcements of devices, which belong
+	// to no user yet. They need a system context.
+	FindBySerial(ctx context.Context, serial string) (*DevicePairing, error)
+	Save(ctx context.Context, pairing *DevicePairing) error
+	// Claim binds the pending pairing of code to the owner of ctx and to
+	// deviceId, or fails with ErrNotFound when there is no such pairing. The
+	// claimed pairing keeps token for the device until expiresAt.
+	Claim(ctx context.Context, code string, deviceId bson.ObjectId, token string, expiresAt time.Time) (*DevicePairing, error)
+	// Release puts a claimed pairing back to pending, for when the device
+	// could not be created after all.
+	Release(ctx context.Context, id bson.ObjectId) error
+	// RemoveByDevice forgets the pairing of a device of the owner, so that
+	// the physical device can announce itself and be claimed again.
+	RemoveByDevice(ctx context.Context, deviceId bson.ObjectId) error
+}
+
+func claimFilter(code string) bson.M {
+	return bson.M{"claimCode": code, "status": PairingPending, "expiresAt": bson.M{"$gt": time.Now()}}
+}
+
+func claimUpdate(owner bson.ObjectId, deviceId bson.ObjectId, token string, expiresAt time.Time) bson.M {
+	return bson.M{
+		"status":    PairingClaimed,
+		"userId":    owner,
+		"deviceId":  deviceId,
+		"token":     token,
+		"expiresAt": expiresAt,
+	}
+}
+
+type mongoDevicePairingRepository struct{}
+
+func (r *mongoDevicePairingRepository) FindBySerial(ctx context.Context, serial string) (*DevicePairing, error) {
+	if !isSystem(ctx) {
+		return nil, ErrSystemOnly
+	}
+	var pairing DevicePairing
+	if err := run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("device_pairing").Find(bson.M{"serial": serial}).One(&pairing)
+	}); err != nil {
+		return nil, err
+	}
+	return &pairing, nil
+}
+
+func (r *mongoDevicePairingRepository) Save(ctx context.Context, pairing *DevicePairing) error {
+	if !isSystem(ctx) {
+		return ErrSystemOnly
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		_, err := db.C("device_pairing").UpsertId(pairing.Id, pairing)
+		return err
+	})
+}
+
+func (r *mongoDevicePairingRepository) Claim(ctx context.Context, code string, deviceId bson.ObjectId, token string, expiresAt time.Time) (*DevicePairing, error) {
+	owner, ok := OwnerFrom(ctx)
+	if !ok {
+		return nil, ErrNoOwner
+	}
+	var pairing DevicePairing
+	err := run(ctx, writeOperation, func(db *mgo.Database) error {
+		_, err := db.C("device_pairing").Find(claimFilter(code)).Apply(mgo.Change{
+			Update:    bson.M{"$set": claimUpdate(owner, deviceId, token, expiresAt)},
+			ReturnNew: true,
+		}, &pairing)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pairing, nil
+}
+
+func (r *mongoDevicePairingRepository) Release(ctx context.Context, id bson.ObjectId) error {
+	filter, err := owned(ctx, bson.M{"_id": id, "status": PairingClaimed}, "userId")
+	if err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("device_pairing").Update(filter, bson.M{
+			"$set":   bson.M{"status": PairingPending},
+			"$unset": bson.M{"userId": "", "deviceId": "", "token": ""},
+		})
+	})
+}
+
+func (r *mongoDevicePairingRepository) RemoveByDevice(ctx context.Context, deviceId bson.ObjectId) error {
+	filter, err := owned(ctx, bson.M{"deviceId": deviceId}, "userId")
+	if err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("device_pairing").Remove(filter)
+	})
+}
+
+type memoryDevicePairingRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryDevicePairingRepository) FindBySerial(ctx context.Context, serial string) (*DevicePairing, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if !isSystem(ctx) {
+		return nil, ErrSystemOnly
+	}
+	var pairing DevicePairing
+	if err := r.store.findOne("device_pairing", bson.M{"serial": serial}, &pairing); err != nil {
+		return nil, err
+	}
+	return &pairing, nil
+}
+
+func (r *memoryDevicePairingRepository) Save(ctx context.Context, pairing *DevicePairing) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if !isSystem(ctx) {
+		return ErrSystemOnly
+	}
+	if r.store.count("device_pairing", bson.M{"_id": pairing.Id}) > 0 {
+		return r.store.replace("device_pairing", bson.M{"_id": pairing.Id}, pairing)
+	}
+	return r.store.insert("device_pairing", pairing)
+}
+
+func (r *memoryDevicePairingRepository) Claim(ctx context.Context, code string, deviceId bson.ObjectId, token string, expiresAt time.Time) (*DevicePairing, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	owner, ok := OwnerFrom(ctx)
+	if !ok {
+		return nil, ErrNoOwner
+	}
+	var pairing DevicePairing
+	if err := r.store.findOne("device_pairing", claimFilter(code), &pairing); err != nil {
+		return nil, err
+	}
+	// the status in the filter makes a concurrent claim of the same code lose
+	if n, err := r.store.update("device_pairing", bson.M{"_id": pairing.Id, "status": PairingPending}, claimUpdate(owner, deviceId, token, expiresAt)); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+	pairing.Status, pairing.UserId, pairing.DeviceId, pairing.Token, pairing.ExpiresAt = PairingClaimed, owner, deviceId, token, expiresAt
+	return &pairing, nil
+}
+
+func (r *memoryDevicePairingRepository) Release(ctx context.Context, id bson.ObjectId) error {
+	filter, err := owned(ctx, bson.M{"_id": id, "status": PairingClaimed}, "userId")
+	if err != nil {
+		return err
+	}
+	if n, err := r.store.update("device_pairing", filter, bson.M{"status": PairingPending, "userId": nil, "deviceId": nil, "token": ""}); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *memoryDevicePairingRepository) RemoveByDevice(ctx context.Context, deviceId bson.ObjectId) error {
+	filter, err := owned(ctx, bson.M{"deviceId": deviceId}, "userId")
+	if err != nil {
+		return err
+	}
+	if r.store.remove("device_pairing", filter) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"time"
+)
+
+// DevicePresence is what the service knows of a device being alive, from its
+// heartbeats and its last will. It is kept on the device document.
+type DevicePresence struct {
+	Online   bool       `json:"online" bson:"online"`
+	LastSeen *time.Time `json:"lastSeen,omitempty" bson:"lastSeen,omitempty"`
+	Firmware string     `json:"firmware,omitempty" bson:"firmware,omitempty"`
+}
+
+// DeviceStatus is a device along with its presence.
+type DeviceStatus struct {
+	model.Device   `bson:",inline"`
+	DevicePresence `bson:",inline"`
+}
+
+// presenceUpdate sets what p knows: a last will tells nothing of the firmware
+// nor of when the device was last seen.
+func presenceUpdate(p DevicePresence) bson.M {
+	set := bson.M{"online": p.Online}
+	if p.LastSeen != nil {
+		set["lastSeen"] = *p.LastSeen
+	}
+	if p.Firmware != "" {
+		set["firmware"] = p.Firmware
+	}
+	return set
+}
+
+// silentDevices matches the devices thought online that were last seen
+// before seenBefore.
+func silentDevices(seenBefore time.Time) bson.M {
+	return bson.M{"deletedAt": nil, "online": true, "lastSeen": bson.M{"$lt": seenBefore}}
+}
+
+func (r *mongoDeviceRepository) UpdatePresence(ctx context.Context, deviceId string, presence DevicePresence) (*DeviceStatus, error) {
+	if !isSystem(ctx) {
+		return nil, ErrSystemOnly
+	}
+	var former DeviceStatus
+	err := run(ctx, writeOperation, func(db *mgo.Database) error {
+		_, err := db.C("device").Find(bson.M{"deviceId": deviceId, "deletedAt": nil}).Apply(mgo.Change{
+			Update: bson.M{"$set": presenceUpdate(presence)},
+		}, &former)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &former, nil
+}
+
+func (r *mongoDeviceRepository) MarkOffline(ctx context.Context, seenBefore time.Time) ([]DeviceStatus, error) {
+	if !isSystem(ctx) {
+		return nil, ErrSystemOnly
+	}
+	marked := make([]DeviceStatus, 0)
+	err := run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		var stale []DeviceStatus
+		if err := db.C("device").Find(silentDevices(seenBefore)).All(&stale); err != nil {
+			return err
+		}
+		for _, status := range stale {
+			// a heartbeat may have come in since the find
+			filter := silentDevices(seenBefore)
+			filter["_id"] = status.Id
+			err := db.C("device").Update(filter, bson.M{"$set": bson.M{"online": false}})
+			if err == mgo.ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			status.Online = false
+			marked = append(marked, status)
+		}
+		return nil
+	})
+	return marked, err
+}
+
+func (r *memoryDeviceRepository) UpdatePresence(ctx context.Context, deviceId string, presence DevicePresence) (*DeviceStatus, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if !isSystem(ctx) {
+		return nil, ErrSystemOnly
+	}
+	var former DeviceStatus
+	if err := r.store.findOne("device", bson.M{"deviceId": deviceId, "deletedAt": nil}, &former); err != nil {
+		return nil, err
+	}
+	if _, err := r.store.update("device", bson.M{"_id": former.Id}, presenceUpdate(presence)); err != nil {
+		return nil, err
+	}
+	return &former, nil
+}
+
+func (r *memoryDeviceRepository) MarkOffline(ctx context.Context, seenBefore time.Time) ([]DeviceStatus, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if !isSystem(ctx) {
+		return nil, ErrSystemOnly
+	}
+	var stale []DeviceStatus
+	if err := decodeDocuments(r.store.find("device", silentDevices(seenBefore)), &stale); err != nil {
+		return nil, err
+	}
+	marked := make([]DeviceStatus, 0)
+	for _, status := range stale {
+		filter := silentDevices(seenBefore)
+		filter["_id"] = status.Id
+		if n, err := r.store.update("device", filter, bson.M{"online": false}); err != nil {
+			return nil, err
+		} else if n > 0 {
+			status.Online = false
+			marked = append(marked, status)
+		}
+	}
+	return marked, nil
+}
@@ -0,0 +1,228 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"time"
+)
+
+type DeviceRepository interface {
+	FindAll(ctx context.Context) ([]model.Device, error)
+	FindById(ctx context.Context, id bson.ObjectId) (*model.Device, error)
+	FindByDesk(ctx context.Context, deskId string) ([]model.Device, error)
+	// FindPageByDesk lists the devices of a desk, optionally of one type only,
+	// along with their presence.
+	FindPageByDesk(ctx context.Context, deskId string, deviceType string, p PageRequest) ([]DeviceStatus, string, error)
+	Insert(ctx context.Context, device *model.Device) error
+	// Update applies changes to a device and returns it as updated.
+	Update(ctx context.Context, id bson.ObjectId, changes DeviceChanges) (*model.Device, error)
+
+	// UpdatePresence records a heartbeat or the last will of the device known
+	// to MQTT as deviceId and returns its status from before. It needs a
+	// system context.
+	UpdatePresence(ctx context.Context, deviceId string, presence DevicePresence) (*DeviceStatus, error)
+	// MarkOffline marks offline the online devices last seen before
+	// seenBefore and returns them. It needs a system context.
+	MarkOffline(ctx context.Context, seenBefore time.Time) ([]DeviceStatus, error)
+}
+
+// DeviceChanges are the fields of a device its owner may change; nil fields
+// are left as they are. The MQTT device id never changes, so that events stay
+// linked to the device.
+type DeviceChanges struct {
+	Name   *string
+	Type   *model.DeviceType
+	DeskId *string
+}
+
+func (d DeviceChanges) set() bson.M {
+	set := bson.M{}
+	if d.Name != nil {
+		set["name"] = *d.Name
+	}
+	if d.Type != nil {
+		set["type"] = *d.Type
+	}
+	if d.DeskId != nil {
+		set["deskId"] = *d.DeskId
+	}
+	return set
+}
+
+type mongoDeviceRepository struct{}
+
+func (r *mongoDeviceRepository) FindAll(ctx context.Context) ([]model.Device, error) {
+	filter, err := scoped(ctx, bson.M{}, "owner")
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]model.Device, 0)
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("device").Find(filter).All(&devices)
+	})
+	return devices, err
+}
+
+func (r *mongoDeviceRepository) FindById(ctx context.Context, id bson.ObjectId) (*model.Device, error) {
+	filter, err := scoped(ctx, bson.M{"_id": id}, "owner")
+	if err != nil {
+		return nil, err
+	}
+	var device model.Device
+	if err := run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("device").Find(filter).One(&device)
+	}); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (r *mongoDeviceRepository) FindByDesk(ctx context.Context, deskId string) ([]model.Device, error) {
+	filter, err := scoped(ctx, bson.M{"deskId": deskId}, "owner")
+	if err != nil {
+		return nil, err
+	}
+	var devices []model.Device
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("device").Find(filter).All(&devices)
+	})
+	return devices, err
+}
+
+func (r *mongoDeviceRepository) FindPageByDesk(ctx context.Context, deskId string, deviceType string, p PageRequest) ([]DeviceStatus, string, error) {
+	filter, err := scoped(ctx, deviceFilter(deskId, deviceType), "owner")
+	if err != nil {
+		return nil, "", err
+	}
+	q, err := newPageQuery(p, filter, "_id", "_id", "name", "type")
+	if err != nil {
+		return nil, "", err
+	}
+	devices := make([]DeviceStatus, 0)
+	next := ""
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		docs, cursor, err := findPage(db.C("device"), q)
+		if err != nil {
+			return err
+		}
+		next = cursor
+		return decodeDocuments(docs, &devices)
+	})
+	return devices, next, err
+}
+
+func deviceFilter(deskId string, deviceType string) bson.M {
+	filter := bson.M{"deskId": deskId}
+	if deviceType != "" {
+		filter["type"] = deviceType
+	}
+	return filter
+}
+
+func (r *mongoDeviceRepository) Insert(ctx context.Context, device *model.Device) error {
+	if err := claim(ctx, &device.Owner); err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("device").Insert(device)
+	})
+}
+
+func (r *mongoDeviceRepository) Update(ctx context.Context, id bson.ObjectId, changes DeviceChanges) (*model.Device, error) {
+	filter, err := scoped(ctx, bson.M{"_id": id}, "owner")
+	if err != nil {
+		return nil, err
+	}
+	var device model.Device
+	err = run(ctx, writeOperation, func(db *mgo.Database) error {
+		_, err := db.C("device").Find(filter).Apply(mgo.Change{
+			Update:    bson.M{"$set": changes.set()},
+			ReturnNew: true,
+		}, &device)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+type memoryDeviceRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryDeviceRepository) FindAll(ctx context.Context) ([]model.Device, error) {
+	filter, err := memoryScoped(ctx, bson.M{}, "owner")
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]model.Device, 0)
+	err = decodeDocuments(r.store.find("device", filter), &devices)
+	return devices, err
+}
+
+func (r *memoryDeviceRepository) FindById(ctx context.Context, id bson.ObjectId) (*model.Device, error) {
+	filter, err := memoryScoped(ctx, bson.M{"_id": id}, "owner")
+	if err != nil {
+		return nil, err
+	}
+	var device model.Device
+	if err := r.store.findOne("device", filter, &device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (r *memoryDeviceRepository) FindByDesk(ctx context.Context, deskId string) ([]model.Device, error) {
+	filter, err := memoryScoped(ctx, bson.M{"deskId": deskId}, "owner")
+	if err != nil {
+		return nil, err
+	}
+	var devices []model.Device
+	err = decodeDocuments(r.store.find("device", filter), &devices)
+	return devices, err
+}
+
+func (r *memoryDeviceRepository) FindPageByDesk(ctx context.Context, deskId string, deviceType string, p PageRequest) ([]DeviceStatus, string, error) {
+	filter, err := memoryScoped(ctx, deviceFilter(deskId, deviceType), "owner")
+	if err != nil {
+		return nil, "", err
+	}
+	q, err := newPageQuery(p, filter, "_id", "_id", "name", "type")
+	if err != nil {
+		return nil, "", err
+	}
+	docs, next := r.store.findPage("device", q)
+	devices := make([]DeviceStatus, 0)
+	err = decodeDocuments(docs, &devices)
+	return devices, next, err
+}
+
+func (r *memoryDeviceRepository) Insert(ctx context.Context, device *model.Device) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := claim(ctx, &device.Owner); err != nil {
+		return err
+	}
+	return r.store.insert("device", device)
+}
+
+func (r *memoryDeviceRepository) Update(ctx context.Context, id bson.ObjectId, changes DeviceChanges) (*model.Device, error) {
+	filter, err := memoryScoped(ctx, bson.M{"_id": id}, "owner")
+	if err != nil {
+		return nil, err
+	}
+	if n, err := r.store.update("device", filter, changes.set()); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+	var device model.Device
+	if err := r.store.findOne("device", bson.M{"_id": id}, &device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
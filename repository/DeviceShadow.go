@@ -0,0 +1,277 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"time"
+)
+
+// ErrStaleReport is returned for a report older than the one stored, which
+// devices may deliver out of order.
+var ErrStaleReport = errors.New("reported config is older than the stored one")
+
+// DeviceShadow holds the configuration of a device twice: the settings its
+// owner wants it to run with, and those it last reported running with. It
+// shares its id with the device.
+type DeviceShadow struct {
+	Id              bson.ObjectId `json:"id" bson:"_id"`
+	UserId          bson.ObjectId `json:"userId" bson:"userId"`
+	DeviceId        string        `json:"deviceId" bson:"deviceId"`
+	Desired         bson.M        `json:"desired" bson:"desired,omitempty"`
+	Reported        bson.M        `json:"reported" bson:"reported,omitempty"`
+	Version         int           `json:"version" bson:"version"`
+	ReportedVersion int           `json:"reportedVersion" bson:"reportedVersion"`
+	DesiredAt       *time.Time    `json:"desiredAt,omitempty" bson:"desiredAt,omitempty"`
+	ReportedAt      *time.Time    `json:"reportedAt,omitempty" bson:"reportedAt,omitempty"`
+}
+
+// Delta returns the desired settings the device has not reported running
+// with yet.
+func (s *DeviceShadow) Delta() bson.M {
+	delta := bson.M{}
+	for name, value := range s.Desired {
+		if reported, ok := s.Reported[name]; !ok || !sameSetting(value, reported) {
+			delta[name] = value
+		}
+	}
+	return delta
+}
+
+// sameSetting compares settings by their JSON, which is how they come in from
+// both the API and the devices.
+func sameSetting(a interface{}, b interface{}) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ja, jb)
+}
+
+type DeviceShadowRepository interface {
+	// FindByDevice returns the shadow of device, an empty one when nothing
+	// was ever desired nor reported.
+	FindByDevice(ctx context.Context, device *model.Device) (*DeviceShadow, error)
+	// UpdateDesired merges patch into the desired settings of device, a nil
+	// value removing a setting, and bumps the version.
+	UpdateDesired(ctx context.Context, device *model.Device, patch bson.M) (*DeviceShadow, error)
+	// UpdateReported replaces the settings reported by the device known to
+	// MQTT as deviceId, unless it reported a later version already. It needs
+	// a system context.
+	UpdateReported(ctx context.Context, deviceId string, version int, reported bson.M) (*DeviceShadow, error)
+}
+
+func emptyShadow(device *model.Device) *DeviceShadow {
+	return &DeviceShadow{
+		Id:       device.Id,
+		UserId:   device.Owner,
+		DeviceId: device.DeviceId,
+		Desired:  bson.M{},
+		Reported: bson.M{},
+	}
+}
+
+// reportedFilter matches the shadow of device unless it holds a report later
+// than version. Shadows only desired so far hold no report version.
+func reportedFilter(device *model.Device, version int) bson.M {
+	return bson.M{
+		"_id":    device.Id,
+		"userId": device.Owner,
+		"$or": []interface{}{
+			bson.M{"reportedVersion": bson.M{"$lte": version}},
+			bson.M{"reportedVersion": bson.M{"$exists": false}},
+		},
+	}
+}
+
+func reportedUpdate(device *model.Device, version int, reported bson.M, now time.Time) bson.M {
+	return bson.M{
+		"deviceId":        device.DeviceId,
+		"reported":        reported,
+		"reportedVersion": version,
+		"reportedAt":      now,
+	}
+}
+
+// withDefaults makes sure the settings of a shadow are never nil, so that
+// they read as {} rather than null.
+func (s *DeviceShadow) withDefaults() *DeviceShadow {
+	if s.Desired == nil {
+		s.Desired = bson.M{}
+	}
+	if s.Reported == nil {
+		s.Reported = bson.M{}
+	}
+	return s
+}
+
+type mongoDeviceShadowRepository struct{}
+
+func (r *mongoDeviceShadowRepository) FindByDevice(ctx context.Context, device *model.Device) (*DeviceShadow, error) {
+	filter, err := owned(ctx, bson.M{"_id": device.Id}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var shadow DeviceShadow
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("device_shadow").Find(filter).One(&shadow)
+	})
+	if err == mgo.ErrNotFound {
+		return emptyShadow(device), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return shadow.withDefaults(), nil
+}
+
+func (r *mongoDeviceShadowRepository) UpdateDesired(ctx context.Context, device *model.Device, patch bson.M) (*DeviceShadow, error) {
+	filter, err := owned(ctx, bson.M{"_id": device.Id}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	set := bson.M{"deviceId": device.DeviceId, "desiredAt": time.Now()}
+	unset := bson.M{}
+	for name, value := range patch {
+		if value == nil {
+			unset["desired."+name] = ""
+		} else {
+			set["desired."+name] = value
+		}
+	}
+	update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	var shadow DeviceShadow
+	err = run(ctx, writeOperation, func(db *mgo.Database) error {
+		_, err := db.C("device_shadow").Find(filter).Apply(mgo.Change{
+			Update:    update,
+			Upsert:    true,
+			ReturnNew: true,
+		}, &shadow)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shadow.withDefaults(), nil
+}
+
+func (r *mongoDeviceShadowRepository) UpdateReported(ctx context.Context, deviceId string, version int, reported bson.M) (*DeviceShadow, error) {
+	if !isSystem(ctx) {
+		return nil, ErrSystemOnly
+	}
+	var shadow DeviceShadow
+	err := run(ctx, writeOperation, func(db *mgo.Database) error {
+		var device model.Device
+		if err := db.C("device").Find(bson.M{"deviceId": deviceId, "deletedAt": nil}).One(&device); err != nil {
+			return err
+		}
+		// a later report keeps the filter from matching, and the upsert
+		// then collides with the stored shadow
+		_, err := db.C("device_shadow").Find(reportedFilter(&device, version)).Apply(mgo.Change{
+			Update:    bson.M{"$set": reportedUpdate(&device, version, reported, time.Now())},
+			Upsert:    true,
+			ReturnNew: true,
+		}, &shadow)
+		if IsDuplicate(err) {
+			return ErrStaleReport
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shadow.withDefaults(), nil
+}
+
+type memoryDeviceShadowRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryDeviceShadowRepository) FindByDevice(ctx context.Context, device *model.Device) (*DeviceShadow, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	filter, err := owned(ctx, bson.M{"_id": device.Id}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var shadow DeviceShadow
+	if err := r.store.findOne("device_shadow", filter, &shadow); err == ErrNotFound {
+		return emptyShadow(device), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return shadow.withDefaults(), nil
+}
+
+func (r *memoryDeviceShadowRepository) UpdateDesired(ctx context.Context, device *model.Device, patch bson.M) (*DeviceShadow, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	shadow, err := r.FindByDevice(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	desired := bson.M{}
+	for name, value := range shadow.Desired {
+		desired[name] = value
+	}
+	for name, value := range patch {
+		if value == nil {
+			delete(desired, name)
+		} else {
+			desired[name] = value
+		}
+	}
+	now := time.Now()
+	shadow.DeviceId, shadow.Desired, shadow.DesiredAt = device.DeviceId, desired, &now
+	shadow.Version++
+	if n, err := r.store.update("device_shadow", bson.M{"_id": shadow.Id}, bson.M{"deviceId": shadow.DeviceId, "desired": desired, "version": shadow.Version, "desiredAt": now}); err != nil {
+		return nil, err
+	} else if n == 0 {
+		if err := r.store.insert("device_shadow", shadow); err != nil {
+			return nil, err
+		}
+	}
+	return shadow, nil
+}
+
+func (r *memoryDeviceShadowRepository) UpdateReported(ctx context.Context, deviceId string, version int, reported bson.M) (*DeviceShadow, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if !isSystem(ctx) {
+		return nil, ErrSystemOnly
+	}
+	var device model.Device
+	if err := r.store.findOne("device", bson.M{"deviceId": deviceId, "deletedAt": nil}, &device); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if n, err := r.store.update("device_shadow", reportedFilter(&device, version), reportedUpdate(&device, version, reported, now)); err != nil {
+		return nil, err
+	} else if n == 0 {
+		shadow := emptyShadow(&device)
+		shadow.Reported, shadow.ReportedVersion, shadow.ReportedAt = reported, version, &now
+		if err := r.store.insert("device_shadow", shadow); err == ErrDuplicateKey {
+			return nil, ErrStaleReport
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	var shadow DeviceShadow
+	if err := r.store.findOne("device_shadow", bson.M{"_id": device.Id}, &shadow); err != nil {
+		return nil, err
+	}
+	return shadow.withDefaults(), nil
+}
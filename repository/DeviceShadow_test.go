@@ -0,0 +1,34 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"testing"
+)
+
+func TestStaleReportIgnored(t *testing.T) {
+	repos := NewMemoryRepositories()
+	owner := WithOwner(context.Background(), bson.NewObjectId())
+	device := model.Device{Id: bson.NewObjectId(), DeviceId: "camera-1"}
+	if err := repos.Devices.Insert(owner, &device); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.Shadows.UpdateDesired(owner, &device, bson.M{"frameRate": 10.0}); err != nil {
+		t.Fatal(err)
+	}
+	system := AsSystem(context.Background())
+	if _, err := repos.Shadows.UpdateReported(system, "camera-1", 2, bson.M{"frameRate": 10.0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.Shadows.UpdateReported(system, "camera-1", 1, bson.M{"frameRate": 5.0}); err != ErrStaleReport {
+		t.Fatalf("expected an older report to be stale, got %v", err)
+	}
+	shadow, err := repos.Shadows.UpdateReported(system, "camera-1", 2, bson.M{"frameRate": 10.0, "resolution": "640x480"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shadow.ReportedVersion != 2 || shadow.Reported["resolution"] != "640x480" || len(shadow.Delta()) != 0 {
+		t.Fatalf("expected the same version to be reported again, got %+v", shadow)
+	}
+}
@@ -0,0 +1,152 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"time"
+)
+
+const (
+	EnrollmentRunning   = "running"
+	EnrollmentCompleted = "completed"
+	EnrollmentFailed    = "failed"
+)
+
+// EnrollmentSession tracks the capture of face samples for one label from a
+// desk device.
+type EnrollmentSession struct {
+	Id        bson.ObjectId      `json:"id" bson:"_id"`
+	UserId    bson.ObjectId      `json:"userId" bson:"userId"`
+	DeviceId  bson.ObjectId      `json:"deviceId" bson:"deviceId"`
+	Label     string             `json:"label" bson:"label"`
+	Status    string             `json:"status" bson:"status"`
+	Target    int                `json:"target" bson:"target"`
+	MaxFrames int                `json:"maxFrames" bson:"maxFrames"`
+	Frames    int                `json:"frames" bson:"frames"`
+	Accepted  int                `json:"accepted" bson:"accepted"`
+	Rejected  int                `json:"rejected" bson:"rejected"`
+	Samples   []EnrollmentSample `json:"samples" bson:"samples"`
+	Error     string             `json:"error,omitempty" bson:"error,omitempty"`
+	Instance  string             `json:"-" bson:"instance,omitempty"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+// EnrollmentSample is the outcome of one captured frame.
+type EnrollmentSample struct {
+	Frame  int           `json:"frame" bson:"frame"`
+	Status string        `json:"status" bson:"status"`
+	FaceId bson.ObjectId `json:"faceId,omitempty" bson:"faceId,omitempty"`
+	Code   string        `json:"code,omitempty" bson:"code,omitempty"`
+	Error  string        `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+type EnrollmentSessionRepository interface {
+	FindById(ctx context.Context, id bson.ObjectId) (*EnrollmentSession, error)
+	Insert(ctx context.Context, session *EnrollmentSession) error
+	Update(ctx context.Context, session *EnrollmentSession) error
+	// Interrupt fails the sessions left running by instance when it stopped,
+	// and those saved before instances were recorded. It needs a system
+	// context.
+	Interrupt(ctx context.Context, instance string, reason string) (int, error)
+}
+
+type mongoEnrollmentSessionRepository struct{}
+
+func (r *mongoEnrollmentSessionRepository) FindById(ctx context.Context, id bson.ObjectId) (*EnrollmentSession, error) {
+	filter, err := scoped(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var session EnrollmentSession
+	if err := run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("enrollment_session").Find(filter).One(&session)
+	}); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (r *mongoEnrollmentSessionRepository) Insert(ctx context.Context, session *EnrollmentSession) error {
+	if err := claim(ctx, &session.UserId); err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("enrollment_session").Insert(session)
+	})
+}
+
+func (r *mongoEnrollmentSessionRepository) Update(ctx context.Context, session *EnrollmentSession) error {
+	if err := claim(ctx, &session.UserId); err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("enrollment_session").Update(bson.M{"_id": session.Id, "userId": session.UserId}, session)
+	})
+}
+
+func (r *mongoEnrollmentSessionRepository) Interrupt(ctx context.Context, instance string, reason string) (int, error) {
+	if !isSystem(ctx) {
+		return 0, ErrSystemOnly
+	}
+	interrupted := 0
+	err := run(ctx, writeOperation, func(db *mgo.Database) error {
+		info, err := db.C("enrollment_session").UpdateAll(
+			interruptedFilter(EnrollmentRunning, instance),
+			bson.M{"$set": bson.M{"status": EnrollmentFailed, "error": reason, "updatedAt": time.Now()}},
+		)
+		if err == nil {
+			interrupted = info.Updated
+		}
+		return err
+	})
+	return interrupted, err
+}
+
+type memoryEnrollmentSessionRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryEnrollmentSessionRepository) FindById(ctx context.Context, id bson.ObjectId) (*EnrollmentSession, error) {
+	filter, err := memoryScoped(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var session EnrollmentSession
+	if err := r.store.findOne("enrollment_session", filter, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (r *memoryEnrollmentSessionRepository) Insert(ctx context.Context, session *EnrollmentSession) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := claim(ctx, &session.UserId); err != nil {
+		return err
+	}
+	return r.store.insert("enrollment_session", session)
+}
+
+func (r *memoryEnrollmentSessionRepository) Update(ctx context.Context, session *EnrollmentSession) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := claim(ctx, &session.UserId); err != nil {
+		return err
+	}
+	return r.store.replace("enrollment_session", bson.M{"_id": session.Id, "userId": session.UserId}, session)
+}
+
+func (r *memoryEnrollmentSessionRepository) Interrupt(ctx context.Context, instance string, reason string) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+	if !isSystem(ctx) {
+		return 0, ErrSystemOnly
+	}
+	set := bson.M{"status": EnrollmentFailed, "error": reason, "updatedAt": time.Now()}
+	return r.store.update("enrollment_session", interruptedFilter(EnrollmentRunning, instance), set)
+}
@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"time"
+)
+
+// EventArchive describes one gzip-compressed NDJSON file of events removed by
+// the retention sweeper.
+type EventArchive struct {
+	Id        bson.ObjectId `json:"id" bson:"_id"`
+	UserId    bson.ObjectId `json:"userId" bson:"userId"`
+	DeviceId  string        `json:"deviceId" bson:"deviceId"`
+	From      time.Time     `json:"from" bson:"from"`
+	To        time.Time     `json:"to" bson:"to"`
+	Count     int           `json:"count" bson:"count"`
+	Size      int64         `json:"size" bson:"size"`
+	CreatedAt time.Time     `json:"createdAt" bson:"createdAt"`
+}
+
+type EventArchiveRepository interface {
+	FindAll(ctx context.Context) ([]EventArchive, error)
+	FindById(ctx context.Context, id bson.ObjectId) (*EventArchive, error)
+	Insert(ctx context.Context, archive *EventArchive) error
+}
+
+type mongoEventArchiveRepository struct{}
+
+func (r *mongoEventArchiveRepository) FindAll(ctx context.Context) ([]EventArchive, error) {
+	filter, err := scoped(ctx, bson.M{}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	archives := make([]EventArchive, 0)
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("event_archive").Find(filter).Sort("-createdAt").All(&archives)
+	})
+	return archives, err
+}
+
+func (r *mongoEventArchiveRepository) FindById(ctx context.Context, id bson.ObjectId) (*EventArchive, error) {
+	filter, err := scoped(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var archive EventArchive
+	if err := run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("event_archive").Find(filter).One(&archive)
+	}); err != nil {
+		return nil, err
+	}
+	return &archive, nil
+}
+
+func (r *mongoEventArchiveRepository) Insert(ctx context.Context, archive *EventArchive) error {
+	if err := claim(ctx, &archive.UserId); err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("event_archive").Insert(archive)
+	})
+}
+
+type memoryEventArchiveRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryEventArchiveRepository) FindAll(ctx context.Context) ([]EventArchive, error) {
+	filter, err := memoryScoped(ctx, bson.M{}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	docs := r.store.find("event_archive", filter)
+	sortDocuments(docs, "-createdAt")
+	archives := make([]EventArchive, 0)
+	err = decodeDocuments(docs, &archives)
+	return archives, err
+}
+
+func (r *memoryEventArchiveRepository) FindById(ctx context.Context, id bson.ObjectId) (*EventArchive, error) {
+	filter, err := memoryScoped(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var archive EventArchive
+	if err := r.store.findOne("event_archive", filter, &archive); err != nil {
+		return nil, err
+	}
+	return &archive, nil
+}
+
+func (r *memoryEventArchiveRepository) Insert(ctx context.Context, archive *EventArchive) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := claim(ctx, &archive.UserId); err != nil {
+		return err
+	}
+	return r.store.insert("event_archive", archive)
+}
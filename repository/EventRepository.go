@@ -0,0 +1,187 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"time"
+)
+
+// EventRepository scopes events through the device that emitted them, since
+// events carry no owner of their own.
+//
+// Events are not unique on deviceId and timestamp, though the migrations were
+// first asked to make them so: a device emits events of several types within
+// the same timestamp, and the services writing events would fail on a unique
+// index and lose them. The index on both only backs listing.
+type EventRepository interface {
+	FindPageByDevice(ctx context.Context, deviceId string, filter EventFilter, p PageRequest) ([]model.Event, string, error)
+	Insert(ctx context.Context, event *model.Event) error
+	// FindExpired returns the raw documents of events older than before,
+	// oldest first, so that archives keep every field the producer wrote.
+	FindExpired(ctx context.Context, deviceId string, before time.Time, limit int) ([]bson.M, error)
+	// RemoveByIds deletes archived events. It needs a system context.
+	RemoveByIds(ctx context.Context, ids []interface{}) (int, error)
+}
+
+// EventFilter narrows an event list. Zero values do not filter; To is
+// exclusive.
+type EventFilter struct {
+	From time.Time
+	To   time.Time
+	Type string
+}
+
+func (f EventFilter) query(deviceId string) bson.M {
+	filter := bson.M{"deviceId": deviceId, "deletedAt": nil}
+	timestamp := bson.M{}
+	if !f.From.IsZero() {
+		timestamp["$gte"] = f.From
+	}
+	if !f.To.IsZero() {
+		timestamp["$lt"] = f.To
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+	if f.Type != "" {
+		filter["type"] = f.Type
+	}
+	return filter
+}
+
+type mongoEventRepository struct{}
+
+func (r *mongoEventRepository) ownsDevice(ctx context.Context, deviceId string) error {
+	filter, err := scoped(ctx, bson.M{"deviceId": deviceId}, "owner")
+	if err != nil {
+		return err
+	}
+	return run(ctx, readOperation, func(db *mgo.Database) error {
+		if count, err := db.C("device").Find(filter).Count(); err != nil {
+			return err
+		} else if count == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (r *mongoEventRepository) FindPageByDevice(ctx context.Context, deviceId string, filter EventFilter, p PageRequest) ([]model.Event, string, error) {
+	if err := r.ownsDevice(ctx, deviceId); err != nil {
+		return nil, "", err
+	}
+	q, err := newPageQuery(p, filter.query(deviceId), "-timestamp", "timestamp", "_id")
+	if err != nil {
+		return nil, "", err
+	}
+	events := make([]model.Event, 0)
+	next := ""
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		docs, cursor, err := findPage(db.C("event"), q)
+		if err != nil {
+			return err
+		}
+		next = cursor
+		return decodeDocuments(docs, &events)
+	})
+	return events, next, err
+}
+
+func (r *mongoEventRepository) Insert(ctx context.Context, event *model.Event) error {
+	if err := r.ownsDevice(ctx, event.DeviceId); err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("event").Insert(event)
+	})
+}
+
+func (r *mongoEventRepository) FindExpired(ctx context.Context, deviceId string, before time.Time, limit int) ([]bson.M, error) {
+	if err := r.ownsDevice(ctx, deviceId); err != nil {
+		return nil, err
+	}
+	docs := make([]bson.M, 0)
+	err := run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		return db.C("event").
+			Find(bson.M{"deviceId": deviceId, "deletedAt": nil, "timestamp": bson.M{"$lt": before}}).
+			Sort("timestamp").
+			Limit(limit).
+			All(&docs)
+	})
+	return docs, err
+}
+
+func (r *mongoEventRepository) RemoveByIds(ctx context.Context, ids []interface{}) (int, error) {
+	if !isSystem(ctx) {
+		return 0, ErrSystemOnly
+	}
+	removed := 0
+	err := run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		info, err := db.C("event").RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+		if err == nil {
+			removed = info.Removed
+		}
+		return err
+	})
+	return removed, err
+}
+
+type memoryEventRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryEventRepository) ownsDevice(ctx context.Context, deviceId string) error {
+	filter, err := memoryScoped(ctx, bson.M{"deviceId": deviceId}, "owner")
+	if err != nil {
+		return err
+	}
+	if r.store.count("device", filter) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *memoryEventRepository) FindPageByDevice(ctx context.Context, deviceId string, filter EventFilter, p PageRequest) ([]model.Event, string, error) {
+	if err := r.ownsDevice(ctx, deviceId); err != nil {
+		return nil, "", err
+	}
+	q, err := newPageQuery(p, filter.query(deviceId), "-timestamp", "timestamp", "_id")
+	if err != nil {
+		return nil, "", err
+	}
+	docs, next := r.store.findPage("event", q)
+	events := make([]model.Event, 0)
+	err = decodeDocuments(docs, &events)
+	return events, next, err
+}
+
+func (r *memoryEventRepository) Insert(ctx context.Context, event *model.Event) error {
+	if err := r.ownsDevice(ctx, event.DeviceId); err != nil {
+		return err
+	}
+	return r.store.insert("event", event)
+}
+
+func (r *memoryEventRepository) FindExpired(ctx context.Context, deviceId string, before time.Time, limit int) ([]bson.M, error) {
+	if err := r.ownsDevice(ctx, deviceId); err != nil {
+		return nil, err
+	}
+	docs := r.store.find("event", bson.M{"deviceId": deviceId, "deletedAt": nil, "timestamp": bson.M{"$lt": before}})
+	sortDocuments(docs, "timestamp")
+	if len(docs) > limit {
+		docs = docs[:limit]
+	}
+	return docs, nil
+}
+
+func (r *memoryEventRepository) RemoveByIds(ctx context.Context, ids []interface{}) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+	if !isSystem(ctx) {
+		return 0, ErrSystemOnly
+	}
+	return r.store.remove("event", bson.M{"_id": bson.M{"$in": ids}}), nil
+}
@@ -0,0 +1,283 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"sort"
+	"time"
+)
+
+var ErrLabelExists = errors.New("label already exists")
+
+type LabelSummary struct {
+	Label       string    `json:"label" bson:"_id"`
+	Count       int       `json:"count" bson:"count"`
+	LastUpdated time.Time `json:"lastUpdated" bson:"-"`
+}
+
+// Label operations span faces in the trash too: they share the unique
+// (userId, label, md5) index with live faces, and a restored desk should not
+// bring a renamed or deleted label back. Where a live face needs the key of a
+// face in the trash, the face in the trash is removed for good. Labels are
+// deleted through the trash, see TrashRepository.DeleteLabel.
+
+func (r *mongoFaceRepository) Labels(ctx context.Context) ([]LabelSummary, error) {
+	filter, err := owned(ctx, bson.M{"deletedAt": nil}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		LabelSummary `bson:",inline"`
+		LastId       bson.ObjectId `bson:"lastId"`
+		UpdatedAt    time.Time     `bson:"updatedAt"`
+	}
+	err = run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		return db.C("face").Pipe([]bson.M{
+			{"$match": filter},
+			{"$group": bson.M{
+				"_id":       "$label",
+				"count":     bson.M{"$sum": 1},
+				"lastId":    bson.M{"$max": "$_id"},
+				"updatedAt": bson.M{"$max": "$updatedAt"},
+			}},
+			{"$sort": bson.M{"_id": 1}},
+		}).All(&groups)
+	})
+	labels := make([]LabelSummary, 0, len(groups))
+	for _, g := range groups {
+		g.LastUpdated = lastUpdated(g.LastId, g.UpdatedAt)
+		labels = append(labels, g.LabelSummary)
+	}
+	return labels, err
+}
+
+func (r *mongoFaceRepository) RenameLabel(ctx context.Context, from string, to string) (int, error) {
+	owner, err := owned(ctx, bson.M{}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	renamed := 0
+	err = run(ctx, writeOperation, func(db *mgo.Database) error {
+		if count, err := db.C("face").Find(liveLabel(owner, to)).Count(); err != nil {
+			return err
+		} else if count > 0 {
+			return ErrLabelExists
+		}
+		// a deleted label gives its name up along with its faces, which
+		// could not be restored without mixing with the renamed ones
+		if _, err := removeFaces(db, trashedLabel(owner, to)); err != nil {
+			return err
+		}
+		// faces may reach to while the faces of from are renamed one by
+		// one; the rename is then undone
+		var ids []bson.ObjectId
+		if err := db.C("face").Find(withLabel(owner, from)).Distinct("_id", &ids); err != nil {
+			return err
+		}
+		renaming := bson.M{"_id": bson.M{"$in": ids}}
+		info, err := db.C("face").UpdateAll(withLabel(renaming, from), bson.M{"$set": bson.M{"label": to, "updatedAt": time.Now()}})
+		if err == nil {
+			others := withLabel(owner, to)
+			others["_id"] = bson.M{"$nin": ids}
+			var count int
+			if count, err = db.C("face").Find(others).Count(); err == nil && count > 0 {
+				err = ErrLabelExists
+			}
+		} else if IsDuplicate(err) {
+			err = ErrLabelExists
+		}
+		if err == ErrLabelExists {
+			if _, undoErr := db.C("face").UpdateAll(withLabel(renaming, to), bson.M{"$set": bson.M{"label": from}}); undoErr != nil {
+				return undoErr
+			}
+			return err
+		}
+		if err == nil {
+			renamed = info.Updated
+		}
+		return err
+	})
+	return renamed, err
+}
+
+func (r *mongoFaceRepository) MergeLabel(ctx context.Context, from string, into string) (int, error) {
+	owner, err := owned(ctx, bson.M{}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	err = run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		var existing, moving []string
+		if err := db.C("face").Find(liveLabel(owner, into)).Distinct("md5", &existing); err != nil {
+			return err
+		}
+		duplicates := withLabel(owner, from)
+		duplicates["md5"] = bson.M{"$in": existing}
+		dropped, err := removeFaces(db, duplicates)
+		if err != nil {
+			return err
+		}
+		if err := db.C("face").Find(withLabel(owner, from)).Distinct("md5", &moving); err != nil {
+			return err
+		}
+		trashed := trashedLabel(owner, into)
+		trashed["md5"] = bson.M{"$in": moving}
+		if _, err := removeFaces(db, trashed); err != nil {
+			return err
+		}
+		info, err := db.C("face").UpdateAll(withLabel(owner, from), bson.M{"$set": bson.M{"label": into, "updatedAt": time.Now()}})
+		if err == nil {
+			moved = dropped + info.Updated
+		}
+		return err
+	})
+	return moved, err
+}
+
+// removeFaces removes the faces matching filter for good, along with the
+// crops no remaining face uses, and counts them.
+func removeFaces(db *mgo.Database, filter bson.M) (int, error) {
+	var faces []struct {
+		Id     bson.ObjectId `bson:"_id"`
+		CropId bson.ObjectId `bson:"cropId,omitempty"`
+	}
+	if err := db.C("face").Find(filter).All(&faces); err != nil || len(faces) == 0 {
+		return 0, err
+	}
+	ids := make([]bson.ObjectId, len(faces))
+	for i, face := range faces {
+		ids[i] = face.Id
+	}
+	info, err := db.C("face").RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+	for _, face := range faces {
+		if face.CropId == "" {
+			continue
+		}
+		if count, err := db.C("face").Find(bson.M{"cropId": face.CropId}).Count(); err != nil {
+			return 0, err
+		} else if count == 0 {
+			if err := removeFrameFile(db, face.CropId); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return info.Removed, nil
+}
+
+func (r *memoryFaceRepository) Labels(ctx context.Context) ([]LabelSummary, error) {
+	filter, err := owned(ctx, bson.M{"deletedAt": nil}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	byLabel := make(map[string]*LabelSummary)
+	for _, doc := range r.store.find("face", filter) {
+		label, _ := doc["label"].(string)
+		summary := byLabel[label]
+		if summary == nil {
+			summary = &LabelSummary{Label: label}
+			byLabel[label] = summary
+		}
+		summary.Count++
+		id, _ := doc["_id"].(bson.ObjectId)
+		updatedAt, _ := doc["updatedAt"].(time.Time)
+		if t := lastUpdated(id, updatedAt); t.After(summary.LastUpdated) {
+			summary.LastUpdated = t
+		}
+	}
+	labels := make([]LabelSummary, 0, len(byLabel))
+	for _, summary := range byLabel {
+		labels = append(labels, *summary)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Label < labels[j].Label
+	})
+	return labels, nil
+}
+
+func (r *memoryFaceRepository) RenameLabel(ctx context.Context, from string, to string) (int, error) {
+	owner, err := owned(ctx, bson.M{}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	if r.store.count("face", liveLabel(owner, to)) > 0 {
+		return 0, ErrLabelExists
+	}
+	r.removeFaces(trashedLabel(owner, to))
+	n, err := r.store.update("face", withLabel(owner, from), bson.M{"label": to, "updatedAt": time.Now()})
+	if err == ErrDuplicateKey {
+		return 0, ErrLabelExists
+	}
+	return n, err
+}
+
+func (r *memoryFaceRepository) MergeLabel(ctx context.Context, from string, into string) (int, error) {
+	owner, err := owned(ctx, bson.M{}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	existing := make([]interface{}, 0)
+	for _, doc := range r.store.find("face", liveLabel(owner, into)) {
+		existing = append(existing, doc["md5"])
+	}
+	duplicates := withLabel(owner, from)
+	duplicates["md5"] = bson.M{"$in": existing}
+	dropped := r.removeFaces(duplicates)
+	moving := make([]interface{}, 0)
+	for _, doc := range r.store.find("face", withLabel(owner, from)) {
+		moving = append(moving, doc["md5"])
+	}
+	trashed := trashedLabel(owner, into)
+	trashed["md5"] = bson.M{"$in": moving}
+	r.removeFaces(trashed)
+	moved, err := r.store.update("face", withLabel(owner, from), bson.M{"label": into, "updatedAt": time.Now()})
+	return dropped + moved, err
+}
+
+func (r *memoryFaceRepository) removeFaces(filter bson.M) int {
+	docs := r.store.find("face", filter)
+	ids := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc["_id"]
+	}
+	removed := r.store.remove("face", bson.M{"_id": bson.M{"$in": ids}})
+	for _, doc := range docs {
+		if cropId, ok := doc["cropId"]; ok && r.store.count("face", bson.M{"cropId": cropId}) == 0 {
+			r.store.remove("frame", bson.M{"_id": cropId})
+		}
+	}
+	return removed
+}
+
+func withLabel(owner bson.M, label string) bson.M {
+	filter := bson.M{"label": label}
+	for k, v := range owner {
+		filter[k] = v
+	}
+	return filter
+}
+
+func liveLabel(owner bson.M, label string) bson.M {
+	filter := withLabel(owner, label)
+	filter["deletedAt"] = nil
+	return filter
+}
+
+func trashedLabel(owner bson.M, label string) bson.M {
+	filter := withLabel(owner, label)
+	filter["deletedAt"] = bson.M{"$ne": nil}
+	return filter
+}
+
+// lastUpdated is the later of the creation time of the newest face and the
+// last time faces were relabeled.
+func lastUpdated(lastId bson.ObjectId, updatedAt time.Time) time.Time {
+	if lastId.Valid() && lastId.Time().After(updatedAt) {
+		return lastId.Time()
+	}
+	return updatedAt
+}
@@ -0,0 +1,155 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"testing"
+	"time"
+)
+
+func TestLabelTrash(t *testing.T) {
+	repos := NewMemoryRepositories()
+	ctx := WithOwner(context.Background(), bson.NewObjectId())
+	for _, f := range []struct{ label, md5 string }{{"alice", "1"}, {"alice", "2"}, {"bob", "1"}} {
+		face := model.Face{Id: bson.NewObjectId(), Label: f.label, MD5: f.md5}
+		if err := repos.Faces.Insert(ctx, &face); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := repos.Faces.RenameLabel(ctx, "alice", "bob"); err != ErrLabelExists {
+		t.Fatalf("expected ErrLabelExists, got %v", err)
+	}
+	if n, err := repos.Trash.DeleteLabel(ctx, "alice"); err != nil || n != 2 {
+		t.Fatalf("expected 2 faces deleted, got %d, %v", n, err)
+	}
+	if n, _ := repos.Trash.DeleteLabel(ctx, "alice"); n != 0 {
+		t.Fatalf("a deleted label was deleted again: %d", n)
+	}
+	if labels, _ := repos.Faces.Labels(ctx); len(labels) != 1 || labels[0].Label != "bob" {
+		t.Fatalf("expected bob only, got %+v", labels)
+	}
+	if n, err := repos.Trash.RestoreLabel(ctx, "alice", time.Now().Add(-time.Hour)); err != nil || n != 2 {
+		t.Fatalf("expected 2 faces restored, got %d, %v", n, err)
+	}
+	if labels, _ := repos.Faces.Labels(ctx); len(labels) != 2 {
+		t.Fatalf("expected alice and bob, got %+v", labels)
+	}
+	if _, err := repos.Trash.RestoreLabel(ctx, "alice", time.Now().Add(-time.Hour)); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRenameLabelThresholds(t *testing.T) {
+	repos := NewMemoryRepositories()
+	ctx := WithOwner(context.Background(), bson.NewObjectId())
+	for _, th := range []LabelThreshold{
+		{Model: "m", Label: "alice", Metric: "euclidean", Threshold: 0.1},
+		{Model: "m", Label: "alice", Metric: "cosine", Threshold: 0.2},
+		{Model: "m", Label: "bob", Metric: "euclidean", Threshold: 0.3},
+	} {
+		if err := repos.Thresholds.Upsert(ctx, &th); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := repos.Thresholds.RenameLabel(ctx, "alice", "bob"); err != nil || n != 1 {
+		t.Fatalf("expected 1 threshold renamed, got %d, %v", n, err)
+	}
+	thresholds, _ := repos.Thresholds.FindAll(ctx, "m")
+	got := make(map[string]float64)
+	for _, th := range thresholds {
+		got[th.Label+"/"+th.Metric] = th.Threshold
+	}
+	if len(got) != 2 || got["bob/euclidean"] != 0.3 || got["bob/cosine"] != 0.2 {
+		t.Fatalf("expected the thresholds of bob to be kept, got %v", got)
+	}
+}
+
+func TestTrashedFacesGiveWay(t *testing.T) {
+	repos := NewMemoryRepositories()
+	ctx := WithOwner(context.Background(), bson.NewObjectId())
+	crops := make(map[string]bson.ObjectId)
+	upsert := func(label, md5 string) bool {
+		cropId, err := repos.Frames.Insert(ctx, label+md5+"-crop.jpg", []byte{0xff, 0xd8})
+		if err != nil {
+			t.Fatal(err)
+		}
+		face := model.Face{Id: bson.NewObjectId(), Label: label, MD5: md5}
+		inserted, err := repos.Faces.Upsert(ctx, &face, FaceMeta{Model: "m", CropId: cropId})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inserted {
+			crops[label+md5] = cropId
+		}
+		return inserted
+	}
+	cropKept := func(key string) bool {
+		_, err := repos.Frames.Read(ctx, crops[key])
+		return err == nil
+	}
+	counts := func() map[string]int {
+		labels, err := repos.Faces.Labels(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[string]int)
+		for _, l := range labels {
+			counts[l.Label] = l.Count
+		}
+		return counts
+	}
+
+	// uploading a face of a deleted label again stores it anew
+	upsert("alice", "1")
+	upsert("alice", "2")
+	if _, err := repos.Trash.DeleteLabel(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	trashedCrop := crops["alice1"]
+	if !upsert("alice", "1") || upsert("alice", "1") {
+		t.Fatal("expected the face in the trash to make room once")
+	}
+	if counts()["alice"] != 1 || !cropKept("alice1") {
+		t.Fatalf("expected alice with 1 face and its crop, got %v", counts())
+	}
+	if _, err := repos.Frames.Read(ctx, trashedCrop); err == nil {
+		t.Fatal("expected the crop of the face in the trash to be gone")
+	}
+
+	// renaming onto a deleted label takes its name for good
+	upsert("bob", "3")
+	upsert("carol", "3")
+	if _, err := repos.Trash.DeleteLabel(ctx, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := repos.Faces.RenameLabel(ctx, "bob", "carol"); err != nil || n != 1 {
+		t.Fatalf("expected 1 face renamed, got %d, %v", n, err)
+	}
+	if _, err := repos.Trash.RestoreLabel(ctx, "carol", time.Now().Add(-time.Hour)); err != ErrNotFound {
+		t.Fatalf("expected nothing to restore, got %v", err)
+	}
+	if cropKept("carol3") || !cropKept("bob3") {
+		t.Fatal("expected the crop of the removed face only to be gone")
+	}
+
+	// merging keeps the faces into has in the trash only
+	for _, md5 := range []string{"7", "8", "9"} {
+		upsert("dave", md5)
+	}
+	upsert("erin", "7")
+	if _, err := repos.Trash.DeleteLabel(ctx, "erin"); err != nil {
+		t.Fatal(err)
+	}
+	upsert("erin", "9")
+	if n, err := repos.Faces.MergeLabel(ctx, "dave", "erin"); err != nil || n != 3 {
+		t.Fatalf("expected 3 faces merged, got %d, %v", n, err)
+	}
+	if c := counts(); c["erin"] != 3 || c["dave"] != 0 {
+		t.Fatalf("expected erin with 3 faces, got %v", c)
+	}
+	if cropKept("dave9") || !cropKept("erin9") || !cropKept("dave7") || cropKept("erin7") {
+		t.Fatal("expected the crops of the dropped faces only to be gone")
+	}
+}
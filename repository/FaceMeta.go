@@ -0,0 +1,63 @@
+package repository
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+)
+
+// LegacyDescriptorModel names the model of the faces stored before faces
+// recorded the model of their descriptor.
+const LegacyDescriptorModel = "dlib_face_recognition_resnet_model_v1"
+
+// FaceMeta is what a face records besides model.Face: the model that computed
+// its descriptor and, when known, the face image it was computed from, which
+// lets it be computed again by another model.
+type FaceMeta struct {
+	Model  string        `json:"model" bson:"model"`
+	CropId bson.ObjectId `json:"cropId,omitempty" bson:"cropId,omitempty"`
+}
+
+// StoredFace is a face along with its meta.
+type StoredFace struct {
+	model.Face `bson:",inline"`
+	FaceMeta   `bson:",inline"`
+}
+
+func (m FaceMeta) document(face *model.Face) (bson.M, error) {
+	doc, err := toDocument(face)
+	if err != nil {
+		return nil, err
+	}
+	doc["model"] = m.Model
+	if m.CropId != "" {
+		doc["cropId"] = m.CropId
+	}
+	return doc, nil
+}
+
+// StrandedFaces counts the faces computed by another model than the current
+// one that have no crop to be computed again from, so never match again.
+type StrandedFaces struct {
+	Faces int `json:"faces"`
+	// Users counts the users left with no face to match at all.
+	Users int `json:"users"`
+}
+
+func (s *StrandedFaces) add(current int, recoverable int, stranded int) {
+	s.Faces += stranded
+	if stranded > 0 && current == 0 && recoverable == 0 {
+		s.Users++
+	}
+}
+
+func staleFilter(descriptorModel string, after bson.ObjectId) bson.M {
+	filter := bson.M{
+		"model":     bson.M{"$ne": descriptorModel},
+		"cropId":    bson.M{"$exists": true},
+		"deletedAt": nil,
+	}
+	if after != "" {
+		filter["_id"] = bson.M{"$gt": after}
+	}
+	return filter
+}
@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"testing"
+)
+
+func TestCountStranded(t *testing.T) {
+	repos := NewMemoryRepositories()
+	store := func(owner bson.ObjectId, md5 string, meta FaceMeta) {
+		face := model.Face{Id: bson.NewObjectId(), Label: "label", MD5: md5}
+		if _, err := repos.Faces.Upsert(WithOwner(context.Background(), owner), &face, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a user with faces of the new model, one with a crop to compute again
+	// from and one with legacy faces only
+	current, cropped, legacy := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+	store(current, "1", FaceMeta{Model: "new"})
+	store(current, "2", FaceMeta{Model: LegacyDescriptorModel})
+	store(cropped, "1", FaceMeta{Model: LegacyDescriptorModel, CropId: bson.NewObjectId()})
+	store(cropped, "2", FaceMeta{Model: LegacyDescriptorModel})
+	store(legacy, "1", FaceMeta{Model: LegacyDescriptorModel})
+	store(legacy, "2", FaceMeta{Model: LegacyDescriptorModel})
+
+	stranded, err := repos.Faces.CountStranded(AsSystem(context.Background()), "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stranded.Faces != 4 || stranded.Users != 1 {
+		t.Fatalf("expected 4 faces and 1 user stranded, got %+v", stranded)
+	}
+	if _, err := repos.Faces.CountStranded(WithOwner(context.Background(), legacy), "new"); err != ErrSystemOnly {
+		t.Fatalf("expected ErrSystemOnly, got %v", err)
+	}
+}
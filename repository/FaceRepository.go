@@ -0,0 +1,397 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"strings"
+	"time"
+)
+
+type FaceRepository interface {
+	// FindAll returns the gallery of the owner made of descriptors of one
+	// model.
+	FindAll(ctx context.Context, descriptorModel string) ([]model.Face, error)
+	FindByDesk(ctx context.Context, deskId string) ([]model.Face, error)
+	FindByLabel(ctx context.Context, label string) ([]model.Face, error)
+	// FindPageByDesk lists the faces of a desk, optionally of one label only.
+	FindPageByDesk(ctx context.Context, deskId string, label string, p PageRequest) ([]model.Face, string, error)
+	FindPageByLabel(ctx context.Context, label string, p PageRequest) ([]model.Face, string, error)
+	Insert(ctx context.Context, face *model.Face) error
+	// Upsert stores face unless the owner already has one with the same label
+	// and md5, in which case it reports false and leaves the stored one as is.
+	// A face in the trash with the same label and md5 is removed for good.
+	Upsert(ctx context.Context, face *model.Face, meta FaceMeta) (bool, error)
+	// SetCrop attaches the image a face was computed from.
+	SetCrop(ctx context.Context, id bson.ObjectId, cropId bson.ObjectId) error
+	// FindStale returns faces of every user that have a crop but were not
+	// computed by descriptorModel, in _id order after the given id. It needs
+	// a system context.
+	FindStale(ctx context.Context, descriptorModel string, after bson.ObjectId, limit int) ([]StoredFace, error)
+	// CountStranded counts the faces of every user that FindStale cannot
+	// return for lack of a crop. It needs a system context.
+	CountStranded(ctx context.Context, descriptorModel string) (StrandedFaces, error)
+	// Supersede moves a face to the trash in favour of the face computed
+	// again from its crop by another model.
+	Supersede(ctx context.Context, id bson.ObjectId, by bson.ObjectId) error
+
+	// Labels summarizes the labels of the owner gallery.
+	Labels(ctx context.Context) ([]LabelSummary, error)
+	// RenameLabel moves every face of a label to a label the owner does not
+	// use yet, or fails with ErrLabelExists. The faces of a deleted label of
+	// the new name are removed for good.
+	RenameLabel(ctx context.Context, from string, to string) (int, error)
+	// MergeLabel moves every face of from into into, dropping the faces whose
+	// descriptor a live face of into already has. It counts both moved and
+	// dropped faces.
+	MergeLabel(ctx context.Context, from string, into string) (int, error)
+}
+
+// facePageQuery lists faces by _id, label or createdAt. The id of a face is
+// taken when the face is stored, so it serves createdAt.
+func facePageQuery(p PageRequest, filter bson.M) (*pageQuery, error) {
+	if strings.TrimPrefix(p.Sort, "-") == "createdAt" {
+		p.Sort = strings.TrimSuffix(p.Sort, "createdAt") + "_id"
+	}
+	return newPageQuery(p, filter, "_id", "_id", "label")
+}
+
+type mongoFaceRepository struct{}
+
+func (r *mongoFaceRepository) FindAll(ctx context.Context, descriptorModel string) ([]model.Face, error) {
+	filter, err := owned(ctx, bson.M{"deletedAt": nil, "model": descriptorModel}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	faces := make([]model.Face, 0)
+	err = run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		return db.C("face").Find(filter).All(&faces)
+	})
+	return faces, err
+}
+
+func (r *mongoFaceRepository) FindByDesk(ctx context.Context, deskId string) ([]model.Face, error) {
+	filter, err := scoped(ctx, bson.M{"deskId": deskId}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var faces []model.Face
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("face").Find(filter).All(&faces)
+	})
+	return faces, err
+}
+
+func (r *mongoFaceRepository) FindByLabel(ctx context.Context, label string) ([]model.Face, error) {
+	filter, err := scoped(ctx, bson.M{"label": label}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	faces := make([]model.Face, 0)
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("face").Find(filter).All(&faces)
+	})
+	return faces, err
+}
+
+func (r *mongoFaceRepository) FindPageByDesk(ctx context.Context, deskId string, label string, p PageRequest) ([]model.Face, string, error) {
+	filter := bson.M{"deskId": deskId}
+	if label != "" {
+		filter["label"] = label
+	}
+	return r.findPage(ctx, filter, p)
+}
+
+func (r *mongoFaceRepository) FindPageByLabel(ctx context.Context, label string, p PageRequest) ([]model.Face, string, error) {
+	return r.findPage(ctx, bson.M{"label": label}, p)
+}
+
+func (r *mongoFaceRepository) findPage(ctx context.Context, filter bson.M, p PageRequest) ([]model.Face, string, error) {
+	filter, err := scoped(ctx, filter, "userId")
+	if err != nil {
+		return nil, "", err
+	}
+	q, err := facePageQuery(p, filter)
+	if err != nil {
+		return nil, "", err
+	}
+	faces := make([]model.Face, 0)
+	next := ""
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		docs, cursor, err := findPage(db.C("face"), q)
+		if err != nil {
+			return err
+		}
+		next = cursor
+		return decodeDocuments(docs, &faces)
+	})
+	return faces, next, err
+}
+
+func (r *mongoFaceRepository) Insert(ctx context.Context, face *model.Face) error {
+	if err := claim(ctx, &face.UserId); err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("face").Insert(face)
+	})
+}
+
+func (r *mongoFaceRepository) Upsert(ctx context.Context, face *model.Face, meta FaceMeta) (bool, error) {
+	if err := claim(ctx, &face.UserId); err != nil {
+		return false, err
+	}
+	doc, err := meta.document(face)
+	if err != nil {
+		return false, err
+	}
+	key := bson.M{"userId": face.UserId, "label": face.Label, "md5": face.MD5}
+	trashed := trashedLabel(bson.M{"userId": face.UserId, "md5": face.MD5}, face.Label)
+	inserted := false
+	err = run(ctx, writeOperation, func(db *mgo.Database) error {
+		if _, err := removeFaces(db, trashed); err != nil {
+			return err
+		}
+		info, err := db.C("face").Upsert(
+			key,
+			bson.M{"$setOnInsert": doc},
+		)
+		if IsDuplicate(err) {
+			// a concurrent upload stored the same face first
+			return nil
+		}
+		if err == nil {
+			inserted = info.UpsertedId != nil
+		}
+		return err
+	})
+	return inserted, err
+}
+
+func (r *mongoFaceRepository) SetCrop(ctx context.Context, id bson.ObjectId, cropId bson.ObjectId) error {
+	filter, err := owned(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("face").Update(filter, bson.M{"$set": bson.M{"cropId": cropId}})
+	})
+}
+
+func (r *mongoFaceRepository) FindStale(ctx context.Context, descriptorModel string, after bson.ObjectId, limit int) ([]StoredFace, error) {
+	if !isSystem(ctx) {
+		return nil, ErrSystemOnly
+	}
+	faces := make([]StoredFace, 0)
+	err := run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		return db.C("face").Find(staleFilter(descriptorModel, after)).Sort("_id").Limit(limit).All(&faces)
+	})
+	return faces, err
+}
+
+func (r *mongoFaceRepository) CountStranded(ctx context.Context, descriptorModel string) (StrandedFaces, error) {
+	var stranded StrandedFaces
+	if !isSystem(ctx) {
+		return stranded, ErrSystemOnly
+	}
+	current := bson.M{"$eq": []interface{}{"$model", descriptorModel}}
+	cropped := bson.M{"$ifNull": []interface{}{"$cropId", false}}
+	count := func(cond interface{}) bson.M {
+		return bson.M{"$sum": bson.M{"$cond": []interface{}{cond, 1, 0}}}
+	}
+	var users []struct {
+		Current     int `bson:"current"`
+		Recoverable int `bson:"recoverable"`
+		Stranded    int `bson:"stranded"`
+	}
+	err := run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		return db.C("face").Pipe([]bson.M{
+			{"$match": bson.M{"deletedAt": nil}},
+			{"$group": bson.M{
+				"_id":         "$userId",
+				"current":     count(current),
+				"recoverable": count(bson.M{"$and": []interface{}{bson.M{"$not": []interface{}{current}}, cropped}}),
+				"stranded":    count(bson.M{"$not": []interface{}{bson.M{"$or": []interface{}{current, cropped}}}}),
+			}},
+		}).All(&users)
+	})
+	for _, u := range users {
+		stranded.add(u.Current, u.Recoverable, u.Stranded)
+	}
+	return stranded, err
+}
+
+func (r *mongoFaceRepository) Supersede(ctx context.Context, id bson.ObjectId, by bson.ObjectId) error {
+	filter, err := scoped(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("face").Update(filter, bson.M{"$set": bson.M{"deletedAt": time.Now(), "supersededBy": by}})
+	})
+}
+
+type memoryFaceRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryFaceRepository) FindAll(ctx context.Context, descriptorModel string) ([]model.Face, error) {
+	filter, err := owned(ctx, bson.M{"deletedAt": nil, "model": descriptorModel}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	faces := make([]model.Face, 0)
+	err = decodeDocuments(r.store.find("face", filter), &faces)
+	return faces, err
+}
+
+func (r *memoryFaceRepository) FindByDesk(ctx context.Context, deskId string) ([]model.Face, error) {
+	filter, err := memoryScoped(ctx, bson.M{"deskId": deskId}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var faces []model.Face
+	err = decodeDocuments(r.store.find("face", filter), &faces)
+	return faces, err
+}
+
+func (r *memoryFaceRepository) FindByLabel(ctx context.Context, label string) ([]model.Face, error) {
+	filter, err := memoryScoped(ctx, bson.M{"label": label}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	faces := make([]model.Face, 0)
+	err = decodeDocuments(r.store.find("face", filter), &faces)
+	return faces, err
+}
+
+func (r *memoryFaceRepository) FindPageByDesk(ctx context.Context, deskId string, label string, p PageRequest) ([]model.Face, string, error) {
+	filter := bson.M{"deskId": deskId}
+	if label != "" {
+		filter["label"] = label
+	}
+	return r.findPage(ctx, filter, p)
+}
+
+func (r *memoryFaceRepository) FindPageByLabel(ctx context.Context, label string, p PageRequest) ([]model.Face, string, error) {
+	return r.findPage(ctx, bson.M{"label": label}, p)
+}
+
+func (r *memoryFaceRepository) findPage(ctx context.Context, filter bson.M, p PageRequest) ([]model.Face, string, error) {
+	filter, err := memoryScoped(ctx, filter, "userId")
+	if err != nil {
+		return nil, "", err
+	}
+	q, err := facePageQuery(p, filter)
+	if err != nil {
+		return nil, "", err
+	}
+	docs, next := r.store.findPage("face", q)
+	faces := make([]model.Face, 0)
+	err = decodeDocuments(docs, &faces)
+	return faces, next, err
+}
+
+func (r *memoryFaceRepository) Insert(ctx context.Context, face *model.Face) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := claim(ctx, &face.UserId); err != nil {
+		return err
+	}
+	return r.store.insert("face", face)
+}
+
+func (r *memoryFaceRepository) Upsert(ctx context.Context, face *model.Face, meta FaceMeta) (bool, error) {
+	if err := checkContext(ctx); err != nil {
+		return false, err
+	}
+	if err := claim(ctx, &face.UserId); err != nil {
+		return false, err
+	}
+	key := bson.M{"userId": face.UserId, "label": face.Label, "md5": face.MD5}
+	r.removeFaces(trashedLabel(bson.M{"userId": face.UserId, "md5": face.MD5}, face.Label))
+	if r.store.count("face", key) > 0 {
+		return false, nil
+	}
+	doc, err := meta.document(face)
+	if err != nil {
+		return false, err
+	}
+	return true, r.store.insert("face", doc)
+}
+
+func (r *memoryFaceRepository) SetCrop(ctx context.Context, id bson.ObjectId, cropId bson.ObjectId) error {
+	filter, err := owned(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return err
+	}
+	if n, err := r.store.update("face", filter, bson.M{"cropId": cropId}); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *memoryFaceRepository) FindStale(ctx context.Context, descriptorModel string, after bson.ObjectId, limit int) ([]StoredFace, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if !isSystem(ctx) {
+		return nil, ErrSystemOnly
+	}
+	docs := r.store.find("face", staleFilter(descriptorModel, after))
+	sortDocuments(docs, "_id")
+	if len(docs) > limit {
+		docs = docs[:limit]
+	}
+	faces := make([]StoredFace, 0)
+	err := decodeDocuments(docs, &faces)
+	return faces, err
+}
+
+func (r *memoryFaceRepository) CountStranded(ctx context.Context, descriptorModel string) (StrandedFaces, error) {
+	var stranded StrandedFaces
+	if err := checkContext(ctx); err != nil {
+		return stranded, err
+	}
+	if !isSystem(ctx) {
+		return stranded, ErrSystemOnly
+	}
+	users := make(map[bson.ObjectId]*[3]int)
+	for _, doc := range r.store.find("face", bson.M{"deletedAt": nil}) {
+		userId, _ := doc["userId"].(bson.ObjectId)
+		counts := users[userId]
+		if counts == nil {
+			counts = new([3]int)
+			users[userId] = counts
+		}
+		switch {
+		case doc["model"] == descriptorModel:
+			counts[0]++
+		case doc["cropId"] != nil:
+			counts[1]++
+		default:
+			counts[2]++
+		}
+	}
+	for _, counts := range users {
+		stranded.add(counts[0], counts[1], counts[2])
+	}
+	return stranded, nil
+}
+
+func (r *memoryFaceRepository) Supersede(ctx context.Context, id bson.ObjectId, by bson.ObjectId) error {
+	filter, err := memoryScoped(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return err
+	}
+	if n, err := r.store.update("face", filter, bson.M{"deletedAt": time.Now(), "supersededBy": by}); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
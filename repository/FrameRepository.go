@@ -0,0 +1,146 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"io/ioutil"
+)
+
+// FrameRepository stores captured camera frames as JPEG files. Mongo keeps
+// them in the "frame" GridFS bucket with their owner in the file metadata.
+type FrameRepository interface {
+	Insert(ctx context.Context, name string, data []byte) (bson.ObjectId, error)
+	Read(ctx context.Context, id bson.ObjectId) ([]byte, error)
+	Remove(ctx context.Context, ids ...bson.ObjectId) error
+}
+
+// FrameIds lists the stored files of frames, thumbnails included.
+func FrameIds(frames []RecognitionFrame) []bson.ObjectId {
+	ids := make([]bson.ObjectId, 0, 2*len(frames))
+	for _, frame := range frames {
+		if frame.FileId.Valid() {
+			ids = append(ids, frame.FileId)
+		}
+		if frame.ThumbnailId.Valid() {
+			ids = append(ids, frame.ThumbnailId)
+		}
+	}
+	return ids
+}
+
+type frameMeta struct {
+	UserId bson.ObjectId `bson:"userId"`
+}
+
+type mongoFrameRepository struct{}
+
+func (r *mongoFrameRepository) Insert(ctx context.Context, name string, data []byte) (bson.ObjectId, error) {
+	var meta frameMeta
+	if err := claim(ctx, &meta.UserId); err != nil {
+		return "", err
+	}
+	id := bson.NewObjectId()
+	err := run(ctx, writeOperation, func(db *mgo.Database) error {
+		file, err := db.GridFS("frame").Create(name)
+		if err != nil {
+			return err
+		}
+		file.SetId(id)
+		file.SetContentType("image/jpeg")
+		file.SetMeta(meta)
+		if _, err := file.Write(data); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	})
+	return id, err
+}
+
+func (r *mongoFrameRepository) Read(ctx context.Context, id bson.ObjectId) ([]byte, error) {
+	filter, err := owned(ctx, bson.M{"_id": id}, "metadata.userId")
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		gfs := db.GridFS("frame")
+		if count, err := gfs.Find(filter).Count(); err != nil {
+			return err
+		} else if count == 0 {
+			return ErrNotFound
+		}
+		file, err := gfs.OpenId(id)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		data, err = ioutil.ReadAll(file)
+		return err
+	})
+	return data, err
+}
+
+func (r *mongoFrameRepository) Remove(ctx context.Context, ids ...bson.ObjectId) error {
+	filter, err := scoped(ctx, bson.M{"_id": bson.M{"$in": ids}}, "metadata.userId")
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		gfs := db.GridFS("frame")
+		var found []bson.ObjectId
+		if err := gfs.Find(filter).Distinct("_id", &found); err != nil {
+			return err
+		}
+		for _, id := range found {
+			if err := gfs.RemoveId(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type memoryFrameRepository struct {
+	store *memoryStore
+}
+
+type memoryFrame struct {
+	Id     bson.ObjectId `bson:"_id"`
+	UserId bson.ObjectId `bson:"userId"`
+	Name   string        `bson:"name"`
+	Data   []byte        `bson:"data"`
+}
+
+func (r *memoryFrameRepository) Insert(ctx context.Context, name string, data []byte) (bson.ObjectId, error) {
+	if err := checkContext(ctx); err != nil {
+		return "", err
+	}
+	frame := memoryFrame{Id: bson.NewObjectId(), Name: name, Data: data}
+	if err := claim(ctx, &frame.UserId); err != nil {
+		return "", err
+	}
+	return frame.Id, r.store.insert("frame", &frame)
+}
+
+func (r *memoryFrameRepository) Read(ctx context.Context, id bson.ObjectId) ([]byte, error) {
+	filter, err := owned(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var frame memoryFrame
+	if err := r.store.findOne("frame", filter, &frame); err != nil {
+		return nil, err
+	}
+	return frame.Data, nil
+}
+
+func (r *memoryFrameRepository) Remove(ctx context.Context, ids ...bson.ObjectId) error {
+	filter, err := memoryScoped(ctx, bson.M{"_id": bson.M{"$in": ids}}, "userId")
+	if err != nil {
+		return err
+	}
+	r.store.remove("frame", filter)
+	return nil
+}
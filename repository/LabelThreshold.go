@@ -0,0 +1,194 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"time"
+)
+
+// LabelThreshold is a distance threshold a user set by hand for matching
+// descriptors of Model with Metric against the faces of Label.
+type LabelThreshold struct {
+	Id        bson.ObjectId `json:"id" bson:"_id"`
+	UserId    bson.ObjectId `json:"userId" bson:"userId"`
+	Model     string        `json:"model" bson:"model"`
+	Label     string        `json:"label" bson:"label"`
+	Metric    string        `json:"metric" bson:"metric"`
+	Threshold float64       `json:"threshold" bson:"threshold"`
+	UpdatedAt time.Time     `json:"updatedAt" bson:"updatedAt"`
+}
+
+type LabelThresholdRepository interface {
+	FindAll(ctx context.Context, descriptorModel string) ([]LabelThreshold, error)
+	Upsert(ctx context.Context, threshold *LabelThreshold) error
+	Remove(ctx context.Context, descriptorModel string, label string, metric string) error
+	// RenameLabel and RemoveLabel follow the label changes of the gallery,
+	// for every model. A threshold of from is dropped rather than renamed
+	// when to has one for the same model and metric already, which is kept.
+	RenameLabel(ctx context.Context, from string, to string) (int, error)
+	RemoveLabel(ctx context.Context, label string) (int, error)
+}
+
+func thresholdKey(t *LabelThreshold) bson.M {
+	return bson.M{"model": t.Model, "label": t.Label, "metric": t.Metric}
+}
+
+type mongoLabelThresholdRepository struct{}
+
+func (r *mongoLabelThresholdRepository) FindAll(ctx context.Context, descriptorModel string) ([]LabelThreshold, error) {
+	filter, err := owned(ctx, bson.M{"model": descriptorModel}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	thresholds := make([]LabelThreshold, 0)
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("label_threshold").Find(filter).All(&thresholds)
+	})
+	return thresholds, err
+}
+
+func (r *mongoLabelThresholdRepository) Upsert(ctx context.Context, threshold *LabelThreshold) error {
+	filter, err := owned(ctx, thresholdKey(threshold), "userId")
+	if err != nil {
+		return err
+	}
+	threshold.UserId = filter["userId"].(bson.ObjectId)
+	threshold.UpdatedAt = time.Now()
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		existing := LabelThreshold{}
+		if err := db.C("label_threshold").Find(filter).One(&existing); err == nil {
+			threshold.Id = existing.Id
+		} else if err != mgo.ErrNotFound {
+			return err
+		} else {
+			threshold.Id = bson.NewObjectId()
+		}
+		_, err := db.C("label_threshold").UpsertId(threshold.Id, threshold)
+		return err
+	})
+}
+
+func (r *mongoLabelThresholdRepository) Remove(ctx context.Context, descriptorModel string, label string, metric string) error {
+	filter, err := owned(ctx, bson.M{"model": descriptorModel, "label": label, "metric": metric}, "userId")
+	if err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("label_threshold").Remove(filter)
+	})
+}
+
+func (r *mongoLabelThresholdRepository) RenameLabel(ctx context.Context, from string, to string) (int, error) {
+	filter, err := owned(ctx, bson.M{"label": from}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	renamed := 0
+	err = run(ctx, writeOperation, func(db *mgo.Database) error {
+		var thresholds []LabelThreshold
+		if err := db.C("label_threshold").Find(filter).All(&thresholds); err != nil {
+			return err
+		}
+		for _, t := range thresholds {
+			err := db.C("label_threshold").UpdateId(t.Id, bson.M{"$set": bson.M{"label": to, "updatedAt": time.Now()}})
+			if IsDuplicate(err) {
+				err = db.C("label_threshold").RemoveId(t.Id)
+			} else if err == nil {
+				renamed++
+			}
+			if err != nil && err != mgo.ErrNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	return renamed, err
+}
+
+func (r *mongoLabelThresholdRepository) RemoveLabel(ctx context.Context, label string) (int, error) {
+	filter, err := owned(ctx, bson.M{"label": label}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	err = run(ctx, writeOperation, func(db *mgo.Database) error {
+		info, err := db.C("label_threshold").RemoveAll(filter)
+		if err == nil {
+			removed = info.Removed
+		}
+		return err
+	})
+	return removed, err
+}
+
+type memoryLabelThresholdRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryLabelThresholdRepository) FindAll(ctx context.Context, descriptorModel string) ([]LabelThreshold, error) {
+	filter, err := owned(ctx, bson.M{"model": descriptorModel}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	thresholds := make([]LabelThreshold, 0)
+	err = decodeDocuments(r.store.find("label_threshold", filter), &thresholds)
+	return thresholds, err
+}
+
+func (r *memoryLabelThresholdRepository) Upsert(ctx context.Context, threshold *LabelThreshold) error {
+	filter, err := owned(ctx, thresholdKey(threshold), "userId")
+	if err != nil {
+		return err
+	}
+	threshold.UserId = filter["userId"].(bson.ObjectId)
+	threshold.UpdatedAt = time.Now()
+	existing := LabelThreshold{}
+	if err := r.store.findOne("label_threshold", filter, &existing); err == nil {
+		threshold.Id = existing.Id
+		return r.store.replace("label_threshold", filter, threshold)
+	}
+	threshold.Id = bson.NewObjectId()
+	return r.store.insert("label_threshold", threshold)
+}
+
+func (r *memoryLabelThresholdRepository) Remove(ctx context.Context, descriptorModel string, label string, metric string) error {
+	filter, err := owned(ctx, bson.M{"model": descriptorModel, "label": label, "metric": metric}, "userId")
+	if err != nil {
+		return err
+	}
+	if r.store.remove("label_threshold", filter) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *memoryLabelThresholdRepository) RenameLabel(ctx context.Context, from string, to string) (int, error) {
+	filter, err := owned(ctx, bson.M{"label": from}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	var thresholds []LabelThreshold
+	if err := decodeDocuments(r.store.find("label_threshold", filter), &thresholds); err != nil {
+		return 0, err
+	}
+	renamed := 0
+	for _, t := range thresholds {
+		n, err := r.store.update("label_threshold", bson.M{"_id": t.Id}, bson.M{"label": to, "updatedAt": time.Now()})
+		if err == ErrDuplicateKey {
+			r.store.remove("label_threshold", bson.M{"_id": t.Id})
+		} else if err != nil {
+			return renamed, err
+		}
+		renamed += n
+	}
+	return renamed, nil
+}
+
+func (r *memoryLabelThresholdRepository) RemoveLabel(ctx context.Context, label string) (int, error) {
+	filter, err := owned(ctx, bson.M{"label": label}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	return r.store.remove("label_threshold", filter), nil
+}
@@ -0,0 +1,381 @@
+package repository
+
+import (
+	"errors"
+	"github.com/globalsign/mgo/bson"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrDuplicateKey = errors.New("duplicate key")
+
+// uniqueKeys mirror the unique indexes the migrations create, so that the
+// in-memory repositories fail where Mongo would.
+var uniqueKeys = map[string][][]string{
+	"desk":             {{"deskId"}},
+	"device":           {{"deviceId"}},
+	"face":             {{"userId", "label", "md5"}},
+	"user":             {{"email"}},
+	"slack_config":     {{"userId"}},
+	"service_token":    {{"tokenId"}},
+	"retention_policy": {{"userId", "deviceType"}},
+	"label_threshold":  {{"userId", "model", "label", "metric"}},
+	"device_pairing":   {{"serial"}, {"claimCode"}},
+}
+
+// conflicts reports whether doc shares its _id or a unique key with another
+// document of docs; skip is the position of doc itself in docs, or -1. Like
+// Mongo, a missing field counts as null.
+func conflicts(name string, docs []bson.M, doc bson.M, skip int) bool {
+	for i, existing := range docs {
+		if i == skip {
+			continue
+		}
+		if equalValue(existing["_id"], doc["_id"]) {
+			return true
+		}
+		for _, key := range uniqueKeys[name] {
+			same := true
+			for _, field := range key {
+				same = same && equalValue(existing[field], doc[field])
+			}
+			if same {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// memoryStore keeps documents as bson.M so that the in-memory repositories
+// filter on the same field names as the Mongo queries do.
+type memoryStore struct {
+	lock        sync.RWMutex
+	collections map[string][]bson.M
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{collections: make(map[string][]bson.M)}
+}
+
+func (s *memoryStore) insert(name string, docs ...interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, d := range docs {
+		doc, err := toDocument(d)
+		if err != nil {
+			return err
+		}
+		if conflicts(name, s.collections[name], doc, -1) {
+			return ErrDuplicateKey
+		}
+		s.collections[name] = append(s.collections[name], doc)
+	}
+	return nil
+}
+
+func (s *memoryStore) find(name string, filter bson.M) []bson.M {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	result := make([]bson.M, 0)
+	for _, doc := range s.collections[name] {
+		if matchDocument(doc, filter) {
+			result = append(result, doc)
+		}
+	}
+	return result
+}
+
+func (s *memoryStore) findOne(name string, filter bson.M, out interface{}) error {
+	docs := s.find(name, filter)
+	if len(docs) == 0 {
+		return ErrNotFound
+	}
+	return decodeDocument(docs[0], out)
+}
+
+func (s *memoryStore) count(name string, filter bson.M) int {
+	return len(s.find(name, filter))
+}
+
+// replace swaps the first document matching filter for doc, keeping its _id.
+func (s *memoryStore) replace(name string, filter bson.M, doc interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, existing := range s.collections[name] {
+		if matchDocument(existing, filter) {
+			replacement, err := toDocument(doc)
+			if err != nil {
+				return err
+			}
+			replacement["_id"] = existing["_id"]
+			if conflicts(name, s.collections[name], replacement, i) {
+				return ErrDuplicateKey
+			}
+			s.collections[name][i] = replacement
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// update applies set to every document matching filter and returns the number
+// of documents changed. Nothing is changed when a document would then break a
+// unique key.
+func (s *memoryStore) update(name string, filter bson.M, set bson.M) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	docs := s.collections[name]
+	next := make([]bson.M, len(docs))
+	changed := make([]bool, len(docs))
+	updated := 0
+	for i, doc := range docs {
+		next[i] = doc
+		if matchDocument(doc, filter) {
+			copied := make(bson.M, len(doc)+len(set))
+			for k, v := range doc {
+				copied[k] = v
+			}
+			for k, v := range set {
+				copied[k] = v
+			}
+			next[i], changed[i] = copied, true
+			updated++
+		}
+	}
+	for i, doc := range next {
+		if changed[i] && conflicts(name, next, doc, i) {
+			return 0, ErrDuplicateKey
+		}
+	}
+	s.collections[name] = next
+	return updated, nil
+}
+
+func (s *memoryStore) remove(name string, filter bson.M) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	kept := make([]bson.M, 0, len(s.collections[name]))
+	for _, doc := range s.collections[name] {
+		if !matchDocument(doc, filter) {
+			kept = append(kept, doc)
+		}
+	}
+	removed := len(s.collections[name]) - len(kept)
+	s.collections[name] = kept
+	return removed
+}
+
+func toDocument(in interface{}) (bson.M, error) {
+	data, err := bson.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+func decodeDocument(doc bson.M, out interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, out)
+}
+
+// decodeDocuments unmarshals docs into out, which must be a pointer to a slice.
+func decodeDocuments(docs []bson.M, out interface{}) error {
+	data, err := bson.Marshal(bson.M{"docs": docs})
+	if err != nil {
+		return err
+	}
+	var wrapper struct {
+		Docs bson.Raw `bson:"docs"`
+	}
+	if err := bson.Unmarshal(data, &wrapper); err != nil {
+		return err
+	}
+	return wrapper.Docs.Unmarshal(out)
+}
+
+// matchDocument supports plain equality plus the handful of query operators
+// the repositories use. Like Mongo, a nil value also matches a missing field.
+func matchDocument(doc bson.M, filter bson.M) bool {
+	for k, v := range filter {
+		if k == "$or" {
+			if !matchAny(doc, v) {
+				return false
+			}
+		} else if ops, ok := v.(bson.M); ok && isOperatorDocument(ops) {
+			for op, arg := range ops {
+				if !matchOperator(doc[k], op, arg) {
+					return false
+				}
+			}
+		} else if !equalValue(doc[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(doc bson.M, filters interface{}) bool {
+	for _, f := range toSlice(filters) {
+		if m, ok := f.(bson.M); ok && matchDocument(doc, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func isOperatorDocument(m bson.M) bool {
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return len(m) > 0
+}
+
+func matchOperator(value interface{}, op string, arg interface{}) bool {
+	switch op {
+	case "$ne":
+		return !equalValue(value, arg)
+	case "$in":
+		for _, candidate := range toSlice(arg) {
+			if equalValue(value, candidate) {
+				return true
+			}
+		}
+		return false
+	case "$nin":
+		for _, candidate := range toSlice(arg) {
+			if equalValue(value, candidate) {
+				return false
+			}
+		}
+		return true
+	case "$exists":
+		exists, _ := arg.(bool)
+		return (value != nil) == exists
+	case "$gt":
+		return value != nil && compareValue(value, arg) > 0
+	case "$gte":
+		return value != nil && compareValue(value, arg) >= 0
+	case "$lt":
+		return value != nil && compareValue(value, arg) < 0
+	case "$lte":
+		return value != nil && compareValue(value, arg) <= 0
+	}
+	panic("memoryStore: unsupported operator " + op)
+}
+
+func toSlice(v interface{}) []interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil
+	}
+	result := make([]interface{}, rv.Len())
+	for i := range result {
+		result[i] = rv.Index(i).Interface()
+	}
+	return result
+}
+
+func equalValue(a, b interface{}) bool {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		return ok && fa == fb
+	}
+	if ta, ok := a.(time.Time); ok {
+		tb, ok := b.(time.Time)
+		return ok && ta.Equal(tb)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func compareValue(a, b interface{}) int {
+	// like Mongo, a missing value sorts before any other
+	if a == nil || b == nil {
+		switch {
+		case a != nil:
+			return 1
+		case b != nil:
+			return -1
+		}
+		return 0
+	}
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			switch {
+			case fa < fb:
+				return -1
+			case fa > fb:
+				return 1
+			}
+			return 0
+		}
+	}
+	if ta, ok := a.(time.Time); ok {
+		if tb, ok := b.(time.Time); ok {
+			switch {
+			case ta.Before(tb):
+				return -1
+			case ta.After(tb):
+				return 1
+			}
+			return 0
+		}
+	}
+	if sa, ok := a.(string); ok {
+		if sb, ok := b.(string); ok {
+			return strings.Compare(sa, sb)
+		}
+	}
+	if ia, ok := a.(bson.ObjectId); ok {
+		if ib, ok := b.(bson.ObjectId); ok {
+			return strings.Compare(string(ia), string(ib))
+		}
+	}
+	return 0
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// sortDocuments sorts docs by fields the way mgo's Query.Sort does: a leading
+// "-" means descending.
+func sortDocuments(docs []bson.M, fields ...string) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, field := range fields {
+			desc := strings.HasPrefix(field, "-")
+			field = strings.TrimPrefix(field, "-")
+			c := compareValue(docs[i][field], docs[j][field])
+			if c == 0 {
+				continue
+			}
+			if desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"testing"
+)
+
+func TestMemoryStoreUniqueKeys(t *testing.T) {
+	store := newMemoryStore()
+	owner := bson.NewObjectId()
+	face := func(label string, md5 string) bson.M {
+		return bson.M{"_id": bson.NewObjectId(), "userId": owner, "label": label, "md5": md5}
+	}
+	if err := store.insert("face", face("alice", "a"), face("bob", "a")); err != nil {
+		t.Fatalf("same descriptor under two labels: %v", err)
+	}
+	if err := store.insert("face", face("alice", "a")); err != ErrDuplicateKey {
+		t.Fatalf("expected ErrDuplicateKey on insert, got %v", err)
+	}
+
+	// renaming bob to alice would give alice the same md5 twice
+	if _, err := store.update("face", bson.M{"label": "bob"}, bson.M{"label": "alice"}); err != ErrDuplicateKey {
+		t.Fatalf("expected ErrDuplicateKey on update, got %v", err)
+	}
+	if n := store.count("face", bson.M{"label": "bob"}); n != 1 {
+		t.Fatalf("a failed update must change nothing, bob has %d face(s)", n)
+	}
+	if n, err := store.update("face", bson.M{"label": "bob"}, bson.M{"label": "carol"}); err != nil || n != 1 {
+		t.Fatalf("expected 1 face renamed, got %d, %v", n, err)
+	}
+
+	if err := store.insert("desk", bson.M{"_id": bson.NewObjectId(), "deskId": "d1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.insert("desk", bson.M{"_id": bson.NewObjectId(), "deskId": "d1"}); err != ErrDuplicateKey {
+		t.Fatalf("expected ErrDuplicateKey on desk, got %v", err)
+	}
+}
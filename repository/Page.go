@@ -0,0 +1,162 @@
+package repository
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"strings"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 500
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("invalid sort")
+)
+
+// PageRequest asks for one page of a keyset-paginated list. Sort names a
+// field, with a leading "-" for descending order; ties are broken by _id in
+// the same direction so the order is total and cursors are stable.
+type PageRequest struct {
+	Limit  int
+	Cursor string
+	Sort   string
+}
+
+type pageCursor struct {
+	Value interface{}   `bson:"v"`
+	Id    bson.ObjectId `bson:"id"`
+}
+
+type pageQuery struct {
+	filter bson.M
+	sort   []string
+	field  string
+	desc   bool
+	limit  int
+}
+
+// newPageQuery validates p against the sort fields a list allows and adds the
+// keyset condition of the cursor to filter.
+func newPageQuery(p PageRequest, filter bson.M, defaultSort string, allowedSorts ...string) (*pageQuery, error) {
+	sortBy := p.Sort
+	if sortBy == "" {
+		sortBy = defaultSort
+	}
+	q := &pageQuery{
+		field: strings.TrimPrefix(sortBy, "-"),
+		desc:  strings.HasPrefix(sortBy, "-"),
+		limit: p.Limit,
+	}
+	allowed := false
+	for _, a := range allowedSorts {
+		allowed = allowed || a == q.field
+	}
+	if !allowed {
+		return nil, ErrInvalidSort
+	}
+	if q.limit <= 0 {
+		q.limit = DefaultPageLimit
+	} else if q.limit > MaxPageLimit {
+		q.limit = MaxPageLimit
+	}
+
+	direction := ""
+	cmp := "$gt"
+	if q.desc {
+		direction = "-"
+		cmp = "$lt"
+	}
+	q.sort = []string{direction + q.field}
+	if q.field != "_id" {
+		q.sort = append(q.sort, direction+"_id")
+	}
+
+	q.filter = bson.M{}
+	for k, v := range filter {
+		q.filter[k] = v
+	}
+	if p.Cursor != "" {
+		c, err := decodeCursor(p.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if q.field == "_id" {
+			q.filter["_id"] = bson.M{cmp: c.Id}
+		} else if c.Value != nil {
+			or := []bson.M{
+				{q.field: bson.M{cmp: c.Value}},
+				{q.field: c.Value, "_id": bson.M{cmp: c.Id}},
+			}
+			// missing values sort before any other, but no operator
+			// compares them with one
+			if q.desc {
+				or = append(or, bson.M{q.field: nil})
+			}
+			q.filter["$or"] = or
+		} else if q.desc {
+			q.filter[q.field] = nil
+			q.filter["_id"] = bson.M{cmp: c.Id}
+		} else {
+			q.filter["$or"] = []bson.M{
+				{q.field: bson.M{"$ne": nil}},
+				{q.field: nil, "_id": bson.M{cmp: c.Id}},
+			}
+		}
+	}
+	return q, nil
+}
+
+// page trims docs, fetched with limit+1, to the page size and returns the
+// cursor of the next page, or "" when this is the last one.
+func (q *pageQuery) page(docs []bson.M) ([]bson.M, string) {
+	if len(docs) <= q.limit {
+		return docs, ""
+	}
+	docs = docs[:q.limit]
+	last := docs[len(docs)-1]
+	id, _ := last["_id"].(bson.ObjectId)
+	return docs, encodeCursor(pageCursor{Value: last[q.field], Id: id})
+}
+
+func encodeCursor(c pageCursor) string {
+	data, err := bson.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c pageCursor
+	if err := bson.Unmarshal(data, &c); err != nil || !c.Id.Valid() {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+func findPage(c *mgo.Collection, q *pageQuery) ([]bson.M, string, error) {
+	docs := make([]bson.M, 0)
+	if err := c.Find(q.filter).Sort(q.sort...).Limit(q.limit + 1).All(&docs); err != nil {
+		return nil, "", err
+	}
+	docs, next := q.page(docs)
+	return docs, next, nil
+}
+
+func (s *memoryStore) findPage(name string, q *pageQuery) ([]bson.M, string) {
+	docs := s.find(name, q.filter)
+	sortDocuments(docs, q.sort...)
+	if len(docs) > q.limit+1 {
+		docs = docs[:q.limit+1]
+	}
+	return q.page(docs)
+}
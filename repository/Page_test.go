@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"strings"
+	"testing"
+)
+
+// pageAll walks every page of a list of limit items each.
+func pageAll(t *testing.T, sort string, limit int, find func(p PageRequest) ([]string, string, error)) []string {
+	all := make([]string, 0)
+	p := PageRequest{Sort: sort, Limit: limit}
+	for {
+		items, next, err := find(p)
+		if err != nil {
+			t.Fatalf("sort %s: %v", sort, err)
+		}
+		all = append(all, items...)
+		if next == "" {
+			return all
+		}
+		p.Cursor = next
+	}
+}
+
+func TestPageSortKeys(t *testing.T) {
+	repos := NewMemoryRepositories()
+	owner := bson.NewObjectId()
+	ctx := WithOwner(context.Background(), owner)
+	for _, name := range []string{"c", "a", "", "b", "a"} {
+		desk := model.Desk{Id: bson.NewObjectId(), DeskId: bson.NewObjectId().Hex(), Name: name}
+		if err := repos.Desks.Insert(ctx, &desk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a desk stored before desks had names
+	if err := repos.Desks.(*memoryDeskRepository).store.insert("desk", bson.M{"_id": bson.NewObjectId(), "deskId": "legacy", "owner": owner}); err != nil {
+		t.Fatal(err)
+	}
+	names := func(p PageRequest) ([]string, string, error) {
+		desks, next, err := repos.Desks.FindPage(ctx, p)
+		items := make([]string, len(desks))
+		for i, d := range desks {
+			items[i] = d.Name
+			if d.DeskId == "legacy" {
+				items[i] = "<none>"
+			}
+		}
+		return items, next, err
+	}
+	for sort, want := range map[string]string{
+		"name":  "<none>,,a,a,b,c",
+		"-name": "c,b,a,a,,<none>",
+	} {
+		for _, limit := range []int{1, 2, 4} {
+			if got := strings.Join(pageAll(t, sort, limit, names), ","); got != want {
+				t.Fatalf("sort %s by %d: expected %s, got %s", sort, limit, want, got)
+			}
+		}
+	}
+
+	for _, label := range []string{"b", "a", "c"} {
+		face := model.Face{Id: bson.NewObjectId(), Label: label, MD5: label}
+		if err := repos.Faces.Insert(ctx, &face); err != nil {
+			t.Fatal(err)
+		}
+	}
+	labels := func(p PageRequest) ([]string, string, error) {
+		faces, next, err := repos.Faces.(*memoryFaceRepository).findPage(ctx, bson.M{}, p)
+		items := make([]string, len(faces))
+		for i, f := range faces {
+			items[i] = f.Label
+		}
+		return items, next, err
+	}
+	for sort, want := range map[string]string{
+		"label":      "a,b,c",
+		"-createdAt": "c,a,b",
+	} {
+		if got := strings.Join(pageAll(t, sort, 2, labels), ","); got != want {
+			t.Fatalf("sort %s: expected %s, got %s", sort, want, got)
+		}
+	}
+
+	if _, _, err := repos.Desks.FindPage(ctx, PageRequest{Sort: "owner"}); err != ErrInvalidSort {
+		t.Fatalf("expected ErrInvalidSort, got %v", err)
+	}
+}
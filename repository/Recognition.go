@@ -0,0 +1,203 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"time"
+)
+
+const (
+	RecognitionRunning   = "running"
+	RecognitionCompleted = "completed"
+	RecognitionFailed    = "failed"
+	RecognitionCanceled  = "canceled"
+)
+
+// Recognition is one capture and recognition run on a device. Captured frames
+// live in the frame store; only their ids are kept here.
+type Recognition struct {
+	Id         bson.ObjectId      `json:"id" bson:"_id"`
+	UserId     bson.ObjectId      `json:"userId" bson:"userId"`
+	DeviceId   bson.ObjectId      `json:"deviceId" bson:"deviceId"`
+	TotalPics  int                `json:"totalPics" bson:"totalPics"`
+	FrameDelay int                `json:"frameDelay" bson:"frameDelay"`
+	Model      string             `json:"model" bson:"model"`
+	Status     string             `json:"status" bson:"status"`
+	Stage      string             `json:"stage,omitempty" bson:"stage,omitempty"`
+	Frames     []RecognitionFrame `json:"frames,omitempty" bson:"frames,omitempty"`
+	Error      string             `json:"error,omitempty" bson:"error,omitempty"`
+	Instance   string             `json:"-" bson:"instance,omitempty"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt  time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+// RecognitionFrame holds the faces found on the n-th captured frame.
+type RecognitionFrame struct {
+	N               int                 `json:"n" bson:"n"`
+	FileId          bson.ObjectId       `json:"-" bson:"fileId"`
+	ThumbnailId     bson.ObjectId       `json:"-" bson:"thumbnailId,omitempty"`
+	FaceDetailsList []model.FaceDetails `json:"faceDetailsList" bson:"faceDetailsList"`
+}
+
+type RecognitionRepository interface {
+	FindById(ctx context.Context, id bson.ObjectId) (*Recognition, error)
+	// Save inserts or replaces recognition.
+	Save(ctx context.Context, recognition *Recognition) error
+	// Interrupt fails the recognitions left running by instance when it
+	// stopped, and those saved before instances were recorded. It needs a
+	// system context.
+	Interrupt(ctx context.Context, instance string, reason string) (int, error)
+	// FindExpired returns finished recognitions of every user last updated
+	// before the given time, in _id order after the given id. It needs a
+	// system context.
+	FindExpired(ctx context.Context, before time.Time, after bson.ObjectId, limit int) ([]Recognition, error)
+	Remove(ctx context.Context, id bson.ObjectId) error
+}
+
+func interruptedFilter(status string, instance string) bson.M {
+	return bson.M{"status": status, "instance": bson.M{"$in": []interface{}{instance, nil}}}
+}
+
+func expiredRecognitionFilter(before time.Time, after bson.ObjectId) bson.M {
+	filter := bson.M{"status": bson.M{"$ne": RecognitionRunning}, "updatedAt": bson.M{"$lt": before}}
+	if after != "" {
+		filter["_id"] = bson.M{"$gt": after}
+	}
+	return filter
+}
+
+type mongoRecognitionRepository struct{}
+
+func (r *mongoRecognitionRepository) FindById(ctx context.Context, id bson.ObjectId) (*Recognition, error) {
+	filter, err := scoped(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var recognition Recognition
+	if err := run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("recognition").Find(filter).One(&recognition)
+	}); err != nil {
+		return nil, err
+	}
+	return &recognition, nil
+}
+
+func (r *mongoRecognitionRepository) Save(ctx context.Context, recognition *Recognition) error {
+	if err := claim(ctx, &recognition.UserId); err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		_, err := db.C("recognition").Upsert(bson.M{"_id": recognition.Id, "userId": recognition.UserId}, recognition)
+		return err
+	})
+}
+
+func (r *mongoRecognitionRepository) Interrupt(ctx context.Context, instance string, reason string) (int, error) {
+	if !isSystem(ctx) {
+		return 0, ErrSystemOnly
+	}
+	interrupted := 0
+	err := run(ctx, writeOperation, func(db *mgo.Database) error {
+		info, err := db.C("recognition").UpdateAll(
+			interruptedFilter(RecognitionRunning, instance),
+			bson.M{"$set": bson.M{"status": RecognitionFailed, "error": reason, "updatedAt": time.Now()}, "$unset": bson.M{"stage": ""}},
+		)
+		if err == nil {
+			interrupted = info.Updated
+		}
+		return err
+	})
+	return interrupted, err
+}
+
+func (r *mongoRecognitionRepository) FindExpired(ctx context.Context, before time.Time, after bson.ObjectId, limit int) ([]Recognition, error) {
+	if !isSystem(ctx) {
+		return nil, ErrSystemOnly
+	}
+	recognitions := make([]Recognition, 0)
+	err := run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("recognition").Find(expiredRecognitionFilter(before, after)).Sort("_id").Limit(limit).All(&recognitions)
+	})
+	return recognitions, err
+}
+
+func (r *mongoRecognitionRepository) Remove(ctx context.Context, id bson.ObjectId) error {
+	filter, err := scoped(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("recognition").Remove(filter)
+	})
+}
+
+type memoryRecognitionRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryRecognitionRepository) FindById(ctx context.Context, id bson.ObjectId) (*Recognition, error) {
+	filter, err := memoryScoped(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var recognition Recognition
+	if err := r.store.findOne("recognition", filter, &recognition); err != nil {
+		return nil, err
+	}
+	return &recognition, nil
+}
+
+func (r *memoryRecognitionRepository) Save(ctx context.Context, recognition *Recognition) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := claim(ctx, &recognition.UserId); err != nil {
+		return err
+	}
+	filter := bson.M{"_id": recognition.Id, "userId": recognition.UserId}
+	if err := r.store.replace("recognition", filter, recognition); err != ErrNotFound {
+		return err
+	}
+	return r.store.insert("recognition", recognition)
+}
+
+func (r *memoryRecognitionRepository) Interrupt(ctx context.Context, instance string, reason string) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+	if !isSystem(ctx) {
+		return 0, ErrSystemOnly
+	}
+	set := bson.M{"status": RecognitionFailed, "error": reason, "stage": nil, "updatedAt": time.Now()}
+	return r.store.update("recognition", interruptedFilter(RecognitionRunning, instance), set)
+}
+
+func (r *memoryRecognitionRepository) FindExpired(ctx context.Context, before time.Time, after bson.ObjectId, limit int) ([]Recognition, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if !isSystem(ctx) {
+		return nil, ErrSystemOnly
+	}
+	docs := r.store.find("recognition", expiredRecognitionFilter(before, after))
+	sortDocuments(docs, "_id")
+	if len(docs) > limit {
+		docs = docs[:limit]
+	}
+	recognitions := make([]Recognition, 0)
+	err := decodeDocuments(docs, &recognitions)
+	return recognitions, err
+}
+
+func (r *memoryRecognitionRepository) Remove(ctx context.Context, id bson.ObjectId) error {
+	filter, err := memoryScoped(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return err
+	}
+	if r.store.remove("recognition", filter) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo/bson"
+	"testing"
+)
+
+func TestInterruptOwnRecognitions(t *testing.T) {
+	repos := NewMemoryRepositories()
+	ctx := WithOwner(context.Background(), bson.NewObjectId())
+	jobs := map[string]*Recognition{"own": {Instance: "a"}, "other": {Instance: "b"}, "legacy": {}}
+	for _, job := range jobs {
+		job.Id = bson.NewObjectId()
+		job.Status = RecognitionRunning
+		if err := repos.Recognitions.Save(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := repos.Recognitions.Interrupt(AsSystem(context.Background()), "a", "restarted"); err != nil || n != 2 {
+		t.Fatalf("expected 2 interrupted recognitions, got %d, %v", n, err)
+	}
+	for name, job := range jobs {
+		found, err := repos.Recognitions.FindById(ctx, job.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if interrupted := found.Status == RecognitionFailed; interrupted != (name != "other") {
+			t.Fatalf("%s recognition has status %s", name, found.Status)
+		}
+	}
+}
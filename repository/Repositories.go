@@ -0,0 +1,87 @@
+package repository
+
+import "github.com/globalsign/mgo"
+
+// ErrNotFound is returned by every repository when no document matches, for
+// both the Mongo and the in-memory implementations.
+var ErrNotFound = mgo.ErrNotFound
+
+// IsDuplicate reports whether err is a unique index violation.
+func IsDuplicate(err error) bool {
+	return err == ErrDuplicateKey || mgo.IsDup(err)
+}
+
+type Repositories struct {
+	Desks         DeskRepository
+	Devices       DeviceRepository
+	Rules         RuleRepository
+	Faces         FaceRepository
+	Events        EventRepository
+	Users         UserRepository
+	ServiceTokens ServiceTokenRepository
+	SlackConfigs  SlackConfigRepository
+	Trash         TrashRepository
+	Retention     RetentionPolicyRepository
+	EventArchives EventArchiveRepository
+	Enrollments   EnrollmentSessionRepository
+	Recognitions  RecognitionRepository
+	Frames        FrameRepository
+	Unlabeled     UnlabeledFaceRepository
+	Thresholds    LabelThresholdRepository
+	Pairings      DevicePairingRepository
+	Shadows       DeviceShadowRepository
+	Commands      DeviceCommandRepository
+}
+
+// NewMongoRepositories returns repositories backed by the dao session. The
+// dao package must be connected before any of them is used.
+func NewMongoRepositories() *Repositories {
+	return &Repositories{
+		Desks:         &mongoDeskRepository{},
+		Devices:       &mongoDeviceRepository{},
+		Rules:         &mongoRuleRepository{},
+		Faces:         &mongoFaceRepository{},
+		Events:        &mongoEventRepository{},
+		Users:         &mongoUserRepository{},
+		ServiceTokens: &mongoServiceTokenRepository{},
+		SlackConfigs:  &mongoSlackConfigRepository{},
+		Trash:         &mongoTrashRepository{},
+		Retention:     &mongoRetentionPolicyRepository{},
+		EventArchives: &mongoEventArchiveRepository{},
+		Enrollments:   &mongoEnrollmentSessionRepository{},
+		Recognitions:  &mongoRecognitionRepository{},
+		Frames:        &mongoFrameRepository{},
+		Unlabeled:     &mongoUnlabeledFaceRepository{},
+		Thresholds:    &mongoLabelThresholdRepository{},
+		Pairings:      &mongoDevicePairingRepository{},
+		Shadows:       &mongoDeviceShadowRepository{},
+		Commands:      &mongoDeviceCommandRepository{},
+	}
+}
+
+// NewMemoryRepositories returns repositories that keep everything in process
+// memory. They are meant for tests and need no database.
+func NewMemoryRepositories() *Repositories {
+	store := newMemoryStore()
+	return &Repositories{
+		Desks:         &memoryDeskRepository{store: store},
+		Devices:       &memoryDeviceRepository{store: store},
+		Rules:         &memoryRuleRepository{store: store},
+		Faces:         &memoryFaceRepository{store: store},
+		Events:        &memoryEventRepository{store: store},
+		Users:         &memoryUserRepository{store: store},
+		ServiceTokens: &memoryServiceTokenRepository{store: store},
+		SlackConfigs:  &memorySlackConfigRepository{store: store},
+		Trash:         &memoryTrashRepository{store: store},
+		Retention:     &memoryRetentionPolicyRepository{store: store},
+		EventArchives: &memoryEventArchiveRepository{store: store},
+		Enrollments:   &memoryEnrollmentSessionRepository{store: store},
+		Recognitions:  &memoryRecognitionRepository{store: store},
+		Frames:        &memoryFrameRepository{store: store},
+		Unlabeled:     &memoryUnlabeledFaceRepository{store: store},
+		Thresholds:    &memoryLabelThresholdRepository{store: store},
+		Pairings:      &memoryDevicePairingRepository{store: store},
+		Shadows:       &memoryDeviceShadowRepository{store: store},
+		Commands:      &memoryDeviceCommandRepository{store: store},
+	}
+}
@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// DefaultPolicyType is the DeviceType of the policy of a user that applies to
+// every type without one of its own. Cameras have no type, so it cannot be
+// empty.
+const DefaultPolicyType = "*"
+
+// RetentionPolicy keeps events of a user's devices of DeviceType for
+// RetentionDays.
+type RetentionPolicy struct {
+	Id            bson.ObjectId `json:"id" bson:"_id"`
+	UserId        bson.ObjectId `json:"userId" bson:"userId"`
+	DeviceType    string        `json:"deviceType" bson:"deviceType"`
+	RetentionDays int           `json:"retentionDays" bson:"retentionDays"`
+}
+
+type RetentionPolicyRepository interface {
+	FindAll(ctx context.Context) ([]RetentionPolicy, error)
+	Upsert(ctx context.Context, policy *RetentionPolicy) error
+	Remove(ctx context.Context, deviceType string) error
+}
+
+type mongoRetentionPolicyRepository struct{}
+
+func (r *mongoRetentionPolicyRepository) FindAll(ctx context.Context) ([]RetentionPolicy, error) {
+	filter, err := scoped(ctx, bson.M{}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	policies := make([]RetentionPolicy, 0)
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("retention_policy").Find(filter).All(&policies)
+	})
+	return policies, err
+}
+
+func (r *mongoRetentionPolicyRepository) Upsert(ctx context.Context, policy *RetentionPolicy) error {
+	filter, err := owned(ctx, bson.M{"deviceType": policy.DeviceType}, "userId")
+	if err != nil {
+		return err
+	}
+	policy.UserId = filter["userId"].(bson.ObjectId)
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		existing := RetentionPolicy{}
+		if err := db.C("retention_policy").Find(filter).One(&existing); err == nil {
+			policy.Id = existing.Id
+		} else if err != mgo.ErrNotFound {
+			return err
+		} else {
+			policy.Id = bson.NewObjectId()
+		}
+		_, err := db.C("retention_policy").UpsertId(policy.Id, policy)
+		return err
+	})
+}
+
+func (r *mongoRetentionPolicyRepository) Remove(ctx context.Context, deviceType string) error {
+	filter, err := owned(ctx, bson.M{"deviceType": deviceType}, "userId")
+	if err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("retention_policy").Remove(filter)
+	})
+}
+
+type memoryRetentionPolicyRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryRetentionPolicyRepository) FindAll(ctx context.Context) ([]RetentionPolicy, error) {
+	filter, err := memoryScoped(ctx, bson.M{}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	policies := make([]RetentionPolicy, 0)
+	err = decodeDocuments(r.store.find("retention_policy", filter), &policies)
+	return policies, err
+}
+
+func (r *memoryRetentionPolicyRepository) Upsert(ctx context.Context, policy *RetentionPolicy) error {
+	filter, err := owned(ctx, bson.M{"deviceType": policy.DeviceType}, "userId")
+	if err != nil {
+		return err
+	}
+	policy.UserId = filter["userId"].(bson.ObjectId)
+	existing := RetentionPolicy{}
+	if err := r.store.findOne("retention_policy", filter, &existing); err == nil {
+		policy.Id = existing.Id
+		return r.store.replace("retention_policy", filter, policy)
+	}
+	policy.Id = bson.NewObjectId()
+	return r.store.insert("retention_policy", policy)
+}
+
+func (r *memoryRetentionPolicyRepository) Remove(ctx context.Context, deviceType string) error {
+	filter, err := owned(ctx, bson.M{"deviceType": deviceType}, "userId")
+	if err != nil {
+		return err
+	}
+	if r.store.remove("retention_policy", filter) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
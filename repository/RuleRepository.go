@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+)
+
+type RuleRepository interface {
+	FindByDesk(ctx context.Context, deskId string) ([]model.Rule, error)
+	Insert(ctx context.Context, rules ...model.Rule) error
+	// SetInterval changes how often a rule reminds and returns the rule. The
+	// desk and type of a rule never change.
+	SetInterval(ctx context.Context, id bson.ObjectId, intervalMinutes int) (*model.Rule, error)
+}
+
+type mongoRuleRepository struct{}
+
+func (r *mongoRuleRepository) FindByDesk(ctx context.Context, deskId string) ([]model.Rule, error) {
+	filter, err := scoped(ctx, bson.M{"deskId": deskId}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]model.Rule, 0)
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("rule").Find(filter).All(&rules)
+	})
+	return rules, err
+}
+
+func (r *mongoRuleRepository) Insert(ctx context.Context, rules ...model.Rule) error {
+	docs := make([]interface{}, len(rules))
+	for i := range rules {
+		if err := claim(ctx, &rules[i].UserId); err != nil {
+			return err
+		}
+		docs[i] = rules[i]
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("rule").Insert(docs...)
+	})
+}
+
+func (r *mongoRuleRepository) SetInterval(ctx context.Context, id bson.ObjectId, intervalMinutes int) (*model.Rule, error) {
+	filter, err := scoped(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var rule model.Rule
+	err = run(ctx, writeOperation, func(db *mgo.Database) error {
+		_, err := db.C("rule").Find(filter).Apply(mgo.Change{
+			Update:    bson.M{"$set": bson.M{"intervalMinutes": intervalMinutes}},
+			ReturnNew: true,
+		}, &rule)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+type memoryRuleRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryRuleRepository) FindByDesk(ctx context.Context, deskId string) ([]model.Rule, error) {
+	filter, err := memoryScoped(ctx, bson.M{"deskId": deskId}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]model.Rule, 0)
+	err = decodeDocuments(r.store.find("rule", filter), &rules)
+	return rules, err
+}
+
+func (r *memoryRuleRepository) Insert(ctx context.Context, rules ...model.Rule) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := claim(ctx, &rule.UserId); err != nil {
+			return err
+		}
+		if err := r.store.insert("rule", rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *memoryRuleRepository) SetInterval(ctx context.Context, id bson.ObjectId, intervalMinutes int) (*model.Rule, error) {
+	filter, err := memoryScoped(ctx, bson.M{"_id": id}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	if n, err := r.store.update("rule", filter, bson.M{"intervalMinutes": intervalMinutes}); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+	var rule model.Rule
+	if err := r.store.findOne("rule", filter, &rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/globalsign/mgo/bson"
+)
+
+// ErrNoOwner is returned when a scoped repository call is made with a context
+// that carries neither an owner nor the system marker.
+var ErrNoOwner = errors.New("no owner in context")
+
+// ErrSystemOnly is returned by calls that span all users when they are made
+// with an owner-scoped context.
+var ErrSystemOnly = errors.New("operation requires a system context")
+
+type ownerKey struct{}
+type systemKey struct{}
+
+// WithOwner scopes every repository call made with the returned context to
+// the documents of owner.
+func WithOwner(ctx context.Context, owner bson.ObjectId) context.Context {
+	return context.WithValue(ctx, ownerKey{}, owner)
+}
+
+// AsSystem lifts owner scoping for background work that legitimately spans
+// all users, such as the notification monitor.
+func AsSystem(ctx context.Context) context.Context {
+	return context.WithValue(ctx, systemKey{}, true)
+}
+
+func OwnerFrom(ctx context.Context) (bson.ObjectId, bool) {
+	owner, ok := ctx.Value(ownerKey{}).(bson.ObjectId)
+	return owner, ok && owner != ""
+}
+
+func isSystem(ctx context.Context) bool {
+	system, _ := ctx.Value(systemKey{}).(bool)
+	return system
+}
+
+// scoped returns a copy of filter restricted to the context owner through
+// ownerField. Soft-deleted documents are left out unless filter asks for
+// deletedAt itself.
+func scoped(ctx context.Context, filter bson.M, ownerField string) (bson.M, error) {
+	result := bson.M{"deletedAt": nil}
+	for k, v := range filter {
+		result[k] = v
+	}
+	if isSystem(ctx) {
+		return result, nil
+	}
+	owner, ok := OwnerFrom(ctx)
+	if !ok {
+		return nil, ErrNoOwner
+	}
+	result[ownerField] = owner
+	return result, nil
+}
+
+// claim stamps the context owner on a document about to be written, so that
+// nothing can be created or moved on behalf of another user.
+func claim(ctx context.Context, ownerField *bson.ObjectId) error {
+	if isSystem(ctx) {
+		return nil
+	}
+	owner, ok := OwnerFrom(ctx)
+	if !ok {
+		return ErrNoOwner
+	}
+	*ownerField = owner
+	return nil
+}
+
+// memoryScoped is scoped for the in-memory repositories, which also have to
+// honour a done context themselves.
+func memoryScoped(ctx context.Context, filter bson.M, ownerField string) (bson.M, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return scoped(ctx, filter, ownerField)
+}
+
+// owned restricts filter to the context owner even for system contexts. It
+// is used by calls that address a single user's document and would otherwise
+// match every user's.
+func owned(ctx context.Context, filter bson.M, ownerField string) (bson.M, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	owner, ok := OwnerFrom(ctx)
+	if !ok {
+		return nil, ErrNoOwner
+	}
+	result := bson.M{ownerField: owner}
+	for k, v := range filter {
+		result[k] = v
+	}
+	return result, nil
+}
@@ -1,4 +1,4 @@
-package auth
+package repository
 
 import (
 	"github.com/globalsign/mgo/bson"
@@ -11,4 +11,6 @@ type ServiceToken struct {
 	UserId    bson.ObjectId `json:"userId" bson:"userId"`
 	Token     string        `json:"token" bson:"token"`
 	TokenId   string        `json:"tokenId" bson:"tokenId"`
+	// DeviceId is the device a device token was issued to.
+	DeviceId bson.ObjectId `json:"deviceId,omitempty" bson:"deviceId,omitempty"`
 }
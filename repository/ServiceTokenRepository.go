@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type ServiceTokenRepository interface {
+	Insert(ctx context.Context, token *ServiceToken) error
+	// RemoveByDevice revokes the tokens of a device.
+	RemoveByDevice(ctx context.Context, deviceId bson.ObjectId) (int, error)
+}
+
+type mongoServiceTokenRepository struct{}
+
+func (r *mongoServiceTokenRepository) Insert(ctx context.Context, token *ServiceToken) error {
+	if err := claim(ctx, &token.UserId); err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("service_token").Insert(token)
+	})
+}
+
+func (r *mongoServiceTokenRepository) RemoveByDevice(ctx context.Context, deviceId bson.ObjectId) (int, error) {
+	filter, err := owned(ctx, bson.M{"deviceId": deviceId}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	err = run(ctx, writeOperation, func(db *mgo.Database) error {
+		info, err := db.C("service_token").RemoveAll(filter)
+		if err == nil {
+			removed = info.Removed
+		}
+		return err
+	})
+	return removed, err
+}
+
+type memoryServiceTokenRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryServiceTokenRepository) Insert(ctx context.Context, token *ServiceToken) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := claim(ctx, &token.UserId); err != nil {
+		return err
+	}
+	return r.store.insert("service_token", token)
+}
+
+func (r *memoryServiceTokenRepository) RemoveByDevice(ctx context.Context, deviceId bson.ObjectId) (int, error) {
+	filter, err := owned(ctx, bson.M{"deviceId": deviceId}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	return r.store.remove("service_token", filter), nil
+}
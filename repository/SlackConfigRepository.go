@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+)
+
+// SlackConfigRepository addresses the Slack config of the context owner.
+type SlackConfigRepository interface {
+	Find(ctx context.Context) (*model.SlackConfig, error)
+	Insert(ctx context.Context, sc *model.SlackConfig) error
+	Update(ctx context.Context, sc *model.SlackConfig) error
+	SetSlackUserId(ctx context.Context, slackUserId string) error
+	SetSentInvitation(ctx context.Context) error
+}
+
+type mongoSlackConfigRepository struct{}
+
+func (r *mongoSlackConfigRepository) Find(ctx context.Context) (*model.SlackConfig, error) {
+	filter, err := owned(ctx, bson.M{}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var sc model.SlackConfig
+	if err := run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("slack_config").Find(filter).One(&sc)
+	}); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+func (r *mongoSlackConfigRepository) Insert(ctx context.Context, sc *model.SlackConfig) error {
+	if err := claim(ctx, &sc.UserId); err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("slack_config").Insert(sc)
+	})
+}
+
+func (r *mongoSlackConfigRepository) Update(ctx context.Context, sc *model.SlackConfig) error {
+	filter, err := owned(ctx, bson.M{"_id": sc.Id}, "userId")
+	if err != nil {
+		return err
+	}
+	if err := claim(ctx, &sc.UserId); err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("slack_config").Update(filter, sc)
+	})
+}
+
+func (r *mongoSlackConfigRepository) SetSlackUserId(ctx context.Context, slackUserId string) error {
+	filter, err := owned(ctx, bson.M{}, "userId")
+	if err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("slack_config").Update(filter, bson.M{"$set": bson.M{"slackUserId": slackUserId}})
+	})
+}
+
+func (r *mongoSlackConfigRepository) SetSentInvitation(ctx context.Context) error {
+	filter, err := owned(ctx, bson.M{}, "userId")
+	if err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("slack_config").Update(filter, bson.M{"$set": bson.M{"sendInvitation": true}})
+	})
+}
+
+type memorySlackConfigRepository struct {
+	store *memoryStore
+}
+
+func (r *memorySlackConfigRepository) Find(ctx context.Context) (*model.SlackConfig, error) {
+	filter, err := owned(ctx, bson.M{}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	var sc model.SlackConfig
+	if err := r.store.findOne("slack_config", filter, &sc); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+func (r *memorySlackConfigRepository) Insert(ctx context.Context, sc *model.SlackConfig) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := claim(ctx, &sc.UserId); err != nil {
+		return err
+	}
+	return r.store.insert("slack_config", sc)
+}
+
+func (r *memorySlackConfigRepository) Update(ctx context.Context, sc *model.SlackConfig) error {
+	filter, err := owned(ctx, bson.M{"_id": sc.Id}, "userId")
+	if err != nil {
+		return err
+	}
+	if err := claim(ctx, &sc.UserId); err != nil {
+		return err
+	}
+	return r.store.replace("slack_config", filter, sc)
+}
+
+func (r *memorySlackConfigRepository) SetSlackUserId(ctx context.Context, slackUserId string) error {
+	filter, err := owned(ctx, bson.M{}, "userId")
+	if err != nil {
+		return err
+	}
+	if n, err := r.store.update("slack_config", filter, bson.M{"slackUserId": slackUserId}); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *memorySlackConfigRepository) SetSentInvitation(ctx context.Context) error {
+	filter, err := owned(ctx, bson.M{}, "userId")
+	if err != nil {
+		return err
+	}
+	if n, err := r.store.update("slack_config", filter, bson.M{"sendInvitation": true}); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,532 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"time"
+)
+
+// ErrInTrash is returned when a document in the trash holds the unique key of
+// a document about to be created.
+var ErrInTrash = errors.New("a deleted document holds the same id; restore it or wait until it is purged")
+
+// trashCollections are the collections whose documents are soft-deleted by
+// setting deletedAt, in the order the purger removes them.
+var trashCollections = []string{"event", "face", "rule", "device", "desk"}
+
+// trashedDevice is a device in the trash. The documents hanging off it that
+// are not soft-deleted themselves go when it is purged.
+type trashedDevice struct {
+	model.Device `bson:",inline"`
+	DeletedAt    time.Time `bson:"deletedAt"`
+}
+
+// remainingCrop matches the faces using cropId that a purge of the faces
+// deleted before the given time leaves; superseded faces share their crop
+// with the face that superseded them.
+func remainingCrop(cropId interface{}, before time.Time) bson.M {
+	return bson.M{"cropId": cropId, "$or": []interface{}{
+		bson.M{"deletedAt": nil},
+		bson.M{"deletedAt": bson.M{"$gte": before}},
+	}}
+}
+
+// TrashRepository soft-deletes desks and devices together with everything
+// that hangs off them. Every document of one cascade gets the same deletedAt,
+// which is what a restore keys on.
+type TrashRepository interface {
+	DeleteDesk(ctx context.Context, deskId string) error
+	RestoreDesk(ctx context.Context, deskId string, notBefore time.Time) error
+	DeleteDevice(ctx context.Context, id bson.ObjectId) error
+	RestoreDevice(ctx context.Context, id bson.ObjectId, notBefore time.Time) error
+	// DeleteLabel moves every face of a label to the trash, including those
+	// already there with their desk, and counts the live ones. A label
+	// without live faces is left as is.
+	DeleteLabel(ctx context.Context, label string) (int, error)
+	// RestoreLabel brings back the faces of the last delete of a label.
+	RestoreLabel(ctx context.Context, label string, notBefore time.Time) (int, error)
+	// Purge removes for good everything deleted before the given time, along
+	// with the shadows, commands, pairings, tokens and recognitions of the
+	// devices and the crops of the faces it removes. It spans all users and
+	// therefore needs a system context.
+	Purge(ctx context.Context, before time.Time) (int, error)
+	// PurgeDevice removes for good the device in the trash known to MQTT as
+	// deviceId, whoever owns it, the way Purge does, or fails with
+	// ErrNotFound. It needs a system context.
+	PurgeDevice(ctx context.Context, deviceId string) (int, error)
+}
+
+type mongoTrashRepository struct{}
+
+func (r *mongoTrashRepository) DeleteDesk(ctx context.Context, deskId string) error {
+	filter, err := scoped(ctx, bson.M{"deskId": deskId}, "owner")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		var desk model.Desk
+		if err := db.C("desk").Find(filter).One(&desk); err != nil {
+			return err
+		}
+		// children first: if anything fails half way the desk is still
+		// visible and the delete can simply be retried
+		if err := markDeskChildren(db, &desk, nil, now); err != nil {
+			return err
+		}
+		return db.C("desk").UpdateId(desk.Id, bson.M{"$set": bson.M{"deletedAt": now}})
+	})
+}
+
+func (r *mongoTrashRepository) RestoreDesk(ctx context.Context, deskId string, notBefore time.Time) error {
+	filter, err := scoped(ctx, bson.M{"deskId": deskId, "deletedAt": bson.M{"$gte": notBefore}}, "owner")
+	if err != nil {
+		return err
+	}
+	return run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		var desk struct {
+			model.Desk `bson:",inline"`
+			DeletedAt  time.Time `bson:"deletedAt"`
+		}
+		if err := db.C("desk").Find(filter).One(&desk); err != nil {
+			return err
+		}
+		if err := markDeskChildren(db, &desk.Desk, desk.DeletedAt, nil); err != nil {
+			return err
+		}
+		return db.C("desk").UpdateId(desk.Id, bson.M{"$set": bson.M{"deletedAt": nil}})
+	})
+}
+
+// markDeskChildren moves the devices, rules, faces and events of desk whose
+// deletedAt equals from to deletedAt to.
+func markDeskChildren(db *mgo.Database, desk *model.Desk, from interface{}, to interface{}) error {
+	var devices []model.Device
+	if err := db.C("device").Find(bson.M{"deskId": desk.DeskId, "owner": desk.Owner, "deletedAt": from}).All(&devices); err != nil {
+		return err
+	}
+	deviceIds := make([]string, len(devices))
+	for i, d := range devices {
+		deviceIds[i] = d.DeviceId
+	}
+	set := bson.M{"$set": bson.M{"deletedAt": to}}
+	if _, err := db.C("event").UpdateAll(bson.M{"deviceId": bson.M{"$in": deviceIds}, "deletedAt": from}, set); err != nil {
+		return err
+	}
+	if _, err := db.C("face").UpdateAll(bson.M{"deskId": desk.DeskId, "userId": desk.Owner, "deletedAt": from}, set); err != nil {
+		return err
+	}
+	if _, err := db.C("rule").UpdateAll(bson.M{"deskId": desk.DeskId, "userId": desk.Owner, "deletedAt": from}, set); err != nil {
+		return err
+	}
+	_, err := db.C("device").UpdateAll(bson.M{"deskId": desk.DeskId, "owner": desk.Owner, "deletedAt": from}, set)
+	return err
+}
+
+func (r *mongoTrashRepository) DeleteDevice(ctx context.Context, id bson.ObjectId) error {
+	filter, err := scoped(ctx, bson.M{"_id": id}, "owner")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		var device model.Device
+		if err := db.C("device").Find(filter).One(&device); err != nil {
+			return err
+		}
+		set := bson.M{"$set": bson.M{"deletedAt": now}}
+		if _, err := db.C("event").UpdateAll(bson.M{"deviceId": device.DeviceId, "deletedAt": nil}, set); err != nil {
+			return err
+		}
+		return db.C("device").UpdateId(device.Id, set)
+	})
+}
+
+func (r *mongoTrashRepository) RestoreDevice(ctx context.Context, id bson.ObjectId, notBefore time.Time) error {
+	filter, err := scoped(ctx, bson.M{"_id": id, "deletedAt": bson.M{"$gte": notBefore}}, "owner")
+	if err != nil {
+		return err
+	}
+	return run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		var device struct {
+			model.Device `bson:",inline"`
+			DeletedAt    time.Time `bson:"deletedAt"`
+		}
+		if err := db.C("device").Find(filter).One(&device); err != nil {
+			return err
+		}
+		set := bson.M{"$set": bson.M{"deletedAt": nil}}
+		if _, err := db.C("event").UpdateAll(bson.M{"deviceId": device.DeviceId, "deletedAt": device.DeletedAt}, set); err != nil {
+			return err
+		}
+		return db.C("device").UpdateId(device.Id, set)
+	})
+}
+
+func (r *mongoTrashRepository) DeleteLabel(ctx context.Context, label string) (int, error) {
+	owner, err := owned(ctx, bson.M{}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	live := withLabel(owner, label)
+	live["deletedAt"] = nil
+	deleted := 0
+	err = run(ctx, writeOperation, func(db *mgo.Database) error {
+		count, err := db.C("face").Find(live).Count()
+		if err != nil || count == 0 {
+			return err
+		}
+		if _, err := db.C("face").UpdateAll(withLabel(owner, label), bson.M{"$set": bson.M{"deletedAt": time.Now()}}); err != nil {
+			return err
+		}
+		deleted = count
+		return nil
+	})
+	return deleted, err
+}
+
+func (r *mongoTrashRepository) RestoreLabel(ctx context.Context, label string, notBefore time.Time) (int, error) {
+	filter, err := owned(ctx, bson.M{"label": label, "deletedAt": bson.M{"$gte": notBefore}}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	restored := 0
+	err = run(ctx, writeOperation, func(db *mgo.Database) error {
+		var last struct {
+			DeletedAt time.Time `bson:"deletedAt"`
+		}
+		if err := db.C("face").Find(filter).Sort("-deletedAt").One(&last); err != nil {
+			return err
+		}
+		filter["deletedAt"] = last.DeletedAt
+		info, err := db.C("face").UpdateAll(filter, bson.M{"$set": bson.M{"deletedAt": nil}})
+		if err == nil {
+			restored = info.Updated
+		}
+		return err
+	})
+	return restored, err
+}
+
+func (r *mongoTrashRepository) Purge(ctx context.Context, before time.Time) (int, error) {
+	if !isSystem(ctx) {
+		return 0, ErrSystemOnly
+	}
+	filter := bson.M{"deletedAt": bson.M{"$lt": before}}
+	removed := 0
+	err := run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		// what hangs off the trash goes first: if anything fails half way
+		// the next purge finds it again
+		var devices []trashedDevice
+		if err := db.C("device").Find(filter).All(&devices); err != nil {
+			return err
+		}
+		for i := range devices {
+			if err := removeDeviceData(db, &devices[i]); err != nil {
+				return err
+			}
+		}
+		var crops []bson.ObjectId
+		if err := db.C("face").Find(bson.M{"deletedAt": bson.M{"$lt": before}, "cropId": bson.M{"$exists": true}}).Distinct("cropId", &crops); err != nil {
+			return err
+		}
+		for _, cropId := range crops {
+			if count, err := db.C("face").Find(remainingCrop(cropId, before)).Count(); err != nil {
+				return err
+			} else if count > 0 {
+				continue
+			}
+			if err := removeFrameFile(db, cropId); err != nil {
+				return err
+			}
+		}
+		for _, name := range trashCollections {
+			info, err := db.C(name).RemoveAll(filter)
+			if err != nil {
+				return err
+			}
+			removed += info.Removed
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (r *mongoTrashRepository) PurgeDevice(ctx context.Context, deviceId string) (int, error) {
+	if !isSystem(ctx) {
+		return 0, ErrSystemOnly
+	}
+	removed := 0
+	err := run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		var device trashedDevice
+		if err := db.C("device").Find(trashedDeviceId(deviceId)).One(&device); err != nil {
+			return err
+		}
+		if err := removeDeviceData(db, &device); err != nil {
+			return err
+		}
+		info, err := db.C("event").RemoveAll(bson.M{"deviceId": deviceId, "deletedAt": device.DeletedAt})
+		if err != nil {
+			return err
+		}
+		if err := db.C("device").RemoveId(device.Id); err != nil {
+			return err
+		}
+		removed = info.Removed + 1
+		return nil
+	})
+	return removed, err
+}
+
+func trashedDeviceId(deviceId string) bson.M {
+	return bson.M{"deviceId": deviceId, "deletedAt": bson.M{"$ne": nil}}
+}
+
+// removeDeviceData removes what a trashed device leaves outside the trash:
+// its shadow, commands, pairing, tokens and recognitions with their frames
+// and unlabeled faces.
+func removeDeviceData(db *mgo.Database, device *trashedDevice) error {
+	var recognitions []Recognition
+	if err := db.C("recognition").Find(bson.M{"deviceId": device.Id, "userId": device.Owner}).All(&recognitions); err != nil {
+		return err
+	}
+	recognitionIds := make([]bson.ObjectId, len(recognitions))
+	for i, recognition := range recognitions {
+		for _, id := range FrameIds(recognition.Frames) {
+			if err := removeFrameFile(db, id); err != nil {
+				return err
+			}
+		}
+		recognitionIds[i] = recognition.Id
+	}
+	removals := []struct {
+		name   string
+		filter bson.M
+	}{
+		{"unlabeled_face", bson.M{"recognitionId": bson.M{"$in": recognitionIds}}},
+		{"recognition", bson.M{"_id": bson.M{"$in": recognitionIds}}},
+		{"device_shadow", bson.M{"_id": device.Id}},
+		// a serial claimed again keeps its MQTT id; the commands sent after
+		// the delete are the new device's
+		{"device_command", bson.M{"deviceId": device.DeviceId, "userId": device.Owner, "createdAt": bson.M{"$lte": device.DeletedAt}}},
+		{"device_pairing", bson.M{"deviceId": device.Id}},
+		{"service_token", bson.M{"deviceId": device.Id}},
+	}
+	for _, removal := range removals {
+		if _, err := db.C(removal.name).RemoveAll(removal.filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFrameFile removes a file of the frame bucket, which may be gone
+// already.
+func removeFrameFile(db *mgo.Database, id bson.ObjectId) error {
+	if err := db.GridFS("frame").RemoveId(id); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+type memoryTrashRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryTrashRepository) DeleteDesk(ctx context.Context, deskId string) error {
+	filter, err := memoryScoped(ctx, bson.M{"deskId": deskId}, "owner")
+	if err != nil {
+		return err
+	}
+	var desk model.Desk
+	if err := r.store.findOne("desk", filter, &desk); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := r.markDeskChildren(&desk, nil, now); err != nil {
+		return err
+	}
+	_, err = r.store.update("desk", bson.M{"_id": desk.Id}, bson.M{"deletedAt": now})
+	return err
+}
+
+func (r *memoryTrashRepository) RestoreDesk(ctx context.Context, deskId string, notBefore time.Time) error {
+	filter, err := memoryScoped(ctx, bson.M{"deskId": deskId, "deletedAt": bson.M{"$gte": notBefore}}, "owner")
+	if err != nil {
+		return err
+	}
+	docs := r.store.find("desk", filter)
+	if len(docs) == 0 {
+		return ErrNotFound
+	}
+	var desk model.Desk
+	if err := decodeDocument(docs[0], &desk); err != nil {
+		return err
+	}
+	if err := r.markDeskChildren(&desk, docs[0]["deletedAt"], nil); err != nil {
+		return err
+	}
+	_, err = r.store.update("desk", bson.M{"_id": desk.Id}, bson.M{"deletedAt": nil})
+	return err
+}
+
+func (r *memoryTrashRepository) markDeskChildren(desk *model.Desk, from interface{}, to interface{}) error {
+	var deviceIds []interface{}
+	for _, d := range r.store.find("device", bson.M{"deskId": desk.DeskId, "owner": desk.Owner, "deletedAt": from}) {
+		deviceIds = append(deviceIds, d["deviceId"])
+	}
+	set := bson.M{"deletedAt": to}
+	children := []struct {
+		name   string
+		filter bson.M
+	}{
+		{"event", bson.M{"deviceId": bson.M{"$in": deviceIds}, "deletedAt": from}},
+		{"face", bson.M{"deskId": desk.DeskId, "userId": desk.Owner, "deletedAt": from}},
+		{"rule", bson.M{"deskId": desk.DeskId, "userId": desk.Owner, "deletedAt": from}},
+		{"device", bson.M{"deskId": desk.DeskId, "owner": desk.Owner, "deletedAt": from}},
+	}
+	for _, child := range children {
+		if _, err := r.store.update(child.name, child.filter, set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *memoryTrashRepository) DeleteDevice(ctx context.Context, id bson.ObjectId) error {
+	filter, err := memoryScoped(ctx, bson.M{"_id": id}, "owner")
+	if err != nil {
+		return err
+	}
+	var device model.Device
+	if err := r.store.findOne("device", filter, &device); err != nil {
+		return err
+	}
+	set := bson.M{"deletedAt": time.Now()}
+	if _, err := r.store.update("event", bson.M{"deviceId": device.DeviceId, "deletedAt": nil}, set); err != nil {
+		return err
+	}
+	_, err = r.store.update("device", bson.M{"_id": device.Id}, set)
+	return err
+}
+
+func (r *memoryTrashRepository) RestoreDevice(ctx context.Context, id bson.ObjectId, notBefore time.Time) error {
+	filter, err := memoryScoped(ctx, bson.M{"_id": id, "deletedAt": bson.M{"$gte": notBefore}}, "owner")
+	if err != nil {
+		return err
+	}
+	docs := r.store.find("device", filter)
+	if len(docs) == 0 {
+		return ErrNotFound
+	}
+	set := bson.M{"deletedAt": nil}
+	if _, err := r.store.update("event", bson.M{"deviceId": docs[0]["deviceId"], "deletedAt": docs[0]["deletedAt"]}, set); err != nil {
+		return err
+	}
+	_, err = r.store.update("device", bson.M{"_id": id}, set)
+	return err
+}
+
+func (r *memoryTrashRepository) DeleteLabel(ctx context.Context, label string) (int, error) {
+	owner, err := owned(ctx, bson.M{}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	live := withLabel(owner, label)
+	live["deletedAt"] = nil
+	count := r.store.count("face", live)
+	if count == 0 {
+		return 0, nil
+	}
+	if _, err := r.store.update("face", withLabel(owner, label), bson.M{"deletedAt": time.Now()}); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r *memoryTrashRepository) RestoreLabel(ctx context.Context, label string, notBefore time.Time) (int, error) {
+	filter, err := owned(ctx, bson.M{"label": label, "deletedAt": bson.M{"$gte": notBefore}}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	docs := r.store.find("face", filter)
+	if len(docs) == 0 {
+		return 0, ErrNotFound
+	}
+	sortDocuments(docs, "-deletedAt")
+	filter["deletedAt"] = docs[0]["deletedAt"]
+	return r.store.update("face", filter, bson.M{"deletedAt": nil})
+}
+
+func (r *memoryTrashRepository) Purge(ctx context.Context, before time.Time) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+	if !isSystem(ctx) {
+		return 0, ErrSystemOnly
+	}
+	filter := bson.M{"deletedAt": bson.M{"$lt": before}}
+	for _, doc := range r.store.find("device", filter) {
+		var device trashedDevice
+		if err := decodeDocument(doc, &device); err != nil {
+			return 0, err
+		}
+		if err := r.removeDeviceData(&device); err != nil {
+			return 0, err
+		}
+	}
+	for _, doc := range r.store.find("face", bson.M{"deletedAt": bson.M{"$lt": before}, "cropId": bson.M{"$exists": true}}) {
+		if r.store.count("face", remainingCrop(doc["cropId"], before)) == 0 {
+			r.store.remove("frame", bson.M{"_id": doc["cropId"]})
+		}
+	}
+	removed := 0
+	for _, name := range trashCollections {
+		removed += r.store.remove(name, filter)
+	}
+	return removed, nil
+}
+
+func (r *memoryTrashRepository) PurgeDevice(ctx context.Context, deviceId string) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+	if !isSystem(ctx) {
+		return 0, ErrSystemOnly
+	}
+	docs := r.store.find("device", trashedDeviceId(deviceId))
+	if len(docs) == 0 {
+		return 0, ErrNotFound
+	}
+	var device trashedDevice
+	if err := decodeDocument(docs[0], &device); err != nil {
+		return 0, err
+	}
+	if err := r.removeDeviceData(&device); err != nil {
+		return 0, err
+	}
+	removed := r.store.remove("event", bson.M{"deviceId": deviceId, "deletedAt": docs[0]["deletedAt"]})
+	return removed + r.store.remove("device", bson.M{"_id": device.Id}), nil
+}
+
+func (r *memoryTrashRepository) removeDeviceData(device *trashedDevice) error {
+	var recognitions []Recognition
+	if err := decodeDocuments(r.store.find("recognition", bson.M{"deviceId": device.Id, "userId": device.Owner}), &recognitions); err != nil {
+		return err
+	}
+	recognitionIds := make([]bson.ObjectId, len(recognitions))
+	for i, recognition := range recognitions {
+		r.store.remove("frame", bson.M{"_id": bson.M{"$in": FrameIds(recognition.Frames)}})
+		recognitionIds[i] = recognition.Id
+	}
+	r.store.remove("unlabeled_face", bson.M{"recognitionId": bson.M{"$in": recognitionIds}})
+	r.store.remove("recognition", bson.M{"_id": bson.M{"$in": recognitionIds}})
+	r.store.remove("device_shadow", bson.M{"_id": device.Id})
+	r.store.remove("device_command", bson.M{"deviceId": device.DeviceId, "userId": device.Owner, "createdAt": bson.M{"$lte": device.DeletedAt}})
+	r.store.remove("device_pairing", bson.M{"deviceId": device.Id})
+	r.store.remove("service_token", bson.M{"deviceId": device.Id})
+	return nil
+}
@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"testing"
+	"time"
+)
+
+func TestTrashLifecycle(t *testing.T) {
+	repos := NewMemoryRepositories()
+	ctx := WithOwner(context.Background(), bson.NewObjectId())
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	desk := model.Desk{Id: bson.NewObjectId(), DeskId: "front"}
+	must(repos.Desks.Insert(ctx, &desk))
+	device := model.Device{Id: bson.NewObjectId(), DeviceId: "cam-1", DeskId: "front"}
+	must(repos.Devices.Insert(ctx, &device))
+	must(repos.Rules.Insert(ctx, model.Rule{Id: bson.NewObjectId(), DeskId: "front"}))
+	must(repos.Events.Insert(ctx, &model.Event{Id: bson.NewObjectId(), DeviceId: "cam-1", Timestamp: time.Now()}))
+	_, err := repos.Shadows.UpdateDesired(ctx, &device, bson.M{"frameRate": 10.0})
+	must(err)
+	command := DeviceCommand{Id: bson.NewObjectId(), DeviceId: "cam-1", Status: CommandPending, CreatedAt: time.Now()}
+	must(repos.Commands.Insert(ctx, &command))
+	frameId, err := repos.Frames.Insert(ctx, "frame.jpg", []byte("frame"))
+	must(err)
+	job := Recognition{Id: bson.NewObjectId(), DeviceId: device.Id, Status: RecognitionCompleted, Frames: []RecognitionFrame{{FileId: frameId}}}
+	must(repos.Recognitions.Save(ctx, &job))
+	must(repos.Unlabeled.Insert(ctx, UnlabeledFace{Id: bson.NewObjectId(), RecognitionId: job.Id}))
+
+	// a superseded face shares its crop with the face superseding it
+	sharedCrop, err := repos.Frames.Insert(ctx, "shared.jpg", []byte("crop"))
+	must(err)
+	ownCrop, err := repos.Frames.Insert(ctx, "own.jpg", []byte("crop"))
+	must(err)
+	superseded := model.Face{Id: bson.NewObjectId(), Label: "alice", MD5: "1"}
+	_, err = repos.Faces.Upsert(ctx, &superseded, FaceMeta{Model: "old", CropId: sharedCrop})
+	must(err)
+	current := model.Face{Id: bson.NewObjectId(), Label: "alice", MD5: "2"}
+	_, err = repos.Faces.Upsert(ctx, &current, FaceMeta{Model: "new", CropId: sharedCrop})
+	must(err)
+	must(repos.Faces.Supersede(ctx, superseded.Id, current.Id))
+	deleted := model.Face{Id: bson.NewObjectId(), Label: "bob", MD5: "3"}
+	_, err = repos.Faces.Upsert(ctx, &deleted, FaceMeta{Model: "new", CropId: ownCrop})
+	must(err)
+
+	must(repos.Trash.DeleteDesk(ctx, "front"))
+	if _, err := repos.Devices.FindById(ctx, device.Id); err != ErrNotFound {
+		t.Fatalf("expected the device of a deleted desk to be hidden, got %v", err)
+	}
+	again := model.Desk{Id: bson.NewObjectId(), DeskId: "front"}
+	if err := repos.Desks.Insert(ctx, &again); err != ErrInTrash {
+		t.Fatalf("expected the id of a deleted desk to be held, got %v", err)
+	}
+	must(repos.Trash.RestoreDesk(ctx, "front", time.Now().Add(-time.Hour)))
+	if rules, _ := repos.Rules.FindByDesk(ctx, "front"); len(rules) != 1 {
+		t.Fatalf("expected the rule to be restored, got %+v", rules)
+	}
+	if _, err := repos.Devices.FindById(ctx, device.Id); err != nil {
+		t.Fatalf("expected the device to be restored, got %v", err)
+	}
+
+	must(repos.Trash.DeleteDesk(ctx, "front"))
+	_, err = repos.Trash.DeleteLabel(ctx, "bob")
+	must(err)
+	if _, err := repos.Trash.Purge(ctx, time.Now().Add(time.Second)); err != ErrSystemOnly {
+		t.Fatalf("expected a purge to need a system context, got %v", err)
+	}
+	if n, err := repos.Trash.Purge(AsSystem(context.Background()), time.Now().Add(time.Second)); err != nil || n != 6 {
+		t.Fatalf("expected 6 documents purged, got %d, %v", n, err)
+	}
+
+	if shadow, err := repos.Shadows.FindByDevice(ctx, &device); err != nil || shadow.Version != 0 {
+		t.Fatalf("expected the shadow to be purged, got %+v, %v", shadow, err)
+	}
+	if _, err := repos.Commands.FindById(ctx, command.Id); err != ErrNotFound {
+		t.Fatalf("expected the command to be purged, got %v", err)
+	}
+	if _, err := repos.Recognitions.FindById(ctx, job.Id); err != ErrNotFound {
+		t.Fatalf("expected the recognition to be purged, got %v", err)
+	}
+	if n, _ := repos.Unlabeled.CountByRecognition(ctx, job.Id); n != 0 {
+		t.Fatalf("expected the unlabeled faces to be purged, got %d", n)
+	}
+	for name, id := range map[string]bson.ObjectId{"frame": frameId, "crop": ownCrop} {
+		if _, err := repos.Frames.Read(ctx, id); err != ErrNotFound {
+			t.Fatalf("expected the %s to be purged, got %v", name, err)
+		}
+	}
+	if _, err := repos.Frames.Read(ctx, sharedCrop); err != nil {
+		t.Fatalf("expected the crop of a live face to be kept, got %v", err)
+	}
+	must(repos.Desks.Insert(ctx, &again))
+}
+
+func TestPurgeDevice(t *testing.T) {
+	repos := NewMemoryRepositories()
+	ctx := WithOwner(context.Background(), bson.NewObjectId())
+	system := AsSystem(context.Background())
+	device := model.Device{Id: bson.NewObjectId(), DeviceId: "SN-1"}
+	if err := repos.Devices.Insert(ctx, &device); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Events.Insert(ctx, &model.Event{Id: bson.NewObjectId(), DeviceId: "SN-1", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.Trash.PurgeDevice(system, "SN-1"); err != ErrNotFound {
+		t.Fatalf("expected a live device to be kept, got %v", err)
+	}
+	if err := repos.Trash.DeleteDevice(ctx, device.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.Trash.PurgeDevice(ctx, "SN-1"); err != ErrSystemOnly {
+		t.Fatalf("expected a purge to need a system context, got %v", err)
+	}
+	if n, err := repos.Trash.PurgeDevice(system, "SN-1"); err != nil || n != 2 {
+		t.Fatalf("expected the device and its event purged, got %d, %v", n, err)
+	}
+	again := model.Device{Id: bson.NewObjectId(), DeviceId: "SN-1"}
+	if err := repos.Devices.Insert(ctx, &again); err != nil {
+		t.Fatalf("expected the serial to be free again, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"image"
+	"time"
+)
+
+// UnlabeledFace is a face seen during a recognition that matched no label of
+// its owner. It points back to the frame it was found on.
+type UnlabeledFace struct {
+	Id            bson.ObjectId   `json:"id" bson:"_id"`
+	UserId        bson.ObjectId   `json:"userId" bson:"userId"`
+	RecognitionId bson.ObjectId   `json:"recognitionId" bson:"recognitionId"`
+	Frame         int             `json:"frame" bson:"frame"`
+	Rect          image.Rectangle `json:"rect" bson:"rect"`
+	Descriptor    []float32       `json:"-" bson:"descriptor"`
+	Model         string          `json:"model" bson:"model"`
+	CreatedAt     time.Time       `json:"createdAt" bson:"createdAt"`
+}
+
+type UnlabeledFaceRepository interface {
+	// FindLatest returns the limit most recent faces of the pool whose
+	// descriptor was computed by descriptorModel.
+	FindLatest(ctx context.Context, descriptorModel string, limit int) ([]UnlabeledFace, error)
+	FindByIds(ctx context.Context, ids []bson.ObjectId) ([]UnlabeledFace, error)
+	Insert(ctx context.Context, faces ...UnlabeledFace) error
+	RemoveByIds(ctx context.Context, ids []bson.ObjectId) (int, error)
+	// CountByRecognition counts the faces of the pool found by a recognition,
+	// whose frames they are cropped from.
+	CountByRecognition(ctx context.Context, recognitionId bson.ObjectId) (int, error)
+}
+
+type mongoUnlabeledFaceRepository struct{}
+
+func (r *mongoUnlabeledFaceRepository) FindLatest(ctx context.Context, descriptorModel string, limit int) ([]UnlabeledFace, error) {
+	filter, err := owned(ctx, bson.M{"model": descriptorModel}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	faces := make([]UnlabeledFace, 0)
+	err = run(ctx, aggregateOperation, func(db *mgo.Database) error {
+		return db.C("unlabeled_face").Find(filter).Sort("-createdAt").Limit(limit).All(&faces)
+	})
+	return faces, err
+}
+
+func (r *mongoUnlabeledFaceRepository) FindByIds(ctx context.Context, ids []bson.ObjectId) ([]UnlabeledFace, error) {
+	filter, err := owned(ctx, bson.M{"_id": bson.M{"$in": ids}}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	faces := make([]UnlabeledFace, 0)
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("unlabeled_face").Find(filter).All(&faces)
+	})
+	return faces, err
+}
+
+func (r *mongoUnlabeledFaceRepository) Insert(ctx context.Context, faces ...UnlabeledFace) error {
+	docs := make([]interface{}, len(faces))
+	for i := range faces {
+		if err := claim(ctx, &faces[i].UserId); err != nil {
+			return err
+		}
+		docs[i] = &faces[i]
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("unlabeled_face").Insert(docs...)
+	})
+}
+
+func (r *mongoUnlabeledFaceRepository) RemoveByIds(ctx context.Context, ids []bson.ObjectId) (int, error) {
+	filter, err := owned(ctx, bson.M{"_id": bson.M{"$in": ids}}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	err = run(ctx, writeOperation, func(db *mgo.Database) error {
+		info, err := db.C("unlabeled_face").RemoveAll(filter)
+		if err == nil {
+			removed = info.Removed
+		}
+		return err
+	})
+	return removed, err
+}
+
+func (r *mongoUnlabeledFaceRepository) CountByRecognition(ctx context.Context, recognitionId bson.ObjectId) (int, error) {
+	filter, err := scoped(ctx, bson.M{"recognitionId": recognitionId}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = run(ctx, readOperation, func(db *mgo.Database) error {
+		count, err = db.C("unlabeled_face").Find(filter).Count()
+		return err
+	})
+	return count, err
+}
+
+type memoryUnlabeledFaceRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryUnlabeledFaceRepository) FindLatest(ctx context.Context, descriptorModel string, limit int) ([]UnlabeledFace, error) {
+	filter, err := owned(ctx, bson.M{"model": descriptorModel}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	docs := r.store.find("unlabeled_face", filter)
+	sortDocuments(docs, "-createdAt")
+	if len(docs) > limit {
+		docs = docs[:limit]
+	}
+	faces := make([]UnlabeledFace, 0)
+	err = decodeDocuments(docs, &faces)
+	return faces, err
+}
+
+func (r *memoryUnlabeledFaceRepository) FindByIds(ctx context.Context, ids []bson.ObjectId) ([]UnlabeledFace, error) {
+	filter, err := owned(ctx, bson.M{"_id": bson.M{"$in": ids}}, "userId")
+	if err != nil {
+		return nil, err
+	}
+	faces := make([]UnlabeledFace, 0)
+	err = decodeDocuments(r.store.find("unlabeled_face", filter), &faces)
+	return faces, err
+}
+
+func (r *memoryUnlabeledFaceRepository) Insert(ctx context.Context, faces ...UnlabeledFace) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	docs := make([]interface{}, len(faces))
+	for i := range faces {
+		if err := claim(ctx, &faces[i].UserId); err != nil {
+			return err
+		}
+		docs[i] = &faces[i]
+	}
+	return r.store.insert("unlabeled_face", docs...)
+}
+
+func (r *memoryUnlabeledFaceRepository) RemoveByIds(ctx context.Context, ids []bson.ObjectId) (int, error) {
+	filter, err := owned(ctx, bson.M{"_id": bson.M{"$in": ids}}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	return r.store.remove("unlabeled_face", filter), nil
+}
+
+func (r *memoryUnlabeledFaceRepository) CountByRecognition(ctx context.Context, recognitionId bson.ObjectId) (int, error) {
+	filter, err := memoryScoped(ctx, bson.M{"recognitionId": recognitionId}, "userId")
+	if err != nil {
+		return 0, err
+	}
+	return r.store.count("unlabeled_face", filter), nil
+}
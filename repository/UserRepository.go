@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"context"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// UserRepository lookups by email happen before anyone is logged in, so the
+// auth flows call it with a system context.
+type UserRepository interface {
+	FindByEmail(ctx context.Context, email string) (*User, error)
+	CountByEmail(ctx context.Context, email string) (int, error)
+	Insert(ctx context.Context, user *User) error
+}
+
+type mongoUserRepository struct{}
+
+func (r *mongoUserRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+	filter, err := scoped(ctx, bson.M{"email": email}, "_id")
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	if err := run(ctx, readOperation, func(db *mgo.Database) error {
+		return db.C("user").Find(filter).One(&user)
+	}); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *mongoUserRepository) CountByEmail(ctx context.Context, email string) (int, error) {
+	filter, err := scoped(ctx, bson.M{"email": email}, "_id")
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = run(ctx, readOperation, func(db *mgo.Database) (err error) {
+		count, err = db.C("user").Find(filter).Count()
+		return
+	})
+	return count, err
+}
+
+func (r *mongoUserRepository) Insert(ctx context.Context, user *User) error {
+	if err := claim(ctx, &user.Id); err != nil {
+		return err
+	}
+	return run(ctx, writeOperation, func(db *mgo.Database) error {
+		return db.C("user").Insert(user)
+	})
+}
+
+type memoryUserRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryUserRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+	filter, err := memoryScoped(ctx, bson.M{"email": email}, "_id")
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	if err := r.store.findOne("user", filter, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *memoryUserRepository) CountByEmail(ctx context.Context, email string) (int, error) {
+	filter, err := memoryScoped(ctx, bson.M{"email": email}, "_id")
+	if err != nil {
+		return 0, err
+	}
+	return r.store.count("user", filter), nil
+}
+
+func (r *memoryUserRepository) Insert(ctx context.Context, user *User) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := claim(ctx, &user.Id); err != nil {
+		return err
+	}
+	if r.store.count("user", bson.M{"email": user.Email}) > 0 {
+		return ErrDuplicateKey
+	}
+	return r.store.insert("user", user)
+}
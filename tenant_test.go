@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"face-service/config"
+	"face-service/controller"
+	"face-service/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const tenantLabel = "alice-label"
+
+// tenant holds what user A owns, which user B must not reach.
+type tenant struct {
+	token       string
+	deskId      string
+	deviceId    string
+	mqttId      string
+	ruleId      string
+	faceId      string
+	jobId       string
+	sessionId   string
+	commandId   string
+	archiveId   string
+	unlabeledId string
+}
+
+// secrets are the values of a tenant no answer to another user may contain.
+func (a *tenant) secrets() []string {
+	return []string{a.deskId, a.deviceId, a.mqttId, a.ruleId, a.faceId, a.jobId, a.sessionId, a.commandId, a.archiveId, a.unlabeledId, tenantLabel}
+}
+
+func testDescriptor(value float32) []float32 {
+	d := make([]float32, config.Get().DescriptorDimension)
+	for i := range d {
+		d[i] = value
+	}
+	return d
+}
+
+// newTenant creates one resource of every kind as a new user, through the API
+// where it can create them.
+func newTenant(s *testServer, email string) *tenant {
+	token, userId := s.login(email)
+	a := &tenant{token: token}
+	var created struct {
+		Id     string `json:"id"`
+		DeskId string `json:"deskId"`
+	}
+	s.expect(http.StatusCreated, token, "POST", "/api/desks", gin.H{"name": "Front desk"}, &created)
+	a.deskId = created.DeskId
+
+	var device struct {
+		Id       string `json:"id"`
+		DeviceId string `json:"deviceId"`
+	}
+	s.expect(http.StatusCreated, token, "POST", "/api/desk/"+a.deskId+"/devices", gin.H{"name": "Camera"}, &device)
+	a.deviceId, a.mqttId = device.Id, device.DeviceId
+
+	var rules []struct {
+		Id string `json:"id"`
+	}
+	s.expect(http.StatusOK, token, "GET", "/api/desk/"+a.deskId+"/rules", nil, &rules)
+	if len(rules) == 0 {
+		s.t.Fatal("a new desk has no rule")
+	}
+	a.ruleId = rules[0].Id
+
+	var ingested struct {
+		Items []struct {
+			Id string `json:"id"`
+		} `json:"items"`
+	}
+	s.expect(http.StatusOK, token, "POST", "/api/labels", []gin.H{{"label": tenantLabel, "descriptor": testDescriptor(0.05)}}, &ingested)
+	if len(ingested.Items) != 1 || ingested.Items[0].Id == "" {
+		s.t.Fatalf("face of %s not inserted", email)
+	}
+	a.faceId = ingested.Items[0].Id
+	s.expect(http.StatusOK, token, "PUT", "/api/label/"+tenantLabel+"/threshold", gin.H{"threshold": 0.4}, nil)
+	s.expect(http.StatusOK, token, "PUT", "/api/retention/WATER_MONITOR", gin.H{"retentionDays": 7}, nil)
+
+	// what only devices and background jobs create
+	ctx := repository.WithOwner(context.Background(), userId)
+	now := time.Now()
+	fileId, err := s.repos.Frames.Insert(ctx, "frame.jpg", []byte{0xff, 0xd8})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	job := repository.Recognition{
+		Id:        bson.NewObjectId(),
+		DeviceId:  bson.ObjectIdHex(a.deviceId),
+		Status:    repository.RecognitionCompleted,
+		Frames:    []repository.RecognitionFrame{{N: 0, FileId: fileId}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	session := repository.EnrollmentSession{
+		Id:        bson.NewObjectId(),
+		DeviceId:  job.DeviceId,
+		Label:     tenantLabel,
+		Status:    repository.EnrollmentCompleted,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	command := repository.DeviceCommand{
+		Id:        bson.NewObjectId(),
+		DeviceId:  a.mqttId,
+		Command:   "reboot",
+		Status:    repository.CommandAcked,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Minute),
+	}
+	archive := repository.EventArchive{Id: bson.NewObjectId(), DeviceId: a.mqttId, CreatedAt: now}
+	unlabeled := repository.UnlabeledFace{
+		Id:            bson.NewObjectId(),
+		RecognitionId: job.Id,
+		Descriptor:    testDescriptor(0.5),
+		Model:         config.Get().DescriptorModel,
+		CreatedAt:     now,
+	}
+	for _, err := range []error{
+		s.repos.Recognitions.Save(ctx, &job),
+		s.repos.Enrollments.Insert(ctx, &session),
+		s.repos.Commands.Insert(ctx, &command),
+		s.repos.EventArchives.Insert(ctx, &archive),
+		s.repos.Unlabeled.Insert(ctx, unlabeled),
+	} {
+		if err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	a.jobId, a.sessionId, a.commandId = job.Id.Hex(), session.Id.Hex(), command.Id.Hex()
+	a.archiveId, a.unlabeledId = archive.Id.Hex(), unlabeled.Id.Hex()
+	return a
+}
+
+func TestCrossTenantAccess(t *testing.T) {
+	s := newTestServer(t)
+	a := newTenant(s, "alice@example.com")
+	tokenB, _ := s.login("bob@example.com")
+
+	desk := "/api/desk/" + a.deskId
+	device := "/api/device/" + a.deviceId
+	label := "/api/label/" + tenantLabel
+	cases := []struct {
+		method string
+		path   string
+		body   interface{}
+		status int
+	}{
+		// user-wide routes answer with the resources of B only
+		{"GET", "/api/desks", nil, http.StatusOK},
+		{"GET", "/api/labels", nil, http.StatusOK},
+		{"GET", "/api/retention", nil, http.StatusOK},
+		{"GET", "/api/archives", nil, http.StatusOK},
+		{"GET", "/api/faces/unlabeled/clusters", nil, http.StatusOK},
+		{"POST", "/api/match", gin.H{"descriptors": [][]float32{testDescriptor(0.05)}}, http.StatusOK},
+
+		{"GET", desk, nil, http.StatusNotFound},
+		{"DELETE", desk, nil, http.StatusNotFound},
+		{"POST", desk + "/restore", nil, http.StatusNotFound},
+		{"GET", desk + "/faceInfos", nil, http.StatusNotFound},
+		{"GET", desk + "/devices", nil, http.StatusNotFound},
+		{"POST", desk + "/devices", gin.H{"name": "Intruder"}, http.StatusNotFound},
+		{"POST", desk + "/devices/claim", gin.H{"claimCode": "ABCDEF"}, http.StatusNotFound},
+		{"GET", desk + "/rules", nil, http.StatusNotFound},
+		{"POST", "/api/rule/" + a.ruleId, gin.H{"intervalMinutes": 1}, http.StatusNotFound},
+
+		{"GET", device, nil, http.StatusNotFound},
+		{"PUT", device, gin.H{"name": "Mine", "type": "", "deskId": a.deskId}, http.StatusNotFound},
+		{"PATCH", device, gin.H{"name": "Mine"}, http.StatusNotFound},
+		{"DELETE", device, nil, http.StatusNotFound},
+		{"POST", device + "/restore", nil, http.StatusNotFound},
+		{"GET", device + "/capture/live", nil, http.StatusNotFound},
+		{"GET", device + "/events", nil, http.StatusNotFound},
+		{"GET", device + "/config", nil, http.StatusNotFound},
+		{"GET", device + "/config/delta", nil, http.StatusNotFound},
+		{"PATCH", device + "/config", gin.H{"desired": gin.H{"fps": 1}}, http.StatusNotFound},
+		{"POST", device + "/commands", gin.H{"command": "reboot", "wait": false}, http.StatusNotFound},
+		{"GET", device + "/commands", nil, http.StatusNotFound},
+		{"GET", device + "/commands/" + a.commandId, nil, http.StatusNotFound},
+		{"POST", device + "/enroll", gin.H{"label": "bob"}, http.StatusNotFound},
+		{"GET", "/api/enrollment/" + a.sessionId, nil, http.StatusNotFound},
+
+		{"POST", "/api/recognitions", gin.H{"deviceId": a.deviceId}, http.StatusNotFound},
+		{"GET", device + "/startRecognize", nil, http.StatusNotFound},
+		{"GET", "/api/recognitions/" + a.jobId, nil, http.StatusNotFound},
+		{"GET", "/api/recognitions/" + a.jobId + "/frames/0", nil, http.StatusNotFound},
+		{"POST", "/api/recognitions/" + a.jobId + "/cancel", nil, http.StatusNotFound},
+
+		{"GET", label + "/descriptors", nil, http.StatusOK},
+		{"PATCH", label, gin.H{"label": "bob"}, http.StatusNotFound},
+		{"POST", "/api/labels/merge", gin.H{"from": tenantLabel, "into": "bob"}, http.StatusNotFound},
+		{"DELETE", label, nil, http.StatusNotFound},
+		{"GET", label + "/threshold", nil, http.StatusNotFound},
+		{"PUT", label + "/threshold", gin.H{"threshold": 0.1}, http.StatusNotFound},
+		{"DELETE", label + "/threshold", nil, http.StatusNotFound},
+
+		{"DELETE", "/api/retention/WATER_MONITOR", nil, http.StatusNotFound},
+		{"GET", "/api/archive/" + a.archiveId, nil, http.StatusNotFound},
+		{"POST", "/api/faces/unlabeled/assign", gin.H{"faceIds": []string{a.unlabeledId}, "label": "bob"}, http.StatusNotFound},
+		{"POST", "/api/admin/reembed", nil, http.StatusForbidden},
+	}
+	route := strings.NewReplacer(a.deskId, ":deskId", a.deviceId, ":deviceId", a.ruleId, ":ruleId", a.commandId, ":commandId",
+		a.sessionId, ":sessionId", a.jobId, ":jobId", a.archiveId, ":archiveId", tenantLabel, ":label")
+	for _, tc := range cases {
+		t.Run(tc.method+" "+route.Replace(strings.TrimPrefix(tc.path, "/api")), func(t *testing.T) {
+			w := s.do(tokenB, tc.method, tc.path, tc.body)
+			if w.Code != tc.status {
+				t.Fatalf("expected %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			for _, secret := range a.secrets() {
+				if strings.Contains(w.Body.String(), secret) {
+					t.Fatalf("answer leaks %s of another user: %s", secret, w.Body.String())
+				}
+			}
+		})
+	}
+
+	// nothing B sent changed what A owns
+	s.expect(http.StatusOK, a.token, "GET", desk, nil, nil)
+	s.expect(http.StatusOK, a.token, "GET", device, nil, nil)
+	s.expect(http.StatusOK, a.token, "GET", label+"/threshold", nil, nil)
+	var rules []struct {
+		Id              string `json:"id"`
+		IntervalMinutes int    `json:"intervalMinutes"`
+	}
+	s.expect(http.StatusOK, a.token, "GET", desk+"/rules", nil, &rules)
+	for _, rule := range rules {
+		if rule.IntervalMinutes == 1 {
+			t.Fatalf("rule %s was changed by another user", rule.Id)
+		}
+	}
+	var faces struct {
+		Items []interface{} `json:"items"`
+	}
+	s.expect(http.StatusOK, a.token, "GET", label+"/descriptors", nil, &faces)
+	if len(faces.Items) != 1 {
+		t.Fatalf("expected 1 face of %s, got %d", tenantLabel, len(faces.Items))
+	}
+}
+
+func TestCrossTenantWatchDesk(t *testing.T) {
+	s := newTestServer(t)
+	a := newTenant(s, "alice@example.com")
+	tokenB, _ := s.login("bob@example.com")
+	server := httptest.NewServer(s.router)
+	defer server.Close()
+
+	watch := func(token string) string {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws?accessToken=" + token
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("fail to connect: %v", err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg controller.WSMessage
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type != "CONNECTED" {
+			t.Fatalf("expected CONNECTED, got %+v, %v", msg, err)
+		}
+		if err := conn.WriteJSON(controller.WSMessage{Type: "WATCH_DESK", Payload: a.deskId}); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg.Type
+	}
+	if got := watch(tokenB); got != "APP_NOTIFICATION_WATCH_DESK_FAIL" {
+		t.Fatalf("another user watches the desk: %s", got)
+	}
+	if got := watch(a.token); got != "APP_NOTIFICATION_WATCH_DESK_SUCCESS" {
+		t.Fatalf("the owner cannot watch the desk: %s", got)
+	}
+}
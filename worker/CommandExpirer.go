@@ -0,0 +1,27 @@
+package worker
+
+import (
+	"context"
+	"face-service/config"
+	"face-service/repository"
+	"log"
+	"time"
+)
+
+// StartCommandExpirer periodically times out the commands devices never
+// acknowledged, including those nobody waits for.
+func StartCommandExpirer(commands repository.DeviceCommandRepository) {
+	go func() {
+		ticker := time.NewTicker(config.Get().CommandSweepInterval)
+		defer ticker.Stop()
+		for {
+			<-ticker.C
+			expired, err := commands.Expire(repository.AsSystem(context.Background()), time.Now())
+			if err != nil {
+				log.Println("[COMMAND]", "Fail to time out commands by error", err.Error())
+			} else if expired > 0 {
+				log.Println("[COMMAND]", "Timed out", expired, "unacknowledged command(s)")
+			}
+		}
+	}()
+}
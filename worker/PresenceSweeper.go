@@ -0,0 +1,36 @@
+package worker
+
+import (
+	"context"
+	"face-service/config"
+	"face-service/repository"
+	"log"
+	"time"
+)
+
+// StartPresenceSweeper periodically marks offline the devices that stopped
+// sending heartbeats without their last will being published, and passes each
+// of them to notify.
+func StartPresenceSweeper(devices repository.DeviceRepository, notify func(repository.DeviceStatus)) {
+	go func() {
+		ticker := time.NewTicker(config.Get().PresenceSweepInterval)
+		defer ticker.Stop()
+		for {
+			<-ticker.C
+			sweepPresence(devices, notify)
+		}
+	}()
+}
+
+func sweepPresence(devices repository.DeviceRepository, notify func(repository.DeviceStatus)) {
+	seenBefore := time.Now().Add(-config.Get().DeviceHeartbeatTimeout)
+	ctx := repository.AsSystem(context.Background())
+	marked, err := devices.MarkOffline(ctx, seenBefore)
+	if err != nil {
+		log.Println("[PRESENCE]", "Fail to mark silent devices offline by error", err.Error())
+		return
+	}
+	for _, status := range marked {
+		notify(status)
+	}
+}
@@ -0,0 +1,156 @@
+package worker
+
+import (
+	"context"
+	"face-service/archive"
+	"face-service/config"
+	"face-service/repository"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ndphu/swd-commons/model"
+	"log"
+	"time"
+)
+
+const sweepBatchSize = 5000
+
+// StartRetentionSweeper periodically archives and then removes events that
+// are older than the retention policy of their device, and removes the
+// recognitions kept longer than the job retention along with their frames.
+func StartRetentionSweeper(repos *repository.Repositories) {
+	go func() {
+		ticker := time.NewTicker(config.Get().RetentionSweepInterval)
+		defer ticker.Stop()
+		for {
+			sweepEvents(repos)
+			sweepRecognitions(repos)
+			<-ticker.C
+		}
+	}()
+}
+
+func sweepEvents(repos *repository.Repositories) {
+	ctx := repository.AsSystem(context.Background())
+	devices, err := repos.Devices.FindAll(ctx)
+	if err != nil {
+		log.Println("[RETENTION]", "Fail to list devices by error", err.Error())
+		return
+	}
+	policies, err := repos.Retention.FindAll(ctx)
+	if err != nil {
+		log.Println("[RETENTION]", "Fail to list retention policies by error", err.Error())
+		return
+	}
+	for _, device := range devices {
+		days := retentionDays(policies, device.Owner, string(device.Type))
+		if days <= 0 {
+			continue
+		}
+		before := time.Now().AddDate(0, 0, -days)
+		for {
+			docs, err := repos.Events.FindExpired(ctx, device.DeviceId, before, sweepBatchSize)
+			if err != nil {
+				log.Println("[RETENTION]", "Fail to find expired events of device", device.DeviceId, "by error", err.Error())
+				break
+			}
+			if len(docs) == 0 {
+				break
+			}
+			if err := archiveEvents(ctx, repos, &device, docs); err != nil {
+				log.Println("[RETENTION]", "Fail to archive events of device", device.DeviceId, "by error", err.Error())
+				break
+			}
+			if len(docs) < sweepBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// sweepRecognitions removes expired recognitions and their frames. Those
+// whose frames faces of the unlabeled pool are still cropped from are kept
+// until the faces leave the pool.
+func sweepRecognitions(repos *repository.Repositories) {
+	ctx := repository.AsSystem(context.Background())
+	before := time.Now().Add(-config.Get().RecognitionJobRetention)
+	removed := 0
+	after := bson.ObjectId("")
+	for {
+		expired, err := repos.Recognitions.FindExpired(ctx, before, after, sweepBatchSize)
+		if err != nil {
+			log.Println("[RETENTION]", "Fail to find expired recognitions by error", err.Error())
+			break
+		}
+		for _, r := range expired {
+			after = r.Id
+			if pooled, err := repos.Unlabeled.CountByRecognition(ctx, r.Id); err != nil || pooled > 0 {
+				continue
+			}
+			if err := repos.Frames.Remove(ctx, repository.FrameIds(r.Frames)...); err != nil {
+				log.Println("[RETENTION]", "Fail to remove frames of recognition", r.Id.Hex(), "by error", err.Error())
+				continue
+			}
+			if err := repos.Recognitions.Remove(ctx, r.Id); err != nil {
+				log.Println("[RETENTION]", "Fail to remove recognition", r.Id.Hex(), "by error", err.Error())
+				continue
+			}
+			removed++
+		}
+		if len(expired) < sweepBatchSize {
+			break
+		}
+	}
+	if removed > 0 {
+		log.Println("[RETENTION]", "Removed", removed, "recognition(s) finished before", before.Format(time.RFC3339))
+	}
+}
+
+// retentionDays resolves the retention of a device type for a user: the
+// policy for that type, else the user's default policy, else the configured
+// default. Zero or less means events are kept forever.
+func retentionDays(policies []repository.RetentionPolicy, userId bson.ObjectId, deviceType string) int {
+	days := config.Get().EventRetentionDays
+	for _, p := range policies {
+		if p.UserId != userId {
+			continue
+		}
+		if p.DeviceType == deviceType {
+			return p.RetentionDays
+		}
+		if p.DeviceType == repository.DefaultPolicyType {
+			days = p.RetentionDays
+		}
+	}
+	return days
+}
+
+func archiveEvents(ctx context.Context, repos *repository.Repositories, device *model.Device, docs []bson.M) error {
+	a := repository.EventArchive{
+		Id:        bson.NewObjectId(),
+		UserId:    device.Owner,
+		DeviceId:  device.DeviceId,
+		Count:     len(docs),
+		CreatedAt: time.Now(),
+	}
+	a.From, _ = docs[0]["timestamp"].(time.Time)
+	a.To, _ = docs[len(docs)-1]["timestamp"].(time.Time)
+
+	size, err := archive.WriteEvents(&a, docs)
+	if err != nil {
+		return err
+	}
+	a.Size = size
+	if err := repos.EventArchives.Insert(ctx, &a); err != nil {
+		return err
+	}
+
+	ids := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc["_id"]
+	}
+	removed, err := repos.Events.RemoveByIds(ctx, ids)
+	if err != nil {
+		return err
+	}
+	log.Println("[RETENTION]", "Archived", removed, "event(s) of device", device.DeviceId, "to", archive.FilePath(&a))
+	return nil
+}
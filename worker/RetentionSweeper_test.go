@@ -0,0 +1,25 @@
+package worker
+
+import (
+	"face-service/repository"
+	"github.com/globalsign/mgo/bson"
+	"testing"
+)
+
+func TestRetentionDays(t *testing.T) {
+	user := bson.NewObjectId()
+	policies := []repository.RetentionPolicy{
+		{UserId: user, DeviceType: repository.DefaultPolicyType, RetentionDays: 30},
+		{UserId: user, DeviceType: "WATER_MONITOR", RetentionDays: 7},
+		{UserId: bson.NewObjectId(), DeviceType: "", RetentionDays: 1},
+	}
+	for deviceType, expected := range map[string]int{"WATER_MONITOR": 7, "": 30} {
+		if days := retentionDays(policies, user, deviceType); days != expected {
+			t.Fatalf("expected %d days for type %q, got %d", expected, deviceType, days)
+		}
+	}
+	policies = append(policies, repository.RetentionPolicy{UserId: user, DeviceType: "", RetentionDays: 3})
+	if days := retentionDays(policies, user, ""); days != 3 {
+		t.Fatalf("expected cameras to keep their own policy, got %d", days)
+	}
+}
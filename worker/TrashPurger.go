@@ -0,0 +1,32 @@
+package worker
+
+import (
+	"context"
+	"face-service/config"
+	"face-service/repository"
+	"log"
+	"time"
+)
+
+// StartTrashPurger periodically removes for good the desks, devices and their
+// children that were soft-deleted longer ago than the grace period.
+func StartTrashPurger(trash repository.TrashRepository) {
+	go func() {
+		ticker := time.NewTicker(config.Get().TrashPurgeInterval)
+		defer ticker.Stop()
+		for {
+			purgeTrash(trash)
+			<-ticker.C
+		}
+	}()
+}
+
+func purgeTrash(trash repository.TrashRepository) {
+	before := time.Now().Add(-config.Get().SoftDeleteGracePeriod)
+	ctx := repository.AsSystem(context.Background())
+	if removed, err := trash.Purge(ctx, before); err != nil {
+		log.Println("[PURGER]", "Fail to purge trash by error", err.Error())
+	} else if removed > 0 {
+		log.Println("[PURGER]", "Purged", removed, "document(s) deleted before", before.Format(time.RFC3339))
+	}
+}